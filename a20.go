@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+/*
+ * The A20 gate and system control port A at 0x92.
+ *
+ * With the gate closed, address line 20 is held low for every physical
+ * access, so real mode addresses above FFFF:000F wrap to the bottom of
+ * memory as on an 8086.  There is no keyboard controller, so the gate is
+ * only reachable through port 0x92 ("fast A20") and int 15h AX=240xh.
+ */
+
+const (
+	A20_BIT      = 1 << 20
+	PORT92_RESET = 0x01 /* fast reset, write only */
+	PORT92_A20   = 0x02
+)
+
+func init() {
+	X86EMU_setupPorts(0x92, 1, "port92", x86emu_port92_read, x86emu_port92_write)
+}
+
+/* Opens or closes the A20 gate. */
+func X86EMU_setA20(on bool) {
+	if DEBUG_IO_TRACE() && M().a20_off == on {
+		fmt.Printf("a20: %v\n", on)
+	}
+	M().a20_off = !on
+}
+
+func x86emu_a20_enabled() bool {
+	return !M().a20_off
+}
+
+func x86emu_port92_read(_ uint16, _ int) uint32 {
+	if x86emu_a20_enabled() {
+		return PORT92_A20
+	}
+	return 0
+}
+
+// REMARKS:
+// The fast reset bit halts the emulator, which cannot reset the machine
+// from inside an instruction.
+func x86emu_port92_write(_ uint16, _ int, val uint32) {
+	X86EMU_setA20(val&PORT92_A20 != 0)
+	if val&PORT92_RESET != 0 {
+		if DEBUG_IO_TRACE() {
+			fmt.Printf("port92: reset requested\n")
+		}
+		HALT_SYS()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+/*
+ * BIOS services written in Go.
+ *
+ * Each service is a typed interrupt hook in _X86EMU_intrTab, so INT n and
+ * hardware interrupts run the handler directly, without a round trip
+ * through guest memory.  The IVT entry points at a stub in the F segment
+ * which traps into the same handler.  While the entry still points at the
+ * stub, the hook runs the handler; once guest code (a video or disk ROM,
+ * say) hooks the vector, the hook delivers through the IVT instead, so the
+ * new handler sees the call first and reaches ours only if it chains to
+ * the old vector.  The stub is also what a far call to the saved vector
+ * lands on.
+ *
+ * Handlers report errors the BIOS way, with a status in AH and CF set.
+ * Arithmetic flags come back as the handler left them on either path; IF
+ * and TF are those of the caller.
+ *
+ * Hooks that are not BIOS services, such as the interception of int 18h
+ * and 19h while booting a BIOS image, are set in the table directly.
+ */
+
+/* AH for a function the BIOS does not have */
+const BIOS_UNSUPPORTED = 0x86
+
+// PARAMETERS:
+// vec  - Interrupt vector
+// name - Name used in traces
+// fn   - Handler, run with the registers of the INT
+//
+// RETURNS:
+// Linear address of the stub.
+//
+// REMARKS:
+// Points the IVT entry at a new stub that runs fn and returns with IRET,
+// and installs the interrupt hook that runs fn while the entry is
+// unchanged.
+func X86EMU_setupBiosVector(vec uint8, name string, fn X86EMU_trapFunc) (uint32, error) {
+	addr, err := x86emu_fseg_alloc(1, 1)
+	if err != nil {
+		return 0, err
+	}
+	x86emu_phys_write(addr, 1, 0xcf) /* IRET, should the trap go away */
+	X86EMU_setupTrap(addr, name, func() {
+		fn()
+		x86emu_trap_iret()
+	})
+	x86emu_set_vector(vec, addr)
+	entry := x86emu_phys_read(uint32(vec)*4, 4)
+	_X86EMU_intrTab[vec] = func(intno int) {
+		hw := x86emu_intr_hw
+		x86emu_intr_hw = false
+		if x86emu_protected_mode() || x86emu_phys_read(uint32(intno)*4, 4) != entry {
+			if hw {
+				/* outside any instruction, so faults are handled here */
+				x86emu_deliver(uint8(intno), true, false, 0)
+			} else {
+				x86emu_int_deliver(uint8(intno), true, false, 0)
+			}
+			return
+		}
+		fn()
+	}
+	return addr, nil
+}
+
+/* Points an IVT entry at a linear address in the F segment. */
+func x86emu_set_vector(vec uint8, addr uint32) {
+	x86emu_phys_write(uint32(vec)*4, 4, FSEG_BASE<<12|(addr-FSEG_BASE))
+}
+
+/* Sets AH and CF from a BIOS status, 0 meaning success. */
+func x86emu_bios_status(status uint8) {
+	M().x86.gen.A.Seth8(status)
+	if status == 0 {
+		CLEAR_FLAG(F_CF)
+	} else {
+		SET_FLAG(F_CF)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import "testing"
+
+// Gives the tests a test machine with the BIOS set up.
+func x86emu_test_bios(t *testing.T) {
+	t.Helper()
+	x86emu_test_machine(t)
+	x86emu_test_setup_bios(t)
+}
+
+// Sets the BIOS up on the test machine as it is, with the RTC reset and
+// CS:IP back at 0000:1000.
+func x86emu_test_setup_bios(t *testing.T) {
+	t.Helper()
+	x86emu_rtc_reset()
+	if err := X86EMU_setupBios(); err != nil {
+		t.Fatal(err)
+	}
+	x86emu_load_cs(0, 0x1000)
+	x86emu_load_seg(SEG_SS, 0)
+	M().x86.spc.SP.Set16(0x800)
+}
+
+// Runs INT vec from guest code at 0000:1000 with the registers as they
+// are, and stops on the instruction after it.
+func x86emu_test_int(t *testing.T, vec uint8) {
+	t.Helper()
+	x86emu_phys_copy_in(0x1000, []byte{0xcd, vec})
+	X86EMU_setupTrap(0x1002, "done", func() { HALT_SYS() })
+	defer X86EMU_setupTrap(0x1002, "", nil)
+	x86emu_load_cs(0, 0x1000)
+	M().x86.intr &^= int(INTR_HALTED)
+	X86EMU_exec()
+	r := &M().x86
+	if cs, ip := r.seg.CS.Get(), r.spc.IP.Get16(); cs != 0 || ip != 0x1002 {
+		t.Fatalf("int %02xh stopped at %04x:%04x", vec, cs, ip)
+	}
+	if sp := r.spc.SP.Get16(); sp != 0x800 {
+		t.Fatalf("int %02xh left SP at %04x", vec, sp)
+	}
+}
+
+func TestBiosVectorDispatch(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		hook               bool /* guest points the vector at its own handler */
+		chain              bool /* which jumps on to the saved vector */
+		hooks, guest, stub int
+	}{
+		{"unchanged vector runs the handler directly", false, false, 1, 0, 0},
+		{"hooked vector goes through the ivt", true, false, 0, 1, 0},
+		{"chained vector reaches the stub", true, true, 0, 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			hooks, guest, stub := 0, 0, 0
+			addr, err := X86EMU_setupBiosVector(0x60, "test", func() { hooks++ })
+			if err != nil {
+				t.Fatal(err)
+			}
+			/* count the stub apart from the hook */
+			X86EMU_setupTrap(addr, "stub", func() {
+				stub++
+				x86emu_trap_iret()
+			})
+			if tc.hook {
+				x86emu_phys_write(0x60*4, 4, 0x0600)
+				X86EMU_setupTrap(0x600, "guest", func() {
+					guest++
+					if tc.chain {
+						x86emu_load_cs(FSEG_BASE>>4, addr-FSEG_BASE)
+					} else {
+						x86emu_trap_iret()
+					}
+				})
+			}
+			x86emu_test_int(t, 0x60)
+			if hooks != tc.hooks || guest != tc.guest || stub != tc.stub {
+				t.Errorf("hook ran %d times, guest %d, stub %d; want %d, %d, %d",
+					hooks, guest, stub, tc.hooks, tc.guest, tc.stub)
+			}
+		})
+	}
+}
+
+func TestBiosUnsupported(t *testing.T) {
+	for _, vec := range []uint8{0x10, 0x13, 0x15, 0x16, 0x1a} {
+		x86emu_test_bios(t)
+		M().x86.gen.A.Set16(0xff00)
+		CLEAR_FLAG(F_CF)
+		x86emu_test_int(t, vec)
+		if ah := M().x86.gen.A.Get8h(); ah != BIOS_UNSUPPORTED || !ACCESS_FLAG(F_CF) {
+			t.Errorf("int %02xh: ah %02x, cf %v; want %02x, set", vec, ah, ACCESS_FLAG(F_CF), BIOS_UNSUPPORTED)
+		}
+	}
+}
+
+func TestBiosVectorIrq(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		hook  bool /* guest points the vector at its own handler */
+		setup func()
+		hooks int
+		cs    uint16 /* where the emulator stopped */
+		ip    uint16
+	}{
+		{name: "unchanged vector runs the handler directly", hooks: 1, ip: 0x1002},
+		{name: "hooked vector goes through the ivt", hook: true, ip: 0x1800},
+		/* IRQ0, then #GP, then #DF beyond the IVT limit: shutdown */
+		{name: "fault delivering a hooked vector", hook: true,
+			setup: func() { M().x86.idtr.limit = 0 },
+			ip:    0x1000},
+		/* hardware interrupts ignore the gate DPL */
+		{name: "protected mode at cpl 3",
+			setup: func() {
+				x86emu_test_enter_protmode()
+				x86emu_test_gate(8, TEST_CODE3, 0x1800, GATE_INT32, 0, true)
+				x86emu_load_seg(SEG_CS, TEST_CODE3|3)
+				x86emu_load_seg(SEG_SS, TEST_DATA3|3)
+			},
+			cs: TEST_CODE3 | 3, ip: 0x1800},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			hooks := 0
+			if _, err := X86EMU_setupBiosVector(8, "test", func() { hooks++ }); err != nil {
+				t.Fatal(err)
+			}
+			if tc.hook {
+				x86emu_phys_write(8*4, 4, 0x1800)
+			}
+			X86EMU_setupTrap(0x1800, "guest", func() { HALT_SYS() })
+			if tc.setup != nil {
+				tc.setup()
+			}
+			sys_outb(0x21, 0xfe)
+			x86emu_pic_pulse(0)
+			SET_FLAG(F_IF)
+			x86emu_test_run(t, []byte{0xfa, 0xf4}) /* CLI; HLT */
+
+			if cs, ip := M().x86.seg.CS.Get(), M().x86.spc.IP.Get16(); cs != tc.cs || ip != tc.ip {
+				t.Errorf("stopped at %04x:%04x, want %04x:%04x", cs, ip, tc.cs, tc.ip)
+			}
+			if hooks != tc.hooks {
+				t.Errorf("hook ran %d times, want %d", hooks, tc.hooks)
+			}
+		})
+	}
+}
+
+func TestBiosIrqDefault(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func()
+		code  []byte
+		ip    uint16   /* where the emulator stopped */
+		isr   [2]uint8 /* master and slave ISR afterwards */
+	}{
+		{name: "irq 0 is acknowledged",
+			setup: func() { x86emu_pic_pulse(0) },
+			code:  []byte{0xfa, 0xf4}, /* CLI; HLT */
+			ip:    0x1002},
+		{name: "irq 10 is acknowledged on both chips",
+			setup: func() { x86emu_pic_pulse(10) },
+			code:  []byte{0xfa, 0xf4}, /* CLI; HLT */
+			ip:    0x1002},
+		{name: "int 08h halts",
+			code: []byte{0xcd, 0x08, 0xf4},
+			ip:   0x1002},
+		{name: "#GP halts at the fault",
+			setup: func() { M().x86.gen.B.Set16(0xffff) },
+			code:  []byte{0x8b, 0x07, 0xf4}, /* MOV AX,[BX] */
+			ip:    0x1000},
+		{name: "spurious irq 7 leaves the isr alone",
+			setup: func() { M().pic[PIC_MASTER].isr = 1 << 3 },
+			code:  []byte{0xcd, 0x0f, 0xf4},
+			ip:    0x1003,
+			isr:   [2]uint8{1 << 3, 0}},
+		{name: "spurious irq 15 acknowledges the cascade",
+			setup: func() { M().pic[PIC_MASTER].isr = 1 << PIC_CASCADE_IRQ },
+			code:  []byte{0xcd, 0x77, 0xf4},
+			ip:    0x1003},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			sys_outb(0x21, 0xfa) /* IRQ 0 and the cascade */
+			sys_outb(0xa1, 0xfb) /* IRQ 10 */
+			SET_FLAG(F_IF)
+			if tc.setup != nil {
+				tc.setup()
+			}
+			x86emu_test_run(t, tc.code)
+
+			if ip := M().x86.spc.IP.Get16(); ip != tc.ip {
+				t.Errorf("stopped at %04x, want %04x", ip, tc.ip)
+			}
+			if isr := [2]uint8{M().pic[PIC_MASTER].isr, M().pic[PIC_SLAVE].isr}; isr != tc.isr {
+				t.Errorf("isr %02x, want %02x", isr, tc.isr)
+			}
+		})
+	}
+}
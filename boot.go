@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+ * Booting a system BIOS image from the reset vector.
+ *
+ * The image is mapped read-only at the top of 4G and its last 128K (or
+ * all of it, if smaller) copied below 1M, which is how a chipset with
+ * shadowing on presents it, so the BIOS can write to its own segment once
+ * it runs from there.  The CPU starts in its power-on state with the CS
+ * base at 0xFFFF0000, so the first instruction is fetched from 0xFFFFFFF0
+ * at the top of the image; the first far jump reloads CS and moves
+ * execution below 1M.
+ *
+ * The BIOS runs until it tries to boot, which it does by calling the
+ * bootstrap loader, int 19h, or int 18h once that has failed.  Both are
+ * intercepted by hooks set directly in the interrupt table, which is
+ * consulted before the IVT, so the BIOS's own handlers never run.  None of
+ * the BIOS services of the emulator are set up: the image provides its
+ * own.
+ */
+
+const (
+	BOOT_CS_BASE   = 0xffff0000 /* CS base after reset */
+	BOOT_LOW_ALIAS = 0x20000    /* bytes of the image aliased below 1M */
+)
+
+/* How a boot from the reset vector ended */
+const (
+	BOOT_INT19   = iota /* called the bootstrap loader */
+	BOOT_INT18          /* called int 18h, booting failed */
+	BOOT_HALTED         /* stopped for another reason */
+	BOOT_TIMEOUT        /* still running when the time was up */
+)
+
+type X86EMU_bootResult struct {
+	how    int
+	cs, ip uint16 /* where execution stopped */
+	ns     uint64 /* virtual time taken */
+}
+
+func (r *X86EMU_bootResult) String() string {
+	how := map[int]string{
+		BOOT_INT19:   "called int 19h",
+		BOOT_INT18:   "called int 18h, no bootable device",
+		BOOT_HALTED:  "halted",
+		BOOT_TIMEOUT: "timed out",
+	}[r.how]
+	return fmt.Sprintf("%s at %04x:%04x after %d.%03ds", how, r.cs, r.ip,
+		r.ns/NS_PER_SEC, r.ns%NS_PER_SEC/1000000)
+}
+
+// PARAMETERS:
+// image - Contents of the BIOS image, a multiple of 64K
+//
+// REMARKS:
+// Maps the image at the top of 4G and copies its top 128K below 1M.
+func X86EMU_loadSystemBios(image []byte) error {
+	size := uint32(len(image))
+	if size == 0 || size%0x10000 != 0 || size > 16<<20 {
+		return fmt.Errorf("%d byte image is not a multiple of 64K up to 16M", size)
+	}
+	if M().mem_size < 0x100000 {
+		return fmt.Errorf("%dK of RAM has no room for the BIOS below 1M", M().mem_size>>10)
+	}
+	base := uint32(-size)
+	if M().mem_size > base {
+		return fmt.Errorf("%d byte image overlaps RAM", size)
+	}
+	X86EMU_setupMmio(base, size, "bios", func(offset uint32, sz int) uint32 {
+		v := uint32(0)
+		for i := sz - 1; i >= 0; i-- {
+			b := uint32(0xff)
+			if o := offset + uint32(i); o < size {
+				b = uint32(image[o])
+			}
+			v = v<<8 | b
+		}
+		return v
+	}, nil)
+
+	n := size
+	if n > BOOT_LOW_ALIAS {
+		n = BOOT_LOW_ALIAS
+	}
+	x86emu_phys_copy_in(0x100000-n, image[size-n:])
+	return nil
+}
+
+// PARAMETERS:
+// limit - Virtual time in ns to give the BIOS, 0 for no limit
+//
+// RETURNS:
+// How and where the BIOS stopped.
+//
+// REMARKS:
+// Resets the CPU and runs the image loaded with X86EMU_loadSystemBios
+// from the reset vector.
+func X86EMU_bootSystemBios(limit uint64) *X86EMU_bootResult {
+	res := &X86EMU_bootResult{how: BOOT_HALTED}
+	start := x86emu_clock_ns()
+
+	X86EMU_resetCpu()
+	X86EMU_setA20(true)
+	M().x86.segcache[SEG_CS].base = BOOT_CS_BASE
+
+	for vec, how := range map[int]int{0x19: BOOT_INT19, 0x18: BOOT_INT18} {
+		vec, how := vec, how
+		old := _X86EMU_intrTab[vec]
+		_X86EMU_intrTab[vec] = func(int) {
+			if DEBUG_SVC() {
+				fmt.Printf("boot: int%02x from %04x:%04x\n", vec, M().x86.seg.CS.Get(), M().x86.spc.IP.Get16())
+			}
+			res.how = how
+			HALT_SYS()
+		}
+		defer func() { _X86EMU_intrTab[vec] = old }()
+	}
+	if limit != 0 {
+		t := x86emu_clock_arm(start+limit, func() {
+			res.how = BOOT_TIMEOUT
+			HALT_SYS()
+		})
+		defer x86emu_clock_cancel(t)
+	}
+
+	X86EMU_exec()
+
+	r := &M().x86
+	res.cs = r.seg.CS.Get()
+	res.ip = r.spc.IP.Get16()
+	res.ns = x86emu_clock_ns() - start
+	return res
+}
+
+/* Reads a BIOS image and boots it; see X86EMU_bootSystemBios. */
+func X86EMU_bootSystemBiosFile(path string, limit uint64) (*X86EMU_bootResult, error) {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := X86EMU_loadSystemBios(image); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return X86EMU_bootSystemBios(limit), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestBootSystemBios(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reset  []byte /* code at F000:FFF0 of the image */
+		limit  uint64
+		how    int
+		cs, ip uint16
+	}{
+		/*
+		 * The copy below 1M has int 18h at F000:FFF0, so only a first
+		 * fetch from the high alias gets to the far jump.
+		 */
+		{"jump below 1M", []byte{0xea, 0x5b, 0xe0, 0x00, 0xf0}, 0, BOOT_INT19, 0xf000, 0xe05d},
+		{"int 18h", []byte{0xcd, 0x18}, 0, BOOT_INT18, 0xf000, 0xfff2},
+		{"hlt", []byte{0xfa, 0xf4}, 0, BOOT_HALTED, 0xf000, 0xfff2},
+		{"loop", []byte{0xeb, 0xfe}, 1000000, BOOT_TIMEOUT, 0xf000, 0xfff0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			image := make([]byte, 0x10000)
+			copy(image[0xe05b:], []byte{0xcd, 0x19}) /* int 19h */
+			copy(image[0xfff0:], tc.reset)
+			if err := X86EMU_loadSystemBios(image); err != nil {
+				t.Fatal(err)
+			}
+			defer X86EMU_removeMmio(BOOT_CS_BASE, 0x10000)
+			x86emu_phys_copy_in(0xffff0, []byte{0xcd, 0x18})
+
+			res := X86EMU_bootSystemBios(tc.limit)
+			if res.how != tc.how || res.cs != tc.cs || res.ip != tc.ip {
+				t.Errorf("%v, want %d at %04x:%04x", res, tc.how, tc.cs, tc.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+/*
+ * Calling guest code from Go.
+ *
+ * The call is made on a fresh stack with a return address pointing at a
+ * Go trap, and the emulator runs until that trap is reached or it halts
+ * for some other reason.  The registers are whatever the caller set up
+ * before, and whatever the guest left afterwards.
+ */
+
+const (
+	CALL_RETURN    = 0x0600 /* linear address of the return sentinel */
+	CALL_STACK_SEG = 0x1000
+	CALL_STACK_TOP = 0xfffe
+)
+
+/* How a call from Go ended */
+type x86emu_call_result struct {
+	returned bool   /* came back to the return sentinel */
+	clean    bool   /* and with the stack as it was */
+	cs, ip   uint16 /* where execution stopped */
+}
+
+// PARAMETERS:
+// enter - Pushes what the callee expects and loads CS:IP
+//
+// REMARKS:
+// The return sentinel is on the stack when enter runs.
+func x86emu_call(enter func()) x86emu_call_result {
+	var res x86emu_call_result
+	X86EMU_setupTrap(CALL_RETURN, "return to go", func() {
+		res.returned = true
+		HALT_SYS()
+	})
+	defer X86EMU_setupTrap(CALL_RETURN, "", nil)
+
+	r := &M().x86
+	x86emu_load_seg(SEG_SS, CALL_STACK_SEG)
+	r.spc.SP.Set32(CALL_STACK_TOP)
+	enter()
+	r.intr &^= int(INTR_HALTED)
+
+	X86EMU_exec()
+
+	res.cs = r.seg.CS.Get()
+	res.ip = r.spc.IP.Get16()
+	res.clean = res.returned && r.seg.SS.Get() == CALL_STACK_SEG &&
+		r.spc.SP.Get16() == CALL_STACK_TOP
+	return res
+}
+
+/* Far call to seg:off. */
+func x86emu_call_far(seg uint16, off uint16) x86emu_call_result {
+	return x86emu_call(func() {
+		push_word(CALL_RETURN >> 4)
+		push_word(CALL_RETURN & 0xf)
+		x86emu_load_cs(seg, uint32(off))
+	})
+}
+
+/* Software interrupt through the IVT, as INT vec would make it. */
+func x86emu_call_int(vec uint8) x86emu_call_result {
+	return x86emu_call(func() {
+		push_word(uint16(M().x86.spc.FLAGS))
+		push_word(CALL_RETURN >> 4)
+		push_word(CALL_RETURN & 0xf)
+		CLEAR_FLAG(F_IF)
+		CLEAR_FLAG(F_TF)
+		v := x86emu_phys_read(uint32(vec)*4, 4)
+		x86emu_load_cs(uint16(v>>16), v&0xffff)
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+	"time"
+)
+
+/*
+ * Virtual clock.
+ *
+ * All time the guest can observe (the TSC, the PIT, the RTC, the ACPI PM
+ * timer) is derived from one clock per machine.  By default it advances
+ * by one cycle per instruction at a configurable frequency, so the same
+ * program produces the same timings on every run and every host.  It can
+ * instead follow host time, which is useful for interactive programs but
+ * gives up determinism.
+ *
+ * Timer devices arm events on the clock; they fire between instructions
+ * once the clock has reached their deadline.
+ */
+
+const (
+	X86EMU_DEFAULT_MHZ = 100
+	NS_PER_SEC         = 1000000000
+)
+
+type x86emu_timer struct {
+	when uint64 /* deadline, ns of virtual time */
+	fn   func()
+}
+
+type x86emu_clock struct {
+	cycles  uint64 /* instructions executed, one cycle each */
+	mhz     uint64
+	host    bool
+	start   time.Time
+	tsc_adj uint64 /* added to the TSC by WRMSR to IA32_TIME_STAMP_COUNTER */
+	timers  []*x86emu_timer
+}
+
+func x86emu_clock_reset() {
+	c := &M().clock
+	*c = x86emu_clock{mhz: c.mhz, host: c.host}
+	if c.mhz == 0 {
+		c.mhz = X86EMU_DEFAULT_MHZ
+	}
+	c.start = time.Now()
+}
+
+func init() {
+	x86emu_clock_reset()
+	X86EMU_hookMsr(0x10, func(_ uint32) uint64 {
+		return x86emu_clock_tsc()
+	}, func(_ uint32, val uint64) {
+		c := &M().clock
+		c.tsc_adj += val - x86emu_clock_tsc()
+	})
+}
+
+// PARAMETERS:
+// mhz - Clock frequency of the emulated CPU
+//
+// REMARKS:
+// Sets how fast virtual time passes: each instruction takes one cycle at
+// this frequency.  The TSC counts these cycles.
+func X86EMU_setClockMHz(mhz uint32) {
+	if mhz == 0 {
+		mhz = X86EMU_DEFAULT_MHZ
+	}
+	c := &M().clock
+	ns := x86emu_clock_ns()
+	c.mhz = uint64(mhz)
+	if !c.host {
+		/* keep the current time, not the cycle count */
+		c.cycles = x86emu_muldiv(ns, c.mhz, 1000)
+	}
+}
+
+// PARAMETERS:
+// host - Whether virtual time follows the host's clock
+//
+// REMARKS:
+// In host mode runs are no longer reproducible; use it for interactive
+// programs that should run at wall clock speed.
+func X86EMU_setHostClock(host bool) {
+	c := &M().clock
+	if c.host == host {
+		return
+	}
+	ns := x86emu_clock_ns()
+	c.host = host
+	if host {
+		c.start = time.Now().Add(-time.Duration(ns))
+	} else {
+		c.cycles = x86emu_muldiv(ns, c.mhz, 1000)
+	}
+}
+
+/* a * b / c without overflowing the intermediate product */
+func x86emu_muldiv(a, b, c uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi >= c {
+		return ^uint64(0)
+	}
+	q, _ := bits.Div64(hi, lo, c)
+	return q
+}
+
+/* Nanoseconds of virtual time since reset. */
+func x86emu_clock_ns() uint64 {
+	c := &M().clock
+	if c.host {
+		return uint64(time.Since(c.start))
+	}
+	return x86emu_muldiv(c.cycles, 1000, c.mhz)
+}
+
+// PARAMETERS:
+// hz - Frequency of a counter driven by the clock
+//
+// RETURNS:
+// Number of times a counter running at hz has ticked since reset.
+func x86emu_clock_count(hz uint64) uint64 {
+	return x86emu_muldiv(x86emu_clock_ns(), hz, NS_PER_SEC)
+}
+
+// RETURNS:
+// Nanoseconds of virtual time after which a counter running at hz has
+// ticked n more times.
+func x86emu_clock_after(n, hz uint64) uint64 {
+	return x86emu_muldiv(n, NS_PER_SEC, hz)
+}
+
+func x86emu_clock_tsc() uint64 {
+	c := &M().clock
+	if c.host {
+		return x86emu_muldiv(x86emu_clock_ns(), c.mhz, 1000) + c.tsc_adj
+	}
+	return c.cycles + c.tsc_adj
+}
+
+// PARAMETERS:
+// when - Deadline in ns of virtual time
+// fn   - Called once the clock reaches the deadline
+//
+// RETURNS:
+// Handle for x86emu_clock_cancel.
+func x86emu_clock_arm(when uint64, fn func()) *x86emu_timer {
+	c := &M().clock
+	t := &x86emu_timer{when: when, fn: fn}
+	/* after any timers with the same deadline, so they fire in arming order */
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].when > when
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return t
+}
+
+func x86emu_clock_cancel(t *x86emu_timer) {
+	c := &M().clock
+	for i, e := range c.timers {
+		if e == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+/* Runs the timers whose deadline has passed, in deadline order. */
+func x86emu_clock_run() {
+	c := &M().clock
+	if len(c.timers) == 0 {
+		return
+	}
+	now := x86emu_clock_ns()
+	for len(c.timers) > 0 && c.timers[0].when <= now {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		t.fn()
+	}
+}
+
+/* Called before every instruction. */
+func x86emu_clock_tick() {
+	M().clock.cycles++
+	x86emu_clock_run()
+}
+
+// PARAMETERS:
+// ns - Nanoseconds to wait
+//
+// REMARKS:
+// Moves the clock forward by ns, or sleeps that long in host mode, and
+// runs the timers that come due, as if the machine had been idle.
+func x86emu_clock_wait(ns uint64) {
+	c := &M().clock
+	if c.host {
+		time.Sleep(time.Duration(ns))
+	} else {
+		when := x86emu_clock_ns() + ns
+		c.cycles = x86emu_muldiv(when, c.mhz, 1000)
+		if x86emu_muldiv(c.cycles, 1000, c.mhz) < when {
+			c.cycles++
+		}
+	}
+	x86emu_clock_run()
+}
+
+// RETURNS:
+// Whether there was a timer to wait for.
+//
+// REMARKS:
+// Used while the CPU is halted waiting for an interrupt: moves the clock
+// forward to the next timer deadline and runs it, rather than spinning.
+func x86emu_clock_idle() bool {
+	c := &M().clock
+	if len(c.timers) == 0 {
+		return false
+	}
+	now := x86emu_clock_ns()
+	if when := c.timers[0].when; when > now {
+		if c.host {
+			time.Sleep(time.Duration(when - now))
+		} else {
+			c.cycles = x86emu_muldiv(when, c.mhz, 1000)
+			if x86emu_muldiv(c.cycles, 1000, c.mhz) < when {
+				c.cycles++
+			}
+		}
+	}
+	x86emu_clock_run()
+	return true
+}
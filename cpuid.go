@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * CPU models.
+ *
+ * CPUID answers come from a table of leaves belonging to the selected CPU
+ * model.  The model also decides which EFLAGS bits software can toggle
+ * (the ID bit is how code detects CPUID in the first place) and which
+ * optional instructions and CR4 bits exist.
+ */
+
+/* CPUID.1:EDX feature bits */
+const (
+	CPUID_FPU  uint32 = 1 << 0
+	CPUID_VME  uint32 = 1 << 1
+	CPUID_DE   uint32 = 1 << 2
+	CPUID_PSE  uint32 = 1 << 3
+	CPUID_TSC  uint32 = 1 << 4
+	CPUID_MSR  uint32 = 1 << 5
+	CPUID_PAE  uint32 = 1 << 6
+	CPUID_CX8  uint32 = 1 << 8
+	CPUID_APIC uint32 = 1 << 9
+	CPUID_MTRR uint32 = 1 << 12
+	CPUID_PGE  uint32 = 1 << 13
+	CPUID_CMOV uint32 = 1 << 15
+	CPUID_PAT  uint32 = 1 << 16
+)
+
+/* CPUID.80000001h:EDX long mode bit */
+const CPUID_LM uint32 = 1 << 29
+
+/*
+ * CPUID.1:EDX features the emulator implements.  MTRR and PAT only need
+ * their MSRs, which the MSR table has; caching is not modelled.  AMD
+ * repeats these bits in the same places in leaf 80000001h.
+ */
+const x86emu_cpuid_modelled = CPUID_DE | CPUID_PSE | CPUID_TSC | CPUID_MSR |
+	CPUID_MTRR | CPUID_PGE | CPUID_PAT
+
+type x86emu_cpuid_leaf struct {
+	leaf    uint32
+	subleaf uint32
+	indexed bool /* answer depends on ECX */
+	eax     uint32
+	ebx     uint32
+	ecx     uint32
+	edx     uint32
+}
+
+type x86emu_cpu_model struct {
+	name     string
+	cpuid    bool   /* has the CPUID instruction */
+	flags    uint32 /* EFLAGS bits beyond F_MSK that software can change */
+	flags_on uint32 /* EFLAGS bits that always read as 1 */
+	zero_oob bool   /* out of range leaves read as 0 (AMD), not as the highest leaf (Intel) */
+	extra    uint32 /* CPUID.1:EDX features usable without being reported */
+	leaves   []x86emu_cpuid_leaf
+}
+
+/* 486 era and later models share these writable EFLAGS bits. */
+const x86emu_flags_486 = F_IOPL | F_NT | F_RF | F_VM | F_AC
+
+func x86emu_cpuid_vendor(leaf0_eax uint32, vendor string) x86emu_cpuid_leaf {
+	b := []byte(vendor)
+	return x86emu_cpuid_leaf{
+		leaf: 0,
+		eax:  leaf0_eax,
+		ebx:  binary.LittleEndian.Uint32(b[0:]),
+		edx:  binary.LittleEndian.Uint32(b[4:]),
+		ecx:  binary.LittleEndian.Uint32(b[8:]),
+	}
+}
+
+/* Leaves 0x80000002-0x80000004: the 48 byte brand string. */
+func x86emu_cpuid_brand(brand string) []x86emu_cpuid_leaf {
+	b := make([]byte, 48)
+	copy(b, brand)
+	var l []x86emu_cpuid_leaf
+	for i := 0; i < 3; i++ {
+		r := b[16*i:]
+		l = append(l, x86emu_cpuid_leaf{
+			leaf: 0x80000002 + uint32(i),
+			eax:  binary.LittleEndian.Uint32(r[0:]),
+			ebx:  binary.LittleEndian.Uint32(r[4:]),
+			ecx:  binary.LittleEndian.Uint32(r[8:]),
+			edx:  binary.LittleEndian.Uint32(r[12:]),
+		})
+	}
+	return l
+}
+
+func x86emu_cpu_models() []*x86emu_cpu_model {
+	intel := &x86emu_cpu_model{
+		name:  "intel",
+		cpuid: true,
+		flags: x86emu_flags_486 | F_VIF | F_VIP | F_ID,
+		leaves: []x86emu_cpuid_leaf{
+			x86emu_cpuid_vendor(0x16, "GenuineIntel"),
+			{leaf: 1, eax: 0x000506e3, ebx: 0x00100800, ecx: 0x7ffafbbf, edx: 0xbfebfbff},
+			{leaf: 2, eax: 0x76036301, ebx: 0x00f0b5ff, edx: 0x00c30000},
+			{leaf: 4, subleaf: 0, indexed: true, eax: 0x1c004121, ebx: 0x01c0003f, ecx: 0x0000003f},
+			{leaf: 4, subleaf: 1, indexed: true, eax: 0x1c004122, ebx: 0x01c0003f, ecx: 0x0000003f},
+			{leaf: 4, subleaf: 2, indexed: true, eax: 0x1c004143, ebx: 0x00c0003f, ecx: 0x000003ff},
+			{leaf: 4, subleaf: 3, indexed: true, eax: 0x1c03c163, ebx: 0x03c0003f, ecx: 0x00001fff, edx: 0x00000006},
+			{leaf: 6, eax: 0x000027f7, ebx: 0x00000002, ecx: 0x00000009},
+			{leaf: 7, subleaf: 0, indexed: true, ebx: 0x029c6fbf, edx: 0x9c002400},
+			{leaf: 0x80000000, eax: 0x80000008},
+			{leaf: 0x80000001, ecx: 0x00000121, edx: 0x2c100800},
+			{leaf: 0x80000006, ecx: 0x01006040},
+			{leaf: 0x80000008, eax: 0x00003027},
+		},
+	}
+	intel.leaves = append(intel.leaves, x86emu_cpuid_brand("Intel(R) Core(TM) i7-6700 CPU @ 3.40GHz")...)
+
+	amd := &x86emu_cpu_model{
+		name:     "amd",
+		cpuid:    true,
+		flags:    x86emu_flags_486 | F_VIF | F_VIP | F_ID,
+		zero_oob: true,
+		leaves: []x86emu_cpuid_leaf{
+			x86emu_cpuid_vendor(0x0d, "AuthenticAMD"),
+			{leaf: 1, eax: 0x00800f11, ebx: 0x00100800, ecx: 0x7ed8320b, edx: 0x178bfbff},
+			{leaf: 7, subleaf: 0, indexed: true, ebx: 0x209c01a9},
+			{leaf: 0x80000000, eax: 0x8000001f, ebx: 0x68747541, ecx: 0x444d4163, edx: 0x69746e65},
+			{leaf: 0x80000001, eax: 0x00800f11, ecx: 0x35c233ff, edx: 0x2fd3fbff},
+			{leaf: 0x80000005, eax: 0xff40ff40, ebx: 0xff40ff40, ecx: 0x20080140, edx: 0x40040140},
+			{leaf: 0x80000006, eax: 0x26006400, ebx: 0x66006400, ecx: 0x02006140, edx: 0x00808140},
+			{leaf: 0x80000008, eax: 0x00003030, ecx: 0x0000400f},
+		},
+	}
+	amd.leaves = append(amd.leaves, x86emu_cpuid_brand("AMD Ryzen 7 1700 Eight-Core Processor")...)
+
+	models := []*x86emu_cpu_model{
+		{
+			/*
+			 * What the emulator has always reported: a 486DX4, but with
+			 * RDTSC, RDMSR/WRMSR and the CR4 page size bits usable
+			 * anyway so existing ROMs keep working.
+			 */
+			name:     "default",
+			cpuid:    true,
+			flags:    x86emu_flags_486 | F_ID,
+			zero_oob: true,
+			extra:    CPUID_DE | CPUID_PSE | CPUID_TSC | CPUID_MSR | CPUID_PGE,
+			leaves: []x86emu_cpuid_leaf{
+				x86emu_cpuid_vendor(1, "GenuineIntel"),
+				{leaf: 1, eax: 0x00000480},
+			},
+		},
+		{
+			/* no CPUID, and EFLAGS bits 12-15 stuck at 1 */
+			name:     "8086",
+			flags_on: 0xf000,
+		},
+		{
+			name:  "486",
+			cpuid: true,
+			flags: x86emu_flags_486 | F_ID,
+			leaves: []x86emu_cpuid_leaf{
+				x86emu_cpuid_vendor(1, "GenuineIntel"),
+				{leaf: 1, eax: 0x00000480},
+			},
+		},
+		{
+			name:  "pentium",
+			cpuid: true,
+			flags: x86emu_flags_486 | F_VIF | F_VIP | F_ID,
+			leaves: []x86emu_cpuid_leaf{
+				x86emu_cpuid_vendor(1, "GenuineIntel"),
+				{leaf: 1, eax: 0x0000052c, edx: 0x000001bf},
+			},
+		},
+		intel,
+		amd,
+	}
+	for _, m := range models {
+		m.mask_unmodelled()
+	}
+	return models
+}
+
+// REMARKS:
+// Clears the feature bits of everything the emulator does not implement,
+// leaving the rest of the table as the real part reports it.  Software
+// that saw them would use CMOV, CMPXCHG8B, SSE, V86 mode, PAE paging or
+// the like and get #UD or #GP instead.  Only the CPUID.1:EDX features in
+// x86emu_cpuid_modelled are left; the ECX features of leaves 1 and
+// 80000001h and the structured features of leaf 7 are all cleared.
+func (m *x86emu_cpu_model) mask_unmodelled() {
+	for i := range m.leaves {
+		l := &m.leaves[i]
+		switch l.leaf {
+		case 1, 0x80000001:
+			l.ecx = 0
+			l.edx &= x86emu_cpuid_modelled
+		case 7:
+			l.ebx, l.ecx, l.edx = 0, 0, 0
+		}
+	}
+}
+
+var x86emu_cpu = x86emu_cpu_models()[0]
+
+// PARAMETERS:
+// name - One of "default", "8086", "486", "pentium", "intel" or "amd"
+//
+// REMARKS:
+// Selects the CPU model the emulator presents.  The MSR table goes back to
+// its reset state with it, so load MSR profiles afterwards.
+func X86EMU_setCpuModel(name string) error {
+	for _, m := range x86emu_cpu_models() {
+		if m.name == name {
+			x86emu_cpu = m
+			x86emu_msr_reset()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown CPU model %q", name)
+}
+
+// PARAMETERS:
+// path - File holding the CPUID table
+//
+// REMARKS:
+// Replaces the CPUID table with one read from a file, keeping the EFLAGS
+// behaviour of a CPUID capable CPU.  Each line is
+//
+//	leaf [subleaf] eax ebx ecx edx
+//
+// in hex or with a 0x prefix; a line with a subleaf only answers when ECX
+// matches.  '#' starts a comment.  Such tables can be written from the
+// output of "cpuid -r" on the machine being imitated; features the
+// emulator lacks are cleared from them as from the built-in models, and
+// leaves out of range answer as the vendor in leaf 0 does.  Like
+// X86EMU_setCpuModel this resets the MSR table.
+func X86EMU_loadCpuidProfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m := &x86emu_cpu_model{
+		name:  path,
+		cpuid: true,
+		flags: x86emu_flags_486 | F_VIF | F_VIP | F_ID,
+	}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 5 && len(fields) != 6 {
+			return fmt.Errorf("%s:%d: want leaf [subleaf] eax ebx ecx edx", path, line)
+		}
+		var v [6]uint32
+		for i, fld := range fields {
+			n, err := strconv.ParseUint(strings.TrimPrefix(fld, "0x"), 16, 32)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			v[i] = uint32(n)
+		}
+		l := x86emu_cpuid_leaf{leaf: v[0]}
+		r := v[1:]
+		if len(fields) == 6 {
+			l.subleaf = v[1]
+			l.indexed = true
+			r = v[2:]
+		}
+		l.eax, l.ebx, l.ecx, l.edx = r[0], r[1], r[2], r[3]
+		m.leaves = append(m.leaves, l)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	/* AMD parts zero out of range leaves, everybody else repeats the top one */
+	top, _ := m.find(0, 0)
+	amd := x86emu_cpuid_vendor(top.eax, "AuthenticAMD")
+	m.zero_oob = top.ebx == amd.ebx && top.ecx == amd.ecx && top.edx == amd.edx
+	m.mask_unmodelled()
+	x86emu_cpu = m
+	x86emu_msr_reset()
+	return nil
+}
+
+func (m *x86emu_cpu_model) find(leaf, subleaf uint32) (x86emu_cpuid_leaf, bool) {
+	for _, l := range m.leaves {
+		if l.leaf == leaf && (!l.indexed || l.subleaf == subleaf) {
+			return l, true
+		}
+	}
+	return x86emu_cpuid_leaf{}, false
+}
+
+// RETURNS:
+// EAX, EBX, ECX and EDX for CPUID with the given EAX and ECX.
+//
+// REMARKS:
+// Leaves above the maximum reported by leaf 0 or 0x80000000 return the
+// highest basic leaf on Intel and zeros on AMD, as the real parts do.
+func (m *x86emu_cpu_model) query(leaf, subleaf uint32) (uint32, uint32, uint32, uint32) {
+	base := leaf & 0x80000000
+	max, _ := m.find(base, 0)
+	if leaf > max.eax {
+		if m.zero_oob {
+			return 0, 0, 0, 0
+		}
+		top, _ := m.find(0, 0)
+		leaf, subleaf = top.eax, 0
+	}
+	l, _ := m.find(leaf, subleaf)
+	return l.eax, l.ebx, l.ecx, l.edx
+}
+
+/* CPUID.1:EDX features the current model implements. */
+func x86emu_cpu_features() uint32 {
+	f := x86emu_cpu.extra
+	if x86emu_cpu.cpuid {
+		l, _ := x86emu_cpu.find(1, 0)
+		f |= l.edx
+	}
+	return f
+}
+
+/* Raises #UD unless the current model has all of the CPUID.1:EDX features. */
+func x86emu_require_feature(f uint32) {
+	if x86emu_cpu_features()&f != f {
+		x86emu_fault_noerr(EXC_UD)
+	}
+}
+
+/* CR4 bits the current model implements. */
+func x86emu_cr4_supported() uint32 {
+	f := x86emu_cpu_features()
+	var cr4 uint32
+	if f&CPUID_TSC != 0 {
+		cr4 |= CR4_TSD
+	}
+	if f&CPUID_DE != 0 {
+		cr4 |= CR4_DE
+	}
+	if f&CPUID_PSE != 0 {
+		cr4 |= CR4_PSE
+	}
+	if f&CPUID_PGE != 0 {
+		cr4 |= CR4_PGE
+	}
+	return cr4
+}
+
+func x86emu_cpuid() {
+	a, b, c, d := x86emu_cpu.query(M().x86.gen.A.Get32(), M().x86.gen.C.Get32())
+	M().x86.gen.A.Set32(a)
+	M().x86.gen.B.Set32(b)
+	M().x86.gen.C.Set32(c)
+	M().x86.gen.D.Set32(d)
+}
+
+// REMARKS:
+// CPUID takes EAX/ECX as inputs, writes EAX/EBX/ECX/EDX as output
+// Handles opcode 0x0f,0xa2
+func x86emuOp2_cpuid(_ uint8) {
+	DECODE_PRINTF("CPUID\n")
+	TRACE_AND_STEP()
+	if !x86emu_cpu.cpuid {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	x86emu_cpuid()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9c.  Only the EFLAGS bits the CPU model implements are
+// visible, which is how code tells an 8086 from a 486 and finds CPUID.
+func x86emuOp_pushf_word(_ uint8) {
+	op32 := M().x86.mode&SYSMODE_PREFIX_DATA != 0
+	if op32 {
+		DECODE_PRINTF("PUSHFD\n")
+	} else {
+		DECODE_PRINTF("PUSHF\n")
+	}
+	TRACE_AND_STEP()
+
+	/* clear out *all* bits not representing flags, and turn on real bits */
+	flags := M().x86.spc.FLAGS&(F_MSK|x86emu_cpu.flags) | F_ALWAYS_ON | x86emu_cpu.flags_on
+	if op32 {
+		push_long(flags &^ (F_RF | F_VM))
+	} else {
+		push_word(uint16(flags))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9d.  IOPL only changes at CPL 0 and IF only when CPL is
+// at most IOPL; RF and VM are never loaded.
+func x86emuOp_popf_word(_ uint8) {
+	var flags uint32
+
+	op32 := M().x86.mode&SYSMODE_PREFIX_DATA != 0
+	if op32 {
+		DECODE_PRINTF("POPFD\n")
+	} else {
+		DECODE_PRINTF("POPF\n")
+	}
+	TRACE_AND_STEP()
+	mask := (F_MSK | x86emu_cpu.flags) &^ (F_RF | F_VM)
+	if op32 {
+		flags = pop_long()
+	} else {
+		flags = uint32(pop_word())
+		mask &= 0xffff
+	}
+	if x86emu_protected_mode() {
+		cpl := x86emu_cpl()
+		if cpl != 0 {
+			mask &^= F_IOPL
+		}
+		if uint32(cpl) > (M().x86.spc.FLAGS&F_IOPL)>>12 {
+			mask &^= F_IF
+		}
+	}
+	M().x86.spc.FLAGS = M().x86.spc.FLAGS&^mask | flags&mask
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x31
+func x86emuOp2_rdtsc(_ uint8) {
+	DECODE_PRINTF("RDTSC\n")
+	TRACE_AND_STEP()
+	x86emu_require_feature(CPUID_TSC)
+	if M().x86.cr[4]&CR4_TSD != 0 && x86emu_cpl() != 0 {
+		x86emu_fault(EXC_GP, 0)
+	}
+	tsc := x86emu_clock_tsc()
+	M().x86.gen.A.Set32(uint32(tsc))
+	M().x86.gen.D.Set32(uint32(tsc >> 32))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func init() {
+	x86emu_optab2[0x31] = x86emuOp2_rdtsc
+	x86emu_optab[0x9c] = x86emuOp_pushf_word
+	x86emu_optab[0x9d] = x86emuOp_popf_word
+	x86emu_optab2[0xa2] = x86emuOp2_cpuid
+}
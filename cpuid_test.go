@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCpuidHidesUnmodelledFeatures(t *testing.T) {
+	defer func(m *x86emu_cpu_model) { x86emu_cpu = m }(x86emu_cpu)
+
+	profile := filepath.Join(t.TempDir(), "cpuid")
+	if err := os.WriteFile(profile, []byte(
+		"0 1 0x756e6547 0x6c65746e 0x49656e69\n"+
+			"1 0x000506e3 0x00100800 0x7ffafbbf 0xbfebfbff\n"+
+			"0x80000000 0x80000001 0 0 0\n"+
+			"0x80000001 0 0 0x00000121 0x2c100840\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	models := x86emu_cpu_models()
+	if err := X86EMU_loadCpuidProfile(profile); err != nil {
+		t.Fatal(err)
+	}
+	models = append(models, x86emu_cpu)
+
+	for _, m := range models {
+		x86emu_cpu = m
+		if !m.cpuid {
+			continue
+		}
+		if _, _, ecx, edx := m.query(1, 0); ecx != 0 || edx&^x86emu_cpuid_modelled != 0 {
+			t.Errorf("%s: leaf 1 ecx %08x edx %08x reports unmodelled features", m.name, ecx, edx)
+		}
+		if max, _, _, _ := m.query(0, 0); max >= 7 {
+			if _, ebx, ecx, edx := m.query(7, 0); ebx|ecx|edx != 0 {
+				t.Errorf("%s: leaf 7 reports features %08x %08x %08x", m.name, ebx, ecx, edx)
+			}
+		}
+		if max, _, _, _ := m.query(0x80000000, 0); max >= 0x80000001 {
+			if _, _, ecx, edx := m.query(0x80000001, 0); ecx != 0 || edx&^x86emu_cpuid_modelled != 0 {
+				t.Errorf("%s: leaf 80000001h ecx %08x edx %08x reports unmodelled features", m.name, ecx, edx)
+			}
+		}
+		if x86emu_cr4_supported()&(CR4_PAE|CR4_VME) != 0 {
+			t.Errorf("%s: CR4.PAE or CR4.VME writable", m.name)
+		}
+	}
+}
+
+func TestCpuidProfileOutOfRangeLeaves(t *testing.T) {
+	defer func(m *x86emu_cpu_model) { x86emu_cpu = m }(x86emu_cpu)
+
+	for _, tc := range []struct {
+		name   string
+		leaf0  string
+		eax    uint32 /* of leaf 20h */
+		vendor string
+	}{
+		{"intel", "0 2 0x756e6547 0x6c65746e 0x49656e69\n", 0x76036301, "GenuineIntel"},
+		{"amd", "0 2 0x68747541 0x444d4163 0x69746e65\n", 0, "AuthenticAMD"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			profile := filepath.Join(t.TempDir(), "cpuid")
+			if err := os.WriteFile(profile, []byte(tc.leaf0+
+				"1 0x000506e3 0x00100800 0 0\n"+
+				"2 0x76036301 0x00f0b5ff 0 0x00c30000\n"+
+				"0x80000000 0x80000001 0 0 0\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := X86EMU_loadCpuidProfile(profile); err != nil {
+				t.Fatal(err)
+			}
+			if eax, _, _, _ := x86emu_cpu.query(0x20, 0); eax != tc.eax {
+				t.Errorf("%s: leaf 20h eax %08x, want %08x", tc.vendor, eax, tc.eax)
+			}
+		})
+	}
+}
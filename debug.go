@@ -64,6 +64,7 @@ func X86EMU_trace_regs() {
 func X86EMU_trace_xregs() {
 	if DEBUG_TRACE() {
 		x86emu_dump_xregs()
+		x86emu_dump_sregs()
 	}
 }
 
@@ -166,12 +167,11 @@ func x86emu_end_instr() {
 }
 
 func print_encoded_bytes(s uint16, o uint16) {
-	panic("print encoded bytes")
-	var _ = `
+	panic(`print encoded bytes
     for (i:=0; i< M().x86.enc_pos; i++) {
-	    snfmt.Printf(buf1+2*i, 64 - 2 * i, "%02x", fetch_data_byte_abs(s,o+i));
+	    snfmt.Printf(buf1+2*i, 64 - 2 * i, "%02x", fetch_data_byte_abs(SEG_CS,o+i));
     }
-    fmt.Printf("%-20s ",buf1);`
+    fmt.Printf("%-20s ",buf1);`)
 }
 
 func print_decoded_instruction() {
@@ -184,8 +184,8 @@ func x86emu_print_int_vect(iv uint16) {
 	if iv > 256 {
 		return
 	}
-	seg = fetch_data_word_abs(0, iv*4)
-	off = fetch_data_word_abs(0, iv*4+2)
+	off = uint16(x86emu_phys_read(uint32(iv)*4, 2))
+	seg = uint16(x86emu_phys_read(uint32(iv)*4+2, 2))
 	fmt.Printf("%04x:%04x ", seg, off)
 }
 
@@ -203,7 +203,7 @@ func X86EMU_dump_memory(seg uint16, o uint16, amt uint32) {
 			fmt.Printf("   ")
 		}
 		for i < end {
-			fmt.Printf("%02x ", fetch_data_byte_abs(seg, uint16(i)))
+			fmt.Printf("%02x ", x86emu_lin_rdb(uint32(seg)<<4+uint32(uint16(i))))
 			fmt.Printf("\n")
 			start = end
 			end = start + 16
@@ -213,8 +213,7 @@ func X86EMU_dump_memory(seg uint16, o uint16, amt uint32) {
 }
 
 func x86emu_single_step() {
-	panic("single step")
-	var _ = `
+	panic(`single step
     char s[1024];
     int ps[10];
     int ntok;
@@ -301,7 +300,7 @@ func x86emu_single_step() {
             break;
         }
     }
-`
+`)
 }
 
 func X86EMU_trace_on() uint32 {
@@ -459,3 +458,14 @@ func x86emu_dump_xregs() {
 	}
 	fmt.Printf("\n")
 }
+
+/* hidden segment state; shows unreal mode limits left over from protected mode */
+func x86emu_dump_sregs() {
+	for n, name := range x86emu_seg_names {
+		c := &M().x86.segcache[n]
+		fmt.Printf("\t%s=%04x base=%08x limit=%08x attr=%03x\n",
+			name, x86emu_sreg(n).Get(), c.base, c.limit, c.attr)
+	}
+	fmt.Printf("\tCR0=%08x GDT=%08x:%04x IDT=%08x:%04x\n", M().x86.cr[0],
+		M().x86.gdtr.base, M().x86.gdtr.limit, M().x86.idtr.base, M().x86.idtr.limit)
+}
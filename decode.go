@@ -37,36 +37,28 @@
 *
 ****************************************************************************/
 
-
 package main
 
 import (
 	"fmt"
 )
+
 /*----------------------------- Implementation ----------------------------*/
 
 /****************************************************************************
 REMARKS:
-Handles any pending asynchronous interrupts.
-****************************************************************************/
-void x86emu_intr_handle(void) {
-    u8  intno;
-
-    if (M.x86.intr & INTR_SYNCH) {
-        intno = M.x86.intno;
-        if (_X86EMU_intrTab[intno]) {
-            (*_X86EMU_intrTab[intno])(intno);
-        } else {
-            push_word((u16)M.x86.R_FLG);
-            CLEAR_FLAG(F_IF);
-            CLEAR_FLAG(F_TF);
-            push_word(M.x86.R_CS);
-            M.x86.R_CS = mem_access_word(intno * 4 + 2);
-            push_word(M.x86.R_IP);
-            M.x86.R_IP = mem_access_word(intno * 4);
-            M.x86.intr = 0;
-        }
-    }
+Handles a pending synchronous interrupt, raised with x86emu_intr_raise.
+****************************************************************************/
+func x86emu_intr_handle() {
+	if M().x86.intr&INTR_SYNCH != 0 {
+		M().x86.intr &^= INTR_SYNCH
+		intno := M().x86.intno
+		if _X86EMU_intrTab[intno] != nil {
+			_X86EMU_intrTab[intno](int(intno))
+		} else {
+			x86emu_deliver(intno, false, false, 0)
+		}
+	}
 }
 
 /****************************************************************************
@@ -77,63 +69,60 @@ REMARKS:
 Raise the specified interrupt to be handled before the execution of the
 next instruction.
 ****************************************************************************/
-void x86emu_intr_raise( u8 intrnum) {
-    printf("%s, raising exception %x\n", __func__, intrnum);
-    x86emu_dump_regs();
-    M.x86.intno = intrnum;
-    M.x86.intr |= INTR_SYNCH;
+func x86emu_intr_raise(intrnum uint8) {
+	M().x86.intno = intrnum
+	M().x86.intr |= INTR_SYNCH
 }
 
 /****************************************************************************
 REMARKS:
 Main execution loop for the emulator. We return from here when the system
-halts, which is normally caused by a stack fault when we return from the
-original real mode call.
+halts, which is normally caused by a trap that ends the call, HLT with
+interrupts disabled, or a timer set up by the caller.
+
+Interrupts are only looked at between whole instructions, never between a
+prefix and the opcode it applies to.  A request from the PIC is taken when
+IF is set, except straight after MOV SS, POP SS or STI (see
+SYSMODE_INTR_SHADOW).  Timers run from x86emu_exec_insn as each instruction
+starts, so a device timer that raises an IRQ is seen before the next
+instruction.
 ****************************************************************************/
-void X86EMU_exec(void) {
-    u8 op1;
-
-    M.x86.intr = 0;
-    DB(x86emu_end_instr();)
-
-    for (;;) {
-DB(     if (CHECK_IP_FETCH())
-            x86emu_check_ip_access();)
-        /* If debugging, save the IP and CS values. */
-        SAVE_IP_CS(M.x86.R_CS, M.x86.R_IP);
-        INC_DECODED_INST_LEN(1);
-        if (M.x86.intr) {
-            if (M.x86.intr & INTR_HALTED) {
-             if (M.x86.R_SP != 0) {
-                    printf("halted\n");
-                    X86EMU_trace_regs();
-                    } else {
-                    if (M.x86.debug) {
-                        printf("Service completed successfully\n");
+func X86EMU_exec() {
+	/* keep requests from the interrupt controller */
+	M().x86.intr &= int(INTR_ASYNCH)
+	x86emu_end_instr()
+
+	for {
+		if CHECK_IP_FETCH() {
+			x86emu_check_ip_access()
 		}
-                    }
-                return;
-            }
-            if (((M.x86.intr & INTR_SYNCH) && (M.x86.intno == 0 || M.x86.intno == 2)) ||
-                !ACCESS_FLAG(F_IF)) {
-                x86emu_intr_handle();
-            }
-        }
-        op1 = (*sys_rdb)(((u32)M.x86.R_CS << 4) + (M.x86.R_IP++));
-        (*x86emu_optab[op1])(op1);
-        //if (M.x86.debug & DEBUG_EXIT) {
-        //    M.x86.debug &= ~DEBUG_EXIT;
-        //    return;
-        //}
-    }
+		if M().x86.mode&SYSMODE_INSN_SAVED == 0 && M().x86.intr != 0 {
+			if M().x86.intr&int(INTR_HALTED) != 0 {
+				if DEBUG_SVC() {
+					fmt.Printf("halted at %04x:%04x\n", M().x86.seg.CS.Get(), M().x86.spc.IP.Get16())
+				}
+				return
+			}
+			x86emu_intr_handle()
+			if M().x86.intr&int(INTR_ASYNCH) != 0 && ACCESS_FLAG(F_IF) &&
+				M().x86.mode&SYSMODE_INTR_SHADOW == 0 {
+				x86emu_intr_async()
+			}
+			if M().x86.intr&int(INTR_HALTED) != 0 {
+				/* shut down delivering it */
+				continue
+			}
+		}
+		x86emu_exec_insn()
+	}
 }
 
 /****************************************************************************
 REMARKS:
 Halts the system by setting the halted system flag.
 ****************************************************************************/
-void X86EMU_halt_sys(void) {
-    M.x86.intr |= INTR_HALTED;
+func X86EMU_halt_sys() {
+	M().x86.intr |= int(INTR_HALTED)
 }
 
 /****************************************************************************
@@ -148,16 +137,15 @@ next instruction.
 
 NOTE: Do not inline this function, as (*sys_rdb) is already inline!
 ****************************************************************************/
-void fetch_decode_modrm( int *mod, int *regh, int *regl) {
-    int fetched;
-
-DB( if (CHECK_IP_FETCH())
-        x86emu_check_ip_access();)
-    fetched = (*sys_rdb)(((u32)M.x86.R_CS << 4) + (M.x86.R_IP++));
-    INC_DECODED_INST_LEN(1);
-    *mod  = (fetched >> 6) & 0x03;
-    *regh = (fetched >> 3) & 0x07;
-    *regl = (fetched >> 0) & 0x07;
+func fetch_decode_modrm(mod, regh, regl *int) {
+	if CHECK_IP_FETCH() {
+		x86emu_check_ip_access()
+	}
+	fetched := int(x86emu_lin_rdb(x86emu_ip_advance(1)))
+	INC_DECODED_INST_LEN(1)
+	*mod = (fetched >> 6) & 0x03
+	*regh = (fetched >> 3) & 0x07
+	*regl = (fetched >> 0) & 0x07
 }
 
 /****************************************************************************
@@ -170,14 +158,13 @@ moves the instruction pointer to the next value.
 
 NOTE: Do not inline this function, as (*sys_rdb) is already inline!
 ****************************************************************************/
-u8 fetch_byte_imm(void) {
-    u8 fetched;
-
-DB( if (CHECK_IP_FETCH())
-        x86emu_check_ip_access();)
-    fetched = (*sys_rdb)(((u32)M.x86.R_CS << 4) + (M.x86.R_IP++));
-    INC_DECODED_INST_LEN(1);
-    return fetched;
+func fetch_byte_imm() uint8 {
+	if CHECK_IP_FETCH() {
+		x86emu_check_ip_access()
+	}
+	fetched := x86emu_lin_rdb(x86emu_ip_advance(1))
+	INC_DECODED_INST_LEN(1)
+	return fetched
 }
 
 /****************************************************************************
@@ -190,15 +177,13 @@ moves the instruction pointer to the next value.
 
 NOTE: Do not inline this function, as (*sys_rdw) is already inline!
 ****************************************************************************/
-u16 fetch_word_imm(void) {
-    u16 fetched;
-
-DB( if (CHECK_IP_FETCH())
-        x86emu_check_ip_access();)
-    fetched = (*sys_rdw)(((u32)M.x86.R_CS << 4) + (M.x86.R_IP));
-    M.x86.R_IP += 2;
-    INC_DECODED_INST_LEN(2);
-    return fetched;
+func fetch_word_imm() uint16 {
+	if CHECK_IP_FETCH() {
+		x86emu_check_ip_access()
+	}
+	fetched := x86emu_lin_rdw(x86emu_ip_advance(2))
+	INC_DECODED_INST_LEN(2)
+	return fetched
 }
 
 /****************************************************************************
@@ -211,15 +196,13 @@ moves the instruction pointer to the next value.
 
 NOTE: Do not inline this function, as (*sys_rdw) is already inline!
 ****************************************************************************/
-u32 fetch_long_imm(void) {
-    u32 fetched;
-
-DB( if (CHECK_IP_FETCH())
-        x86emu_check_ip_access();)
-    fetched = (*sys_rdl)(((u32)M.x86.R_CS << 4) + (M.x86.R_IP));
-    M.x86.R_IP += 4;
-    INC_DECODED_INST_LEN(4);
-    return fetched;
+func fetch_long_imm() uint32 {
+	if CHECK_IP_FETCH() {
+		x86emu_check_ip_access()
+	}
+	fetched := x86emu_lin_rdl(x86emu_ip_advance(4))
+	INC_DECODED_INST_LEN(4)
+	return fetched
 }
 
 /****************************************************************************
@@ -251,37 +234,47 @@ cpu-state-variable M.x86.mode. There are several potential states:
 
 Each of the above 7 items are handled with a bit in the mode field.
 ****************************************************************************/
-u32 get_data_segment(void) {
-#define GET_SEGMENT(segment)
-    switch (M.x86.mode & SYSMODE_SEGMASK) {
-      case 0:                   /* default case: use ds register */
-      case SYSMODE_SEGOVR_DS:
-      case SYSMODE_SEGOVR_DS | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_DS;
-      case SYSMODE_SEG_DS_SS:   /* non-overridden, use ss register */
-        return  M.x86.R_SS;
-      case SYSMODE_SEGOVR_CS:
-      case SYSMODE_SEGOVR_CS | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_CS;
-      case SYSMODE_SEGOVR_ES:
-      case SYSMODE_SEGOVR_ES | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_ES;
-      case SYSMODE_SEGOVR_FS:
-      case SYSMODE_SEGOVR_FS | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_FS;
-      case SYSMODE_SEGOVR_GS:
-      case SYSMODE_SEGOVR_GS | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_GS;
-      case SYSMODE_SEGOVR_SS:
-      case SYSMODE_SEGOVR_SS | SYSMODE_SEG_DS_SS:
-        return  M.x86.R_SS;
-      default:
-#ifdef  DEBUG
-        printf("error: should not happen:  multiple overrides.\n");
-#endif
-        HALT_SYS();
-        return 0;
-    }
+func get_data_segment() uint16 {
+	return x86emu_sreg(get_data_segment_index()).Get()
+}
+
+/****************************************************************************
+RETURNS:
+Number of the default data segment register
+
+REMARKS:
+Same as get_data_segment, but returns which segment register is in use so
+that its hidden base and limit can be applied.
+****************************************************************************/
+func get_data_segment_index() int {
+	switch M().x86.mode & SYSMODE_SEGMASK {
+	case 0, /* default case: use ds register */
+		SYSMODE_SEGOVR_DS,
+		SYSMODE_SEGOVR_DS | SYSMODE_SEG_DS_SS:
+		return SEG_DS
+	case SYSMODE_SEG_DS_SS: /* non-overridden, use ss register */
+		return SEG_SS
+	case SYSMODE_SEGOVR_CS,
+		SYSMODE_SEGOVR_CS | SYSMODE_SEG_DS_SS:
+		return SEG_CS
+	case SYSMODE_SEGOVR_ES,
+		SYSMODE_SEGOVR_ES | SYSMODE_SEG_DS_SS:
+		return SEG_ES
+	case SYSMODE_SEGOVR_FS,
+		SYSMODE_SEGOVR_FS | SYSMODE_SEG_DS_SS:
+		return SEG_FS
+	case SYSMODE_SEGOVR_GS,
+		SYSMODE_SEGOVR_GS | SYSMODE_SEG_DS_SS:
+		return SEG_GS
+	case SYSMODE_SEGOVR_SS,
+		SYSMODE_SEGOVR_SS | SYSMODE_SEG_DS_SS:
+		return SEG_SS
+	}
+	if DEBUG_DECODE() {
+		fmt.Printf("error: should not happen:  multiple overrides.\n")
+	}
+	HALT_SYS()
+	return SEG_DS
 }
 
 /****************************************************************************
@@ -293,12 +286,11 @@ Byte value read from the absolute memory location.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u8 fetch_data_byte( uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    return (*sys_rdb)((get_data_segment() << 4) + offset);
+func fetch_data_byte(offset uint32) uint8 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	return x86emu_lin_rdb(x86emu_seg_linear(get_data_segment_index(), offset, 1, false))
 }
 
 /****************************************************************************
@@ -310,12 +302,11 @@ Word value read from the absolute memory location.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u16 fetch_data_word( uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    return (*sys_rdw)((get_data_segment() << 4) + offset);
+func fetch_data_word(offset uint32) uint16 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	return x86emu_lin_rdw(x86emu_seg_linear(get_data_segment_index(), offset, 2, false))
 }
 
 /****************************************************************************
@@ -327,66 +318,65 @@ Long value read from the absolute memory location.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u32 fetch_data_long( uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    return (*sys_rdl)((get_data_segment() << 4) + offset);
+func fetch_data_long(offset uint32) uint32 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	return x86emu_lin_rdl(x86emu_seg_linear(get_data_segment_index(), offset, 4, false))
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to load data from
+n       - Segment register to load data through
 offset  - Offset to load data from
 
 RETURNS:
-Byte value read from the absolute memory location.
+Byte value read from the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u8 fetch_data_byte_abs( uint segment, uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    return (*sys_rdb)(((u32)segment << 4) + offset);
+func fetch_data_byte_abs(n int, offset uint32) uint8 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	return x86emu_lin_rdb(x86emu_seg_linear(n, offset, 1, false))
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to load data from
+n       - Segment register to load data through
 offset  - Offset to load data from
 
 RETURNS:
-Word value read from the absolute memory location.
+Word value read from the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u16 fetch_data_word_abs( uint segment, uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    return (*sys_rdw)(((u32)segment << 4) + offset);
+func fetch_data_word_abs(n int, offset uint32) uint16 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	return x86emu_lin_rdw(x86emu_seg_linear(n, offset, 2, false))
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to load data from
+n       - Segment register to load data through
 offset  - Offset to load data from
 
 RETURNS:
-Long value read from the absolute memory location.
+Long value read from the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_rdX) is already inline!
 ****************************************************************************/
-u32 fetch_data_long_abs( uint segment, uint offset) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    return (*sys_rdl)(((u32)segment << 4) + offset);
+func fetch_data_long_abs(n int, offset uint32) uint32 {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	return x86emu_lin_rdl(x86emu_seg_linear(n, offset, 4, false))
 }
 
 /****************************************************************************
@@ -400,12 +390,11 @@ the current 'default' segment, which may have been overridden.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_byte( uint offset, u8 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    (*sys_wrb)((get_data_segment() << 4) + offset, val);
+func store_data_byte(offset uint32, val uint8) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	x86emu_lin_wrb(x86emu_seg_linear(get_data_segment_index(), offset, 1, true), val)
 }
 
 /****************************************************************************
@@ -419,12 +408,11 @@ the current 'default' segment, which may have been overridden.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_word( uint offset, u16 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    (*sys_wrw)((get_data_segment() << 4) + offset, val);
+func store_data_word(offset uint32, val uint16) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	x86emu_lin_wrw(x86emu_seg_linear(get_data_segment_index(), offset, 2, true), val)
 }
 
 /****************************************************************************
@@ -438,195 +426,101 @@ the current 'default' segment, which may have been overridden.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_long( uint offset, u32 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access((u16)get_data_segment(), offset);
-#endif
-    (*sys_wrl)((get_data_segment() << 4) + offset, val);
+func store_data_long(offset uint32, val uint32) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(get_data_segment()), uint(offset))
+	}
+	x86emu_lin_wrl(x86emu_seg_linear(get_data_segment_index(), offset, 4, true), val)
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to store data at
+n       - Segment register to store data through
 offset  - Offset to store data at
 val     - Value to store
 
 REMARKS:
-Writes a byte value to an absolute memory location.
+Writes a byte value to the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_byte_abs( uint segment, uint offset, u8 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    (*sys_wrb)(((u32)segment << 4) + offset, val);
+func store_data_byte_abs(n int, offset uint32, val uint8) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	x86emu_lin_wrb(x86emu_seg_linear(n, offset, 1, true), val)
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to store data at
+n       - Segment register to store data through
 offset  - Offset to store data at
 val     - Value to store
 
 REMARKS:
-Writes a word value to an absolute memory location.
+Writes a word value to the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_word_abs( uint segment, uint offset, u16 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    (*sys_wrw)(((u32)segment << 4) + offset, val);
+func store_data_word_abs(n int, offset uint32, val uint16) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	x86emu_lin_wrw(x86emu_seg_linear(n, offset, 2, true), val)
 }
 
 /****************************************************************************
 PARAMETERS:
-segment - Segment to store data at
+n       - Segment register to store data through
 offset  - Offset to store data at
 val     - Value to store
 
 REMARKS:
-Writes a long value to an absolute memory location.
+Writes a long value to the memory location n:offset, ignoring
+the default segment and any override.
 
 NOTE: Do not inline this function as (*sys_wrX) is already inline!
 ****************************************************************************/
-void store_data_long_abs( uint segment, uint offset, u32 val) {
-#ifdef DEBUG
-    if (CHECK_DATA_ACCESS())
-        x86emu_check_data_access(segment, offset);
-#endif
-    (*sys_wrl)(((u32)segment << 4) + offset, val);
+func store_data_long_abs(n int, offset uint32, val uint32) {
+	if CHECK_DATA_ACCESS() {
+		x86emu_check_data_access(uint(x86emu_sreg(n).Get()), uint(offset))
+	}
+	x86emu_lin_wrl(x86emu_seg_linear(n, offset, 4, true), val)
 }
 
-/****************************************************************************
-PARAMETERS:
-reg - Register to decode
+/*
+ * The register operands of a ModR/M byte are x86emu_greg(rl), with the
+ * byte registers in the low and high halves of the first four, and
+ * x86emu_sreg(rh) for segment registers; see segment.go.
+ */
 
-RETURNS:
-Pointer to the appropriate register
-
-REMARKS:
-Return a pointer to the register given by the R/RM field of the
-modrm byte, for byte operands. Also enables the decoding of instructions.
-****************************************************************************/
-u8* decode_rm_byte_register( int reg) {
-    switch (reg) {
-      case 0:
-        DECODE_PRINTF("AL");
-        return &M.x86.R_AL;
-      case 1:
-        DECODE_PRINTF("CL");
-        return &M.x86.R_CL;
-      case 2:
-        DECODE_PRINTF("DL");
-        return &M.x86.R_DL;
-      case 3:
-        DECODE_PRINTF("BL");
-        return &M.x86.R_BL;
-      case 4:
-        DECODE_PRINTF("AH");
-        return &M.x86.R_AH;
-      case 5:
-        DECODE_PRINTF("CH");
-        return &M.x86.R_CH;
-      case 6:
-        DECODE_PRINTF("DH");
-        return &M.x86.R_DH;
-      case 7:
-        DECODE_PRINTF("BH");
-        return &M.x86.R_BH;
-    }
-    HALT_SYS();
-    return NULL;                /* NOT REACHED OR REACHED ON ERROR */
-}
+var x86emu_greg32_names = [8]string{"EAX", "ECX", "EDX", "EBX", "ESP", "EBP", "ESI", "EDI"}
 
-/****************************************************************************
-PARAMETERS:
-reg - Register to decode
+var x86emu_greg16_names = [8]string{"AX", "CX", "DX", "BX", "SP", "BP", "SI", "DI"}
 
-RETURNS:
-Pointer to the appropriate register
+var x86emu_greg8_names = [8]string{"AL", "CL", "DL", "BL", "AH", "CH", "DH", "BH"}
 
-REMARKS:
-Return a pointer to the register given by the R/RM field of the
-modrm byte, for word operands.  Also enables the decoding of instructions.
-****************************************************************************/
-u16* decode_rm_word_register( int reg) {
-    switch (reg) {
-      case 0:
-        DECODE_PRINTF("AX");
-        return &M.x86.R_AX;
-      case 1:
-        DECODE_PRINTF("CX");
-        return &M.x86.R_CX;
-      case 2:
-        DECODE_PRINTF("DX");
-        return &M.x86.R_DX;
-      case 3:
-        DECODE_PRINTF("BX");
-        return &M.x86.R_BX;
-      case 4:
-        DECODE_PRINTF("SP");
-        return &M.x86.R_SP;
-      case 5:
-        DECODE_PRINTF("BP");
-        return &M.x86.R_BP;
-      case 6:
-        DECODE_PRINTF("SI");
-        return &M.x86.R_SI;
-      case 7:
-        DECODE_PRINTF("DI");
-        return &M.x86.R_DI;
-    }
-    HALT_SYS();
-    return NULL;                /* NOTREACHED OR REACHED ON ERROR */
+/* A byte register: the low or high half of AX, CX, DX or BX. */
+type x86emu_breg struct {
+	r    *reg
+	high bool
 }
 
-/****************************************************************************
-PARAMETERS:
-reg - Register to decode
-
-RETURNS:
-Pointer to the appropriate register
+func (b x86emu_breg) Get() uint8 {
+	if b.high {
+		return b.r.Get8h()
+	}
+	return b.r.Get8l()
+}
 
-REMARKS:
-Return a pointer to the register given by the R/RM field of the
-modrm byte, for dword operands.  Also enables the decoding of instructions.
-****************************************************************************/
-u32* decode_rm_long_register( int reg) {
-    switch (reg) {
-      case 0:
-        DECODE_PRINTF("EAX");
-        return &M.x86.R_EAX;
-      case 1:
-        DECODE_PRINTF("ECX");
-        return &M.x86.R_ECX;
-      case 2:
-        DECODE_PRINTF("EDX");
-        return &M.x86.R_EDX;
-      case 3:
-        DECODE_PRINTF("EBX");
-        return &M.x86.R_EBX;
-      case 4:
-        DECODE_PRINTF("ESP");
-        return &M.x86.R_ESP;
-      case 5:
-        DECODE_PRINTF("EBP");
-        return &M.x86.R_EBP;
-      case 6:
-        DECODE_PRINTF("ESI");
-        return &M.x86.R_ESI;
-      case 7:
-        DECODE_PRINTF("EDI");
-        return &M.x86.R_EDI;
-    }
-    HALT_SYS();
-    return NULL;                /* NOTREACHED OR REACHED ON ERROR */
+func (b x86emu_breg) Set(v uint8) {
+	if b.high {
+		b.r.Seth8(v)
+	} else {
+		b.r.Setl8(v)
+	}
 }
 
 /****************************************************************************
@@ -634,42 +528,18 @@ PARAMETERS:
 reg - Register to decode
 
 RETURNS:
-Pointer to the appropriate register
+The byte register given by the R/RM field of the modrm byte.
 
 REMARKS:
-Return a pointer to the register given by the R/RM field of the
-modrm byte, for word operands, modified from above for the weirdo
-special case of segreg operands.  Also enables the decoding of instructions.
+Also enables the decoding of instructions.
 ****************************************************************************/
-u16* decode_rm_seg_register( int reg) {
-    switch (reg) {
-      case 0:
-        DECODE_PRINTF("ES");
-        return &M.x86.R_ES;
-      case 1:
-        DECODE_PRINTF("CS");
-        return &M.x86.R_CS;
-      case 2:
-        DECODE_PRINTF("SS");
-        return &M.x86.R_SS;
-      case 3:
-        DECODE_PRINTF("DS");
-        return &M.x86.R_DS;
-      case 4:
-        DECODE_PRINTF("FS");
-        return &M.x86.R_FS;
-      case 5:
-        DECODE_PRINTF("GS");
-        return &M.x86.R_GS;
-      case 6:
-      case 7:
-        DECODE_PRINTF("ILLEGAL SEGREG");
-        break;
-    }
-    HALT_SYS();
-    return NULL;                /* NOT REACHED OR REACHED ON ERROR */
+func decode_rm_byte_register(reg int) x86emu_breg {
+	DECODE_PRINTF("%s", x86emu_greg8_names[reg&7])
+	return x86emu_breg{r: x86emu_greg(reg & 3), high: reg&4 != 0}
 }
 
+var x86emu_rm16_names = [8]string{"[BX+SI]", "[BX+DI]", "[BP+SI]", "[BP+DI]", "[SI]", "[DI]", "[BP]", "[BX]"}
+
 /****************************************************************************
 PARAMETERS:
 scale - scale value of SIB byte
@@ -682,41 +552,18 @@ REMARKS:
 Decodes scale/index of SIB byte and returns relevant offset part of
 effective address.
 ****************************************************************************/
-unsigned decode_sib_si( int scale, int index) {
-    scale = 1 << scale;
-    if (scale > 1) {
-        DECODE_PRINTF2("[%d*", scale);
-    } else {
-        DECODE_PRINTF("[");
-    }
-    switch (index) {
-      case 0:
-        DECODE_PRINTF("EAX]");
-        return M.x86.R_EAX * index;
-      case 1:
-        DECODE_PRINTF("ECX]");
-        return M.x86.R_ECX * index;
-      case 2:
-        DECODE_PRINTF("EDX]");
-        return M.x86.R_EDX * index;
-      case 3:
-        DECODE_PRINTF("EBX]");
-        return M.x86.R_EBX * index;
-      case 4:
-        DECODE_PRINTF("0]");
-        return 0;
-      case 5:
-        DECODE_PRINTF("EBP]");
-        return M.x86.R_EBP * index;
-      case 6:
-        DECODE_PRINTF("ESI]");
-        return M.x86.R_ESI * index;
-      case 7:
-        DECODE_PRINTF("EDI]");
-        return M.x86.R_EDI * index;
-    }
-    HALT_SYS();
-    return 0;                   /* NOT REACHED OR REACHED ON ERROR */
+func decode_sib_si(scale, index int) uint32 {
+	scale = 1 << uint(scale)
+	if index == 4 {
+		DECODE_PRINTF("[0]")
+		return 0
+	}
+	if scale > 1 {
+		DECODE_PRINTF("[%d*%s]", scale, x86emu_greg32_names[index])
+	} else {
+		DECODE_PRINTF("[%s]", x86emu_greg32_names[index])
+	}
+	return x86emu_greg(index).Get32() * uint32(scale)
 }
 
 /****************************************************************************
@@ -729,71 +576,26 @@ Offset in memory for the address decoding
 REMARKS:
 Decodes SIB addressing byte and returns calculated effective address.
 ****************************************************************************/
-unsigned decode_sib_address( int mod) {
-    int sib   = fetch_byte_imm();
-    int ss    = (sib >> 6) & 0x03;
-    int index = (sib >> 3) & 0x07;
-    int base  = sib & 0x07;
-    int offset = 0;
-    int displacement;
-
-    switch (base) {
-      case 0:
-        DECODE_PRINTF("[EAX]");
-        offset = M.x86.R_EAX;
-        break;
-      case 1:
-        DECODE_PRINTF("[ECX]");
-        offset = M.x86.R_ECX;
-        break;
-      case 2:
-        DECODE_PRINTF("[EDX]");
-        offset = M.x86.R_EDX;
-        break;
-      case 3:
-        DECODE_PRINTF("[EBX]");
-        offset = M.x86.R_EBX;
-        break;
-      case 4:
-        DECODE_PRINTF("[ESP]");
-        offset = M.x86.R_ESP;
-        break;
-      case 5:
-        switch (mod) {
-          case 0:
-            displacement = (s32)fetch_long_imm();
-            DECODE_PRINTF2("[%d]", displacement);
-            offset = displacement;
-            break;
-          case 1:
-            displacement = (s8)fetch_byte_imm();
-            DECODE_PRINTF2("[%d][EBP]", displacement);
-            offset = M.x86.R_EBP + displacement;
-            break;
-          case 2:
-            displacement = (s32)fetch_long_imm();
-            DECODE_PRINTF2("[%d][EBP]", displacement);
-            offset = M.x86.R_EBP + displacement;
-            break;
-          default:
-            HALT_SYS();
-        }
-        DECODE_PRINTF("[EAX]");
-        offset = M.x86.R_EAX;
-        break;
-      case 6:
-        DECODE_PRINTF("[ESI]");
-        offset = M.x86.R_ESI;
-        break;
-      case 7:
-        DECODE_PRINTF("[EDI]");
-        offset = M.x86.R_EDI;
-        break;
-      default:
-        HALT_SYS();
-    }
-    offset += decode_sib_si(ss, index);
-    return offset;
+func decode_sib_address(mod int) uint32 {
+	sib := int(fetch_byte_imm())
+	ss := (sib >> 6) & 0x03
+	index := (sib >> 3) & 0x07
+	base := sib & 0x07
+	var offset uint32
+
+	if base == 5 && mod == 0 {
+		/* no base, a 32-bit displacement instead */
+		offset = fetch_long_imm()
+		DECODE_PRINTF("[%08x]", offset)
+	} else {
+		DECODE_PRINTF("[%s]", x86emu_greg32_names[base])
+		offset = x86emu_greg(base).Get32()
+		if base == 4 || base == 5 {
+			/* ESP and EBP based addresses are on the stack */
+			M().x86.mode |= SYSMODE_SEG_DS_SS
+		}
+	}
+	return offset + decode_sib_si(ss, index)
 }
 
 /****************************************************************************
@@ -816,71 +618,27 @@ NOTE:   The code which specifies the corresponding segment (ds vs ss)
         if a SS access is needed, set this bit.  Otherwise, DS access
         occurs (unless any of the segment override bits are set).
 ****************************************************************************/
-unsigned decode_rm00_address( int rm) {
-    unsigned offset;
-
-    if (M.x86.mode & SYSMODE_PREFIX_ADDR) {
-        /* 32-bit addressing */
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF("[EAX]");
-            return M.x86.R_EAX;
-          case 1:
-            DECODE_PRINTF("[ECX]");
-            return M.x86.R_ECX;
-          case 2:
-            DECODE_PRINTF("[EDX]");
-            return M.x86.R_EDX;
-          case 3:
-            DECODE_PRINTF("[EBX]");
-            return M.x86.R_EBX;
-          case 4:
-            return decode_sib_address(0);
-          case 5:
-            offset = fetch_long_imm();
-            DECODE_PRINTF2("[%08x]", offset);
-            return offset;
-          case 6:
-            DECODE_PRINTF("[ESI]");
-            return M.x86.R_ESI;
-          case 7:
-            DECODE_PRINTF("[EDI]");
-            return M.x86.R_EDI;
-        }
-    } else {
-        /* 16-bit addressing */
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF("[BX+SI]");
-            return (M.x86.R_BX + M.x86.R_SI) & 0xffff;
-          case 1:
-            DECODE_PRINTF("[BX+DI]");
-            return (M.x86.R_BX + M.x86.R_DI) & 0xffff;
-          case 2:
-            DECODE_PRINTF("[BP+SI]");
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_SI) & 0xffff;
-          case 3:
-            DECODE_PRINTF("[BP+DI]");
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_DI) & 0xffff;
-          case 4:
-            DECODE_PRINTF("[SI]");
-            return M.x86.R_SI;
-          case 5:
-            DECODE_PRINTF("[DI]");
-            return M.x86.R_DI;
-          case 6:
-            offset = fetch_word_imm();
-            DECODE_PRINTF2("[%04x]", offset);
-            return offset;
-          case 7:
-            DECODE_PRINTF("[BX]");
-            return M.x86.R_BX;
-        }
-    }
-    HALT_SYS();
-    return 0;
+func decode_rm00_address(rm int) uint32 {
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		/* 32-bit addressing */
+		switch rm {
+		case 4:
+			return decode_sib_address(0)
+		case 5:
+			offset := fetch_long_imm()
+			DECODE_PRINTF("[%08x]", offset)
+			return offset
+		}
+		DECODE_PRINTF("[%s]", x86emu_greg32_names[rm])
+		return x86emu_greg(rm).Get32()
+	}
+	/* 16-bit addressing */
+	if rm == 6 {
+		offset := uint32(fetch_word_imm())
+		DECODE_PRINTF("[%04x]", offset)
+		return offset
+	}
+	return decode_rm16_address(rm, 0)
 }
 
 /****************************************************************************
@@ -894,80 +652,21 @@ REMARKS:
 Return the offset given by mod=01 addressing.  Also enables the
 decoding of instructions.
 ****************************************************************************/
-unsigned decode_rm01_address( int rm) {
-    int displacement;
-
-    if (M.x86.mode & SYSMODE_PREFIX_ADDR) {
-        /* 32-bit addressing */
-        if (rm != 4)
-            displacement = (s8)fetch_byte_imm();
-        else
-            displacement = 0;
-
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF2("%d[EAX]", displacement);
-            return M.x86.R_EAX + displacement;
-          case 1:
-            DECODE_PRINTF2("%d[ECX]", displacement);
-            return M.x86.R_ECX + displacement;
-          case 2:
-            DECODE_PRINTF2("%d[EDX]", displacement);
-            return M.x86.R_EDX + displacement;
-          case 3:
-            DECODE_PRINTF2("%d[EBX]", displacement);
-            return M.x86.R_EBX + displacement;
-          case 4: {
-            int offset = decode_sib_address(1);
-            displacement = (s8)fetch_byte_imm();
-            DECODE_PRINTF2("[%d]", displacement);
-            return offset + displacement;
-          }
-          case 5:
-            DECODE_PRINTF2("%d[EBP]", displacement);
-            return M.x86.R_EBP + displacement;
-          case 6:
-            DECODE_PRINTF2("%d[ESI]", displacement);
-            return M.x86.R_ESI + displacement;
-          case 7:
-            DECODE_PRINTF2("%d[EDI]", displacement);
-            return M.x86.R_EDI + displacement;
-        }
-    } else {
-        /* 16-bit addressing */
-        displacement = (s8)fetch_byte_imm();
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF2("%d[BX+SI]", displacement);
-            return (M.x86.R_BX + M.x86.R_SI + displacement) & 0xffff;
-          case 1:
-            DECODE_PRINTF2("%d[BX+DI]", displacement);
-            return (M.x86.R_BX + M.x86.R_DI + displacement) & 0xffff;
-          case 2:
-            DECODE_PRINTF2("%d[BP+SI]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_SI + displacement) & 0xffff;
-          case 3:
-            DECODE_PRINTF2("%d[BP+DI]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_DI + displacement) & 0xffff;
-          case 4:
-            DECODE_PRINTF2("%d[SI]", displacement);
-            return (M.x86.R_SI + displacement) & 0xffff;
-          case 5:
-            DECODE_PRINTF2("%d[DI]", displacement);
-            return (M.x86.R_DI + displacement) & 0xffff;
-          case 6:
-            DECODE_PRINTF2("%d[BP]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + displacement) & 0xffff;
-          case 7:
-            DECODE_PRINTF2("%d[BX]", displacement);
-            return (M.x86.R_BX + displacement) & 0xffff;
-        }
-    }
-    HALT_SYS();
-    return 0;                   /* SHOULD NOT HAPPEN */
+func decode_rm01_address(rm int) uint32 {
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		/* 32-bit addressing */
+		if rm == 4 {
+			offset := decode_sib_address(1)
+			displacement := int32(int8(fetch_byte_imm()))
+			DECODE_PRINTF("[%d]", displacement)
+			return offset + uint32(displacement)
+		}
+		displacement := int32(int8(fetch_byte_imm()))
+		return decode_rm32_address(rm, displacement)
+	}
+	/* 16-bit addressing */
+	displacement := int32(int8(fetch_byte_imm()))
+	return decode_rm16_address(rm, displacement)
 }
 
 /****************************************************************************
@@ -981,81 +680,81 @@ REMARKS:
 Return the offset given by mod=10 addressing.  Also enables the
 decoding of instructions.
 ****************************************************************************/
-unsigned decode_rm10_address( int rm) {
-    if (M.x86.mode & SYSMODE_PREFIX_ADDR) {
-        int displacement;
-
-        /* 32-bit addressing */
-        if (rm != 4)
-            displacement = (s32)fetch_long_imm();
-        else
-            displacement = 0;
-
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF2("%d[EAX]", displacement);
-            return M.x86.R_EAX + displacement;
-          case 1:
-            DECODE_PRINTF2("%d[ECX]", displacement);
-            return M.x86.R_ECX + displacement;
-          case 2:
-            DECODE_PRINTF2("%d[EDX]", displacement);
-            return M.x86.R_EDX + displacement;
-          case 3:
-            DECODE_PRINTF2("%d[EBX]", displacement);
-            return M.x86.R_EBX + displacement;
-          case 4: {
-            int offset = decode_sib_address(2);
-            displacement = (s32)fetch_long_imm();
-            DECODE_PRINTF2("[%d]", displacement);
-            return offset + displacement;
-          }
-          case 5:
-            DECODE_PRINTF2("%d[EBP]", displacement);
-            return M.x86.R_EBP + displacement;
-          case 6:
-            DECODE_PRINTF2("%d[ESI]", displacement);
-            return M.x86.R_ESI + displacement;
-          case 7:
-            DECODE_PRINTF2("%d[EDI]", displacement);
-            return M.x86.R_EDI + displacement;
-        }
-    } else {
-        int displacement = (s16)fetch_word_imm();
-
-        /* 16-bit addressing */
-        switch (rm) {
-          case 0:
-            DECODE_PRINTF2("%d[BX+SI]", displacement);
-            return (M.x86.R_BX + M.x86.R_SI + displacement) & 0xffff;
-          case 1:
-            DECODE_PRINTF2("%d[BX+DI]", displacement);
-            return (M.x86.R_BX + M.x86.R_DI + displacement) & 0xffff;
-          case 2:
-            DECODE_PRINTF2("%d[BP+SI]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_SI + displacement) & 0xffff;
-          case 3:
-            DECODE_PRINTF2("%d[BP+DI]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + M.x86.R_DI + displacement) & 0xffff;
-          case 4:
-            DECODE_PRINTF2("%d[SI]", displacement);
-            return (M.x86.R_SI + displacement) & 0xffff;
-          case 5:
-            DECODE_PRINTF2("%d[DI]", displacement);
-            return (M.x86.R_DI + displacement) & 0xffff;
-          case 6:
-            DECODE_PRINTF2("%d[BP]", displacement);
-            M.x86.mode |= SYSMODE_SEG_DS_SS;
-            return (M.x86.R_BP + displacement) & 0xffff;
-          case 7:
-            DECODE_PRINTF2("%d[BX]", displacement);
-            return (M.x86.R_BX + displacement) & 0xffff;
-        }
-    }
-    HALT_SYS();
-    return 0;                   /* SHOULD NOT HAPPEN */
+func decode_rm10_address(rm int) uint32 {
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		/* 32-bit addressing */
+		if rm == 4 {
+			offset := decode_sib_address(2)
+			displacement := int32(fetch_long_imm())
+			DECODE_PRINTF("[%d]", displacement)
+			return offset + uint32(displacement)
+		}
+		displacement := int32(fetch_long_imm())
+		return decode_rm32_address(rm, displacement)
+	}
+	/* 16-bit addressing */
+	displacement := int32(int16(fetch_word_imm()))
+	return decode_rm16_address(rm, displacement)
+}
+
+/****************************************************************************
+PARAMETERS:
+rm           - RM value to decode, not 4
+displacement - Displacement that followed the ModR/M byte
+
+RETURNS:
+Offset in memory for 32-bit mod=01 and mod=10 addressing.
+****************************************************************************/
+func decode_rm32_address(rm int, displacement int32) uint32 {
+	DECODE_PRINTF("%d[%s]", displacement, x86emu_greg32_names[rm])
+	if rm == 5 {
+		M().x86.mode |= SYSMODE_SEG_DS_SS
+	}
+	return x86emu_greg(rm).Get32() + uint32(displacement)
+}
+
+/****************************************************************************
+PARAMETERS:
+rm           - RM value to decode
+displacement - Displacement that followed the ModR/M byte, or 0
+
+RETURNS:
+Offset in memory for 16-bit addressing; mod=00 with rm=6 is a plain
+displacement and is handled by the caller.
+
+REMARKS:
+Addresses based on BP are relative to SS unless overridden.
+****************************************************************************/
+func decode_rm16_address(rm int, displacement int32) uint32 {
+	r := &M().x86
+	var offset uint32
+	switch rm {
+	case 0:
+		offset = uint32(r.gen.B.Get16()) + uint32(r.spc.SI.Get16())
+	case 1:
+		offset = uint32(r.gen.B.Get16()) + uint32(r.spc.DI.Get16())
+	case 2:
+		r.mode |= SYSMODE_SEG_DS_SS
+		offset = uint32(r.spc.BP.Get16()) + uint32(r.spc.SI.Get16())
+	case 3:
+		r.mode |= SYSMODE_SEG_DS_SS
+		offset = uint32(r.spc.BP.Get16()) + uint32(r.spc.DI.Get16())
+	case 4:
+		offset = uint32(r.spc.SI.Get16())
+	case 5:
+		offset = uint32(r.spc.DI.Get16())
+	case 6:
+		r.mode |= SYSMODE_SEG_DS_SS
+		offset = uint32(r.spc.BP.Get16())
+	case 7:
+		offset = uint32(r.gen.B.Get16())
+	}
+	if displacement != 0 {
+		DECODE_PRINTF("%d%s", displacement, x86emu_rm16_names[rm])
+	} else {
+		DECODE_PRINTF("%s", x86emu_rm16_names[rm])
+	}
+	return (offset + uint32(displacement)) & 0xffff
 }
 
 
@@ -1072,10 +771,12 @@ REMARKS:
 Return the offset given by "mod" addressing.
 ****************************************************************************/
 
-unsigned decode_rmXX_address(int mod, int rm) {
-  if (mod == 0)
-    return decode_rm00_address(rm);
-  if (mod == 1)
-    return decode_rm01_address(rm);
-  return decode_rm10_address(rm);
+func decode_rmXX_address(mod, rm int) uint32 {
+	if mod == 0 {
+		return decode_rm00_address(rm)
+	}
+	if mod == 1 {
+		return decode_rm01_address(rm)
+	}
+	return decode_rm10_address(rm)
 }
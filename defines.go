@@ -13,6 +13,8 @@ const F_TF uint32 = 256
 const F_IF uint32 = 512
 const F_DF uint32 = 1024
 const F_OF uint32 = 2048
+const F_ALWAYS_ON uint32 = 2
+const F_MSK uint32 = F_CF | F_PF | F_AF | F_ZF | F_SF | F_TF | F_IF | F_DF | F_OF
 
 const SYSMODE_SEG_DS_SS uint32 = 1
 const SYSMODE_SEGOVR_CS uint32 = 2
@@ -38,13 +40,20 @@ const SYSMODE_CLRMASK uint32 = (SYSMODE_SEG_DS_SS      |
 						 SYSMODE_SEGOVR_SS      | 
 						 SYSMODE_PREFIX_DATA    | 
 						 SYSMODE_PREFIX_ADDR    | 
-						 SYSMODE_32BIT_REP)
+						 SYSMODE_32BIT_REP      | 
+						 SYSMODE_PREFIX_REPE    | 
+						 SYSMODE_PREFIX_REPNE   | 
+						 SYSMODE_INSN_SAVED)
 
 const SYSMODE_PREFIX_REPE uint32 = 128
 const SYSMODE_PREFIX_REPNE uint32 = 256
 const SYSMODE_PREFIX_DATA uint32 = 512
 const SYSMODE_PREFIX_ADDR uint32 = 1024
 const SYSMODE_32BIT_REP uint32 = 2048
+// Start of the current instruction has been recorded; see x86emu_exec_insn.
+const SYSMODE_INSN_SAVED uint32 = 4096
+// MOV SS, POP SS or STI: no interrupt before the next instruction.
+const SYSMODE_INTR_SHADOW uint32 = 8192
 const SYSMODE_INTR_PENDING uint32 = 268435456
 const SYSMODE_EXTRN_INTR uint32 = 536870912
 const SYSMODE_HALTED uint32 = 1073741824
@@ -88,3 +97,4 @@ var DEBUG_DECODE_NOPRINT_F uint32 = uint32(32768)
 var DEBUG_SAVE_IP_CS_F uint32 = uint32(65536)
 var DEBUG_TRACEJMP_F uint32 = uint32(131072)
 var DEBUG_TRACEJMP_REGS_F uint32 = uint32(262144)
+var DEBUG_MSR_F uint32 = uint32(524288)
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+ * Int 13h disk services over image files.
+ *
+ * Each BIOS drive number, 00h and up for floppies and 80h and up for hard
+ * disks, maps to a raw image file.  The geometry comes from the image size
+ * for floppies and from the partition table, when there is one, for hard
+ * disks.  Images are opened read-write, read-only, in which case writes
+ * fail as write protected, or copy-on-write, where written sectors are kept
+ * in memory and the file is never changed.
+ *
+ * The service is installed with X86EMU_setupBiosVector, so a disk
+ * controller ROM that hooks int 13h sees calls first and reaches these
+ * drives when it chains to the old vector.
+ */
+
+const (
+	DISK_RW = iota
+	DISK_RO
+	DISK_COW
+)
+
+const (
+	DISK_SECTOR_SIZE = 512
+
+	DISK_OK            = 0x00
+	DISK_BAD_COMMAND   = 0x01
+	DISK_WRITE_PROTECT = 0x03
+	DISK_NOT_FOUND     = 0x04 /* sector not found */
+	DISK_TIMEOUT       = 0x80 /* drive not ready */
+	DISK_READ_FAULT    = 0xbb /* undefined error, used for host I/O errors */
+
+	BDA_EQUIPMENT     = 0x410
+	BDA_FLOPPY_STATUS = 0x441
+	BDA_HDD_STATUS    = 0x474
+)
+
+type X86EMU_disk struct {
+	drive    uint8
+	path     string
+	file     *os.File
+	mode     int
+	sectors  uint64
+	cyls     uint32
+	heads    uint32
+	spt      uint32 /* sectors per track */
+	fd_type  uint8  /* CMOS floppy type, 0 for hard disks */
+	overlay  map[uint64][]byte
+	readonly bool
+}
+
+var x86emu_disks = map[uint8]*X86EMU_disk{}
+
+var x86emu_disk struct {
+	dpt uint32 /* diskette parameter table */
+}
+
+/* Standard floppy formats, by image size */
+var x86emu_floppy_formats = []struct {
+	size             int64
+	cyls, heads, spt uint32
+	fd_type          uint8
+}{
+	{160 << 10, 40, 1, 8, 1},
+	{180 << 10, 40, 1, 9, 1},
+	{320 << 10, 40, 2, 8, 1},
+	{360 << 10, 40, 2, 9, 1},
+	{720 << 10, 80, 2, 9, 3},
+	{1200 << 10, 80, 2, 15, 2},
+	{1440 << 10, 80, 2, 18, 4},
+	{2880 << 10, 80, 2, 36, 6},
+}
+
+var x86emu_disk_modes = map[string]int{"rw": DISK_RW, "ro": DISK_RO, "cow": DISK_COW}
+
+func (d *X86EMU_disk) String() string {
+	return fmt.Sprintf("%02x: %s, %d sectors, CHS %d/%d/%d", d.drive, d.path, d.sectors, d.cyls, d.heads, d.spt)
+}
+
+// PARAMETERS:
+// drive - BIOS drive number
+// path  - Raw image file
+// mode  - DISK_RW, DISK_RO or DISK_COW
+//
+// REMARKS:
+// Replaces any image attached to the drive before.
+func X86EMU_attachDisk(drive uint8, path string, mode int) (*X86EMU_disk, error) {
+	flag := os.O_RDWR
+	if mode != DISK_RW {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	if size < DISK_SECTOR_SIZE {
+		f.Close()
+		return nil, fmt.Errorf("%s: image is smaller than a sector", path)
+	}
+	d := &X86EMU_disk{
+		drive:    drive,
+		path:     path,
+		file:     f,
+		mode:     mode,
+		sectors:  uint64(size) / DISK_SECTOR_SIZE,
+		readonly: mode == DISK_RO,
+	}
+	if mode == DISK_COW {
+		d.overlay = map[uint64][]byte{}
+	}
+	if drive < 0x80 {
+		err = d.floppy_geometry(size)
+	} else {
+		d.disk_geometry()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if old := x86emu_disks[drive]; old != nil {
+		old.file.Close()
+	}
+	x86emu_disks[drive] = d
+	return d, nil
+}
+
+// PARAMETERS:
+// spec - drive=path[,ro|,cow], the drive in hex, or fd0/hd0 style
+//
+// REMARKS:
+// Attaches a disk described the way the command line does.
+func X86EMU_attachDiskSpec(spec string) (*X86EMU_disk, error) {
+	var name, path, mode string
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == '=' {
+			name, path = spec[:i], spec[i+1:]
+			break
+		}
+	}
+	if name == "" || path == "" {
+		return nil, fmt.Errorf("%s: expected drive=image", spec)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == ',' {
+			if _, ok := x86emu_disk_modes[path[i+1:]]; ok {
+				path, mode = path[:i], path[i+1:]
+			}
+			break
+		}
+	}
+	var drive uint8
+	var n uint
+	switch {
+	case len(name) == 3 && name[:2] == "fd" && name[2] >= '0' && name[2] <= '3':
+		drive = name[2] - '0'
+	case len(name) == 3 && name[:2] == "hd" && name[2] >= '0' && name[2] <= '9':
+		drive = 0x80 + name[2] - '0'
+	default:
+		if _, err := fmt.Sscanf(name, "%x", &n); err != nil || n > 0xff {
+			return nil, fmt.Errorf("%s: bad drive %q", spec, name)
+		}
+		drive = uint8(n)
+	}
+	return X86EMU_attachDisk(drive, path, x86emu_disk_modes[mode])
+}
+
+func (d *X86EMU_disk) floppy_geometry(size int64) error {
+	for _, f := range x86emu_floppy_formats {
+		if f.size == size {
+			d.cyls, d.heads, d.spt, d.fd_type = f.cyls, f.heads, f.spt, f.fd_type
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %d bytes is not a floppy size", d.path, size)
+}
+
+// REMARKS:
+// Takes heads and sectors per track from the ending CHS of the partitions
+// in the MBR, as most tools and BIOSes do; images without a partition
+// table get the usual translated geometry for their size.
+func (d *X86EMU_disk) disk_geometry() {
+	mbr := make([]byte, DISK_SECTOR_SIZE)
+	d.heads, d.spt = 16, 63
+	if d.sectors > 1024*16*63 {
+		d.heads = 255
+	}
+	if _, err := d.file.ReadAt(mbr, 0); err == nil && mbr[510] == 0x55 && mbr[511] == 0xaa {
+		for i := 0; i < 4; i++ {
+			e := mbr[0x1be+16*i:]
+			if e[4] == 0 {
+				continue
+			}
+			heads, spt := uint32(e[5])+1, uint32(e[6]&0x3f)
+			if spt != 0 {
+				d.heads, d.spt = heads, spt
+				break
+			}
+		}
+	}
+	c := d.sectors / uint64(d.heads*d.spt)
+	if c > 1024 {
+		c = 1024
+	}
+	if c == 0 {
+		c = 1
+	}
+	d.cyls = uint32(c)
+}
+
+/* Reads count sectors from lba, as far as the image goes. */
+func (d *X86EMU_disk) read(lba uint64, count uint32) ([]byte, uint8) {
+	if lba >= d.sectors {
+		return nil, DISK_NOT_FOUND
+	}
+	status := uint8(DISK_OK)
+	if lba+uint64(count) > d.sectors {
+		count = uint32(d.sectors - lba)
+		status = DISK_NOT_FOUND
+	}
+	buf := make([]byte, count*DISK_SECTOR_SIZE)
+	if _, err := d.file.ReadAt(buf, int64(lba)*DISK_SECTOR_SIZE); err != nil && err != io.EOF {
+		return nil, DISK_READ_FAULT
+	}
+	for i := uint64(0); i < uint64(count); i++ {
+		if s := d.overlay[lba+i]; s != nil {
+			copy(buf[i*DISK_SECTOR_SIZE:], s)
+		}
+	}
+	return buf, status
+}
+
+/* Writes whole sectors at lba; returns the sectors written. */
+func (d *X86EMU_disk) write(lba uint64, data []byte) (uint32, uint8) {
+	if d.readonly {
+		return 0, DISK_WRITE_PROTECT
+	}
+	if lba >= d.sectors {
+		return 0, DISK_NOT_FOUND
+	}
+	count := uint32(len(data) / DISK_SECTOR_SIZE)
+	status := uint8(DISK_OK)
+	if lba+uint64(count) > d.sectors {
+		count = uint32(d.sectors - lba)
+		status = DISK_NOT_FOUND
+	}
+	if d.overlay != nil {
+		for i := uint64(0); i < uint64(count); i++ {
+			d.overlay[lba+i] = append([]byte(nil), data[i*DISK_SECTOR_SIZE:(i+1)*DISK_SECTOR_SIZE]...)
+		}
+		return count, status
+	}
+	if _, err := d.file.WriteAt(data[:count*DISK_SECTOR_SIZE], int64(lba)*DISK_SECTOR_SIZE); err != nil {
+		return 0, DISK_READ_FAULT
+	}
+	return count, status
+}
+
+/* Number of attached drives of the kind of drive, floppy or hard disk. */
+func x86emu_disk_count(drive uint8) uint8 {
+	n := uint8(0)
+	for dr := range x86emu_disks {
+		if dr&0x80 == drive&0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+// REMARKS:
+// Installs the int 13h hook and vector, the diskette parameter table at
+// int 1Eh, and records the attached drives in the equipment word and the
+// hard disk count of the BIOS data area.  Attach the images first.
+func X86EMU_setupDiskBios() error {
+	d := &x86emu_disk
+	dpt, err := x86emu_fseg_alloc(11, 1)
+	if err != nil {
+		return err
+	}
+	/* 1.44M parameters, as most BIOSes leave them */
+	x86emu_phys_copy_in(dpt, []byte{0xaf, 0x02, 0x25, 0x02, 0x12, 0x1b, 0xff, 0x6c, 0xf6, 0x0f, 0x08})
+	if _, err := X86EMU_setupBiosVector(0x13, "int13", x86emu_int13_service); err != nil {
+		return err
+	}
+	d.dpt = dpt
+	x86emu_set_vector(0x1e, d.dpt)
+
+	eq := x86emu_phys_read(BDA_EQUIPMENT, 2) &^ 0xc1
+	if n := x86emu_disk_count(0); n > 0 {
+		eq |= 1 | uint32(n-1)<<6
+	}
+	x86emu_phys_write(BDA_EQUIPMENT, 2, eq)
+	x86emu_phys_write(BDA_HDD_COUNT, 1, uint32(x86emu_disk_count(0x80)))
+	return nil
+}
+
+/* Sets AH, CF and the last status in the BIOS data area. */
+func x86emu_disk_status(drive uint8, status uint8) {
+	x86emu_bios_status(status)
+	if drive&0x80 != 0 {
+		x86emu_phys_write(BDA_HDD_STATUS, 1, uint32(status))
+	} else {
+		x86emu_phys_write(BDA_FLOPPY_STATUS, 1, uint32(status))
+	}
+}
+
+/* Linear address of seg:off + n, wrapping at 64K the way real mode does. */
+func x86emu_disk_buffer(seg uint16, off uint16, n uint32) uint32 {
+	return uint32(seg)<<4 + uint32(off+uint16(n))
+}
+
+func x86emu_int13_service() {
+	r := &M().x86
+	ah, drive := r.gen.A.Get8h(), r.gen.D.Get8l()
+	d := x86emu_disks[drive]
+	if DEBUG_SVC() {
+		fmt.Printf("int13: ax=%04x bx=%04x cx=%04x dx=%04x\n",
+			r.gen.A.Get16(), r.gen.B.Get16(), r.gen.C.Get16(), r.gen.D.Get16())
+	}
+	if d == nil && ah != 0x00 && ah != 0x01 && ah != 0x0d {
+		status := uint8(DISK_BAD_COMMAND)
+		if drive < 0x80 {
+			status = DISK_TIMEOUT
+		}
+		if ah == 0x08 || ah == 0x15 {
+			r.gen.A.Setl8(0)
+		}
+		x86emu_disk_status(drive, status)
+		return
+	}
+
+	switch ah {
+	case 0x00, 0x0d: /* reset */
+		x86emu_disk_status(drive, DISK_OK)
+
+	case 0x01: /* last status */
+		addr := uint32(BDA_FLOPPY_STATUS)
+		if drive&0x80 != 0 {
+			addr = BDA_HDD_STATUS
+		}
+		status := uint8(x86emu_phys_read(addr, 1))
+		x86emu_disk_status(drive, DISK_OK)
+		r.gen.A.Seth8(status)
+		if status != DISK_OK {
+			SET_FLAG(F_CF)
+		}
+
+	case 0x02, 0x03, 0x04: /* read, write, verify */
+		count := uint32(r.gen.A.Get8l())
+		cyl := uint32(r.gen.C.Get8h()) | uint32(r.gen.C.Get8l()&0xc0)<<2
+		sect := uint32(r.gen.C.Get8l() & 0x3f)
+		head := uint32(r.gen.D.Get8h())
+		if count == 0 || sect == 0 || sect > d.spt || head >= d.heads || cyl >= d.cyls {
+			r.gen.A.Setl8(0)
+			x86emu_disk_status(drive, DISK_NOT_FOUND)
+			break
+		}
+		lba := (uint64(cyl)*uint64(d.heads)+uint64(head))*uint64(d.spt) + uint64(sect-1)
+		done, status := x86emu_disk_transfer(d, ah, lba, count, r.seg.ES.Get(), r.gen.B.Get16())
+		r.gen.A.Setl8(uint8(done))
+		x86emu_disk_status(drive, status)
+
+	case 0x08: /* drive parameters */
+		r.gen.A.Setl8(0)
+		maxc := d.cyls - 1
+		r.gen.C.Seth8(uint8(maxc))
+		r.gen.C.Setl8(uint8(maxc>>2&0xc0) | uint8(d.spt))
+		r.gen.D.Seth8(uint8(d.heads - 1))
+		r.gen.D.Setl8(x86emu_disk_count(drive))
+		if drive < 0x80 {
+			r.gen.B.Setl8(d.fd_type)
+			x86emu_load_seg(SEG_ES, FSEG_BASE>>4)
+			r.spc.DI.Set16(uint16(x86emu_disk.dpt - FSEG_BASE))
+		}
+		x86emu_disk_status(drive, DISK_OK)
+
+	case 0x0c, 0x10, 0x11: /* seek, test ready, recalibrate */
+		x86emu_disk_status(drive, DISK_OK)
+
+	case 0x15: /* drive type */
+		x86emu_disk_status(drive, DISK_OK)
+		if drive < 0x80 {
+			r.gen.A.Seth8(0x02) /* floppy with change line */
+		} else {
+			r.gen.A.Seth8(0x03)
+			r.gen.C.Set16(uint16(d.sectors >> 16))
+			r.gen.D.Set16(uint16(d.sectors))
+		}
+
+	case 0x16: /* media change */
+		x86emu_disk_status(drive, DISK_OK)
+
+	case 0x41: /* extensions installation check */
+		if drive < 0x80 || r.gen.B.Get16() != 0x55aa {
+			x86emu_disk_status(drive, DISK_BAD_COMMAND)
+			break
+		}
+		x86emu_disk_status(drive, DISK_OK)
+		r.gen.A.Seth8(0x30) /* EDD 3.0 */
+		r.gen.B.Set16(0xaa55)
+		r.gen.C.Set16(0x0001) /* fixed disk access subset */
+
+	case 0x42, 0x43, 0x44: /* extended read, write, verify */
+		if drive < 0x80 {
+			x86emu_disk_status(drive, DISK_BAD_COMMAND)
+			break
+		}
+		x86emu_disk_status(drive, x86emu_disk_ext_transfer(d, ah))
+
+	case 0x47: /* extended seek */
+		if drive < 0x80 {
+			x86emu_disk_status(drive, DISK_BAD_COMMAND)
+			break
+		}
+		x86emu_disk_status(drive, x86emu_disk_ext_seek(d))
+
+	case 0x48: /* extended drive parameters */
+		if drive < 0x80 {
+			x86emu_disk_status(drive, DISK_BAD_COMMAND)
+			break
+		}
+		x86emu_disk_status(drive, x86emu_disk_ext_params(d))
+
+	default:
+		if DEBUG_SVC() {
+			fmt.Printf("int13: function %02x not supported\n", ah)
+		}
+		x86emu_disk_status(drive, DISK_BAD_COMMAND)
+	}
+}
+
+// RETURNS:
+// Sectors transferred and the status of an AH=02h/03h/04h or 42h/43h/44h
+// request between the disk and the buffer at seg:off.
+func x86emu_disk_transfer(d *X86EMU_disk, ah uint8, lba uint64, count uint32, seg uint16, off uint16) (uint32, uint8) {
+	return x86emu_disk_transfer_to(d, ah, lba, count, func(i uint32) uint32 {
+		return x86emu_disk_buffer(seg, off, i)
+	})
+}
+
+/* Like x86emu_disk_transfer, with addr giving the address of byte i. */
+func x86emu_disk_transfer_to(d *X86EMU_disk, ah uint8, lba uint64, count uint32, addr func(i uint32) uint32) (uint32, uint8) {
+	switch ah {
+	case 0x02, 0x42:
+		buf, status := d.read(lba, count)
+		for i, b := range buf {
+			x86emu_phys_write(addr(uint32(i)), 1, uint32(b))
+		}
+		return uint32(len(buf) / DISK_SECTOR_SIZE), status
+	case 0x03, 0x43:
+		buf := make([]byte, count*DISK_SECTOR_SIZE)
+		for i := range buf {
+			buf[i] = uint8(x86emu_phys_read(addr(uint32(i)), 1))
+		}
+		return d.write(lba, buf)
+	}
+	/* verify */
+	buf, status := d.read(lba, count)
+	return uint32(len(buf) / DISK_SECTOR_SIZE), status
+}
+
+// REMARKS:
+// Handles the disk address packet at DS:SI of AH=42h/43h/44h and stores
+// the number of blocks transferred back into it.
+func x86emu_disk_ext_transfer(d *X86EMU_disk, ah uint8) uint8 {
+	r := &M().x86
+	pkt := x86emu_disk_buffer(r.seg.DS.Get(), r.spc.SI.Get16(), 0)
+	size := x86emu_phys_read(pkt, 1)
+	if size < 0x10 {
+		return DISK_BAD_COMMAND
+	}
+	count := x86emu_phys_read(pkt+2, 2)
+	ptr := x86emu_phys_read(pkt+4, 4)
+	lba := uint64(x86emu_phys_read(pkt+8, 4)) | uint64(x86emu_phys_read(pkt+12, 4))<<32
+	if count == 0 {
+		return DISK_OK
+	}
+	var done uint32
+	var status uint8
+	if ptr == 0xffffffff && size >= 0x18 {
+		flat := uint64(x86emu_phys_read(pkt+0x10, 4)) | uint64(x86emu_phys_read(pkt+0x14, 4))<<32
+		if flat > 0xffffffff {
+			return DISK_BAD_COMMAND
+		}
+		done, status = x86emu_disk_transfer_to(d, ah, lba, count, func(i uint32) uint32 {
+			return uint32(flat) + i
+		})
+	} else {
+		done, status = x86emu_disk_transfer(d, ah, lba, count, uint16(ptr>>16), uint16(ptr))
+	}
+	x86emu_phys_write(pkt+2, 2, done)
+	return status
+}
+
+/* Checks the LBA in the disk address packet at DS:SI of AH=47h. */
+func x86emu_disk_ext_seek(d *X86EMU_disk) uint8 {
+	r := &M().x86
+	pkt := x86emu_disk_buffer(r.seg.DS.Get(), r.spc.SI.Get16(), 0)
+	if x86emu_phys_read(pkt, 1) < 0x10 {
+		return DISK_BAD_COMMAND
+	}
+	lba := uint64(x86emu_phys_read(pkt+8, 4)) | uint64(x86emu_phys_read(pkt+12, 4))<<32
+	if lba >= d.sectors {
+		return DISK_NOT_FOUND
+	}
+	return DISK_OK
+}
+
+/* Fills the result buffer at DS:SI of AH=48h. */
+func x86emu_disk_ext_params(d *X86EMU_disk) uint8 {
+	r := &M().x86
+	buf := x86emu_disk_buffer(r.seg.DS.Get(), r.spc.SI.Get16(), 0)
+	size := x86emu_phys_read(buf, 2)
+	if size < 0x1a {
+		return DISK_BAD_COMMAND
+	}
+	b := make([]byte, 0x1a)
+	binary.LittleEndian.PutUint16(b[0x00:], 0x1a)
+	binary.LittleEndian.PutUint16(b[0x02:], 0x0002) /* CHS information valid */
+	binary.LittleEndian.PutUint32(b[0x04:], d.cyls)
+	binary.LittleEndian.PutUint32(b[0x08:], d.heads)
+	binary.LittleEndian.PutUint32(b[0x0c:], d.spt)
+	binary.LittleEndian.PutUint64(b[0x10:], d.sectors)
+	binary.LittleEndian.PutUint16(b[0x18:], DISK_SECTOR_SIZE)
+	if size >= 0x1e {
+		/* no device parameter table extension */
+		b = append(b, 0xff, 0xff, 0xff, 0xff)
+		binary.LittleEndian.PutUint16(b[0x00:], 0x1e)
+	}
+	x86emu_phys_copy_in(buf, b)
+	return DISK_OK
+}
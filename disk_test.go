@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Attaches a zero filled image of the given number of sectors to drive,
+// with the sectors in marks holding their LBA in their first four bytes,
+// and sets the int 13h service up.  Returns the image path.
+func x86emu_test_disk(t *testing.T, drive uint8, sectors int64, mode int, marks ...uint64) string {
+	t.Helper()
+	x86emu_test_bios(t)
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(sectors * DISK_SECTOR_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	for _, lba := range marks {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(lba))
+		if _, err := f.WriteAt(b[:], int64(lba)*DISK_SECTOR_SIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	d, err := X86EMU_attachDisk(drive, path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.file.Close()
+		delete(x86emu_disks, drive)
+	})
+	if err := X86EMU_setupDiskBios(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/* Runs int 13h and returns AH, failing the test if CF does not match it. */
+func x86emu_test_int13(t *testing.T) uint8 {
+	t.Helper()
+	x86emu_test_int(t, 0x13)
+	ah := M().x86.gen.A.Get8h()
+	if cf := ACCESS_FLAG(F_CF); cf != (ah != DISK_OK) {
+		t.Errorf("AH=%02x with CF=%v", ah, cf)
+	}
+	return ah
+}
+
+const (
+	TEST_FLOPPY_SECTORS = 2880          /* 1.44M */
+	TEST_HDD_SECTORS    = 320 * 16 * 63 /* no MBR: 16 heads, 63 sectors */
+)
+
+func TestInt13Chs(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		drive   uint8
+		sectors int64
+		c, h, s uint32
+		lba     uint64
+		status  uint8
+	}{
+		{"floppy first sector", 0x00, TEST_FLOPPY_SECTORS, 0, 0, 1, 0, DISK_OK},
+		{"floppy head 1", 0x00, TEST_FLOPPY_SECTORS, 0, 1, 1, 18, DISK_OK},
+		{"floppy last sector", 0x00, TEST_FLOPPY_SECTORS, 79, 1, 18, 2879, DISK_OK},
+		{"floppy sector 0", 0x00, TEST_FLOPPY_SECTORS, 0, 0, 0, 0, DISK_NOT_FOUND},
+		{"floppy sector past track", 0x00, TEST_FLOPPY_SECTORS, 0, 0, 19, 0, DISK_NOT_FOUND},
+		{"hdd cylinder above 255", 0x80, TEST_HDD_SECTORS, 300, 5, 7, (300*16+5)*63 + 6, DISK_OK},
+		{"hdd head past geometry", 0x80, TEST_HDD_SECTORS, 0, 16, 1, 0, DISK_NOT_FOUND},
+		{"hdd cylinder past geometry", 0x80, TEST_HDD_SECTORS, 320, 0, 1, 0, DISK_NOT_FOUND},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_disk(t, tc.drive, tc.sectors, DISK_RO, tc.lba)
+			x86emu_phys_write(0x2000, 4, 0xffffffff)
+			r := &M().x86
+			r.gen.A.Set16(0x0201)
+			r.gen.C.Seth8(uint8(tc.c))
+			r.gen.C.Setl8(uint8(tc.c>>2&0xc0) | uint8(tc.s))
+			r.gen.D.Seth8(uint8(tc.h))
+			r.gen.D.Setl8(tc.drive)
+			x86emu_load_seg(SEG_ES, 0x0200)
+			r.gen.B.Set16(0)
+			if ah := x86emu_test_int13(t); ah != tc.status {
+				t.Fatalf("AH=%02x, want %02x", ah, tc.status)
+			}
+			if tc.status != DISK_OK {
+				return
+			}
+			if n := r.gen.A.Get8l(); n != 1 {
+				t.Errorf("AL=%d, want 1", n)
+			}
+			if v := x86emu_phys_read(0x2000, 4); uint64(v) != tc.lba {
+				t.Errorf("read the sector marked %d, want %d", v, tc.lba)
+			}
+		})
+	}
+}
+
+func TestInt13Geometry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		drive   uint8
+		sectors int64
+		cx, dx  uint16
+		bl      uint8 /* CMOS floppy type */
+	}{
+		{"1.44M floppy", 0x00, TEST_FLOPPY_SECTORS, 79<<8 | 18, 1<<8 | 1, 4},
+		/* cylinder 319: CH holds the low 8 bits, CL bits 7-6 the top 2 */
+		{"hdd", 0x80, TEST_HDD_SECTORS, 0x3f<<8 | 0x40 | 63, 15<<8 | 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_disk(t, tc.drive, tc.sectors, DISK_RO)
+			r := &M().x86
+			r.gen.A.Seth8(0x08)
+			r.gen.B.Set16(0)
+			r.gen.D.Setl8(tc.drive)
+			if ah := x86emu_test_int13(t); ah != DISK_OK {
+				t.Fatalf("AH=%02x", ah)
+			}
+			if cx, dx := r.gen.C.Get16(), r.gen.D.Get16(); cx != tc.cx || dx != tc.dx {
+				t.Errorf("CX=%04x DX=%04x, want %04x %04x", cx, dx, tc.cx, tc.dx)
+			}
+			if bl := r.gen.B.Get8l(); bl != tc.bl {
+				t.Errorf("BL=%02x, want %02x", bl, tc.bl)
+			}
+			if tc.drive < 0x80 {
+				if a := uint32(r.seg.ES.Get())<<4 + uint32(r.spc.DI.Get16()); a != x86emu_disk.dpt {
+					t.Errorf("ES:DI at %05x, want the parameter table at %05x", a, x86emu_disk.dpt)
+				}
+			}
+		})
+	}
+}
+
+func TestInt13ExtendedRead(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		dap    []byte
+		status uint8
+		done   uint16 /* blocks reported back in the packet */
+		buf    uint32 /* where the two sectors land */
+	}{
+		{"segment:offset buffer", []byte{
+			0x10, 0, 2, 0, 0x00, 0x00, 0x00, 0x02, /* 2 blocks to 0200:0000 */
+			5, 0, 0, 0, 0, 0, 0, 0, /* LBA 5 */
+		}, DISK_OK, 2, 0x2000},
+		{"flat buffer", []byte{
+			0x18, 0, 2, 0, 0xff, 0xff, 0xff, 0xff,
+			5, 0, 0, 0, 0, 0, 0, 0,
+			0x00, 0x30, 0, 0, 0, 0, 0, 0, /* 64-bit address 3000h */
+		}, DISK_OK, 2, 0x3000},
+		{"short packet", []byte{
+			0x0c, 0, 2, 0, 0x00, 0x00, 0x00, 0x02,
+			5, 0, 0, 0,
+		}, DISK_BAD_COMMAND, 2, 0},
+		{"past the end", []byte{
+			0x10, 0, 2, 0, 0x00, 0x00, 0x00, 0x02,
+			0xff, 0xeb, 0x04, 0, 0, 0, 0, 0, /* the last LBA */
+		}, DISK_NOT_FOUND, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_disk(t, 0x80, TEST_HDD_SECTORS, DISK_RO, 5, 6)
+			x86emu_phys_copy_in(0x1800, tc.dap)
+			r := &M().x86
+			r.gen.A.Seth8(0x42)
+			r.gen.D.Setl8(0x80)
+			x86emu_load_seg(SEG_DS, 0x0180)
+			r.spc.SI.Set16(0)
+			if ah := x86emu_test_int13(t); ah != tc.status {
+				t.Fatalf("AH=%02x, want %02x", ah, tc.status)
+			}
+			if n := uint16(x86emu_phys_read(0x1802, 2)); n != tc.done {
+				t.Errorf("packet says %d blocks, want %d", n, tc.done)
+			}
+			if tc.buf == 0 {
+				return
+			}
+			for i, want := range []uint32{5, 6} {
+				if v := x86emu_phys_read(tc.buf+uint32(i)*DISK_SECTOR_SIZE, 4); v != want {
+					t.Errorf("block %d holds the sector marked %d, want %d", i, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInt13WriteModes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		mode   int
+		status uint8
+		file   bool /* the image file changes */
+		reads  bool /* int 13h reads the new data back */
+	}{
+		{"read-write", DISK_RW, DISK_OK, true, true},
+		{"copy-on-write", DISK_COW, DISK_OK, false, true},
+		{"read-only", DISK_RO, DISK_WRITE_PROTECT, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := x86emu_test_disk(t, 0x00, TEST_FLOPPY_SECTORS, tc.mode)
+			data := bytes.Repeat([]byte{0xa5}, DISK_SECTOR_SIZE)
+			x86emu_phys_copy_in(0x2000, data)
+			r := &M().x86
+			/* write, then read back, C/H/S 0/0/2: LBA 1 */
+			r.gen.A.Set16(0x0301)
+			r.gen.C.Set16(0x0002)
+			r.gen.D.Set16(0x0000)
+			x86emu_load_seg(SEG_ES, 0x0200)
+			r.gen.B.Set16(0)
+			if ah := x86emu_test_int13(t); ah != tc.status {
+				t.Fatalf("write: AH=%02x, want %02x", ah, tc.status)
+			}
+			r.gen.A.Set16(0x0201)
+			r.gen.B.Set16(0x1000)
+			if ah := x86emu_test_int13(t); ah != DISK_OK {
+				t.Fatalf("read: AH=%02x", ah)
+			}
+			if v := x86emu_phys_read(0x3000, 1) == 0xa5; v != tc.reads {
+				t.Errorf("read back the new data: %v, want %v", v, tc.reads)
+			}
+			img, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := img[DISK_SECTOR_SIZE] == 0xa5; v != tc.file {
+				t.Errorf("image file changed: %v, want %v", v, tc.file)
+			}
+		})
+	}
+}
+
+func TestInt13FixedDiskSubset(t *testing.T) {
+	/* everything AH=41h promises with CX bit 0 */
+	for _, tc := range []struct {
+		name   string
+		drive  uint8
+		ah     uint8
+		lba    uint32
+		status uint8
+		done   uint16 /* blocks reported back in the packet */
+	}{
+		{"verify", 0x80, 0x44, 5, DISK_OK, 2},
+		{"verify past the end", 0x80, 0x44, TEST_HDD_SECTORS - 1, DISK_NOT_FOUND, 1},
+		{"seek", 0x80, 0x47, 5, DISK_OK, 2},
+		{"seek past the end", 0x80, 0x47, TEST_HDD_SECTORS, DISK_NOT_FOUND, 2},
+		{"seek on a floppy", 0x00, 0x47, 5, DISK_BAD_COMMAND, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sectors := int64(TEST_HDD_SECTORS)
+			if tc.drive < 0x80 {
+				sectors = TEST_FLOPPY_SECTORS
+			}
+			x86emu_test_disk(t, tc.drive, sectors, DISK_RO)
+			r := &M().x86
+			if tc.drive >= 0x80 {
+				r.gen.A.Seth8(0x41)
+				r.gen.B.Set16(0x55aa)
+				r.gen.D.Setl8(tc.drive)
+				x86emu_test_int(t, 0x13)
+				if ACCESS_FLAG(F_CF) || r.gen.C.Get16()&1 == 0 {
+					t.Fatalf("AH=41h: CF=%v CX=%04x", ACCESS_FLAG(F_CF), r.gen.C.Get16())
+				}
+			}
+
+			dap := []byte{0x10, 0, 2, 0, 0x00, 0x00, 0x00, 0x02, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.LittleEndian.PutUint32(dap[8:], tc.lba)
+			x86emu_phys_copy_in(0x1800, dap)
+			r.gen.A.Seth8(tc.ah)
+			r.gen.D.Setl8(tc.drive)
+			x86emu_load_seg(SEG_DS, 0x0180)
+			r.spc.SI.Set16(0)
+			if ah := x86emu_test_int13(t); ah != tc.status {
+				t.Fatalf("AH=%02x, want %02x", ah, tc.status)
+			}
+			if n := uint16(x86emu_phys_read(0x1802, 2)); n != tc.done {
+				t.Errorf("packet says %d blocks, want %d", n, tc.done)
+			}
+		})
+	}
+}
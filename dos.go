@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * A small DOS for running .COM and .EXE utilities.
+ *
+ * The program gets a PSP and environment in a chain of memory control
+ * blocks covering conventional memory, the way DOS lays them out, and is
+ * loaded as DOS would load it: a .COM image at PSP:0100h, an MZ image at
+ * the paragraph after the PSP with its relocations applied.  Int 21h is a
+ * Go handler implementing a subset of DOS 5: console I/O on the host's
+ * standard streams, files confined to one host directory (dosfs.go),
+ * memory allocation, date and time from the RTC, and program exit.  There
+ * is no second process; EXEC fails.
+ */
+
+const (
+	DOS_ARENA   = 0x0100 /* segment of the first memory control block */
+	DOS_ENV_LEN = 0x0010 /* paragraphs */
+	DOS_COM_MAX = 0xff00 - 0x100
+
+	MCB_MEMBER = 'M'
+	MCB_LAST   = 'Z'
+
+	MZ_SIGNATURE = 0x5a4d
+
+	DOS_RUN_FAILED = 125 /* sim86 exit status when the program did not exit */
+
+	/* DOS error codes */
+	DOSERR_FUNCTION = 0x01
+	DOSERR_NOFILE   = 0x02
+	DOSERR_NOPATH   = 0x03
+	DOSERR_HANDLES  = 0x04
+	DOSERR_ACCESS   = 0x05
+	DOSERR_HANDLE   = 0x06
+	DOSERR_ARENA    = 0x07
+	DOSERR_MEMORY   = 0x08
+	DOSERR_BLOCK    = 0x09
+	DOSERR_DRIVE    = 0x0f
+	DOSERR_NOMORE   = 0x12
+	DOSERR_EXISTS   = 0x50
+)
+
+var x86emu_dos struct {
+	root    *os.Root
+	cwd     string /* DOS form, "" for the root, else "DIR\SUB" */
+	psp     uint16
+	dta     uint32 /* segment:offset */
+	files   map[uint16]*x86emu_dos_file
+	finds   map[uint32]*x86emu_dos_find /* by linear address of the DTA */
+	stdin   *bufio.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	echo    bool /* stdin is not a terminal, so echo what is read */
+	exited  bool
+	code    uint8
+	lasterr uint16
+}
+
+// PARAMETERS:
+// seg - Segment of a memory control block
+//
+// RETURNS:
+// Its signature byte, owner PSP (0 for free) and size in paragraphs.
+func x86emu_mcb(seg uint16) (uint8, uint16, uint16) {
+	addr := uint32(seg) << 4
+	return uint8(x86emu_phys_read(addr, 1)), uint16(x86emu_phys_read(addr+1, 2)), uint16(x86emu_phys_read(addr+3, 2))
+}
+
+func x86emu_mcb_set(seg uint16, sig uint8, owner uint16, size uint16) {
+	addr := uint32(seg) << 4
+	x86emu_phys_write(addr, 1, uint32(sig))
+	x86emu_phys_write(addr+1, 2, uint32(owner))
+	x86emu_phys_write(addr+3, 2, uint32(size))
+}
+
+/* Gives the block a name, as DOS 4+ does for programs. */
+func x86emu_mcb_name(seg uint16, name string) {
+	b := make([]byte, 8)
+	copy(b, strings.ToUpper(name))
+	x86emu_phys_copy_in(uint32(seg)<<4+8, b)
+}
+
+/* Sets up one free block over conventional memory. */
+func x86emu_mcb_init() {
+	top := uint16(x86emu_base_memory() >> 4)
+	x86emu_mcb_set(DOS_ARENA, MCB_LAST, 0, top-DOS_ARENA-1)
+}
+
+// REMARKS:
+// Walks the chain from the first block, joining free neighbours on the way.
+// fn sees each block and stops the walk by returning true.
+func x86emu_mcb_walk(fn func(seg uint16, sig uint8, owner uint16, size uint16) bool) uint16 {
+	seg := uint16(DOS_ARENA)
+	for {
+		sig, owner, size := x86emu_mcb(seg)
+		if sig != MCB_MEMBER && sig != MCB_LAST {
+			return DOSERR_ARENA
+		}
+		for owner == 0 && sig == MCB_MEMBER {
+			nsig, nowner, nsize := x86emu_mcb(seg + size + 1)
+			if nowner != 0 || (nsig != MCB_MEMBER && nsig != MCB_LAST) {
+				break
+			}
+			sig, size = nsig, size+nsize+1
+			x86emu_mcb_set(seg, sig, 0, size)
+		}
+		if fn(seg, sig, owner, size) || sig == MCB_LAST {
+			return 0
+		}
+		seg += size + 1
+	}
+}
+
+/* Splits the block at seg after paras paragraphs, the rest free. */
+func x86emu_mcb_split(seg uint16, paras uint16) {
+	sig, owner, size := x86emu_mcb(seg)
+	if size <= paras {
+		return
+	}
+	x86emu_mcb_set(seg+paras+1, sig, 0, size-paras-1)
+	x86emu_mcb_set(seg, MCB_MEMBER, owner, paras)
+}
+
+// RETURNS:
+// Segment of a new block of paras paragraphs owned by owner, or 0 and the
+// size of the largest free block.
+func x86emu_dos_alloc(paras uint16, owner uint16) (uint16, uint16) {
+	var found, largest uint16
+	x86emu_mcb_walk(func(seg uint16, _ uint8, o uint16, size uint16) bool {
+		if o != 0 {
+			return false
+		}
+		if size >= paras {
+			found = seg
+			return true
+		}
+		if size > largest {
+			largest = size
+		}
+		return false
+	})
+	if found == 0 {
+		return 0, largest
+	}
+	x86emu_mcb_split(found, paras)
+	sig, _, size := x86emu_mcb(found)
+	x86emu_mcb_set(found, sig, owner, size)
+	return found + 1, 0
+}
+
+func x86emu_dos_free(block uint16) uint16 {
+	sig, owner, size := x86emu_mcb(block - 1)
+	if (sig != MCB_MEMBER && sig != MCB_LAST) || owner == 0 {
+		return DOSERR_BLOCK
+	}
+	x86emu_mcb_set(block-1, sig, 0, size)
+	return 0
+}
+
+// RETURNS:
+// 0, or an error and the most the block could grow to.
+func x86emu_dos_resize(block uint16, paras uint16) (uint16, uint16) {
+	seg := block - 1
+	sig, owner, size := x86emu_mcb(seg)
+	if (sig != MCB_MEMBER && sig != MCB_LAST) || owner == 0 {
+		return DOSERR_BLOCK, 0
+	}
+	/* take in the free blocks that follow */
+	for sig == MCB_MEMBER {
+		nsig, nowner, nsize := x86emu_mcb(seg + size + 1)
+		if nowner != 0 || (nsig != MCB_MEMBER && nsig != MCB_LAST) {
+			break
+		}
+		sig, size = nsig, size+nsize+1
+	}
+	x86emu_mcb_set(seg, sig, owner, size)
+	if paras > size {
+		return DOSERR_MEMORY, size
+	}
+	x86emu_mcb_split(seg, paras)
+	return 0, 0
+}
+
+/* Frees every block the PSP owns. */
+func x86emu_dos_free_all(psp uint16) {
+	x86emu_mcb_walk(func(seg uint16, sig uint8, owner uint16, size uint16) bool {
+		if owner == psp {
+			x86emu_mcb_set(seg, sig, 0, size)
+		}
+		return false
+	})
+}
+
+// PARAMETERS:
+// path - Host file of the program
+// args - Command line arguments
+// root - Host directory the program sees as C:\
+//
+// RETURNS:
+// The program's exit code.
+//
+// REMARKS:
+// Sets up DOS, loads the program and runs it until it exits.  An error is
+// returned when it could not be loaded or stopped without exiting.
+func X86EMU_runDos(path string, args []string, root string) (uint8, error) {
+	image, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := x86emu_dos_setup(root); err != nil {
+		return 0, err
+	}
+	defer x86emu_dos_close_all()
+	tail := ""
+	if len(args) > 0 {
+		tail = " " + strings.Join(args, " ")
+	}
+	if len(tail) > 126 {
+		return 0, fmt.Errorf("%s: command line too long", path)
+	}
+	name := strings.ToUpper(filepath.Base(path))
+	if err := x86emu_dos_load(image, name, tail); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+
+	r := &M().x86
+	r.intr &^= int(INTR_HALTED)
+	X86EMU_exec()
+	if !x86emu_dos.exited {
+		return 0, fmt.Errorf("%s: stopped at %04x:%04x without exiting", path, r.seg.CS.Get(), r.spc.IP.Get16())
+	}
+	return x86emu_dos.code, nil
+}
+
+func x86emu_dos_setup(root string) error {
+	rt, err := os.OpenRoot(root)
+	if err != nil {
+		return err
+	}
+	d := &x86emu_dos
+	d.root, d.cwd = rt, ""
+	d.files = map[uint16]*x86emu_dos_file{}
+	d.finds = map[uint32]*x86emu_dos_find{}
+	d.stdin = bufio.NewReader(os.Stdin)
+	d.stdout, d.stderr = os.Stdout, os.Stderr
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		d.echo = true
+	}
+	d.exited, d.code = false, 0
+	for h, dev := range []string{"CON", "CON", "CON", "AUX", "PRN"} {
+		d.files[uint16(h)] = &x86emu_dos_file{dev: dev, mode: 2}
+	}
+	d.files[2].stderr = true
+
+	x86emu_mcb_init()
+	for _, v := range []struct {
+		vec  uint8
+		name string
+		fn   X86EMU_trapFunc
+	}{
+		{0x20, "int20", func() { x86emu_dos_exit(0) }},
+		{0x21, "int21", x86emu_int21},
+		{0x23, "int23", func() {}},
+		{0x24, "int24", func() { M().x86.gen.A.Setl8(3) }}, /* fail */
+	} {
+		if _, err := X86EMU_setupBiosVector(v.vec, v.name, v.fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PARAMETERS:
+// image - Program file
+// name  - Program name, for the environment and the memory block
+// tail  - Command tail, starting with a space when not empty
+//
+// REMARKS:
+// Builds the environment and PSP and loads the program, leaving the
+// registers ready to start it.
+func x86emu_dos_load(image []byte, name string, tail string) error {
+	d := &x86emu_dos
+	exe := len(image) >= 0x1c && binary.LittleEndian.Uint16(image) == MZ_SIGNATURE
+
+	/* the environment, then everything else for the program */
+	env, _ := x86emu_dos_alloc(DOS_ENV_LEN, 0xffff)
+	if env == 0 {
+		return fmt.Errorf("no memory for the environment")
+	}
+	var eb []byte
+	for _, s := range []string{"PATH=C:\\", "COMSPEC=C:\\COMMAND.COM"} {
+		eb = append(eb, s...)
+		eb = append(eb, 0)
+	}
+	eb = append(eb, 0, 1, 0)
+	eb = append(eb, "C:\\"+name...)
+	eb = append(eb, 0)
+	x86emu_phys_copy_in(uint32(env)<<4, eb)
+
+	_, largest := x86emu_dos_alloc(0xffff, 0)
+	need := uint32(0x10)
+	var hdr []uint16
+	var load []byte
+	if exe {
+		hdr = make([]uint16, 14)
+		for i := range hdr {
+			hdr[i] = binary.LittleEndian.Uint16(image[2*i:])
+		}
+		size := uint32(hdr[2]) * 512
+		if hdr[1] != 0 {
+			size -= 512 - uint32(hdr[1])
+		}
+		start := uint32(hdr[4]) * 16
+		if size > uint32(len(image)) {
+			size = uint32(len(image))
+		}
+		if start > size {
+			return fmt.Errorf("bad MZ header")
+		}
+		load = image[start:size]
+		need += (uint32(len(load))+15)/16 + uint32(hdr[5])
+	} else {
+		if len(image) > DOS_COM_MAX {
+			return fmt.Errorf(".COM file too big")
+		}
+		load = image
+		need += 0x1000 - 0x10 /* a whole 64K segment if it can have one */
+		if need > uint32(largest) {
+			need = 0x10 + (uint32(len(image))+0x100+15)/16
+		}
+	}
+	if need > uint32(largest) {
+		return fmt.Errorf("not enough memory: %d paragraphs needed, %d free", need, largest)
+	}
+	paras := uint32(largest)
+	if exe && hdr[6] != 0xffff {
+		if max := 0x10 + (uint32(len(load))+15)/16 + uint32(hdr[6]); max < paras {
+			paras = max
+		}
+		if paras < need {
+			paras = need
+		}
+	}
+	psp, _ := x86emu_dos_alloc(uint16(paras), 0xffff)
+	x86emu_mcb_owner(psp-1, psp)
+	x86emu_mcb_owner(env-1, psp)
+	x86emu_mcb_name(psp-1, strings.TrimSuffix(strings.TrimSuffix(name, ".COM"), ".EXE"))
+	d.psp = psp
+	d.dta = uint32(psp)<<16 | 0x80
+	x86emu_dos_build_psp(psp, psp+uint16(paras), env, tail)
+
+	r := &M().x86
+	base := uint32(psp) << 4
+	r.spc.FLAGS = F_ALWAYS_ON | F_IF
+	r.gen.A.Set32(0)
+	r.gen.B.Set32(0)
+	r.gen.C.Set32(0)
+	r.gen.D.Set32(0)
+	x86emu_load_seg(SEG_DS, psp)
+	x86emu_load_seg(SEG_ES, psp)
+	if !exe {
+		x86emu_phys_copy_in(base+0x100, load)
+		sp := uint32(0xfffe)
+		if paras < 0x1000 {
+			sp = paras*16 - 2
+		}
+		x86emu_load_seg(SEG_SS, psp)
+		r.spc.SP.Set32(sp)
+		x86emu_phys_write(base+sp, 2, 0) /* RET goes to the INT 20h at PSP:0000 */
+		x86emu_load_cs(psp, 0x100)
+		return nil
+	}
+
+	lseg := psp + 0x10
+	x86emu_phys_copy_in(uint32(lseg)<<4, load)
+	for i := 0; i < int(hdr[3]); i++ {
+		off := int(hdr[12]) + 4*i
+		if off+4 > len(image) {
+			return fmt.Errorf("relocation table past the end of the file")
+		}
+		ro := binary.LittleEndian.Uint16(image[off:])
+		rs := binary.LittleEndian.Uint16(image[off+2:])
+		addr := uint32(lseg+rs)<<4 + uint32(ro)
+		x86emu_phys_write(addr, 2, x86emu_phys_read(addr, 2)+uint32(lseg))
+	}
+	x86emu_load_seg(SEG_SS, lseg+hdr[7])
+	r.spc.SP.Set32(uint32(hdr[8]))
+	x86emu_load_cs(lseg+hdr[11], uint32(hdr[10]))
+	return nil
+}
+
+func x86emu_mcb_owner(seg uint16, owner uint16) {
+	sig, _, size := x86emu_mcb(seg)
+	x86emu_mcb_set(seg, sig, owner, size)
+}
+
+/* Fills in the program segment prefix. */
+func x86emu_dos_build_psp(psp uint16, top uint16, env uint16, tail string) {
+	b := make([]byte, 0x100)
+	b[0x00], b[0x01] = 0xcd, 0x20 /* INT 20h */
+	binary.LittleEndian.PutUint16(b[0x02:], top)
+	for i, v := range []uint8{0x22, 0x23, 0x24} {
+		binary.LittleEndian.PutUint32(b[0x0a+4*i:], x86emu_phys_read(uint32(v)*4, 4))
+	}
+	binary.LittleEndian.PutUint16(b[0x16:], psp) /* its own parent, like COMMAND.COM */
+	copy(b[0x18:0x2c], []byte{1, 1, 1, 0, 2, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint16(b[0x2c:], env)
+	binary.LittleEndian.PutUint16(b[0x32:], 20)
+	binary.LittleEndian.PutUint32(b[0x34:], uint32(psp)<<16|0x18)
+	b[0x50], b[0x51], b[0x52] = 0xcd, 0x21, 0xcb /* INT 21h; RETF */
+	for _, fcb := range []int{0x5c, 0x6c} {
+		copy(b[fcb+1:fcb+12], "           ")
+	}
+	b[0x80] = uint8(len(tail))
+	copy(b[0x81:], tail)
+	b[0x81+len(tail)] = '\r'
+	x86emu_phys_copy_in(uint32(psp)<<4, b)
+}
+
+/* Ends the program with a return code. */
+func x86emu_dos_exit(code uint8) {
+	d := &x86emu_dos
+	if DEBUG_SVC() {
+		fmt.Printf("dos: exit %d\n", code)
+	}
+	d.exited, d.code = true, code
+	x86emu_dos_free_all(d.psp)
+	HALT_SYS()
+}
+
+/* DS:DX, the usual buffer argument, as a linear address. */
+func x86emu_dos_dsdx() uint32 {
+	r := &M().x86
+	return uint32(r.seg.DS.Get())<<4 + uint32(r.gen.D.Get16())
+}
+
+/* ASCIIZ string at a linear address. */
+func x86emu_dos_string(addr uint32) string {
+	var b []byte
+	for len(b) < 128 {
+		c := uint8(x86emu_phys_read(addr, 1))
+		if c == 0 {
+			break
+		}
+		b = append(b, c)
+		addr++
+	}
+	return string(b)
+}
+
+/* Result of a call that reports errors in AX with CF. */
+func x86emu_dos_result(err uint16) {
+	if err == 0 {
+		CLEAR_FLAG(F_CF)
+		return
+	}
+	x86emu_dos.lasterr = err
+	M().x86.gen.A.Set16(err)
+	SET_FLAG(F_CF)
+}
+
+// RETURNS:
+// A character from standard input, CR for a line end and ^Z at the end.
+func x86emu_dos_getc(echo bool) uint8 {
+	d := &x86emu_dos
+	c, err := d.stdin.ReadByte()
+	if err != nil {
+		return 0x1a
+	}
+	if c == '\n' {
+		c = '\r'
+	}
+	if echo && d.echo {
+		x86emu_dos_putc(c)
+		if c == '\r' {
+			x86emu_dos_putc('\n')
+		}
+	}
+	return c
+}
+
+func x86emu_dos_putc(c uint8) {
+	x86emu_dos.stdout.Write([]byte{c})
+}
+
+func x86emu_int21() {
+	r := &M().x86
+	d := &x86emu_dos
+	ah := r.gen.A.Get8h()
+	if DEBUG_SVC() {
+		fmt.Printf("int21: ax=%04x bx=%04x cx=%04x dx=%04x\n",
+			r.gen.A.Get16(), r.gen.B.Get16(), r.gen.C.Get16(), r.gen.D.Get16())
+	}
+
+	switch ah {
+	case 0x00: /* terminate */
+		x86emu_dos_exit(0)
+	case 0x4c: /* exit with return code */
+		x86emu_dos_exit(r.gen.A.Get8l())
+	case 0x31: /* stay resident: nothing stays behind without a shell */
+		x86emu_dos_exit(r.gen.A.Get8l())
+
+	case 0x01: /* read with echo */
+		r.gen.A.Setl8(x86emu_dos_getc(true))
+	case 0x02: /* write character */
+		x86emu_dos_putc(r.gen.D.Get8l())
+		r.gen.A.Setl8(r.gen.D.Get8l())
+	case 0x06: /* direct console I/O */
+		if r.gen.D.Get8l() != 0xff {
+			x86emu_dos_putc(r.gen.D.Get8l())
+			r.gen.A.Setl8(r.gen.D.Get8l())
+			break
+		}
+		if _, err := d.stdin.Peek(1); err != nil {
+			SET_FLAG(F_ZF)
+			r.gen.A.Setl8(0)
+			break
+		}
+		CLEAR_FLAG(F_ZF)
+		r.gen.A.Setl8(x86emu_dos_getc(false))
+	case 0x07, 0x08: /* read without echo */
+		r.gen.A.Setl8(x86emu_dos_getc(false))
+	case 0x09: /* write $ terminated string */
+		addr := x86emu_dos_dsdx()
+		for n := 0; n < 0x10000; n++ {
+			c := uint8(x86emu_phys_read(addr+uint32(n), 1))
+			if c == '$' {
+				break
+			}
+			x86emu_dos_putc(c)
+		}
+		r.gen.A.Setl8('$')
+	case 0x0a: /* buffered input */
+		addr := x86emu_dos_dsdx()
+		max := x86emu_phys_read(addr, 1)
+		n := uint32(0)
+		for max > 0 {
+			c := x86emu_dos_getc(true)
+			if c == '\r' || c == 0x1a {
+				break
+			}
+			if n+1 < max {
+				x86emu_phys_write(addr+2+n, 1, uint32(c))
+				n++
+			}
+		}
+		if max > 0 {
+			x86emu_phys_write(addr+2+n, 1, '\r')
+			x86emu_phys_write(addr+1, 1, n)
+		}
+	case 0x0b: /* input status */
+		if _, err := d.stdin.Peek(1); err != nil {
+			r.gen.A.Setl8(0)
+		} else {
+			r.gen.A.Setl8(0xff)
+		}
+	case 0x0c: /* flush input, then a read function */
+		fn := r.gen.A.Get8l()
+		if fn == 0x01 || fn == 0x06 || fn == 0x07 || fn == 0x08 || fn == 0x0a {
+			r.gen.A.Seth8(fn)
+			x86emu_int21()
+		}
+
+	case 0x0d: /* disk reset */
+	case 0x0e: /* select drive */
+		r.gen.A.Setl8(3)
+	case 0x19: /* current drive */
+		r.gen.A.Setl8(2) /* C: */
+	case 0x1a: /* set DTA */
+		d.dta = uint32(r.seg.DS.Get())<<16 | uint32(r.gen.D.Get16())
+	case 0x2f: /* get DTA */
+		x86emu_load_seg(SEG_ES, uint16(d.dta>>16))
+		r.gen.B.Set16(uint16(d.dta))
+
+	case 0x25: /* set vector */
+		x86emu_phys_write(uint32(r.gen.A.Get8l())*4, 4, uint32(r.seg.DS.Get())<<16|uint32(r.gen.D.Get16()))
+	case 0x35: /* get vector */
+		v := x86emu_phys_read(uint32(r.gen.A.Get8l())*4, 4)
+		x86emu_load_seg(SEG_ES, uint16(v>>16))
+		r.gen.B.Set16(uint16(v))
+
+	case 0x2a: /* get date */
+		t := x86emu_rtc_now()
+		r.gen.C.Set16(uint16(t.Year()))
+		r.gen.D.Seth8(uint8(t.Month()))
+		r.gen.D.Setl8(uint8(t.Day()))
+		r.gen.A.Setl8(uint8(t.Weekday()))
+	case 0x2b: /* set date */
+		t := x86emu_rtc_now()
+		X86EMU_setRtcTime(time.Date(int(r.gen.C.Get16()), time.Month(r.gen.D.Get8h()), int(r.gen.D.Get8l()),
+			t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location()))
+		r.gen.A.Setl8(0)
+	case 0x2c: /* get time */
+		t := x86emu_rtc_now()
+		r.gen.C.Seth8(uint8(t.Hour()))
+		r.gen.C.Setl8(uint8(t.Minute()))
+		r.gen.D.Seth8(uint8(t.Second()))
+		r.gen.D.Setl8(uint8(t.Nanosecond() / 10000000))
+	case 0x2d: /* set time */
+		t := x86emu_rtc_now()
+		X86EMU_setRtcTime(time.Date(t.Year(), t.Month(), t.Day(), int(r.gen.C.Get8h()), int(r.gen.C.Get8l()),
+			int(r.gen.D.Get8h()), int(r.gen.D.Get8l())*10000000, t.Location()))
+		r.gen.A.Setl8(0)
+
+	case 0x30: /* version */
+		r.gen.A.Set16(0x0005) /* 5.0 */
+		r.gen.B.Set16(0)
+		r.gen.C.Set16(0)
+	case 0x33: /* ctrl-break checking */
+		if r.gen.A.Get8l() == 0x00 {
+			r.gen.D.Setl8(0)
+		}
+	case 0x51, 0x62: /* get PSP */
+		r.gen.B.Set16(d.psp)
+	case 0x4d: /* return code of the last child */
+		r.gen.A.Set16(0)
+	case 0x59: /* extended error */
+		r.gen.A.Set16(d.lasterr)
+		r.gen.B.Set16(0x0101)
+		r.gen.C.Seth8(0x01)
+
+	case 0x48: /* allocate */
+		seg, largest := x86emu_dos_alloc(r.gen.B.Get16(), d.psp)
+		if seg == 0 {
+			x86emu_dos_result(DOSERR_MEMORY)
+			r.gen.B.Set16(largest)
+			break
+		}
+		r.gen.A.Set16(seg)
+		x86emu_dos_result(0)
+	case 0x49: /* free */
+		x86emu_dos_result(x86emu_dos_free(r.seg.ES.Get()))
+	case 0x4a: /* resize */
+		err, max := x86emu_dos_resize(r.seg.ES.Get(), r.gen.B.Get16())
+		x86emu_dos_result(err)
+		if err == DOSERR_MEMORY {
+			r.gen.B.Set16(max)
+		}
+	case 0x58: /* allocation strategy: first fit is all there is */
+		if r.gen.A.Get8l() == 0x00 {
+			r.gen.A.Set16(0)
+		}
+		x86emu_dos_result(0)
+
+	case 0x4b: /* exec */
+		x86emu_dos_result(DOSERR_FUNCTION)
+
+	default:
+		if x86emu_dos_file_service(ah) {
+			break
+		}
+		if DEBUG_SVC() {
+			fmt.Printf("int21: function %02x not supported\n", ah)
+		}
+		r.gen.A.Setl8(0)
+		x86emu_dos_result(DOSERR_FUNCTION)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* Creates OUT.TXT, then exits with 7 if opening ..\..\etc\passwd fails. */
+var x86emu_test_com = []byte{
+	0xb4, 0x3c, /* mov ah,3ch */
+	0x31, 0xc9, /* xor cx,cx */
+	0xba, 0x31, 0x01, /* mov dx,name */
+	0xcd, 0x21, /* int 21h */
+	0x72, 0x21, /* jc fail */
+	0x89, 0xc3, /* mov bx,ax */
+	0xb4, 0x40, /* mov ah,40h */
+	0xb9, 0x05, 0x00, /* mov cx,5 */
+	0xba, 0x39, 0x01, /* mov dx,data */
+	0xcd, 0x21, /* int 21h */
+	0x72, 0x13, /* jc fail */
+	0xb4, 0x3e, /* mov ah,3eh */
+	0xcd, 0x21, /* int 21h */
+	0xb8, 0x00, 0x3d, /* mov ax,3d00h */
+	0xba, 0x3e, 0x01, /* mov dx,bad */
+	0xcd, 0x21, /* int 21h */
+	0x73, 0x05, /* jnc fail */
+	0xb8, 0x07, 0x4c, /* mov ax,4c07h */
+	0xcd, 0x21, /* int 21h */
+	0xb8, 0x01, 0x4c, /* fail: mov ax,4c01h */
+	0xcd, 0x21, /* int 21h */
+	'O', 'U', 'T', '.', 'T', 'X', 'T', 0, /* name */
+	'h', 'e', 'l', 'l', 'o', /* data */
+	'.', '.', '\\', '.', '.', '\\', 'e', 't', 'c', '\\',
+	'p', 'a', 's', 's', 'w', 'd', 0, /* bad */
+}
+
+/* Exits with the byte at DS:000C, DS being relocated to the load segment. */
+var x86emu_test_exe = []byte{
+	'M', 'Z',
+	45, 0, /* bytes in the last page */
+	1, 0, /* pages */
+	1, 0, /* relocations */
+	2, 0, /* header paragraphs */
+	0x10, 0, /* minimum allocation */
+	0xff, 0xff, /* maximum allocation */
+	0, 0, /* SS */
+	0, 1, /* SP */
+	0, 0, /* checksum */
+	0, 0, /* IP */
+	0, 0, /* CS */
+	0x1c, 0, /* relocation table */
+	0, 0, /* overlay */
+	1, 0, 0, 0, /* relocation: 0000:0001 */
+	0xb8, 0x00, 0x00, /* mov ax,seg data */
+	0x8e, 0xd8, /* mov ds,ax */
+	0xa0, 0x0c, 0x00, /* mov al,[data] */
+	0xb4, 0x4c, /* mov ah,4ch */
+	0xcd, 0x21, /* int 21h */
+	42, /* data */
+}
+
+func TestDosRun(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		image []byte
+		code  uint8
+		out   string /* contents of OUT.TXT, if it is written */
+	}{
+		{"PROG.COM", x86emu_test_com, 7, "hello"},
+		{"PROG.EXE", x86emu_test_exe, 42, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			/* C:\ is two levels down, with an etc/passwd above it */
+			tmp := t.TempDir()
+			root := filepath.Join(tmp, "a", "b")
+			if err := os.MkdirAll(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(filepath.Join(tmp, "etc"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(tmp, "etc", "passwd"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			prog := filepath.Join(t.TempDir(), tc.name)
+			if err := os.WriteFile(prog, tc.image, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			code, err := X86EMU_runDos(prog, nil, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tc.code {
+				t.Errorf("exit code %d, want %d", code, tc.code)
+			}
+			if tc.out != "" {
+				b, err := os.ReadFile(filepath.Join(root, "OUT.TXT"))
+				if err != nil || string(b) != tc.out {
+					t.Errorf("OUT.TXT holds %q, %v; want %q", b, err, tc.out)
+				}
+			}
+		})
+	}
+}
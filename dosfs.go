@@ -0,0 +1,605 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+ * DOS file services over a host directory.
+ *
+ * Drive C: is the directory given to X86EMU_runDos and nothing outside it
+ * can be reached: every access goes through an os.Root, which also stops
+ * symbolic links and ".." from leading out.  DOS names are matched to host
+ * names without regard to case; new files get the name as the program
+ * spelled it.  Handles 0-4 are the standard devices, with CON on the
+ * host's standard streams and AUX and PRN discarding output.
+ */
+
+const (
+	DOS_ATTR_RDONLY = 0x01
+	DOS_ATTR_HIDDEN = 0x02
+	DOS_ATTR_SYSTEM = 0x04
+	DOS_ATTR_VOLUME = 0x08
+	DOS_ATTR_DIR    = 0x10
+	DOS_ATTR_ARCH   = 0x20
+
+	DOS_MAX_HANDLES = 20
+)
+
+type x86emu_dos_file struct {
+	f      *os.File
+	dev    string /* device name, for handles that are not files */
+	mode   int    /* 0 read, 1 write, 2 both */
+	stderr bool
+}
+
+type x86emu_dos_find struct {
+	entries []fs.FileInfo
+	next    int
+}
+
+var x86emu_dos_devices = map[string]bool{"CON": true, "NUL": true, "AUX": true, "PRN": true}
+
+/* Maps a host error to a DOS error code. */
+func x86emu_dos_errno(err error, notfound uint16) uint16 {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, fs.ErrNotExist):
+		return notfound
+	case errors.Is(err, fs.ErrExist):
+		return DOSERR_EXISTS
+	}
+	return DOSERR_ACCESS
+}
+
+// RETURNS:
+// The host name, relative to the root, of an entry in the host directory
+// dir matching name without regard to case, or name itself.
+func x86emu_dos_lookup(dir string, name string) string {
+	f, err := x86emu_dos.root.Open(dir)
+	if err != nil {
+		return name
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(-1)
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return n
+		}
+	}
+	return name
+}
+
+// PARAMETERS:
+// name - DOS path, absolute or relative to the current directory
+//
+// RETURNS:
+// The host path relative to the root and the DOS form of the directory,
+// or an error code.  The last component need not exist.
+func x86emu_dos_path(name string) (string, uint16) {
+	name = strings.ReplaceAll(name, "/", "\\")
+	if len(name) >= 2 && name[1] == ':' {
+		if name[0]|0x20 != 'c' {
+			return "", DOSERR_DRIVE
+		}
+		name = name[2:]
+	}
+	var parts []string
+	if !strings.HasPrefix(name, "\\") && x86emu_dos.cwd != "" {
+		parts = strings.Split(x86emu_dos.cwd, "\\")
+	}
+	for _, p := range strings.Split(name, "\\") {
+		switch p {
+		case "", ".":
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, p)
+		}
+	}
+	host := "."
+	for i, p := range parts {
+		host = path.Join(host, x86emu_dos_lookup(host, p))
+		if i < len(parts)-1 {
+			if fi, err := x86emu_dos.root.Stat(host); err != nil || !fi.IsDir() {
+				return "", DOSERR_NOPATH
+			}
+		}
+	}
+	return host, 0
+}
+
+/* Device a name refers to, with or without an extension, or "". */
+func x86emu_dos_device(name string) string {
+	if i := strings.LastIndexAny(name, "\\:"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.ToUpper(name)
+	if x86emu_dos_devices[name] {
+		return name
+	}
+	return ""
+}
+
+// RETURNS:
+// A new handle for the file, or an error code.
+func x86emu_dos_new_handle(file *x86emu_dos_file) (uint16, uint16) {
+	for h := uint16(0); h < DOS_MAX_HANDLES; h++ {
+		if x86emu_dos.files[h] == nil {
+			x86emu_dos.files[h] = file
+			return h, 0
+		}
+	}
+	if file.f != nil {
+		file.f.Close()
+	}
+	return 0, DOSERR_HANDLES
+}
+
+/* Closes the files left open when the program ends. */
+func x86emu_dos_close_all() {
+	d := &x86emu_dos
+	for h, file := range d.files {
+		if file.f != nil {
+			file.f.Close()
+		}
+		delete(d.files, h)
+	}
+	if d.root != nil {
+		d.root.Close()
+		d.root = nil
+	}
+}
+
+// PARAMETERS:
+// name - DOS path
+// flag - os.OpenFile flags
+// mode - DOS access mode
+//
+// RETURNS:
+// A handle, or an error code.
+func x86emu_dos_open(name string, flag int, mode int) (uint16, uint16) {
+	if dev := x86emu_dos_device(name); dev != "" {
+		return x86emu_dos_new_handle(&x86emu_dos_file{dev: dev, mode: mode})
+	}
+	host, err := x86emu_dos_path(name)
+	if err != 0 {
+		return 0, err
+	}
+	if fi, e := x86emu_dos.root.Stat(host); e == nil && fi.IsDir() {
+		return 0, DOSERR_ACCESS
+	}
+	f, e := x86emu_dos.root.OpenFile(host, flag, 0644)
+	if e != nil {
+		return 0, x86emu_dos_errno(e, DOSERR_NOFILE)
+	}
+	return x86emu_dos_new_handle(&x86emu_dos_file{f: f, mode: mode})
+}
+
+/* Reads n bytes from a handle into memory at addr. */
+func x86emu_dos_read(file *x86emu_dos_file, addr uint32, n int) (int, uint16) {
+	if file.mode == 1 {
+		return 0, DOSERR_ACCESS
+	}
+	var buf []byte
+	switch {
+	case file.f != nil:
+		buf = make([]byte, n)
+		got, err := file.f.Read(buf)
+		if err != nil && err != io.EOF {
+			return 0, DOSERR_ACCESS
+		}
+		buf = buf[:got]
+	case file.dev == "CON":
+		/* a line at a time, cooked, as from the keyboard */
+		for len(buf) < n {
+			c := x86emu_dos_getc(true)
+			if c == 0x1a {
+				break
+			}
+			buf = append(buf, c)
+			if c == '\r' {
+				if len(buf) < n {
+					buf = append(buf, '\n')
+				}
+				break
+			}
+		}
+	}
+	x86emu_phys_copy_in(addr, buf)
+	return len(buf), 0
+}
+
+/* Writes n bytes of memory at addr to a handle; 0 bytes truncates. */
+func x86emu_dos_write(file *x86emu_dos_file, addr uint32, n int) (int, uint16) {
+	if file.mode == 0 {
+		return 0, DOSERR_ACCESS
+	}
+	buf := x86emu_phys_copy_out(addr, n)
+	switch {
+	case file.f != nil:
+		if n == 0 {
+			pos, _ := file.f.Seek(0, io.SeekCurrent)
+			if file.f.Truncate(pos) != nil {
+				return 0, DOSERR_ACCESS
+			}
+			return 0, 0
+		}
+		got, err := file.f.Write(buf)
+		if err != nil {
+			return got, DOSERR_ACCESS
+		}
+	case file.dev == "CON" && file.stderr:
+		x86emu_dos.stderr.Write(buf)
+	case file.dev == "CON":
+		x86emu_dos.stdout.Write(buf)
+	}
+	return n, 0
+}
+
+/* DOS time and date words of a host time. */
+func x86emu_dos_time(t time.Time) (uint16, uint16) {
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	y := t.Year() - 1980
+	if y < 0 {
+		y = 0
+	}
+	dt := uint16(y)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	return tm, dt
+}
+
+func x86emu_dos_attr(fi fs.FileInfo) uint8 {
+	a := uint8(DOS_ATTR_ARCH)
+	if fi.IsDir() {
+		a = DOS_ATTR_DIR
+	}
+	if fi.Mode().Perm()&0200 == 0 {
+		a |= DOS_ATTR_RDONLY
+	}
+	return a
+}
+
+/* 8.3 form of a host name, or "" if it has none. */
+func x86emu_dos_83(name string) string {
+	up := strings.ToUpper(name)
+	base, ext := up, ""
+	if i := strings.LastIndexByte(up, '.'); i > 0 {
+		base, ext = up[:i], up[i+1:]
+	}
+	if up == "." || up == ".." {
+		return up
+	}
+	if base == "" || len(base) > 8 || len(ext) > 3 || strings.ContainsAny(up, " +,;=[]\"/\\:*?<>|") ||
+		strings.Count(up, ".") > 1 {
+		return ""
+	}
+	return up
+}
+
+/* Whether an 8.3 name matches a pattern with * and ? wildcards. */
+func x86emu_dos_match(pattern string, name string) bool {
+	split := func(s string) []byte {
+		b := []byte("           ")
+		base, ext := s, ""
+		if i := strings.LastIndexByte(s, '.'); i >= 0 && s != "." && s != ".." {
+			base, ext = s[:i], s[i+1:]
+		}
+		fill := func(dst []byte, src string) {
+			for i := 0; i < len(dst) && i < len(src); i++ {
+				if src[i] == '*' {
+					for ; i < len(dst); i++ {
+						dst[i] = '?'
+					}
+					return
+				}
+				dst[i] = src[i]
+			}
+		}
+		fill(b[:8], base)
+		fill(b[8:], ext)
+		return b
+	}
+	p, n := split(strings.ToUpper(pattern)), split(name)
+	for i := range p {
+		if p[i] != '?' && p[i] != n[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// REMARKS:
+// Fills the DTA with the next match of a find first/next search.
+func x86emu_dos_find_next(addr uint32) uint16 {
+	s := x86emu_dos.finds[addr]
+	if s == nil || s.next >= len(s.entries) {
+		delete(x86emu_dos.finds, addr)
+		return DOSERR_NOMORE
+	}
+	fi := s.entries[s.next]
+	s.next++
+	b := make([]byte, 43)
+	b[0] = 3 /* drive, the rest of the search state is kept in Go */
+	b[0x15] = x86emu_dos_attr(fi)
+	tm, dt := x86emu_dos_time(fi.ModTime())
+	b[0x16], b[0x17] = uint8(tm), uint8(tm>>8)
+	b[0x18], b[0x19] = uint8(dt), uint8(dt>>8)
+	size := uint32(fi.Size())
+	if fi.IsDir() {
+		size = 0
+	}
+	b[0x1a], b[0x1b], b[0x1c], b[0x1d] = uint8(size), uint8(size>>8), uint8(size>>16), uint8(size>>24)
+	copy(b[0x1e:0x2a], x86emu_dos_83(fi.Name()))
+	x86emu_phys_copy_in(addr, b)
+	return 0
+}
+
+func x86emu_dos_find_first(pattern string, attr uint8, addr uint32) uint16 {
+	dir, name := "", pattern
+	if i := strings.LastIndexAny(pattern, "\\:"); i >= 0 {
+		dir, name = pattern[:i+1], pattern[i+1:]
+	}
+	host, err := x86emu_dos_path(dir + ".")
+	if err != 0 {
+		return err
+	}
+	f, e := x86emu_dos.root.Open(host)
+	if e != nil {
+		return DOSERR_NOPATH
+	}
+	entries, _ := f.Readdir(-1)
+	f.Close()
+	s := &x86emu_dos_find{}
+	for _, fi := range entries {
+		n := x86emu_dos_83(fi.Name())
+		if n == "" || (fi.IsDir() && attr&DOS_ATTR_DIR == 0) || !x86emu_dos_match(name, n) {
+			continue
+		}
+		s.entries = append(s.entries, fi)
+	}
+	if len(s.entries) == 0 {
+		return DOSERR_NOFILE
+	}
+	x86emu_dos.finds[addr] = s
+	return x86emu_dos_find_next(addr)
+}
+
+// RETURNS:
+// Whether ah is one of the file functions handled here.
+func x86emu_dos_file_service(ah uint8) bool {
+	r := &M().x86
+	d := &x86emu_dos
+	name := func() string { return x86emu_dos_string(x86emu_dos_dsdx()) }
+	handle := func() *x86emu_dos_file { return d.files[r.gen.B.Get16()] }
+
+	switch ah {
+	case 0x3c, 0x5b: /* create, create new */
+		flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		if ah == 0x5b {
+			flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+		}
+		h, err := x86emu_dos_open(name(), flag, 2)
+		if err == 0 {
+			r.gen.A.Set16(h)
+		}
+		x86emu_dos_result(err)
+
+	case 0x3d: /* open */
+		mode := int(r.gen.A.Get8l() & 7)
+		flag := []int{os.O_RDONLY, os.O_WRONLY, os.O_RDWR}
+		if mode > 2 {
+			x86emu_dos_result(DOSERR_FUNCTION)
+			break
+		}
+		h, err := x86emu_dos_open(name(), flag[mode], mode)
+		if err == 0 {
+			r.gen.A.Set16(h)
+		}
+		x86emu_dos_result(err)
+
+	case 0x3e: /* close */
+		file := handle()
+		if file == nil {
+			x86emu_dos_result(DOSERR_HANDLE)
+			break
+		}
+		if file.f != nil {
+			/* the same file may be open under a handle from 45h */
+			shared := false
+			for h, o := range d.files {
+				if o == file && h != r.gen.B.Get16() {
+					shared = true
+				}
+			}
+			if !shared {
+				file.f.Close()
+			}
+		}
+		delete(d.files, r.gen.B.Get16())
+		x86emu_dos_result(0)
+
+	case 0x3f, 0x40: /* read, write */
+		file := handle()
+		if file == nil {
+			x86emu_dos_result(DOSERR_HANDLE)
+			break
+		}
+		var n int
+		var err uint16
+		if ah == 0x3f {
+			n, err = x86emu_dos_read(file, x86emu_dos_dsdx(), int(r.gen.C.Get16()))
+		} else {
+			n, err = x86emu_dos_write(file, x86emu_dos_dsdx(), int(r.gen.C.Get16()))
+		}
+		if err == 0 {
+			r.gen.A.Set16(uint16(n))
+		}
+		x86emu_dos_result(err)
+
+	case 0x41: /* delete */
+		host, err := x86emu_dos_path(name())
+		if err == 0 {
+			err = x86emu_dos_errno(d.root.Remove(host), DOSERR_NOFILE)
+		}
+		x86emu_dos_result(err)
+
+	case 0x42: /* seek */
+		file := handle()
+		if file == nil {
+			x86emu_dos_result(DOSERR_HANDLE)
+			break
+		}
+		off := int64(int32(uint32(r.gen.C.Get16())<<16 | uint32(r.gen.D.Get16())))
+		whence := int(r.gen.A.Get8l())
+		if whence > 2 {
+			x86emu_dos_result(DOSERR_FUNCTION)
+			break
+		}
+		if whence == 0 {
+			off = int64(uint32(off))
+		}
+		pos := int64(0)
+		if file.f != nil {
+			p, err := file.f.Seek(off, whence)
+			if err != nil {
+				x86emu_dos_result(DOSERR_FUNCTION)
+				break
+			}
+			pos = p
+		}
+		r.gen.D.Set16(uint16(pos >> 16))
+		r.gen.A.Set16(uint16(pos))
+		x86emu_dos_result(0)
+
+	case 0x43: /* attributes */
+		host, err := x86emu_dos_path(name())
+		if err != 0 {
+			x86emu_dos_result(err)
+			break
+		}
+		fi, e := d.root.Stat(host)
+		if e != nil {
+			x86emu_dos_result(x86emu_dos_errno(e, DOSERR_NOFILE))
+			break
+		}
+		if r.gen.A.Get8l() == 0x00 {
+			r.gen.C.Set16(uint16(x86emu_dos_attr(fi)))
+		}
+		/* setting them is accepted and ignored */
+		x86emu_dos_result(0)
+
+	case 0x44: /* IOCTL: only get device information */
+		file := handle()
+		if file == nil {
+			x86emu_dos_result(DOSERR_HANDLE)
+			break
+		}
+		if r.gen.A.Get8l() != 0x00 {
+			x86emu_dos_result(DOSERR_FUNCTION)
+			break
+		}
+		info := uint16(0x0002) /* a file on C: */
+		if file.f == nil {
+			info = 0x80c0
+			if file.dev == "CON" {
+				info |= 0x03 /* standard input and output */
+			}
+			if file.dev == "NUL" {
+				info |= 0x04
+			}
+		}
+		r.gen.D.Set16(info)
+		r.gen.A.Set16(info)
+		x86emu_dos_result(0)
+
+	case 0x45: /* duplicate handle */
+		file := handle()
+		if file == nil {
+			x86emu_dos_result(DOSERR_HANDLE)
+			break
+		}
+		h, err := x86emu_dos_new_handle(file)
+		if err == 0 {
+			r.gen.A.Set16(h)
+		}
+		x86emu_dos_result(err)
+
+	case 0x39, 0x3a: /* mkdir, rmdir */
+		host, err := x86emu_dos_path(name())
+		if err == 0 && host == "." {
+			err = DOSERR_ACCESS
+		}
+		if err == 0 && ah == 0x39 {
+			err = x86emu_dos_errno(d.root.Mkdir(host, 0755), DOSERR_NOPATH)
+		} else if err == 0 {
+			err = x86emu_dos_errno(d.root.Remove(host), DOSERR_NOPATH)
+		}
+		x86emu_dos_result(err)
+
+	case 0x3b: /* chdir */
+		host, err := x86emu_dos_path(name())
+		if err == 0 {
+			if fi, e := d.root.Stat(host); e != nil || !fi.IsDir() {
+				err = DOSERR_NOPATH
+			}
+		}
+		if err == 0 {
+			d.cwd = strings.ReplaceAll(strings.ToUpper(strings.TrimPrefix(host, ".")), "/", "\\")
+			if host == "." {
+				d.cwd = ""
+			}
+		}
+		x86emu_dos_result(err)
+
+	case 0x47: /* get current directory */
+		if dl := r.gen.D.Get8l(); dl != 0 && dl != 3 {
+			x86emu_dos_result(DOSERR_DRIVE)
+			break
+		}
+		addr := uint32(r.seg.DS.Get())<<4 + uint32(r.spc.SI.Get16())
+		x86emu_phys_copy_in(addr, append([]byte(d.cwd), 0))
+		r.gen.A.Set16(0x0100)
+		x86emu_dos_result(0)
+
+	case 0x56: /* rename */
+		from, err := x86emu_dos_path(name())
+		var to string
+		if err == 0 {
+			addr := uint32(r.seg.ES.Get())<<4 + uint32(r.spc.DI.Get16())
+			to, err = x86emu_dos_path(x86emu_dos_string(addr))
+		}
+		if err == 0 {
+			err = x86emu_dos_errno(d.root.Rename(from, to), DOSERR_NOFILE)
+		}
+		x86emu_dos_result(err)
+
+	case 0x4e: /* find first */
+		addr := uint32(d.dta>>16)<<4 + d.dta&0xffff
+		x86emu_dos_result(x86emu_dos_find_first(name(), uint8(r.gen.C.Get16()), addr))
+	case 0x4f: /* find next */
+		addr := uint32(d.dta>>16)<<4 + d.dta&0xffff
+		x86emu_dos_result(x86emu_dos_find_next(addr))
+
+	case 0x36: /* free space: report 32M free in 4K clusters */
+		r.gen.A.Set16(8)
+		r.gen.B.Set16(8192)
+		r.gen.C.Set16(512)
+		r.gen.D.Set16(0xffff)
+
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,288 @@
+package main
+
+import "fmt"
+
+/*
+ * Processor exceptions.
+ *
+ * Faults (#DE, #UD, #BR, #NM, #SS, #GP, #PF, ...) are raised by panicking
+ * with an x86emu_exception; x86emu_exec_insn rolls the instruction back so
+ * the handler sees CS:EIP of the faulting instruction, and delivers the
+ * exception through the IVT or IDT.  Traps (#DB for single stepping, #BP,
+ * #OF) are delivered once the instruction has completed, with CS:EIP of
+ * the next one.
+ *
+ * A fault raised while delivering another is handled as on the 286 and
+ * later: two contributory faults, or a page fault followed by a page or
+ * contributory fault, become a double fault (#DF); a fault while delivering
+ * #DF shuts the processor down.
+ */
+
+/* Exception classes for double fault detection. */
+const (
+	EXC_BENIGN = iota
+	EXC_CONTRIBUTORY
+	EXC_PAGE_FAULT
+	EXC_DOUBLE_FAULT
+)
+
+var x86emu_exc_names = map[uint8]string{
+	EXC_DE: "#DE", EXC_DB: "#DB", EXC_BP: "#BP", EXC_OF: "#OF",
+	EXC_BR: "#BR", EXC_UD: "#UD", EXC_NM: "#NM", EXC_DF: "#DF",
+	EXC_TS: "#TS", EXC_NP: "#NP", EXC_SS: "#SS", EXC_GP: "#GP",
+	EXC_PF: "#PF",
+}
+
+/* DR6 and DR7 bits */
+const (
+	DR6_BS    uint32 = 0x00004000
+	DR6_RESET uint32 = 0xffff0ff0
+	DR7_RESET uint32 = 0x00000400
+)
+
+/*
+ * Whether the emulator stops at the first fault instead of delivering it,
+ * leaving CS:EIP at the faulting instruction.  Useful when running code
+ * that has no exception handlers of its own.
+ */
+var x86emu_stop_on_fault bool
+
+/* Whether faults halt the emulator rather than being delivered to the guest. */
+func X86EMU_setStopOnFault(stop bool) {
+	x86emu_stop_on_fault = stop
+}
+
+func x86emu_exc_name(vec uint8) string {
+	if s, ok := x86emu_exc_names[vec]; ok {
+		return s
+	}
+	return fmt.Sprintf("vector %#x", vec)
+}
+
+func x86emu_exc_class(vec uint8) int {
+	switch vec {
+	case EXC_DE, EXC_TS, EXC_NP, EXC_SS, EXC_GP:
+		return EXC_CONTRIBUTORY
+	case EXC_PF:
+		return EXC_PAGE_FAULT
+	case EXC_DF:
+		return EXC_DOUBLE_FAULT
+	}
+	return EXC_BENIGN
+}
+
+// PARAMETERS:
+// e - Fault raised by the instruction at insn_cs:insn_ip
+//
+// REMARKS:
+// Called once the instruction has been rolled back.  Delivers the fault, or
+// halts the emulator if the host asked to stop on faults.
+func x86emu_handle_fault(e x86emu_exception) {
+	if x86emu_stop_on_fault {
+		fmt.Printf("%04x:%08x: %s", M().x86.insn_cs, M().x86.insn_ip, x86emu_exc_name(e.vec))
+		if e.has_err {
+			fmt.Printf(" error %#x", e.err)
+		}
+		fmt.Printf(", stopping\n")
+		x86emu_dump_xregs()
+		HALT_SYS()
+		return
+	}
+	x86emu_deliver(e.vec, false, e.has_err, e.err)
+}
+
+/* Delivers one interrupt, returning the exception it raised, if any. */
+func x86emu_try_deliver(vec uint8, has_err bool, err uint32) (exc *x86emu_exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(x86emu_exception)
+			if !ok {
+				panic(r)
+			}
+			exc = &e
+		}
+	}()
+	x86emu_int_deliver(vec, false, has_err, err)
+	return nil
+}
+
+// PARAMETERS:
+// vec     - Interrupt vector
+// ext     - A hardware interrupt rather than an exception
+// has_err - Whether an error code is pushed
+// err     - Error code
+//
+// REMARKS:
+// Delivers an exception or hardware interrupt outside of any instruction.
+// If that raises a fault the machine state is put back and the fault is
+// delivered instead, escalating to #DF and finally to shutdown, which halts
+// the emulator.  Hardware interrupts count as benign whatever their vector,
+// so IRQ0 on vector 8 is not taken for a double fault.
+func x86emu_deliver(vec uint8, ext bool, has_err bool, err uint32) {
+	cs := M().x86.seg.CS.Get()
+	csc := M().x86.segcache[SEG_CS]
+	ip := M().x86.spc.IP.Get32()
+	sp := M().x86.spc.SP.Get32()
+	flags := M().x86.spc.FLAGS
+	for {
+		e := x86emu_try_deliver(vec, has_err, err)
+		if e == nil {
+			return
+		}
+		x86emu_sreg(SEG_CS).Set(cs)
+		M().x86.segcache[SEG_CS] = csc
+		M().x86.spc.IP.Set32(ip)
+		M().x86.spc.SP.Set32(sp)
+		M().x86.spc.FLAGS = flags
+		if DEBUG_TRACE() {
+			fmt.Printf("%04x:%08x: %s while delivering %s\n",
+				cs, ip, x86emu_exc_name(e.vec), x86emu_exc_name(vec))
+		}
+
+		first, second := x86emu_exc_class(vec), x86emu_exc_class(e.vec)
+		if ext {
+			first, ext = EXC_BENIGN, false
+		}
+		switch {
+		case first == EXC_DOUBLE_FAULT:
+			fmt.Printf("%04x:%08x: %s while delivering #DF, shutting down\n",
+				cs, ip, x86emu_exc_name(e.vec))
+			x86emu_dump_xregs()
+			HALT_SYS()
+			return
+		case first == EXC_CONTRIBUTORY && second == EXC_CONTRIBUTORY,
+			first == EXC_PAGE_FAULT && second != EXC_BENIGN:
+			vec, has_err, err = EXC_DF, true, 0
+		default:
+			vec, has_err, err = e.vec, e.has_err, e.err
+		}
+	}
+}
+
+/*
+ * Single step trap: when TF was set at the start of an instruction, #DB is
+ * delivered after it completes, with DR6.BS set.
+ */
+func x86emu_single_step_trap() {
+	M().x86.dr[6] |= DR6_BS
+	x86emu_deliver(EXC_DB, false, false, 0)
+}
+
+/*
+ * #NM for coprocessor instructions: ESC with CR0.EM or CR0.TS set, and WAIT
+ * with CR0.TS and CR0.MP both set.
+ */
+func x86emu_check_fpu(op1 uint8) {
+	cr0 := M().x86.cr[0]
+	switch {
+	case op1 >= 0xd8 && op1 <= 0xdf:
+		if cr0&(CR0_EM|CR0_TS) != 0 {
+			x86emu_fault_noerr(EXC_NM)
+		}
+	case op1 == 0x9b:
+		if cr0&(CR0_TS|CR0_MP) == CR0_TS|CR0_MP {
+			x86emu_fault_noerr(EXC_NM)
+		}
+	}
+}
+
+// REMARKS:
+// Handles illegal opcodes by raising #UD.
+func x86emuOp_illegal_op(op1 uint8) {
+	DECODE_PRINTF("ILLEGAL X86 OPCODE\n")
+	if DEBUG_TRACE() {
+		fmt.Printf("%04x:%08x: %02X ILLEGAL X86 OPCODE!\n",
+			M().x86.insn_cs, M().x86.insn_ip, op1)
+	}
+	x86emu_fault_noerr(EXC_UD)
+}
+
+// REMARKS:
+// Handles illegal two byte opcodes.
+func x86emuOp2_illegal_op(op2 uint8) {
+	DECODE_PRINTF("ILLEGAL EXTENDED X86 OPCODE\n")
+	if DEBUG_TRACE() {
+		fmt.Printf("%04x:%08x: 0F %02X ILLEGAL EXTENDED X86 OPCODE!\n",
+			M().x86.insn_cs, M().x86.insn_ip, op2)
+	}
+	x86emu_fault_noerr(EXC_UD)
+}
+
+// REMARKS:
+// Handles opcode 0x62: BOUND r,m raises #BR when the register is outside
+// the signed bounds stored at m.
+func x86emuOp_bound(_ uint8) {
+	var mod, rh, rl int
+
+	DECODE_PRINTF("BOUND\t")
+	fetch_decode_modrm(&mod, &rh, &rl)
+	if mod == 3 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	addr := decode_rmXX_address(mod, rl)
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+		val := int32(x86emu_greg(rh).Get32())
+		lo := int32(fetch_data_long(addr))
+		hi := int32(fetch_data_long(addr + 4))
+		if val < lo || val > hi {
+			x86emu_fault_noerr(EXC_BR)
+		}
+	} else {
+		val := int16(x86emu_greg(rh).Get16())
+		lo := int16(fetch_data_word(addr))
+		hi := int16(fetch_data_word(addr + 2))
+		if val < lo || val > hi {
+			x86emu_fault_noerr(EXC_BR)
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+/* Debug register number, with DR4/DR5 aliasing DR6/DR7 unless CR4.DE. */
+func x86emu_dr_index(n int) int {
+	if n == 4 || n == 5 {
+		if M().x86.cr[4]&CR4_DE != 0 {
+			x86emu_fault_noerr(EXC_UD)
+		}
+		n += 2
+	}
+	return n
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x21: MOV r32,DRn.  Breakpoints are not modelled;
+// the registers only hold what software puts there, plus DR6.BS.
+func x86emuOp2_mov_R_DR(_ uint8) {
+	var mod, rh, rl int
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	DECODE_PRINTF("MOV\tDR%d\n", rh)
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	x86emu_greg(rl).Set32(M().x86.dr[x86emu_dr_index(rh)])
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x23: MOV DRn,r32
+func x86emuOp2_mov_DR_R(_ uint8) {
+	var mod, rh, rl int
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	DECODE_PRINTF("MOV\tDR%d\n", rh)
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	M().x86.dr[x86emu_dr_index(rh)] = x86emu_greg(rl).Get32()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func init() {
+	x86emu_optab[0x62] = x86emuOp_bound
+	x86emu_optab2[0x21] = x86emuOp2_mov_R_DR
+	x86emu_optab2[0x23] = x86emuOp2_mov_DR_R
+}
@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestExceptionDelivery(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		prot  bool
+		stop  bool /* stop on fault */
+		setup func()
+		code  []byte
+		ip    uint16   /* where the emulator stopped */
+		sp    uint16   /* and SP there */
+		frame []uint16 /* the words from SP up */
+	}{
+		{name: "#DE in real mode",
+			code:  []byte{0xb9, 0x00, 0x00, 0xf7, 0xf1}, /* MOV CX,0; DIV CX */
+			ip:    0x1801,
+			sp:    0x800 - 6,
+			frame: []uint16{0x1003, 0, 0x0002}},
+		{name: "#UD in real mode",
+			code:  []byte{0xd6},
+			ip:    0x1801,
+			sp:    0x800 - 6,
+			frame: []uint16{0x1000, 0, 0x0002}},
+		{name: "#UD with SP at zero",
+			setup: func() { M().x86.spc.SP.Set32(0) },
+			code:  []byte{0xd6},
+			ip:    0x1801,
+			sp:    0x10000 - 6,
+			frame: []uint16{0x1000, 0, 0x0002}},
+		{name: "#UD through a not present gate is #NP", prot: true,
+			setup: func() {
+				x86emu_test_gate(EXC_UD, TEST_CODE16, 0x1800, GATE_INT16, 0, false)
+				x86emu_test_gate(EXC_NP, TEST_CODE16, 0x1800, GATE_INT16, 0, true)
+			},
+			code:  []byte{0xd6},
+			ip:    0x1801,
+			sp:    0x800 - 8,
+			frame: []uint16{uint16(EXC_UD)*8 + 3, 0x1000, TEST_CODE16, 0x0002}},
+		{name: "#GP through a not present gate is #DF", prot: true,
+			setup: func() {
+				M().x86.gen.A.Set16(TEST_SYSTEM)
+				x86emu_test_gate(EXC_GP, TEST_CODE16, 0x1800, GATE_INT16, 0, false)
+				x86emu_test_gate(EXC_DF, TEST_CODE16, 0x1800, GATE_INT16, 0, true)
+			},
+			code:  []byte{0x8e, 0xd8}, /* MOV DS,AX */
+			ip:    0x1801,
+			sp:    0x800 - 8,
+			frame: []uint16{0, 0x1000, TEST_CODE16, 0x0002}},
+		{name: "fault delivering #DF shuts down", prot: true,
+			setup: func() {
+				M().x86.gen.A.Set16(TEST_SYSTEM)
+				x86emu_test_gate(EXC_GP, TEST_CODE16, 0x1800, GATE_INT16, 0, false)
+				x86emu_test_gate(EXC_DF, TEST_CODE16, 0x1800, GATE_INT16, 0, false)
+			},
+			code: []byte{0x8e, 0xd8}, /* MOV DS,AX */
+			ip:   0x1000,
+			sp:   0x800},
+		{name: "stop on fault", stop: true,
+			code: []byte{0xd6},
+			ip:   0x1000,
+			sp:   0x800},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.prot {
+				x86emu_test_protmode(t)
+			} else {
+				x86emu_test_machine(t)
+				/* #DE and #UD handlers: HLT at 0000:1800 */
+				sys_wrl(uint32(EXC_DE)*4, 0x1800)
+				sys_wrl(uint32(EXC_UD)*4, 0x1800)
+			}
+			sys_wrb(0x1800, 0xf4)
+			M().x86.spc.FLAGS = 0x0002
+			if tc.setup != nil {
+				tc.setup()
+			}
+			X86EMU_setStopOnFault(tc.stop)
+			defer X86EMU_setStopOnFault(false)
+			x86emu_test_run(t, append(tc.code, 0xf4))
+
+			r := &M().x86
+			if ip, sp := r.spc.IP.Get16(), r.spc.SP.Get16(); ip != tc.ip || sp != tc.sp {
+				t.Fatalf("stopped at %04x with SP %04x, want %04x with SP %04x", ip, sp, tc.ip, tc.sp)
+			}
+			for i, want := range tc.frame {
+				if got := sys_rdw(uint32(tc.sp) + uint32(i)*2); got != want {
+					t.Errorf("frame[%d] %04x, want %04x", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 var notyet = `
 # define CHECK_IP_FETCH()              	(M.x86.check & CHECK_IP_FETCH_F)
 # define CHECK_SP_ACCESS()             	(M.x86.check & CHECK_SP_ACCESS_F)
@@ -144,6 +146,13 @@ func ACCESS_FLAG(flag uint32) bool {
 func CLEARALL_FLAG(_ uint32) {
 	M().x86.spc.FLAGS = 0
 }
+func CONDITIONAL_SET_FLAG(cond bool, flag uint32) {
+	if cond {
+		SET_FLAG(flag)
+	} else {
+		CLEAR_FLAG(flag)
+	}
+}
 
 // :.,$s/func \(.*\) {^M\(.*\)/func \1() {\2}/^M}
 func CHECK_IP_FETCH() bool {
@@ -214,22 +223,61 @@ func DEBUG_MEM_TRACE() bool {
 func DEBUG_IO_TRACE() bool {
 	return 	(M().x86.debug & DEBUG_IO_TRACE_F) != 0
 }
+func DEBUG_MSR() bool {
+	return 	(M().x86.debug & DEBUG_MSR_F) != 0
+}
 func DEBUG_DECODE_NOPRINT() bool {
 	return 	(M().x86.debug & DEBUG_DECODE_NOPRINT_F) != 0
 }
+func DECODE_PRINTF(x string, y ...interface{}) {
+	if DEBUG_DECODE() {
+		x86emu_decode_printf(x, y...)
+	}
+}
+func INC_DECODED_INST_LEN(x int) {
+	if DEBUG_DECODE() {
+		x86emu_inc_decoded_inst_len(x)
+	}
+}
+func TRACE_AND_STEP() {
+	if DEBUG_TRACE() || DEBUG_DECODE() {
+		X86EMU_trace_regs()
+	}
+	if DEBUG_STEP() {
+		x86emu_single_step()
+	}
+}
+func END_OF_INSTR() {
+	x86emu_end_instr()
+}
+func HALT_SYS() {
+	X86EMU_halt_sys()
+}
 func initDEBUG_SYS_F() {
 	DEBUG_SYS_F = (DEBUG_SVC_F | DEBUG_FS_F | DEBUG_PROC_F)
 }
-func sys_rdb(ip uint32) byte {
-	panic("fix me")
-	return 0
-}
 
-func fetch_data_word_abs(seg, off uint16) uint16 {
-	panic("fix me")
-	return 0
+func CALL_TRACE(u, v, w uint16, x uint32, s string) {
+	if DEBUG_TRACECALLREGS() {
+		x86emu_dump_regs()
+	}
+	if DEBUG_TRACECALL() {
+		fmt.Printf("%04x:%04x: CALL %s%04x:%04x\n", u, v, s, w, x)
+	}
 }
-func fetch_data_byte_abs(seg, off uint16) uint8 {
-		panic("fix me")
-	return 0
+func RETURN_TRACE(u, v, w uint16, x uint32, s string) {
+	if DEBUG_TRACECALLREGS() {
+		x86emu_dump_regs()
+	}
+	if DEBUG_TRACECALL() {
+		fmt.Printf("%04x:%04x: RET %s %04x:%04x\n", u, v, s, w, x)
+	}
+}
+func JMP_TRACE(u, v, w uint16, x uint32, s string) {
+	if DEBUG_TRACEJMPREGS() {
+		x86emu_dump_regs()
+	}
+	if DEBUG_TRACEJMP() {
+		fmt.Printf("%04x:%04x: JMP %s%04x:%04x\n", u, v, s, w, x)
+	}
 }
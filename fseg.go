@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+/*
+ * The F segment.
+ *
+ * Structures that guest code finds by scanning 0xF0000-0xFFFFF or that the
+ * emulator points it at (the PnP installation check, $PMM, entry points of
+ * BIOS services) are placed in the low part of the segment, leaving the top
+ * free for the reset vector.  Space is never freed; X86EMU_setupBios starts
+ * the segment afresh for a new machine.
+ */
+
+const (
+	FSEG_BASE  = 0xf0000
+	FSEG_LIMIT = 0xfe000
+)
+
+var x86emu_fseg_next uint32 = FSEG_BASE
+
+// PARAMETERS:
+// size  - Bytes needed
+// align - Alignment, a power of two
+//
+// RETURNS:
+// Linear address of the space, cleared.
+func x86emu_fseg_alloc(size uint32, align uint32) (uint32, error) {
+	addr := (x86emu_fseg_next + align - 1) &^ (align - 1)
+	if addr < x86emu_fseg_next || addr+size > FSEG_LIMIT {
+		return 0, fmt.Errorf("F segment full: no room for %d bytes", size)
+	}
+	x86emu_fseg_next = addr + size
+	x86emu_phys_copy_in(addr, make([]byte, size))
+	return addr, nil
+}
+
+/* Frees the whole allocated part of the segment and the traps in it. */
+func x86emu_fseg_reset() {
+	for addr := range x86emu_traps {
+		if addr >= FSEG_BASE && addr < x86emu_fseg_next {
+			delete(x86emu_traps, addr)
+		}
+	}
+	x86emu_fseg_next = FSEG_BASE
+}
+
+/* Sets the checksum byte at addr+at so that size bytes from addr sum to 0. */
+func x86emu_fix_checksum(addr uint32, size uint32, at uint32) {
+	x86emu_phys_write(addr+at, 1, 0)
+	sum := uint8(0)
+	for _, b := range x86emu_phys_copy_out(addr, int(size)) {
+		sum += b
+	}
+	x86emu_phys_write(addr+at, 1, uint32(-sum))
+}
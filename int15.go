@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+ * Int 15h system services: the memory size calls (E820h, E801h, 88h), the
+ * A20 gate (2400h-2403h) and the wait (86h), which passes virtual time.
+ *
+ * The E820 map is built when asked for from the memory the machine has:
+ * RAM, the BIOS areas below 1M, device regions mapped above 1M and any
+ * ranges a platform adds with X86EMU_addE820.  Platform specific calls,
+ * such as the 5Fxxh hooks Intel video BIOSes make into the system BIOS,
+ * go through hooks registered with X86EMU_hookInt15, which see every call
+ * before the built-in services do.
+ */
+
+const (
+	E820_RAM      = 1
+	E820_RESERVED = 2
+	E820_ACPI     = 3
+	E820_NVS      = 4
+	E820_UNUSABLE = 5
+
+	E820_SMAP = 0x534d4150 /* "SMAP" */
+)
+
+type X86EMU_e820Entry struct {
+	base, size uint64
+	typ        uint32
+}
+
+/* An int 15h handler; returns whether it handled the call. */
+type X86EMU_int15Hook func() bool
+
+var x86emu_int15 struct {
+	hooks []X86EMU_int15Hook
+	extra []X86EMU_e820Entry /* from X86EMU_addE820 */
+}
+
+var x86emu_e820_names = map[uint32]string{
+	E820_RAM: "usable", E820_RESERVED: "reserved", E820_ACPI: "ACPI data",
+	E820_NVS: "ACPI NVS", E820_UNUSABLE: "unusable",
+}
+
+func (e X86EMU_e820Entry) String() string {
+	name := x86emu_e820_names[e.typ]
+	if name == "" {
+		name = fmt.Sprintf("type %d", e.typ)
+	}
+	return fmt.Sprintf("%#010x-%#010x %s", e.base, e.base+e.size-1, name)
+}
+
+// REMARKS:
+// Installs the int 15h vector and drops the hooks and E820 ranges of the
+// last machine; add new ones after calling it.
+func X86EMU_setupSystemBios() error {
+	x86emu_int15.hooks, x86emu_int15.extra = nil, nil
+	_, err := X86EMU_setupBiosVector(0x15, "int15", x86emu_int15_service)
+	return err
+}
+
+// PARAMETERS:
+// fn - Handler, run with the registers of the INT
+//
+// REMARKS:
+// Hooks are tried newest first; one that returns true has handled the
+// call and set AH and CF itself.
+func X86EMU_hookInt15(fn X86EMU_int15Hook) {
+	x86emu_int15.hooks = append(x86emu_int15.hooks, fn)
+}
+
+// PARAMETERS:
+// base - Physical base address
+// size - Length in bytes
+// typ  - E820_RAM, E820_RESERVED, ...
+//
+// REMARKS:
+// Adds a range to the E820 map, overriding what the map would otherwise
+// say about it; used for ACPI tables and platform reserved memory.
+func X86EMU_addE820(base, size uint64, typ uint32) {
+	x86emu_int15.extra = append(x86emu_int15.extra, X86EMU_e820Entry{base, size, typ})
+}
+
+// RETURNS:
+// The memory map, sorted and without overlaps.  Where ranges overlap the
+// one added last wins, so device regions punch holes in RAM and platform
+// ranges override both.
+func X86EMU_e820Map() []X86EMU_e820Entry {
+	top := uint64(x86emu_base_memory())
+	l := []X86EMU_e820Entry{
+		{0, top, E820_RAM},
+		{top, 0xa0000 - top, E820_RESERVED}, /* EBDA */
+		{FSEG_BASE, 0x10000, E820_RESERVED},
+	}
+	if M().mem_size > 0x100000 {
+		l = append(l, X86EMU_e820Entry{0x100000, uint64(M().mem_size) - 0x100000, E820_RAM})
+	}
+	for _, r := range x86emu_mmio_regions {
+		if r.base >= 0x100000 {
+			l = append(l, X86EMU_e820Entry{uint64(r.base), uint64(r.size), E820_RESERVED})
+		}
+	}
+	l = append(l, x86emu_int15.extra...)
+
+	var edges []uint64
+	for _, e := range l {
+		if e.size != 0 {
+			edges = append(edges, e.base, e.base+e.size)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i] < edges[j] })
+	var m []X86EMU_e820Entry
+	for i := 0; i+1 < len(edges); i++ {
+		start, end := edges[i], edges[i+1]
+		if start == end {
+			continue
+		}
+		typ := uint32(0)
+		for _, e := range l {
+			if e.base <= start && end <= e.base+e.size {
+				typ = e.typ
+			}
+		}
+		if typ == 0 {
+			continue
+		}
+		if n := len(m); n > 0 && m[n-1].typ == typ && m[n-1].base+m[n-1].size == start {
+			m[n-1].size += end - start
+		} else {
+			m = append(m, X86EMU_e820Entry{start, end - start, typ})
+		}
+	}
+	return m
+}
+
+/* KB of RAM from 1M up to limit. */
+func x86emu_ext_memory(limit uint32) uint32 {
+	top := M().mem_size
+	if top > limit {
+		top = limit
+	}
+	if top <= 0x100000 {
+		return 0
+	}
+	return (top - 0x100000) >> 10
+}
+
+func x86emu_int15_service() {
+	r := &M().x86
+	for i := len(x86emu_int15.hooks) - 1; i >= 0; i-- {
+		if x86emu_int15.hooks[i]() {
+			return
+		}
+	}
+	if DEBUG_SVC() {
+		fmt.Printf("int15: ax=%04x bx=%04x cx=%04x dx=%04x\n",
+			r.gen.A.Get16(), r.gen.B.Get16(), r.gen.C.Get16(), r.gen.D.Get16())
+	}
+
+	switch r.gen.A.Get16() {
+	case 0xe820:
+		x86emu_int15_e820()
+		return
+	case 0xe801:
+		ext1 := x86emu_ext_memory(16 << 20)
+		ext2 := uint32(0)
+		if M().mem_size > 16<<20 {
+			ext2 = (M().mem_size - 16<<20) >> 16
+		}
+		r.gen.A.Set16(uint16(ext1))
+		r.gen.B.Set16(uint16(ext2))
+		r.gen.C.Set16(uint16(ext1))
+		r.gen.D.Set16(uint16(ext2))
+		CLEAR_FLAG(F_CF)
+		return
+	case 0x2400, 0x2401:
+		X86EMU_setA20(r.gen.A.Get8l() == 0x01)
+		x86emu_bios_status(0)
+		return
+	case 0x2402:
+		x86emu_bios_status(0)
+		if x86emu_a20_enabled() {
+			r.gen.A.Setl8(1)
+		} else {
+			r.gen.A.Setl8(0)
+		}
+		return
+	case 0x2403:
+		x86emu_bios_status(0)
+		r.gen.B.Set16(0x0002) /* port 0x92 only, there is no keyboard controller */
+		return
+	}
+
+	switch r.gen.A.Get8h() {
+	case 0x86:
+		us := uint64(r.gen.C.Get16())<<16 | uint64(r.gen.D.Get16())
+		x86emu_clock_wait(us * 1000)
+		x86emu_bios_status(0)
+	case 0x88:
+		/* capped at 63M like most BIOSes, for programs that add it to 1M in 16 bits */
+		kb := x86emu_ext_memory(0xffffffff)
+		if kb > 0xfc00 {
+			kb = 0xfc00
+		}
+		r.gen.A.Set16(uint16(kb))
+		CLEAR_FLAG(F_CF)
+	default:
+		if DEBUG_SVC() {
+			fmt.Printf("int15: function %04x not supported\n", r.gen.A.Get16())
+		}
+		x86emu_bios_status(BIOS_UNSUPPORTED)
+	}
+}
+
+// REMARKS:
+// Copies the entry EBX names to ES:DI.  A 24 byte buffer gets the ACPI
+// 3.0 extended attributes too.
+func x86emu_int15_e820() {
+	r := &M().x86
+	m := X86EMU_e820Map()
+	idx, size := r.gen.B.Get32(), r.gen.C.Get32()
+	if r.gen.D.Get32() != E820_SMAP || size < 20 || idx >= uint32(len(m)) {
+		x86emu_bios_status(BIOS_UNSUPPORTED)
+		return
+	}
+	e := m[idx]
+	buf := uint32(r.seg.ES.Get())<<4 + uint32(r.spc.DI.Get16())
+	x86emu_phys_write(buf, 4, uint32(e.base))
+	x86emu_phys_write(buf+4, 4, uint32(e.base>>32))
+	x86emu_phys_write(buf+8, 4, uint32(e.size))
+	x86emu_phys_write(buf+12, 4, uint32(e.size>>32))
+	x86emu_phys_write(buf+16, 4, e.typ)
+	if size >= 24 {
+		x86emu_phys_write(buf+20, 4, 1) /* enabled */
+		size = 24
+	} else {
+		size = 20
+	}
+	if idx++; idx == uint32(len(m)) {
+		idx = 0
+	}
+	r.gen.A.Set32(E820_SMAP)
+	r.gen.B.Set32(idx)
+	r.gen.C.Set32(size)
+	CLEAR_FLAG(F_CF)
+}
+
+/* Answers to the Intel video BIOS 5Fxxh hooks */
+type X86EMU_intelVbios struct {
+	boot_display uint16 /* 5F35h: 0 lets the VBT decide */
+	panel_fit    uint8  /* 5F34h */
+	panel_type   uint8  /* 5F40h */
+}
+
+// REMARKS:
+// Hooks int 15h with the 5F34h/5F35h/5F40h answers Intel video BIOSes ask
+// the system BIOS for during init; they report success as AX=005Fh.
+func X86EMU_hookIntelVbios(v X86EMU_intelVbios) {
+	X86EMU_hookInt15(func() bool {
+		r := &M().x86
+		switch r.gen.A.Get16() {
+		case 0x5f34:
+			r.gen.C.Setl8(v.panel_fit)
+		case 0x5f35:
+			r.gen.C.Set16(v.boot_display)
+		case 0x5f40:
+			r.gen.C.Setl8(v.panel_type)
+		default:
+			return false
+		}
+		if DEBUG_SVC() {
+			fmt.Printf("int15: intel vbios hook %04x cx=%04x\n", r.gen.A.Get16(), r.gen.C.Get16())
+		}
+		r.gen.A.Set16(0x005f)
+		CLEAR_FLAG(F_CF)
+		return true
+	})
+}
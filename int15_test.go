@@ -0,0 +1,281 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Sets the BIOS up on a machine with mem bytes of RAM and the ranges in
+// extra added to the E820 map.
+func x86emu_test_e820(t *testing.T, mem uint32, extra []X86EMU_e820Entry) {
+	t.Helper()
+	x86emu_test_machine(t)
+	X86EMU_setMemBase(make([]byte, mem))
+	x86emu_test_setup_bios(t)
+	if err := X86EMU_setupSystemBios(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range extra {
+		X86EMU_addE820(e.base, e.size, e.typ)
+	}
+}
+
+func TestE820Map(t *testing.T) {
+	low := []X86EMU_e820Entry{
+		{0, 0x9fc00, E820_RAM},
+		{0x9fc00, 0x400, E820_RESERVED},
+		{0xf0000, 0x10000, E820_RESERVED},
+	}
+	for _, tc := range []struct {
+		name  string
+		mem   uint32
+		extra []X86EMU_e820Entry
+		want  []X86EMU_e820Entry
+	}{
+		{"1M", 0x100000, nil, low},
+		{"16M", 0x1000000, nil,
+			append(low[:3:3], X86EMU_e820Entry{0x100000, 0xf00000, E820_RAM})},
+		{"512K", 0x80000, nil, []X86EMU_e820Entry{
+			{0, 0x7fc00, E820_RAM},
+			{0x7fc00, 0x20400, E820_RESERVED},
+			{0xf0000, 0x10000, E820_RESERVED},
+		}},
+		{"ACPI at the top", 0x1000000, []X86EMU_e820Entry{{0xff0000, 0x10000, E820_ACPI}},
+			append(low[:3:3],
+				X86EMU_e820Entry{0x100000, 0xef0000, E820_RAM},
+				X86EMU_e820Entry{0xff0000, 0x10000, E820_ACPI})},
+		{"reserved next to the EBDA merges", 0x100000,
+			[]X86EMU_e820Entry{{0x9f000, 0x1000, E820_RESERVED}}, []X86EMU_e820Entry{
+				{0, 0x9f000, E820_RAM},
+				{0x9f000, 0x1000, E820_RESERVED},
+				{0xf0000, 0x10000, E820_RESERVED},
+			}},
+		{"last added wins", 0x1000000, []X86EMU_e820Entry{
+			{0x200000, 0x100000, E820_RESERVED},
+			{0x280000, 0x10000, E820_NVS},
+		}, append(low[:3:3],
+			X86EMU_e820Entry{0x100000, 0x100000, E820_RAM},
+			X86EMU_e820Entry{0x200000, 0x80000, E820_RESERVED},
+			X86EMU_e820Entry{0x280000, 0x10000, E820_NVS},
+			X86EMU_e820Entry{0x290000, 0x70000, E820_RESERVED},
+			X86EMU_e820Entry{0x300000, 0xd00000, E820_RAM})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, tc.mem, tc.extra)
+			if m := X86EMU_e820Map(); !reflect.DeepEqual(m, tc.want) {
+				t.Errorf("map %v, want %v", m, tc.want)
+			}
+		})
+	}
+}
+
+func TestInt15E820(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		edx        uint32
+		ebx, ecx   uint32
+		fail       bool
+		next, size uint32 /* EBX and ECX returned */
+	}{
+		{"first entry", E820_SMAP, 0, 20, false, 1, 20},
+		{"acpi 3.0 buffer", E820_SMAP, 1, 24, false, 2, 24},
+		{"large buffer", E820_SMAP, 2, 64, false, 3, 24},
+		{"last entry wraps to 0", E820_SMAP, 3, 20, false, 0, 20},
+		{"past the end", E820_SMAP, 4, 20, true, 0, 0},
+		{"small buffer", E820_SMAP, 0, 16, true, 0, 0},
+		{"no signature", 0, 0, 20, true, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, 0x1000000, nil)
+			m := X86EMU_e820Map()
+			r := &M().x86
+			x86emu_phys_copy_in(0x2000, make([]byte, 32))
+			r.gen.A.Set32(0xe820)
+			r.gen.B.Set32(tc.ebx)
+			r.gen.C.Set32(tc.ecx)
+			r.gen.D.Set32(tc.edx)
+			x86emu_load_seg(SEG_ES, 0x200)
+			r.spc.DI.Set16(0)
+			x86emu_test_int(t, 0x15)
+			if tc.fail {
+				if ah := r.gen.A.Get8h(); !ACCESS_FLAG(F_CF) || ah != BIOS_UNSUPPORTED {
+					t.Errorf("ah %02x, cf %v; want %02x, set", ah, ACCESS_FLAG(F_CF), BIOS_UNSUPPORTED)
+				}
+				return
+			}
+			if ACCESS_FLAG(F_CF) || r.gen.A.Get32() != E820_SMAP {
+				t.Fatalf("eax %08x, cf %v", r.gen.A.Get32(), ACCESS_FLAG(F_CF))
+			}
+			if r.gen.B.Get32() != tc.next || r.gen.C.Get32() != tc.size {
+				t.Errorf("ebx %d, ecx %d; want %d, %d", r.gen.B.Get32(), r.gen.C.Get32(), tc.next, tc.size)
+			}
+			e := m[tc.ebx]
+			got := X86EMU_e820Entry{
+				uint64(x86emu_phys_read(0x2000, 4)) | uint64(x86emu_phys_read(0x2004, 4))<<32,
+				uint64(x86emu_phys_read(0x2008, 4)) | uint64(x86emu_phys_read(0x200c, 4))<<32,
+				x86emu_phys_read(0x2010, 4),
+			}
+			if got != e {
+				t.Errorf("entry %v, want %v", got, e)
+			}
+			attr := uint32(0)
+			if tc.size == 24 {
+				attr = 1
+			}
+			if a := x86emu_phys_read(0x2014, 4); a != attr {
+				t.Errorf("extended attributes %x, want %x", a, attr)
+			}
+		})
+	}
+}
+
+func TestInt15ExtMemory(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		mem   uint32
+		e801  [2]uint16 /* AX and BX of E801h */
+		ext88 uint16
+	}{
+		{"1M", 0x100000, [2]uint16{0, 0}, 0},
+		{"16M", 0x1000000, [2]uint16{0x3c00, 0}, 0x3c00},
+		{"64M", 0x4000000, [2]uint16{0x3c00, 0x300}, 0xfc00},
+		{"128M caps 88h", 0x8000000, [2]uint16{0x3c00, 0x700}, 0xfc00},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, tc.mem, nil)
+			r := &M().x86
+			r.gen.A.Set16(0xe801)
+			x86emu_test_int(t, 0x15)
+			if ACCESS_FLAG(F_CF) {
+				t.Fatalf("e801h failed")
+			}
+			e801 := [2]uint16{r.gen.A.Get16(), r.gen.B.Get16()}
+			if e801 != tc.e801 || r.gen.C.Get16() != e801[0] || r.gen.D.Get16() != e801[1] {
+				t.Errorf("e801h ax %04x bx %04x cx %04x dx %04x, want %04x",
+					e801[0], e801[1], r.gen.C.Get16(), r.gen.D.Get16(), tc.e801)
+			}
+			r.gen.A.Set16(0x8800)
+			x86emu_test_int(t, 0x15)
+			if ax := r.gen.A.Get16(); ACCESS_FLAG(F_CF) || ax != tc.ext88 {
+				t.Errorf("88h ax %04x cf %v, want %04x", ax, ACCESS_FLAG(F_CF), tc.ext88)
+			}
+		})
+	}
+}
+
+func TestInt15A20(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  func()
+		on   bool
+	}{
+		{"2401h opens", func() { M().x86.gen.A.Set16(0x2401); x86emu_test_int(t, 0x15) }, true},
+		{"2400h closes", func() { M().x86.gen.A.Set16(0x2400); x86emu_test_int(t, 0x15) }, false},
+		{"port 92 opens", func() { sys_outb(0x92, PORT92_A20) }, true},
+		{"port 92 closes", func() { sys_outb(0x92, 0) }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, 0x200000, nil)
+			X86EMU_setA20(!tc.on)
+			sys_wrl(0x2000, 0x11111111)
+			sys_wrl(0x102000, 0x22222222)
+			tc.set()
+
+			r := &M().x86
+			r.gen.A.Set16(0x2402)
+			x86emu_test_int(t, 0x15)
+			want := uint8(0)
+			if tc.on {
+				want = 1
+			}
+			if al := r.gen.A.Get8l(); ACCESS_FLAG(F_CF) || al != want {
+				t.Errorf("2402h al %d cf %v, want %d", al, ACCESS_FLAG(F_CF), want)
+			}
+			if p := sys_inb(0x92); p&PORT92_A20 != want<<1 {
+				t.Errorf("port 92 reads %02x", p)
+			}
+			/* FFFF:2010 is 102000 with the gate open, 2000 with it closed */
+			val := uint32(0x11111111)
+			if tc.on {
+				val = 0x22222222
+			}
+			if got := x86emu_phys_read(0xffff0+0x2010, 4); got != val {
+				t.Errorf("ffff:2010 reads %08x, want %08x", got, val)
+			}
+
+			r.gen.A.Set16(0x2403)
+			x86emu_test_int(t, 0x15)
+			if bx := r.gen.B.Get16(); ACCESS_FLAG(F_CF) || bx != 0x0002 {
+				t.Errorf("2403h bx %04x cf %v", bx, ACCESS_FLAG(F_CF))
+			}
+		})
+	}
+}
+
+func TestInt15Wait(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cx, dx uint16
+		us     uint64
+	}{
+		{"none", 0, 0, 0},
+		{"1 ms", 0, 1000, 1000},
+		{"100 ms", 0x0001, 0x86a0, 100000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, 0x100000, nil)
+			r := &M().x86
+			r.gen.A.Set16(0x8600)
+			r.gen.C.Set16(tc.cx)
+			r.gen.D.Set16(tc.dx)
+			start := x86emu_clock_ns()
+			x86emu_test_int(t, 0x15)
+			if ACCESS_FLAG(F_CF) {
+				t.Fatalf("86h failed, ah %02x", r.gen.A.Get8h())
+			}
+			/* give or take the INT and IRET */
+			if d := x86emu_clock_ns() - start; d < tc.us*1000 || d > tc.us*1000+10000 {
+				t.Errorf("waited %d ns, want %d us", d, tc.us)
+			}
+		})
+	}
+}
+
+func TestInt15IntelVbios(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		ax    uint16
+		reset bool /* set the system BIOS up again after hooking */
+		cx    uint16
+		fail  bool
+	}{
+		{"5f34h panel fit", 0x5f34, false, 0x0002, false},
+		{"5f35h boot display", 0x5f35, false, 0x0003, false},
+		{"5f40h panel type", 0x5f40, false, 0x0005, false},
+		{"other 5fxxh", 0x5f14, false, 0, true},
+		{"setup drops the hook", 0x5f40, true, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_e820(t, 0x100000, nil)
+			X86EMU_hookIntelVbios(X86EMU_intelVbios{boot_display: 3, panel_fit: 2, panel_type: 5})
+			if tc.reset {
+				if err := X86EMU_setupSystemBios(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := &M().x86
+			r.gen.A.Set16(tc.ax)
+			r.gen.C.Set16(0)
+			x86emu_test_int(t, 0x15)
+			if tc.fail {
+				if ah := r.gen.A.Get8h(); !ACCESS_FLAG(F_CF) || ah != BIOS_UNSUPPORTED {
+					t.Errorf("ah %02x, cf %v; want %02x, set", ah, ACCESS_FLAG(F_CF), BIOS_UNSUPPORTED)
+				}
+				return
+			}
+			if ax, cx := r.gen.A.Get16(), r.gen.C.Get16(); ACCESS_FLAG(F_CF) || ax != 0x005f || cx != tc.cx {
+				t.Errorf("ax %04x cx %04x cf %v, want 005f %04x", ax, cx, ACCESS_FLAG(F_CF), tc.cx)
+			}
+		})
+	}
+}
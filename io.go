@@ -0,0 +1,112 @@
+package main
+
+import "fmt"
+
+/*
+ * I/O port space.
+ *
+ * IN and OUT go through sys_in* and sys_out*, which dispatch to the device
+ * model that claimed the port.  Unclaimed ports read as all ones, as on an
+ * ISA bus with nothing driving it, and writes to them are dropped.
+ */
+
+/* Go callbacks for a range of ports; size is 1, 2 or 4 bytes. */
+type X86EMU_portRead func(port uint16, size int) uint32
+type X86EMU_portWrite func(port uint16, size int, val uint32)
+
+type x86emu_port struct {
+	name string
+	rd   X86EMU_portRead
+	wr   X86EMU_portWrite
+}
+
+var x86emu_ports = make(map[uint16]*x86emu_port)
+
+// PARAMETERS:
+// first - First port of the range
+// count - Number of ports
+// name  - Device name used in traces
+// rd    - Called for IN from the range; nil reads as all ones
+// wr    - Called for OUT to the range; nil drops the write
+//
+// REMARKS:
+// Claims a range of I/O ports for a device model, replacing whatever
+// claimed them before.  Passing nil for both releases the range.
+func X86EMU_setupPorts(first uint16, count int, name string, rd X86EMU_portRead, wr X86EMU_portWrite) {
+	for i := 0; i < count; i++ {
+		port := first + uint16(i)
+		if rd == nil && wr == nil {
+			delete(x86emu_ports, port)
+			continue
+		}
+		x86emu_ports[port] = &x86emu_port{name: name, rd: rd, wr: wr}
+	}
+}
+
+func x86emu_port_name(port uint16) string {
+	if p := x86emu_ports[port]; p != nil {
+		return p.name
+	}
+	return "unclaimed"
+}
+
+var x86emu_io_suffix = map[int]string{1: "b", 2: "w", 4: "l"}
+
+func x86emu_port_in(port uint16, size int) uint32 {
+	val := ^uint32(0) >> (32 - 8*uint(size))
+	if p := x86emu_ports[port]; p != nil && p.rd != nil {
+		val = p.rd(port, size) & val
+	}
+	if DEBUG_IO_TRACE() {
+		fmt.Printf("in%s %#04x (%s) -> %#x\n", x86emu_io_suffix[size], port, x86emu_port_name(port), val)
+	}
+	return val
+}
+
+func x86emu_port_out(port uint16, size int, val uint32) {
+	if DEBUG_IO_TRACE() {
+		fmt.Printf("out%s %#x -> %#04x (%s)\n", x86emu_io_suffix[size], val, port, x86emu_port_name(port))
+	}
+	if p := x86emu_ports[port]; p != nil && p.wr != nil {
+		p.wr(port, size, val)
+	}
+}
+
+func sys_inb(addr uint16) uint8 {
+	return uint8(x86emu_port_in(addr, 1))
+}
+
+func sys_inw(addr uint16) uint16 {
+	return uint16(x86emu_port_in(addr, 2))
+}
+
+func sys_inl(addr uint16) uint32 {
+	return x86emu_port_in(addr, 4)
+}
+
+func sys_outb(addr uint16, val uint8) {
+	x86emu_port_out(addr, 1, uint32(val))
+}
+
+func sys_outw(addr uint16, val uint16) {
+	x86emu_port_out(addr, 2, uint32(val))
+}
+
+func sys_outl(addr uint16, val uint32) {
+	x86emu_port_out(addr, 4, val)
+}
+
+/* ACPI power management timer: a 24-bit counter at 3.579545 MHz. */
+const PM_TIMER_HZ = 3579545
+
+// PARAMETERS:
+// port - PM_TMR port, as given in the FADT (PMBASE + 8 on Intel chipsets)
+//
+// REMARKS:
+// Adds an ACPI PM timer driven by the virtual clock.
+func X86EMU_setupPmTimer(port uint16) {
+	X86EMU_setupPorts(port, 4, "pmtimer", func(p uint16, size int) uint32 {
+		val := uint32(x86emu_clock_count(PM_TIMER_HZ)) & 0xffffff
+		return val >> (8 * (p - port))
+	}, nil)
+}
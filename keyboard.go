@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Int 16h keyboard services fed from a key script.
+ *
+ * Keystrokes go through the usual ring buffer in the BIOS data area, so
+ * guest code that peeks at it directly sees them too.  There is no
+ * keyboard controller and no IRQ 1; keys are moved from the script into
+ * the buffer whenever the guest asks int 16h for one.
+ *
+ * A script has one step per line, # starting a comment:
+ *
+ *	key Ctrl-S             named keys, one or more: Enter, Esc, F1, Alt-X,
+ *	key Down Down Enter    Shift-Tab, ... or a scancode:ASCII word, 0x1c0d
+ *	type "password\n"      text, as a Go string literal
+ *	delay 500ms            virtual time before the next key is available
+ *	wait "RAID Setup" 30s  until the text is on screen, with a timeout
+ *
+ * A guest that blocks on a key when the script is done, or while the
+ * script waits for text the guest cannot draw while blocked, halts the
+ * emulator; X86EMU_keyScriptError says why.
+ */
+
+const (
+	BDA_KBD_FLAGS     = 0x417
+	BDA_KBD_HEAD      = 0x41a
+	BDA_KBD_TAIL      = 0x41c
+	BDA_KBD_BUF       = 0x41e
+	BDA_KBD_BUF_START = 0x480
+	BDA_KBD_BUF_END   = 0x482
+	BDA_KBD_STATUS    = 0x496
+
+	KBD_BUF_SIZE = 32
+)
+
+const (
+	KEY_STEP_KEYS = iota
+	KEY_STEP_DELAY
+	KEY_STEP_WAIT
+)
+
+type x86emu_key_step struct {
+	kind int
+	line int
+	keys []uint16 /* scancode << 8 | ASCII */
+	ns   uint64   /* delay, or wait timeout (0 for none) */
+	text string   /* wait */
+}
+
+var x86emu_kbd struct {
+	path  string
+	steps []*x86emu_key_step
+	until uint64 /* end of the current delay or wait, ns of virtual time */
+	armed bool   /* until is set for the current step */
+	err   error
+}
+
+/* Named keys, with the Shift, Ctrl and Alt variants where they differ */
+var x86emu_key_names = map[string]uint16{
+	"Enter": 0x1c0d, "Esc": 0x011b, "Backspace": 0x0e08, "Tab": 0x0f09,
+	"Space": 0x3920, "Shift-Tab": 0x0f00, "Ctrl-Enter": 0x1c0a,
+	"Up": 0x4800, "Down": 0x5000, "Left": 0x4b00, "Right": 0x4d00,
+	"Home": 0x4700, "End": 0x4f00, "PgUp": 0x4900, "PgDn": 0x5100,
+	"Ins": 0x5200, "Del": 0x5300,
+	"F11": 0x8500, "F12": 0x8600, "Shift-F11": 0x8700, "Shift-F12": 0x8800,
+	"Ctrl-F11": 0x8900, "Ctrl-F12": 0x8a00, "Alt-F11": 0x8b00, "Alt-F12": 0x8c00,
+}
+
+/* US layout: characters in scancode order, unshifted and shifted */
+var x86emu_key_rows = []struct {
+	scan           uint8
+	lower, shifted string
+}{
+	{0x02, "1234567890-=", "!@#$%^&*()_+"},
+	{0x10, "qwertyuiop[]", "QWERTYUIOP{}"},
+	{0x1e, "asdfghjkl;'`", "ASDFGHJKL:\"~"},
+	{0x2b, "\\zxcvbnm,./", "|ZXCVBNM<>?"},
+}
+
+func init() {
+	for i := 0; i < 10; i++ {
+		f := fmt.Sprintf("F%d", i+1)
+		x86emu_key_names[f] = uint16(0x3b+i) << 8
+		x86emu_key_names["Shift-"+f] = uint16(0x54+i) << 8
+		x86emu_key_names["Ctrl-"+f] = uint16(0x5e+i) << 8
+		x86emu_key_names["Alt-"+f] = uint16(0x68+i) << 8
+	}
+	for _, row := range x86emu_key_rows {
+		for i := 0; i < len(row.lower); i++ {
+			scan := uint16(row.scan) + uint16(i)
+			c := row.lower[i]
+			if c >= 'a' && c <= 'z' {
+				upper := string(c - 'a' + 'A')
+				x86emu_key_names["Ctrl-"+upper] = scan<<8 | uint16(c-'a'+1)
+				x86emu_key_names["Alt-"+upper] = scan << 8
+			}
+			if c >= '0' && c <= '9' {
+				x86emu_key_names["Alt-"+string(c)] = (scan + 0x76) << 8
+			}
+		}
+	}
+}
+
+/* Key word for an ASCII character, or 0. */
+func x86emu_key_char(c byte) uint16 {
+	switch c {
+	case ' ':
+		return 0x3920
+	case '\n', '\r':
+		return 0x1c0d
+	case '\t':
+		return 0x0f09
+	case '\b':
+		return 0x0e08
+	case 0x1b:
+		return 0x011b
+	}
+	for _, row := range x86emu_key_rows {
+		if i := strings.IndexByte(row.lower, c); i >= 0 {
+			return uint16(int(row.scan)+i)<<8 | uint16(c)
+		}
+		if i := strings.IndexByte(row.shifted, c); i >= 0 {
+			return uint16(int(row.scan)+i)<<8 | uint16(c)
+		}
+	}
+	return 0
+}
+
+/* Splits a script line into words and Go string literals. */
+func x86emu_key_fields(line string) ([]string, error) {
+	var f []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == '#' {
+			return f, nil
+		}
+		if line[0] == '"' {
+			q, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			f = append(f, q)
+			line = line[len(q):]
+			continue
+		}
+		n := strings.IndexAny(line, " \t")
+		if n < 0 {
+			n = len(line)
+		}
+		f = append(f, line[:n])
+		line = line[n:]
+	}
+}
+
+func x86emu_key_duration(s string) (uint64, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return uint64(d), nil
+}
+
+func x86emu_key_parse(f []string) (*x86emu_key_step, error) {
+	s := &x86emu_key_step{}
+	switch f[0] {
+	case "key":
+		if len(f) < 2 {
+			return nil, fmt.Errorf("key needs a key name")
+		}
+		for _, name := range f[1:] {
+			k, ok := x86emu_key_names[name]
+			if !ok && len(name) == 1 {
+				k = x86emu_key_char(name[0])
+				ok = k != 0
+			}
+			if !ok {
+				v, err := strconv.ParseUint(name, 0, 16)
+				if err != nil || !strings.HasPrefix(name, "0x") {
+					return nil, fmt.Errorf("unknown key %q", name)
+				}
+				k = uint16(v)
+			}
+			s.keys = append(s.keys, k)
+		}
+	case "type":
+		if len(f) != 2 || f[1][0] != '"' {
+			return nil, fmt.Errorf("type needs a quoted string")
+		}
+		text, _ := strconv.Unquote(f[1])
+		for i := 0; i < len(text); i++ {
+			k := x86emu_key_char(text[i])
+			if k == 0 {
+				return nil, fmt.Errorf("no key types %q", text[i])
+			}
+			s.keys = append(s.keys, k)
+		}
+	case "delay":
+		if len(f) != 2 {
+			return nil, fmt.Errorf("delay needs a duration")
+		}
+		ns, err := x86emu_key_duration(f[1])
+		if err != nil {
+			return nil, err
+		}
+		s.kind, s.ns = KEY_STEP_DELAY, ns
+	case "wait":
+		if len(f) < 2 || len(f) > 3 || f[1][0] != '"' {
+			return nil, fmt.Errorf("wait needs a quoted string and an optional timeout")
+		}
+		s.kind = KEY_STEP_WAIT
+		s.text, _ = strconv.Unquote(f[1])
+		if len(f) == 3 {
+			ns, err := x86emu_key_duration(f[2])
+			if err != nil {
+				return nil, err
+			}
+			s.ns = ns
+		}
+	default:
+		return nil, fmt.Errorf("unknown step %q", f[0])
+	}
+	return s, nil
+}
+
+// PARAMETERS:
+// path - Key script
+//
+// REMARKS:
+// Replaces the script int 16h reads keys from.
+func X86EMU_loadKeyScript(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var steps []*x86emu_key_step
+	for n, line := range strings.Split(string(data), "\n") {
+		f, err := x86emu_key_fields(line)
+		if err == nil && len(f) == 0 {
+			continue
+		}
+		var s *x86emu_key_step
+		if err == nil {
+			s, err = x86emu_key_parse(f)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n+1, err)
+		}
+		s.line = n + 1
+		steps = append(steps, s)
+	}
+	k := &x86emu_kbd
+	k.path, k.steps, k.armed, k.err = path, steps, false, nil
+	return nil
+}
+
+// RETURNS:
+// Why the guest was halted waiting for a key, or nil.
+func X86EMU_keyScriptError() error {
+	return x86emu_kbd.err
+}
+
+/* Whether every step of the script has been fed to the guest. */
+func X86EMU_keyScriptDone() bool {
+	return len(x86emu_kbd.steps) == 0
+}
+
+// REMARKS:
+// Sets up an empty keyboard buffer in the BIOS data area and installs
+// the int 16h vector.
+func X86EMU_setupKeyboardBios() error {
+	x86emu_phys_write(BDA_KBD_BUF_START, 2, BDA_KBD_BUF-0x400)
+	x86emu_phys_write(BDA_KBD_BUF_END, 2, BDA_KBD_BUF+KBD_BUF_SIZE-0x400)
+	x86emu_phys_write(BDA_KBD_HEAD, 2, BDA_KBD_BUF-0x400)
+	x86emu_phys_write(BDA_KBD_TAIL, 2, BDA_KBD_BUF-0x400)
+	x86emu_phys_write(BDA_KBD_STATUS, 1, 0x10) /* enhanced keyboard */
+	_, err := X86EMU_setupBiosVector(0x16, "int16", x86emu_int16)
+	return err
+}
+
+/* Buffer bounds as offsets from segment 40h */
+func x86emu_kbd_bounds() (uint32, uint32) {
+	start := x86emu_phys_read(BDA_KBD_BUF_START, 2)
+	end := x86emu_phys_read(BDA_KBD_BUF_END, 2)
+	if start == 0 || end <= start {
+		start, end = BDA_KBD_BUF-0x400, BDA_KBD_BUF+KBD_BUF_SIZE-0x400
+	}
+	return start, end
+}
+
+// RETURNS:
+// Whether there was room for the key.
+func x86emu_kbd_put(key uint16) bool {
+	start, end := x86emu_kbd_bounds()
+	head, tail := x86emu_phys_read(BDA_KBD_HEAD, 2), x86emu_phys_read(BDA_KBD_TAIL, 2)
+	next := tail + 2
+	if next >= end {
+		next = start
+	}
+	if next == head {
+		return false
+	}
+	x86emu_phys_write(0x400+tail, 2, uint32(key))
+	x86emu_phys_write(BDA_KBD_TAIL, 2, next)
+	return true
+}
+
+/* The key at the head of the buffer, removed if remove is set. */
+func x86emu_kbd_get(remove bool) (uint16, bool) {
+	start, end := x86emu_kbd_bounds()
+	head, tail := x86emu_phys_read(BDA_KBD_HEAD, 2), x86emu_phys_read(BDA_KBD_TAIL, 2)
+	if head == tail {
+		return 0, false
+	}
+	key := uint16(x86emu_phys_read(0x400+head, 2))
+	if remove {
+		if head += 2; head >= end {
+			head = start
+		}
+		x86emu_phys_write(BDA_KBD_HEAD, 2, head)
+	}
+	return key, true
+}
+
+/* True when the text is anywhere on the screen. */
+func x86emu_screen_has(text string) bool {
+	return strings.Contains(strings.Join(X86EMU_textScreen(), "\n"), text)
+}
+
+// RETURNS:
+// Whether a blocked guest could get a key by waiting: false when the
+// script is done or stuck on text that is not on the screen.
+//
+// REMARKS:
+// Moves keys from the script into the buffer as far as delays and waits
+// allow.  With block set, delays are waited out.
+func x86emu_kbd_feed(block bool) bool {
+	k := &x86emu_kbd
+	for len(k.steps) > 0 {
+		s := k.steps[0]
+		now := x86emu_clock_ns()
+		switch s.kind {
+		case KEY_STEP_KEYS:
+			for len(s.keys) > 0 && x86emu_kbd_put(s.keys[0]) {
+				s.keys = s.keys[1:]
+			}
+			if len(s.keys) > 0 {
+				return true
+			}
+		case KEY_STEP_DELAY:
+			if !k.armed {
+				k.until, k.armed = now+s.ns, true
+			}
+			if now < k.until {
+				if !block {
+					return true
+				}
+				x86emu_clock_wait(k.until - now)
+			}
+		case KEY_STEP_WAIT:
+			if !k.armed {
+				k.until, k.armed = now+s.ns, true
+			}
+			if !x86emu_screen_has(s.text) {
+				if s.ns != 0 && now >= k.until {
+					k.err = fmt.Errorf("%s:%d: %q did not show within %v", k.path, s.line, s.text, time.Duration(s.ns))
+					HALT_SYS()
+					return false
+				}
+				if block {
+					k.err = fmt.Errorf("%s:%d: waiting for %q, but the guest is waiting for a key", k.path, s.line, s.text)
+					return false
+				}
+				return true
+			}
+			if DEBUG_SVC() {
+				fmt.Printf("int16: %s:%d: found %q\n", k.path, s.line, s.text)
+			}
+		}
+		k.steps, k.armed = k.steps[1:], false
+	}
+	return false
+}
+
+/* Strips the E0h of extended keys for the AH=00h/01h interface. */
+func x86emu_kbd_compat(key uint16) uint16 {
+	if key&0xff == 0xe0 && key>>8 != 0 {
+		return key &^ 0xff
+	}
+	return key
+}
+
+func x86emu_int16() {
+	r := &M().x86
+	ah := r.gen.A.Get8h()
+	switch ah {
+	case 0x00, 0x10: /* read key */
+		x86emu_kbd_feed(false)
+		key, ok := x86emu_kbd_get(true)
+		for !ok {
+			more := x86emu_kbd_feed(true)
+			if key, ok = x86emu_kbd_get(true); !ok && !more {
+				if x86emu_kbd.err == nil {
+					x86emu_kbd.err = fmt.Errorf("guest waits for a key after the end of the key script")
+				}
+				if DEBUG_SVC() {
+					fmt.Printf("int16: %v\n", x86emu_kbd.err)
+				}
+				HALT_SYS()
+				return
+			}
+		}
+		if ah == 0x00 {
+			key = x86emu_kbd_compat(key)
+		}
+		if DEBUG_SVC() {
+			fmt.Printf("int16: key %04x\n", key)
+		}
+		r.gen.A.Set16(key)
+
+	case 0x01, 0x11: /* key available */
+		x86emu_kbd_feed(false)
+		key, ok := x86emu_kbd_get(false)
+		if !ok {
+			SET_FLAG(F_ZF)
+			break
+		}
+		if ah == 0x01 {
+			key = x86emu_kbd_compat(key)
+		}
+		CLEAR_FLAG(F_ZF)
+		r.gen.A.Set16(key)
+
+	case 0x02: /* shift flags */
+		r.gen.A.Setl8(uint8(x86emu_phys_read(BDA_KBD_FLAGS, 1)))
+	case 0x12:
+		r.gen.A.Setl8(uint8(x86emu_phys_read(BDA_KBD_FLAGS, 1)))
+		r.gen.A.Seth8(uint8(x86emu_phys_read(BDA_KBD_FLAGS+1, 1)))
+
+	case 0x03: /* typematic rate, nothing to do */
+
+	case 0x05: /* store key */
+		if x86emu_kbd_put(r.gen.C.Get16()) {
+			r.gen.A.Setl8(0)
+		} else {
+			r.gen.A.Setl8(1)
+		}
+
+	case 0x09: /* capabilities */
+		r.gen.A.Setl8(0x20) /* AH=10h-12h */
+
+	case 0x0a: /* keyboard ID */
+		r.gen.B.Set16(0x41ab) /* MF2 */
+
+	default:
+		if DEBUG_SVC() {
+			fmt.Printf("int16: function %02x not supported\n", ah)
+		}
+	}
+}
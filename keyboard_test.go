@@ -0,0 +1,258 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKeyScriptParse(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want *x86emu_key_step /* nil for a blank line */
+		err  bool
+	}{
+		{"", nil, false},
+		{"   # comment", nil, false},
+		{"key Enter", &x86emu_key_step{keys: []uint16{0x1c0d}}, false},
+		{"key Down Down Enter # menu", &x86emu_key_step{keys: []uint16{0x5000, 0x5000, 0x1c0d}}, false},
+		{"key Ctrl-S Alt-X F1 Shift-F2", &x86emu_key_step{keys: []uint16{0x1f13, 0x2d00, 0x3b00, 0x5500}}, false},
+		{"key Alt-1 Ctrl-F12", &x86emu_key_step{keys: []uint16{0x7800, 0x8a00}}, false},
+		{"key y Y ?", &x86emu_key_step{keys: []uint16{0x1579, 0x1559, 0x353f}}, false},
+		{"key 0x1c0d", &x86emu_key_step{keys: []uint16{0x1c0d}}, false},
+		{"key", nil, true},
+		{"key Hyper-X", nil, true},
+		{"key 7181", nil, true},
+		{`type "ok\n"`, &x86emu_key_step{keys: []uint16{0x186f, 0x256b, 0x1c0d}}, false},
+		{`type "a b" # two words`, &x86emu_key_step{keys: []uint16{0x1e61, 0x3920, 0x3062}}, false},
+		{`type "\t\x1b"`, &x86emu_key_step{keys: []uint16{0x0f09, 0x011b}}, false},
+		{`type "é"`, nil, true},
+		{"type ok", nil, true},
+		{`type "open`, nil, true},
+		{"delay 500ms", &x86emu_key_step{kind: KEY_STEP_DELAY, ns: 500000000}, false},
+		{"delay 2s", &x86emu_key_step{kind: KEY_STEP_DELAY, ns: 2000000000}, false},
+		{"delay", nil, true},
+		{"delay -1s", nil, true},
+		{"delay soon", nil, true},
+		{`wait "RAID Setup" 30s`, &x86emu_key_step{kind: KEY_STEP_WAIT, text: "RAID Setup", ns: 30000000000}, false},
+		{`wait "Press F2"`, &x86emu_key_step{kind: KEY_STEP_WAIT, text: "Press F2"}, false},
+		{"wait Setup", nil, true},
+		{`wait "a" 1s 2s`, nil, true},
+		{`wait "a" never`, nil, true},
+		{"press Enter", nil, true},
+	} {
+		f, err := x86emu_key_fields(tc.line)
+		var s *x86emu_key_step
+		if err == nil && len(f) > 0 {
+			s, err = x86emu_key_parse(f)
+		}
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(s, tc.want) {
+			t.Errorf("%q: %+v, want %+v", tc.line, s, tc.want)
+		}
+	}
+}
+
+// Sets up the video and keyboard BIOS with the given key script and
+// the screen in text mode 3.
+func x86emu_test_keys(t *testing.T, script string) {
+	t.Helper()
+	x86emu_test_video(t)
+	if err := X86EMU_setupKeyboardBios(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := X86EMU_loadKeyScript(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// RETURNS:
+// Whether INT 16h with the given AH returned, rather than halting the
+// emulator.
+func x86emu_test_int16(t *testing.T, ah uint8) bool {
+	t.Helper()
+	done := false
+	x86emu_phys_copy_in(0x1000, []byte{0xcd, 0x16})
+	X86EMU_setupTrap(0x1002, "done", func() { done = true; HALT_SYS() })
+	defer X86EMU_setupTrap(0x1002, "", nil)
+	x86emu_load_cs(0, 0x1000)
+	M().x86.gen.A.Seth8(ah)
+	M().x86.intr &^= int(INTR_HALTED)
+	X86EMU_exec()
+	if sp := M().x86.spc.SP.Get16(); done && sp != 0x800 {
+		t.Fatalf("int 16h left SP at %04x", sp)
+	}
+	return done
+}
+
+func TestInt16Buffer(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		at     uint32 /* head and tail, as offsets from segment 40h */
+		n      int    /* keys stored with AH=05h */
+		low    uint8  /* ASCII byte of the keys */
+		read   uint8  /* AH=00h or 10h, peeking with the one after */
+		compat bool   /* the read drops an E0h ASCII byte */
+	}{
+		{"read and peek", 0x1e, 3, 'a', 0x00, false},
+		{"enhanced read and peek", 0x1e, 3, 'a', 0x10, false},
+		{"extended key through 00h", 0x1e, 1, 0xe0, 0x00, true},
+		{"extended key through 10h", 0x1e, 1, 0xe0, 0x10, false},
+		{"wrap at the end", 0x3a, 4, 'a', 0x10, false},
+		{"full buffer", 0x1e, 16, 'a', 0x00, false},
+		{"full buffer across the end", 0x30, 16, 'a', 0x10, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_keys(t, "")
+			x86emu_phys_write(BDA_KBD_HEAD, 2, tc.at)
+			x86emu_phys_write(BDA_KBD_TAIL, 2, tc.at)
+			r := &M().x86
+			key := func(i int) uint16 { return uint16(0x10+i)<<8 | uint16(tc.low) }
+			stored := 0
+			for i := 0; i < tc.n; i++ {
+				r.gen.C.Set16(key(i))
+				x86emu_test_int16(t, 0x05)
+				full := stored == KBD_BUF_SIZE/2-1
+				if al := r.gen.A.Get8l(); al != 0 != full {
+					t.Fatalf("storing key %d: al %d", i, al)
+				}
+				if !full {
+					stored++
+				}
+			}
+			if k := sys_rdw(0x400 + tc.at); k != key(0) {
+				t.Errorf("first key in the buffer %04x, want %04x", k, key(0))
+			}
+			for i := 0; i < stored; i++ {
+				want := key(i)
+				if tc.compat {
+					want &^= 0xff
+				}
+				x86emu_test_int16(t, tc.read+1)
+				if ax := r.gen.A.Get16(); ACCESS_FLAG(F_ZF) || ax != want {
+					t.Fatalf("peek %d: ax %04x zf %v, want %04x", i, ax, ACCESS_FLAG(F_ZF), want)
+				}
+				if !x86emu_test_int16(t, tc.read) {
+					t.Fatalf("read %d halted: %v", i, X86EMU_keyScriptError())
+				}
+				if ax := r.gen.A.Get16(); ax != want {
+					t.Fatalf("read %d: ax %04x, want %04x", i, ax, want)
+				}
+			}
+			x86emu_test_int16(t, tc.read+1)
+			if !ACCESS_FLAG(F_ZF) {
+				t.Errorf("buffer not empty after %d keys", stored)
+			}
+		})
+	}
+}
+
+func TestInt16Delay(t *testing.T) {
+	x86emu_test_keys(t, "key a\ndelay 1s\nkey b\n")
+	r := &M().x86
+	start := x86emu_clock_ns()
+	if !x86emu_test_int16(t, 0x00) || r.gen.A.Get16() != 0x1e61 {
+		t.Fatalf("first read ax %04x", r.gen.A.Get16())
+	}
+	x86emu_test_int16(t, 0x01)
+	if !ACCESS_FLAG(F_ZF) {
+		t.Errorf("key available during the delay: ax %04x", r.gen.A.Get16())
+	}
+	if d := x86emu_clock_ns() - start; d >= 1000000 {
+		t.Errorf("peeking waited %d ns", d)
+	}
+	if !x86emu_test_int16(t, 0x00) || r.gen.A.Get16() != 0x3062 {
+		t.Fatalf("second read ax %04x", r.gen.A.Get16())
+	}
+	if d := x86emu_clock_ns() - start; d < 1000000000 {
+		t.Errorf("read after the delay at %d ns", d)
+	}
+	if !X86EMU_keyScriptDone() {
+		t.Errorf("script not done")
+	}
+}
+
+func TestInt16Script(t *testing.T) {
+	type op struct {
+		ah   uint8
+		wait uint64 /* ns of virtual time passed first */
+	}
+	for _, tc := range []struct {
+		name   string
+		script string
+		screen string
+		ops    []op /* all but the last return */
+		halt   bool /* the last one halts */
+		ax     uint16
+		zf     bool
+		err    string
+	}{
+		{name: "text on screen", script: "wait \"RAID\" 1s\nkey x\n", screen: "RAID Setup",
+			ops: []op{{ah: 0x00}}, ax: 0x2d78},
+		{name: "waiting within the timeout", script: "wait \"RAID\" 1s\nkey x\n",
+			ops: []op{{ah: 0x01}, {ah: 0x01, wait: 500000000}}, zf: true},
+		{name: "read blocked on text", script: "wait \"RAID\" 1s\nkey x\n",
+			ops: []op{{ah: 0x00}}, halt: true,
+			err: `waiting for "RAID", but the guest is waiting for a key`},
+		{name: "text times out", script: "wait \"RAID\" 1s\nkey x\n",
+			ops: []op{{ah: 0x01}, {ah: 0x01, wait: 1000000000}}, halt: true,
+			err: `"RAID" did not show within 1s`},
+		{name: "no timeout", script: "wait \"RAID\"\nkey x\n",
+			ops: []op{{ah: 0x01}, {ah: 0x01, wait: 60000000000}}, zf: true},
+		{name: "script exhausted", script: "key a\n",
+			ops: []op{{ah: 0x00}, {ah: 0x10}}, halt: true,
+			err: "guest waits for a key after the end of the key script"},
+		{name: "no script", ops: []op{{ah: 0x00}}, halt: true,
+			err: "guest waits for a key after the end of the key script"},
+		{name: "peek at the end", script: "key a\n",
+			ops: []op{{ah: 0x00}, {ah: 0x11}}, zf: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_keys(t, tc.script)
+			for i := 0; i < len(tc.screen); i++ {
+				sys_wrb(0xb8000+uint32(i)*2, tc.screen[i])
+			}
+			r := &M().x86
+			for i, o := range tc.ops {
+				if o.wait != 0 {
+					x86emu_clock_wait(o.wait)
+				}
+				last := i == len(tc.ops)-1
+				if ret, want := x86emu_test_int16(t, o.ah), !last || !tc.halt; ret != want {
+					t.Fatalf("step %d: returned %v, want %v: %v", i, ret, want, X86EMU_keyScriptError())
+				}
+			}
+			err := X86EMU_keyScriptError()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if zf := ACCESS_FLAG(F_ZF); zf != tc.zf {
+					t.Errorf("zf %v, want %v", zf, tc.zf)
+				}
+				if !tc.zf && !tc.halt && r.gen.A.Get16() != tc.ax {
+					t.Errorf("ax %04x, want %04x", r.gen.A.Get16(), tc.ax)
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), tc.err) {
+				t.Errorf("error %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
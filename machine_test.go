@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// Gives the tests a clean real mode machine with 1M of RAM, the PIC and PIT
+// in their reset state, no interrupt hooks and CS:IP at 0000:1000.
+func x86emu_test_machine(t *testing.T) {
+	t.Helper()
+	X86EMU_setMemBase(make([]byte, 0x100000))
+	x86emu_traps = make(map[uint32]*x86emu_trap)
+	_X86EMU_intrTab = [256]X86EMU_intrFuncs{}
+	x86emu_clock_reset()
+	x86emu_pit_reset()
+	x86emu_pic_reset()
+	X86EMU_resetCpu()
+	x86emu_load_cs(0, 0x1000)
+	x86emu_load_seg(SEG_SS, 0)
+	M().x86.spc.SP.Set16(0x800)
+}
+
+// Runs f and returns the exception it raised, or nil if it completed.
+func x86emu_test_fault(f func()) (exc *x86emu_exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(x86emu_exception)
+			if !ok {
+				panic(r)
+			}
+			exc = &e
+		}
+	}()
+	f()
+	return nil
+}
+
+// Runs code placed at CS:1000 until the emulator halts.
+func x86emu_test_run(t *testing.T, code []byte) {
+	t.Helper()
+	base := x86emu_seg_sync(SEG_CS).base
+	for i, b := range code {
+		sys_wrb(base+0x1000+uint32(i), b)
+	}
+	M().x86.spc.IP.Set32(0x1000)
+	M().x86.intr &^= int(INTR_HALTED)
+	X86EMU_exec()
+}
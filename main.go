@@ -0,0 +1,373 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/*
+ * sim86 command line.
+ *
+ *	sim86 <command> [flags] args...
+ *
+ * Each command sets up a machine for one kind of guest code and runs it.
+ */
+
+type x86emu_command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var x86emu_commands = map[string]*x86emu_command{
+	"rom":  {"[flags] rom.bin   run the initialisation of an option ROM", x86emu_cmd_rom},
+	"dos":  {"[flags] prog.com|prog.exe [args...]   run a DOS program and exit with its return code", x86emu_cmd_dos},
+	"boot": {"[flags] bios.bin   run a system BIOS image from the reset vector until it tries to boot", x86emu_cmd_boot},
+}
+
+func x86emu_usage() {
+	fmt.Fprintf(os.Stderr, "usage: sim86 <command> [flags] args...\n\ncommands:\n")
+	var names []string
+	for name := range x86emu_commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, x86emu_commands[name].usage)
+	}
+}
+
+/* Flags every command takes; applied by x86emu_machine_setup. */
+type x86emu_machine_flags struct {
+	mem   *uint
+	cpu   *string
+	trace *bool
+	tty   *bool
+	keys  *string
+	irq0  *bool
+	disks []string
+}
+
+func x86emu_machine_flagset(name string) (*flag.FlagSet, *x86emu_machine_flags) {
+	fs := flag.NewFlagSet("sim86 "+name, flag.ExitOnError)
+	mf := &x86emu_machine_flags{
+		mem:   fs.Uint("mem", 16, "RAM size in MB"),
+		cpu:   fs.String("cpu", "default", "CPU model"),
+		trace: fs.Bool("trace", false, "trace BIOS services and I/O"),
+		tty:   fs.Bool("tty", false, "copy BIOS teletype output to stdout"),
+		keys:  fs.String("keys", "", "key script for int 16h"),
+		irq0:  fs.Bool("irq0", true, "count BIOS ticks on IRQ 0; false counts them from the clock directly"),
+	}
+	fs.Func("disk", "attach a disk image, drive=path[,ro|,cow] with drive fd0, hd0 or a hex number; repeatable",
+		func(s string) error {
+			mf.disks = append(mf.disks, s)
+			return nil
+		})
+	return fs, mf
+}
+
+// PARAMETERS:
+// mf   - Parsed machine flags
+// bios - Lay out the legacy BIOS environment; false is for BIOS images
+func x86emu_machine_setup(mf *x86emu_machine_flags, bios bool) error {
+	if err := X86EMU_setCpuModel(*mf.cpu); err != nil {
+		return err
+	}
+	X86EMU_setMemBase(make([]byte, *mf.mem<<20))
+	if bios {
+		if err := X86EMU_setupBios(); err != nil {
+			return err
+		}
+	} else if len(mf.disks) > 0 {
+		return fmt.Errorf("-disk needs the built-in int 13h services")
+	}
+	if *mf.trace {
+		M().x86.debug |= DEBUG_SVC_F | DEBUG_IO_TRACE_F
+	}
+	if *mf.tty {
+		X86EMU_captureTeletype(os.Stdout)
+	}
+	if *mf.keys != "" {
+		if err := X86EMU_loadKeyScript(*mf.keys); err != nil {
+			return err
+		}
+	}
+	for _, spec := range mf.disks {
+		if _, err := X86EMU_attachDiskSpec(spec); err != nil {
+			return err
+		}
+	}
+	if bios && len(mf.disks) > 0 {
+		return X86EMU_setupDiskBios()
+	}
+	return nil
+}
+
+/* Runs BIOS service setup functions in order, stopping at the first error. */
+func x86emu_setup_services(setups ...func() error) error {
+	for _, setup := range setups {
+		if err := setup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func x86emu_cmd_rom(args []string) int {
+	fs, mf := x86emu_machine_flagset("rom")
+	segstr := fs.String("seg", "c000", "segment to load the ROM at, in hex")
+	slot := fs.String("pci", "", "PCI slot of the device, bb:dd.f")
+	lspci := fs.String("lspci", "", "import the device at -pci from lspci -xxx output or a sysfs config file")
+	desc := fs.String("desc", "", "lspci -v output or sysfs resource file with the BAR sizes of the -lspci device")
+	pnp := fs.Bool("pnp", true, "pass a PnP installation check structure, for the BBS flow")
+	bcv := fs.Bool("bcv", false, "after init, call the BCV of every $PnP header")
+	bev := fs.Int("bev", -1, "after init, call the BEV of the $PnP header with this index")
+	pmm := fs.Bool("pmm", true, "provide $PMM memory allocation services")
+	video := fs.Bool("video", true, "provide int 10h video services")
+	vbe := fs.Bool("vbe", false, "after init, query the VBE controller, its modes and the EDID")
+	intel := fs.Int("intel-panel", -1, "answer the int 15h 5Fxxh calls of Intel video BIOSes with this panel type")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if err := x86emu_machine_setup(mf, true); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 2
+	}
+	seg, err := strconv.ParseUint(*segstr, 16, 16)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sim86: bad segment", *segstr)
+		return 2
+	}
+
+	rom, err := X86EMU_readOptionRom(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 1
+	}
+	fmt.Printf("%s: x86 image %d at %#x, %d bytes\n", path, rom.images, rom.offset, len(rom.data))
+	if rom.pcir != nil {
+		fmt.Printf("%s: PCIR %s\n", path, rom.pcir)
+	}
+
+	bdf := uint16(OPROM_NO_PCI_BDF)
+	if *lspci != "" {
+		d, err := X86EMU_importPciDev(*lspci, *slot, *desc, path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sim86:", err)
+			return 1
+		}
+		*slot = d.String()
+	}
+	if *slot != "" {
+		bus, dev, fn, err := x86emu_parse_slot(*slot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sim86:", err)
+			return 2
+		}
+		bdf = x86emu_pci_bdf(bus, dev, fn)
+		d := X86EMU_pciFindDev(bus, dev, fn)
+		switch {
+		case d == nil:
+			fmt.Fprintf(os.Stderr, "sim86: warning: no device at %s\n", *slot)
+		case rom.pcir != nil && (rom.pcir.vendor != d.get16(PCI_VENDOR_ID) || rom.pcir.device != d.get16(PCI_DEVICE_ID)):
+			fmt.Fprintf(os.Stderr, "sim86: warning: ROM is for %04x:%04x, device at %s is %04x:%04x\n",
+				rom.pcir.vendor, rom.pcir.device, *slot, d.get16(PCI_VENDOR_ID), d.get16(PCI_DEVICE_ID))
+		}
+	}
+	setups := []func() error{
+		X86EMU_setupPciBios,
+		X86EMU_setupSystemBios,
+		X86EMU_setupKeyboardBios,
+		func() error { return X86EMU_setupTimeBios(*mf.irq0) },
+	}
+	if *intel >= 0 {
+		setups = append(setups, func() error {
+			X86EMU_hookIntelVbios(X86EMU_intelVbios{panel_type: uint8(*intel)})
+			return nil
+		})
+	}
+	if *video {
+		setups = append(setups, X86EMU_setupVideoBios)
+	}
+	if *pnp {
+		setups = append(setups, X86EMU_setupPnpBios)
+	}
+	if *pmm {
+		setups = append(setups, X86EMU_setupPmm)
+	}
+	if err := x86emu_setup_services(setups...); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 2
+	}
+	if *pmm {
+		defer func() {
+			for _, l := range X86EMU_pmmLog() {
+				fmt.Printf("%s: pmm %s\n", path, l)
+			}
+		}()
+	}
+
+	if err := X86EMU_copyOptionRom(rom, uint16(seg)); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 1
+	}
+	res := X86EMU_initOptionRom(uint16(seg), bdf)
+	fmt.Printf("%s: init %s\n", path, res)
+	if err := X86EMU_keyScriptError(); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+	}
+	if !res.clean {
+		return 1
+	}
+
+	if *vbe {
+		x86emu_vbe_report(path)
+	}
+
+	hdrs, err := X86EMU_romPnpHeaders(uint16(seg))
+	for i, h := range hdrs {
+		fmt.Printf("%s: $PnP %d at %#x: %s\n", path, i, h.offset, h)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+	}
+	if *bcv {
+		for i, h := range hdrs {
+			if h.bcv == 0 {
+				continue
+			}
+			r, _ := X86EMU_callBcv(uint16(seg), h, bdf)
+			fmt.Printf("%s: bcv %d %s\n", path, i, r)
+			if !r.clean {
+				return 1
+			}
+		}
+	}
+	if *bev >= 0 {
+		if *bev >= len(hdrs) {
+			fmt.Fprintf(os.Stderr, "sim86: no $PnP header %d\n", *bev)
+			return 1
+		}
+		r, err := X86EMU_callBev(uint16(seg), hdrs[*bev], bdf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sim86:", err)
+			return 1
+		}
+		fmt.Printf("%s: bev %d %s\n", path, *bev, r)
+		if r.returned {
+			/* a BEV that returns failed to boot */
+			return 1
+		}
+	}
+	return 0
+}
+
+/* Prints what the VBE calls return and where the ROM breaks the rules. */
+func x86emu_vbe_report(path string) {
+	info, err := X86EMU_vbeGetInfo()
+	if err != nil {
+		fmt.Printf("%s: vbe: %v\n", path, err)
+		return
+	}
+	fmt.Printf("%s: vbe %s\n", path, info)
+	for _, p := range info.problems {
+		fmt.Printf("%s: vbe: warning: %s\n", path, p)
+	}
+	for _, mode := range info.modes {
+		m, err := X86EMU_vbeGetModeInfo(mode)
+		if err != nil {
+			fmt.Printf("%s: vbe mode %04x: %v\n", path, mode, err)
+			continue
+		}
+		fmt.Printf("%s: vbe mode %s\n", path, m)
+		for _, p := range m.problems {
+			fmt.Printf("%s: vbe mode %04x: warning: %s\n", path, mode, p)
+		}
+	}
+	e, err := X86EMU_vbeReadEdid()
+	if err != nil {
+		fmt.Printf("%s: edid: %v\n", path, err)
+		return
+	}
+	fmt.Printf("%s: edid %s\n", path, e)
+	for _, p := range e.problems {
+		fmt.Printf("%s: edid: warning: %s\n", path, p)
+	}
+}
+
+// REMARKS:
+// The exit status is the program's return code, or DOS_RUN_FAILED when it
+// could not be run to the end.
+func x86emu_cmd_dos(args []string) int {
+	fs, mf := x86emu_machine_flagset("dos")
+	root := fs.String("root", ".", "host directory the program sees as C:\\")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := x86emu_machine_setup(mf, true); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 2
+	}
+	if err := x86emu_setup_services(X86EMU_setupSystemBios, X86EMU_setupKeyboardBios,
+		func() error { return X86EMU_setupTimeBios(*mf.irq0) }, X86EMU_setupVideoBios); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 2
+	}
+
+	code, err := X86EMU_runDos(fs.Arg(0), fs.Args()[1:], *root)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return DOS_RUN_FAILED
+	}
+	return int(code)
+}
+
+// REMARKS:
+// Exits with 0 once the BIOS has called int 19h, 1 if it gave up with
+// int 18h or stopped anywhere else.
+func x86emu_cmd_boot(args []string) int {
+	fs, mf := x86emu_machine_flagset("boot")
+	limit := fs.Duration("time", 60*time.Second, "virtual time to give the BIOS; 0 for no limit")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if err := x86emu_machine_setup(mf, false); err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 2
+	}
+
+	res, err := X86EMU_bootSystemBiosFile(path, uint64(*limit))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sim86:", err)
+		return 1
+	}
+	fmt.Printf("%s: %s\n", path, res)
+	if res.how != BOOT_INT19 {
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		x86emu_usage()
+		os.Exit(2)
+	}
+	cmd := x86emu_commands[os.Args[1]]
+	if cmd == nil {
+		x86emu_usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
@@ -0,0 +1,107 @@
+package main
+
+import "fmt"
+
+/*
+ * Memory mapped I/O.
+ *
+ * Physical accesses first look for a device region covering the address and
+ * only fall through to the sys_rd and sys_wr memory functions when there is
+ * none.  Regions are few (PCI BARs, expansion ROMs), so a list will do.
+ */
+
+/* Go callbacks for a memory region; offset is from the region base. */
+type X86EMU_mmioRead func(offset uint32, size int) uint32
+type X86EMU_mmioWrite func(offset uint32, size int, val uint32)
+
+type x86emu_mmio struct {
+	base uint32
+	size uint32
+	name string
+	rd   X86EMU_mmioRead
+	wr   X86EMU_mmioWrite
+}
+
+var x86emu_mmio_regions []*x86emu_mmio
+
+// PARAMETERS:
+// base - Physical base address
+// size - Size of the region in bytes
+// name - Device name used in traces
+// rd   - Called for reads; nil reads as all ones
+// wr   - Called for writes; nil drops them
+//
+// REMARKS:
+// Maps a device region into physical memory, in front of RAM.  A region
+// with the same base and size is replaced.
+func X86EMU_setupMmio(base uint32, size uint32, name string, rd X86EMU_mmioRead, wr X86EMU_mmioWrite) {
+	X86EMU_removeMmio(base, size)
+	x86emu_mmio_regions = append(x86emu_mmio_regions,
+		&x86emu_mmio{base: base, size: size, name: name, rd: rd, wr: wr})
+}
+
+/* Unmaps the region mapped at base with the given size. */
+func X86EMU_removeMmio(base uint32, size uint32) {
+	for i, r := range x86emu_mmio_regions {
+		if r.base == base && r.size == size {
+			x86emu_mmio_regions = append(x86emu_mmio_regions[:i], x86emu_mmio_regions[i+1:]...)
+			return
+		}
+	}
+}
+
+func x86emu_mmio_find(addr uint32) *x86emu_mmio {
+	for _, r := range x86emu_mmio_regions {
+		if addr-r.base < r.size {
+			return r
+		}
+	}
+	return nil
+}
+
+/* Physical memory accesses, as made after segmentation and paging. */
+func x86emu_phys_read(addr uint32, size uint32) uint32 {
+	if M().a20_off {
+		addr &^= A20_BIT
+	}
+	if r := x86emu_mmio_find(addr); r != nil {
+		val := ^uint32(0) >> (32 - 8*size)
+		if r.rd != nil {
+			val &= r.rd(addr-r.base, int(size))
+		}
+		if DEBUG_MEM_TRACE() {
+			fmt.Printf("%s: read%d %#08x -> %#x\n", r.name, 8*size, addr, val)
+		}
+		return val
+	}
+	switch size {
+	case 1:
+		return uint32(sys_rdb(addr))
+	case 2:
+		return uint32(sys_rdw(addr))
+	}
+	return sys_rdl(addr)
+}
+
+func x86emu_phys_write(addr uint32, size uint32, val uint32) {
+	if M().a20_off {
+		addr &^= A20_BIT
+	}
+	if r := x86emu_mmio_find(addr); r != nil {
+		if DEBUG_MEM_TRACE() {
+			fmt.Printf("%s: write%d %#x -> %#08x\n", r.name, 8*size, val, addr)
+		}
+		if r.wr != nil {
+			r.wr(addr-r.base, int(size), val)
+		}
+		return
+	}
+	switch size {
+	case 1:
+		sys_wrb(addr, uint8(val))
+	case 2:
+		sys_wrw(addr, uint16(val))
+	default:
+		sys_wrl(addr, val)
+	}
+}
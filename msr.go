@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Model specific registers.
+ *
+ * RDMSR and WRMSR go to a table of MSRs, each with a value, a mask of bits
+ * that writes cannot change and optional Go callbacks.  The table starts
+ * out with the MSRs firmware commonly touches; a profile file can add to it
+ * or override entries to mimic a particular platform.
+ */
+
+/* Go callbacks for an MSR; either may be nil. */
+type X86EMU_msrRead func(index uint32) uint64
+type X86EMU_msrWrite func(index uint32, val uint64)
+
+type x86emu_msr struct {
+	name   string
+	value  uint64
+	romask uint64 /* bits writes leave alone */
+	rd     X86EMU_msrRead
+	wr     X86EMU_msrWrite
+}
+
+var x86emu_msrs = make(map[uint32]*x86emu_msr)
+
+/*
+ * Whether accesses to MSRs missing from the table raise #GP, as on
+ * hardware.  When off, unknown MSRs read as 0 and ignore writes.
+ */
+var x86emu_msr_strict = true
+
+/* Common MSRs and their values after reset. */
+var x86emu_msr_defaults = []struct {
+	index  uint32
+	name   string
+	value  uint64
+	romask uint64
+}{
+	{0x00000010, "IA32_TIME_STAMP_COUNTER", 0, 0},
+	{0x00000017, "IA32_PLATFORM_ID", 0, ^uint64(0)},
+	{0x0000001b, "IA32_APIC_BASE", 0xfee00900, 0x100},
+	{0x0000003a, "IA32_FEATURE_CONTROL", 0, 0},
+	{0x0000008b, "IA32_BIOS_SIGN_ID", 0, 0},
+	{0x000000fe, "IA32_MTRRCAP", 0x508, ^uint64(0)},
+	{0x00000174, "IA32_SYSENTER_CS", 0, 0},
+	{0x00000175, "IA32_SYSENTER_ESP", 0, 0},
+	{0x00000176, "IA32_SYSENTER_EIP", 0, 0},
+	{0x000001a0, "IA32_MISC_ENABLE", 0x1, 0},
+	{0x00000250, "IA32_MTRR_FIX64K_00000", 0, 0},
+	{0x00000258, "IA32_MTRR_FIX16K_80000", 0, 0},
+	{0x00000259, "IA32_MTRR_FIX16K_A0000", 0, 0},
+	{0x00000268, "IA32_MTRR_FIX4K_C0000", 0, 0},
+	{0x00000269, "IA32_MTRR_FIX4K_C8000", 0, 0},
+	{0x0000026a, "IA32_MTRR_FIX4K_D0000", 0, 0},
+	{0x0000026b, "IA32_MTRR_FIX4K_D8000", 0, 0},
+	{0x0000026c, "IA32_MTRR_FIX4K_E0000", 0, 0},
+	{0x0000026d, "IA32_MTRR_FIX4K_E8000", 0, 0},
+	{0x0000026e, "IA32_MTRR_FIX4K_F0000", 0, 0},
+	{0x0000026f, "IA32_MTRR_FIX4K_F8000", 0, 0},
+	{0x00000277, "IA32_PAT", 0x0007040600070406, 0},
+	{0x000002ff, "IA32_MTRR_DEF_TYPE", 0, 0},
+}
+
+func init() {
+	x86emu_msr_reset()
+}
+
+// REMARKS:
+// Puts the MSR table back to the common MSRs at their reset values,
+// dropping what profiles added.  MSRs with Go callbacks stay, since devices
+// hook them once, but lose any value a profile gave them.
+func x86emu_msr_reset() {
+	for index, m := range x86emu_msrs {
+		if m.rd == nil && m.wr == nil {
+			delete(x86emu_msrs, index)
+		} else {
+			m.value, m.romask = 0, 0
+		}
+	}
+	for _, d := range x86emu_msr_defaults {
+		X86EMU_setupMsr(d.index, d.name, d.value, d.romask)
+	}
+	for i := uint32(0); i < 8; i++ {
+		X86EMU_setupMsr(0x200+2*i, fmt.Sprintf("IA32_MTRR_PHYSBASE%d", i), 0, 0)
+		X86EMU_setupMsr(0x201+2*i, fmt.Sprintf("IA32_MTRR_PHYSMASK%d", i), 0, 0)
+	}
+}
+
+// PARAMETERS:
+// index  - MSR number
+// name   - Name used in traces
+// value  - Initial value
+// romask - Bits that WRMSR cannot change
+//
+// REMARKS:
+// Adds an MSR to the table, or resets an existing one.  Callbacks already
+// registered for the MSR are kept.
+func X86EMU_setupMsr(index uint32, name string, value uint64, romask uint64) {
+	m := x86emu_msrs[index]
+	if m == nil {
+		m = &x86emu_msr{}
+		x86emu_msrs[index] = m
+	}
+	m.name = name
+	m.value = value
+	m.romask = romask
+}
+
+// PARAMETERS:
+// index - MSR number
+// rd    - Called for RDMSR instead of returning the stored value
+// wr    - Called for WRMSR after the stored value has been updated
+//
+// REMARKS:
+// Attaches Go callbacks to an MSR, adding it to the table if needed.
+func X86EMU_hookMsr(index uint32, rd X86EMU_msrRead, wr X86EMU_msrWrite) {
+	m := x86emu_msrs[index]
+	if m == nil {
+		m = &x86emu_msr{name: fmt.Sprintf("MSR_%08X", index)}
+		x86emu_msrs[index] = m
+	}
+	m.rd = rd
+	m.wr = wr
+}
+
+/* Whether RDMSR/WRMSR of an MSR missing from the table raise #GP. */
+func X86EMU_setMsrStrict(strict bool) {
+	x86emu_msr_strict = strict
+}
+
+// PARAMETERS:
+// path - Profile file
+//
+// REMARKS:
+// Loads MSRs from a profile.  Each line holds an index, a value, and
+// optionally a read-only mask and a name; numbers take a 0x prefix for hex.
+// '#' starts a comment:
+//
+//	# index     value               romask  name
+//	0x1b        0xfee00900          0x100   IA32_APIC_BASE
+//	0xce        0x0000000080000000
+func X86EMU_loadMsrProfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: want index and value", path, line)
+		}
+		var nums [3]uint64
+		n := 0
+		for ; n < len(fields) && n < 3; n++ {
+			v, err := strconv.ParseUint(fields[n], 0, 64)
+			if err != nil {
+				if n < 2 {
+					return fmt.Errorf("%s:%d: %v", path, line, err)
+				}
+				break
+			}
+			nums[n] = v
+		}
+		if nums[0] > 0xffffffff {
+			return fmt.Errorf("%s:%d: MSR index %#x out of range", path, line, nums[0])
+		}
+		name := fmt.Sprintf("MSR_%08X", nums[0])
+		if n < len(fields) {
+			name = fields[n]
+		}
+		X86EMU_setupMsr(uint32(nums[0]), name, nums[1], nums[2])
+	}
+	return sc.Err()
+}
+
+func x86emu_msr_name(index uint32) string {
+	if m := x86emu_msrs[index]; m != nil {
+		return m.name
+	}
+	return "unknown"
+}
+
+// RETURNS:
+// Value of the MSR, and whether it exists.
+func x86emu_rdmsr(index uint32) (uint64, bool) {
+	m := x86emu_msrs[index]
+	if m == nil {
+		return 0, false
+	}
+	if m.rd != nil {
+		return m.rd(index), true
+	}
+	return m.value, true
+}
+
+// RETURNS:
+// Whether the MSR exists.
+func x86emu_wrmsr(index uint32, val uint64) bool {
+	m := x86emu_msrs[index]
+	if m == nil {
+		return false
+	}
+	m.value = m.value&m.romask | val&^m.romask
+	if m.wr != nil {
+		m.wr(index, m.value)
+	}
+	return true
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x30
+func x86emuOp2_wrmsr(_ uint8) {
+	DECODE_PRINTF("WRMSR\n")
+	TRACE_AND_STEP()
+	x86emu_require_feature(CPUID_MSR)
+	x86emu_check_cpl0()
+	index := M().x86.gen.C.Get32()
+	val := uint64(M().x86.gen.D.Get32())<<32 | uint64(M().x86.gen.A.Get32())
+	ok := x86emu_wrmsr(index, val)
+	if DEBUG_MSR() {
+		fmt.Printf("%04x:%08x: wrmsr %08x (%s) <- %016x\n",
+			M().x86.insn_cs, M().x86.insn_ip, index, x86emu_msr_name(index), val)
+	}
+	if !ok && x86emu_msr_strict {
+		x86emu_fault(EXC_GP, 0)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x32
+func x86emuOp2_rdmsr(_ uint8) {
+	DECODE_PRINTF("RDMSR\n")
+	TRACE_AND_STEP()
+	x86emu_require_feature(CPUID_MSR)
+	x86emu_check_cpl0()
+	index := M().x86.gen.C.Get32()
+	val, ok := x86emu_rdmsr(index)
+	if DEBUG_MSR() {
+		fmt.Printf("%04x:%08x: rdmsr %08x (%s) -> %016x\n",
+			M().x86.insn_cs, M().x86.insn_ip, index, x86emu_msr_name(index), val)
+	}
+	if !ok && x86emu_msr_strict {
+		x86emu_fault(EXC_GP, 0)
+	}
+	M().x86.gen.A.Set32(uint32(val))
+	M().x86.gen.D.Set32(uint32(val >> 32))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func init() {
+	x86emu_optab2[0x30] = x86emuOp2_wrmsr
+	x86emu_optab2[0x32] = x86emuOp2_rdmsr
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMsrResetDropsProfile(t *testing.T) {
+	defer x86emu_msr_reset()
+
+	profile := filepath.Join(t.TempDir(), "msr")
+	if err := os.WriteFile(profile, []byte(
+		"0xce 0x80000000 0 MSR_PLATFORM_INFO\n"+
+			"0x1b 0xfee00000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := X86EMU_loadMsrProfile(profile); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := x86emu_rdmsr(0xce); !ok || v != 0x80000000 {
+		t.Fatalf("profile MSR ce reads %#x, %v", v, ok)
+	}
+	x86emu_wrmsr(0x10, 1234)
+
+	x86emu_msr_reset()
+	if _, ok := x86emu_rdmsr(0xce); ok {
+		t.Errorf("profile MSR ce survives the reset")
+	}
+	if v, _ := x86emu_rdmsr(0x1b); v != 0xfee00900 {
+		t.Errorf("IA32_APIC_BASE reads %#x after the reset, want 0xfee00900", v)
+	}
+	if m := x86emu_msrs[0x10]; m == nil || m.rd == nil {
+		t.Errorf("TSC callbacks dropped by the reset")
+	}
+	if !x86emu_msr_strict {
+		t.Errorf("unknown MSRs do not raise #GP by default")
+	}
+}
@@ -0,0 +1,1629 @@
+/****************************************************************************
+*
+*                       Realmode X86 Emulator Library
+*
+*               Copyright (C) 1991-2004 SciTech Software, Inc.
+*                    Copyright (C) David Mosberger-Tang
+*                      Copyright (C) 1999 Egbert Eich
+*
+*  ========================================================================
+*
+*  Permission to use, copy, modify, distribute, and sell this software and
+*  its documentation for any purpose is hereby granted without fee,
+*  provided that the above copyright notice appear in all copies and that
+*  both that copyright notice and this permission notice appear in
+*  supporting documentation, and that the name of the authors not be used
+*  in advertising or publicity pertaining to distribution of the software
+*  without specific, written prior permission.  The authors makes no
+*  representations about the suitability of this software for any purpose.
+*  It is provided "as is" without express or implied warranty.
+*
+*  THE AUTHORS DISCLAIMS ALL WARRANTIES WITH REGARD TO THIS SOFTWARE,
+*  INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS, IN NO
+*  EVENT SHALL THE AUTHORS BE LIABLE FOR ANY SPECIAL, INDIRECT OR
+*  CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM LOSS OF
+*  USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+*  OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+*  PERFORMANCE OF THIS SOFTWARE.
+*
+*  ========================================================================
+*
+* Language:     ANSI C
+* Environment:  Any
+* Developer:    Kendall Bennett
+*
+* Description:  This file includes subroutines to implement the decoding
+*               and emulation of all the x86 processor instructions.
+*
+* There are approximately 250 subroutines in here, which correspond
+* to the 256 byte-"opcodes" found on the 8086.  The table which
+* dispatches this is found at the bottom of the file.
+*
+* The C version has a byte, a word and a dword copy of most handlers.
+* Here a handler works on an operand width in bits instead: 8 for the
+* byte forms, and 16 or 32 for the word forms depending on the operand
+* size prefix.  The primitive operations in prim_ops.go take the same
+* width, and x86emu_rm below reads and writes the r/m operand of a
+* ModR/M byte whether it is a register or memory.
+*
+* Handlers that the protected mode, exception, CPUID, MSR and interrupt
+* controller code replaced live with that code; see the init functions
+* there.
+*
+****************************************************************************/
+
+package main
+
+/*----------------------------- Implementation ----------------------------*/
+
+var x86emu_genop_names = [8]string{"ADD", "OR", "ADC", "SBB", "AND", "SUB", "XOR", "CMP"}
+
+var x86emu_shift_names = [8]string{"ROL", "ROR", "RCL", "RCR", "SHL", "SHR", "SAL", "SAR"}
+
+var x86emu_opF6_names = [8]string{"TEST", "TEST", "NOT", "NEG", "MUL", "IMUL", "DIV", "IDIV"}
+
+/* Operand width of a word instruction: 32 bits with an operand size prefix */
+func x86emu_opsize() uint {
+	if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+		return 32
+	}
+	return 16
+}
+
+/* Width of an instruction from the low bit of its opcode, byte or word */
+func x86emu_opwidth(op1 uint8) uint {
+	if op1&1 == 0 {
+		return 8
+	}
+	return x86emu_opsize()
+}
+
+func x86emu_reg_name(n int, width uint) string {
+	switch width {
+	case 8:
+		return x86emu_greg8_names[n&7]
+	case 16:
+		return x86emu_greg16_names[n&7]
+	}
+	return x86emu_greg32_names[n&7]
+}
+
+/* General register n, or byte register n for a width of 8 */
+func x86emu_reg_read(n int, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(decode_rm_byte_register(n).Get())
+	case 16:
+		return uint32(x86emu_greg(n).Get16())
+	}
+	return x86emu_greg(n).Get32()
+}
+
+func x86emu_reg_write(n int, width uint, v uint32) {
+	switch width {
+	case 8:
+		x86emu_breg{r: x86emu_greg(n & 3), high: n&4 != 0}.Set(uint8(v))
+	case 16:
+		x86emu_greg(n).Set16(uint16(v))
+	default:
+		x86emu_greg(n).Set32(v)
+	}
+}
+
+/* Memory at segment register n, offset off */
+func x86emu_data_read(n int, off uint32, width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(fetch_data_byte_abs(n, off))
+	case 16:
+		return uint32(fetch_data_word_abs(n, off))
+	}
+	return fetch_data_long_abs(n, off)
+}
+
+func x86emu_data_write(n int, off uint32, width uint, v uint32) {
+	switch width {
+	case 8:
+		store_data_byte_abs(n, off, uint8(v))
+	case 16:
+		store_data_word_abs(n, off, uint16(v))
+	default:
+		store_data_long_abs(n, off, v)
+	}
+}
+
+func x86emu_fetch_imm(width uint) uint32 {
+	switch width {
+	case 8:
+		return uint32(fetch_byte_imm())
+	case 16:
+		return uint32(fetch_word_imm())
+	}
+	return fetch_long_imm()
+}
+
+/* Sign extends the low width bits of v to 32 bits. */
+func x86emu_sext(v uint32, width uint) uint32 {
+	return uint32(int32(v<<(32-width)) >> (32 - width))
+}
+
+/*
+ * The r/m operand of a ModR/M byte: general register rl when mod is 3,
+ * otherwise memory at offset in the default or overriding data segment.
+ */
+type x86emu_rm struct {
+	mod, rh, rl int
+	offset      uint32
+}
+
+// PARAMETERS:
+// width - Operand width in bits, for printing a register operand
+//
+// RETURNS:
+// The decoded ModR/M byte with the offset of a memory operand.
+//
+// REMARKS:
+// Fetches the ModR/M byte and any SIB byte and displacement after it.
+func x86emu_decode_rm(width uint) x86emu_rm {
+	var o x86emu_rm
+	fetch_decode_modrm(&o.mod, &o.rh, &o.rl)
+	if o.mod < 3 {
+		o.offset = decode_rmXX_address(o.mod, o.rl)
+	} else {
+		DECODE_PRINTF("%s", x86emu_reg_name(o.rl, width))
+	}
+	return o
+}
+
+func (o *x86emu_rm) is_reg() bool {
+	return o.mod == 3
+}
+
+func (o *x86emu_rm) read(width uint) uint32 {
+	if o.mod == 3 {
+		return x86emu_reg_read(o.rl, width)
+	}
+	return x86emu_data_read(get_data_segment_index(), o.offset, width)
+}
+
+func (o *x86emu_rm) write(width uint, v uint32) {
+	if o.mod == 3 {
+		x86emu_reg_write(o.rl, width, v)
+		return
+	}
+	x86emu_data_write(get_data_segment_index(), o.offset, width, v)
+}
+
+/* Memory operand only, as for LEA, LES and far indirect transfers */
+func (o *x86emu_rm) check_mem() {
+	if o.mod == 3 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+}
+
+// REMARKS:
+// The eight arithmetic operations of opcodes 0x00-0x3f, 0x80-0x83.  CMP
+// computes the flags of SUB and leaves the destination alone.
+func x86emu_genop(op uint8, d, s uint32, width uint) uint32 {
+	switch op & 7 {
+	case 0:
+		return x86emu_add(d, s, 0, width)
+	case 1:
+		return x86emu_logic(d|s, width)
+	case 2:
+		return x86emu_add(d, s, x86emu_cf(), width)
+	case 3:
+		return x86emu_sub(d, s, x86emu_cf(), width)
+	case 4:
+		return x86emu_logic(d&s, width)
+	case 5:
+		return x86emu_sub(d, s, 0, width)
+	case 6:
+		return x86emu_logic(d^s, width)
+	}
+	x86emu_sub(d, s, 0, width)
+	return d
+}
+
+/* The rotates and shifts of opcodes 0xc0, 0xc1 and 0xd0-0xd3. */
+func x86emu_shiftop(op int, d uint32, cnt uint8, width uint) uint32 {
+	cnt &= 0x1f
+	switch op & 7 {
+	case 0:
+		return x86emu_rol(d, uint(cnt), width)
+	case 1:
+		return x86emu_ror(d, uint(cnt), width)
+	case 2:
+		return x86emu_rcl(d, uint(cnt), width)
+	case 3:
+		return x86emu_rcr(d, uint(cnt), width)
+	case 4, 6: /* sal is shl by definition */
+		return x86emu_shl(d, uint(cnt), width)
+	case 5:
+		return x86emu_shr(d, uint(cnt), width)
+	}
+	return x86emu_sar(d, uint(cnt), width)
+}
+
+// PARAMETERS:
+// ip - New instruction pointer
+//
+// REMARKS:
+// Near transfers: with a 16-bit operand size the upper half of EIP is
+// cleared, so the target wraps within the 64K segment.
+func x86emu_set_ip(ip uint32) {
+	if M().x86.mode&SYSMODE_PREFIX_DATA == 0 {
+		ip &= 0xffff
+	}
+	M().x86.spc.IP.Set32(ip)
+}
+
+func x86emu_jump_rel(disp uint32) {
+	x86emu_set_ip(M().x86.spc.IP.Get32() + disp)
+}
+
+/* Pushes and pops at the operand size */
+func x86emu_push(v uint32) {
+	if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+		push_long(v)
+	} else {
+		push_word(uint16(v))
+	}
+}
+
+func x86emu_pop() uint32 {
+	if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+		return pop_long()
+	}
+	return uint32(pop_word())
+}
+
+// PARAMETERS:
+// cond - Low four bits of a Jcc, SETcc or CMOVcc opcode
+//
+// RETURNS:
+// Whether the condition holds.
+func x86emu_check_jump_condition(cond uint8) bool {
+	var res bool
+	switch cond >> 1 {
+	case 0: /* O */
+		res = ACCESS_FLAG(F_OF)
+	case 1: /* B */
+		res = ACCESS_FLAG(F_CF)
+	case 2: /* Z */
+		res = ACCESS_FLAG(F_ZF)
+	case 3: /* BE */
+		res = ACCESS_FLAG(F_CF) || ACCESS_FLAG(F_ZF)
+	case 4: /* S */
+		res = ACCESS_FLAG(F_SF)
+	case 5: /* P */
+		res = ACCESS_FLAG(F_PF)
+	case 6: /* L */
+		res = ACCESS_FLAG(F_SF) != ACCESS_FLAG(F_OF)
+	case 7: /* LE */
+		res = ACCESS_FLAG(F_SF) != ACCESS_FLAG(F_OF) || ACCESS_FLAG(F_ZF)
+	}
+	return res != (cond&1 != 0)
+}
+
+var x86emu_cond_names = [16]string{
+	"O", "NO", "B", "NB", "Z", "NZ", "BE", "NBE",
+	"S", "NS", "P", "NP", "L", "NL", "LE", "NLE",
+}
+
+/* CLI and STI need IOPL at least the CPL in protected mode */
+func x86emu_check_iopl() {
+	if x86emu_protected_mode() && uint32(x86emu_cpl()) > (M().x86.spc.FLAGS&F_IOPL)>>12 {
+		x86emu_fault(EXC_GP, 0)
+	}
+}
+
+// REMARKS:
+// Handles opcodes 0x00-0x05, 0x08-0x0d, ... 0x38-0x3d
+func x86emuOp_genop(op1 uint8) {
+	op := (op1 >> 3) & 7
+	width := x86emu_opwidth(op1)
+
+	DECODE_PRINTF("%s\t", x86emu_genop_names[op])
+	switch op1 & 7 {
+	case 0, 1: /* r/m, reg */
+		rm := x86emu_decode_rm(width)
+		DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+		TRACE_AND_STEP()
+		res := x86emu_genop(op, rm.read(width), x86emu_reg_read(rm.rh, width), width)
+		if op != 7 {
+			rm.write(width, res)
+		}
+	case 2, 3: /* reg, r/m */
+		rm := x86emu_decode_rm(width)
+		DECODE_PRINTF("\n")
+		TRACE_AND_STEP()
+		res := x86emu_genop(op, x86emu_reg_read(rm.rh, width), rm.read(width), width)
+		if op != 7 {
+			x86emu_reg_write(rm.rh, width, res)
+		}
+	default: /* accumulator, immediate */
+		imm := x86emu_fetch_imm(width)
+		DECODE_PRINTF("%s,%x\n", x86emu_reg_name(0, width), imm)
+		TRACE_AND_STEP()
+		res := x86emu_genop(op, x86emu_reg_read(0, width), imm, width)
+		if op != 7 {
+			x86emu_reg_write(0, width, res)
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x06, 0x0e, 0x16 and 0x1e; 0x0f,0xa0 and 0x0f,0xa8 for FS
+// and GS.
+func x86emu_push_seg(n int) {
+	DECODE_PRINTF("PUSH\t%s\n", x86emu_seg_names[n])
+	TRACE_AND_STEP()
+	x86emu_push(uint32(x86emu_sreg(n).Get()))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func x86emuOp_push_seg(op1 uint8) {
+	x86emu_push_seg(int(op1 >> 3))
+}
+
+// REMARKS:
+// Handles opcodes 0x07, 0x17 and 0x1f; 0x0f,0xa1 and 0x0f,0xa9 for FS and
+// GS.  Like MOV SS, POP SS holds off interrupts until after the next
+// instruction so that it can load SP.
+func x86emu_pop_seg(n int) {
+	DECODE_PRINTF("POP\t%s\n", x86emu_seg_names[n])
+	TRACE_AND_STEP()
+	x86emu_load_seg(n, uint16(x86emu_pop()))
+	if n == SEG_SS {
+		M().x86.mode |= SYSMODE_INTR_SHADOW
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func x86emuOp_pop_seg(op1 uint8) {
+	x86emu_pop_seg(int(op1 >> 3))
+}
+
+// REMARKS:
+// Handles opcodes 0x26, 0x2e, 0x36, 0x3e, 0x64 and 0x65.  A later override
+// replaces an earlier one.
+func x86emuOp_segovr(op1 uint8) {
+	var n int
+	var ovr uint32
+
+	switch op1 {
+	case 0x26:
+		n, ovr = SEG_ES, SYSMODE_SEGOVR_ES
+	case 0x2e:
+		n, ovr = SEG_CS, SYSMODE_SEGOVR_CS
+	case 0x36:
+		n, ovr = SEG_SS, SYSMODE_SEGOVR_SS
+	case 0x3e:
+		n, ovr = SEG_DS, SYSMODE_SEGOVR_DS
+	case 0x64:
+		n, ovr = SEG_FS, SYSMODE_SEGOVR_FS
+	default:
+		n, ovr = SEG_GS, SYSMODE_SEGOVR_GS
+	}
+	DECODE_PRINTF("%s:\n", x86emu_seg_names[n])
+	TRACE_AND_STEP()
+	M().x86.mode = M().x86.mode&^(SYSMODE_SEGMASK&^SYSMODE_SEG_DS_SS) | ovr
+	/* note no DECODE_CLEAR_SEGOVR here. */
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x27, 0x2f, 0x37 and 0x3f
+func x86emuOp_bcd(op1 uint8) {
+	r := &M().x86
+	switch op1 {
+	case 0x27:
+		DECODE_PRINTF("DAA\n")
+		TRACE_AND_STEP()
+		r.gen.A.Setl8(daa_byte(r.gen.A.Get8l()))
+	case 0x2f:
+		DECODE_PRINTF("DAS\n")
+		TRACE_AND_STEP()
+		r.gen.A.Setl8(das_byte(r.gen.A.Get8l()))
+	case 0x37:
+		DECODE_PRINTF("AAA\n")
+		TRACE_AND_STEP()
+		r.gen.A.Set16(aaa_word(r.gen.A.Get16()))
+	default:
+		DECODE_PRINTF("AAS\n")
+		TRACE_AND_STEP()
+		r.gen.A.Set16(aas_word(r.gen.A.Get16()))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x40-0x4f
+func x86emuOp_inc_dec_register(op1 uint8) {
+	width := x86emu_opsize()
+	n := int(op1 & 7)
+	if op1 < 0x48 {
+		DECODE_PRINTF("INC\t%s\n", x86emu_reg_name(n, width))
+		TRACE_AND_STEP()
+		x86emu_reg_write(n, width, x86emu_inc(x86emu_reg_read(n, width), width))
+	} else {
+		DECODE_PRINTF("DEC\t%s\n", x86emu_reg_name(n, width))
+		TRACE_AND_STEP()
+		x86emu_reg_write(n, width, x86emu_dec(x86emu_reg_read(n, width), width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x50-0x57.  PUSH SP pushes the value from before the push.
+func x86emuOp_push_register(op1 uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("PUSH\t%s\n", x86emu_reg_name(int(op1&7), width))
+	TRACE_AND_STEP()
+	x86emu_push(x86emu_reg_read(int(op1&7), width))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x58-0x5f
+func x86emuOp_pop_register(op1 uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("POP\t%s\n", x86emu_reg_name(int(op1&7), width))
+	TRACE_AND_STEP()
+	x86emu_reg_write(int(op1&7), width, x86emu_pop())
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x60
+func x86emuOp_push_all(_ uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("PUSHA\n")
+	TRACE_AND_STEP()
+	sp := x86emu_reg_read(4, width)
+	for n := 0; n < 8; n++ {
+		if n == 4 {
+			x86emu_push(sp)
+		} else {
+			x86emu_push(x86emu_reg_read(n, width))
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x61.  The saved SP is skipped.
+func x86emuOp_pop_all(_ uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("POPA\n")
+	TRACE_AND_STEP()
+	for n := 7; n >= 0; n-- {
+		v := x86emu_pop()
+		if n != 4 {
+			x86emu_reg_write(n, width, v)
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x68 and 0x6a; the byte form is sign extended.
+func x86emuOp_push_IMM(op1 uint8) {
+	var imm uint32
+	if op1 == 0x6a {
+		imm = x86emu_sext(uint32(fetch_byte_imm()), 8)
+	} else {
+		imm = x86emu_fetch_imm(x86emu_opsize())
+	}
+	DECODE_PRINTF("PUSH\t%x\n", imm)
+	TRACE_AND_STEP()
+	x86emu_push(imm)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x69 and 0x6b: IMUL reg, r/m, immediate
+func x86emuOp_imul_IMM(op1 uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("IMUL\t")
+	rm := x86emu_decode_rm(width)
+	var imm uint32
+	if op1 == 0x6b {
+		imm = x86emu_sext(uint32(fetch_byte_imm()), 8)
+	} else {
+		imm = x86emu_fetch_imm(width)
+	}
+	DECODE_PRINTF(",%x\n", imm)
+	TRACE_AND_STEP()
+	x86emu_reg_write(rm.rh, width, x86emu_imul(rm.read(width), imm, width))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+/*
+ * String instructions.  The index registers are SI and DI, or ESI and EDI
+ * with a 32-bit address size, and so is the count in CX or ECX under a REP
+ * prefix.  The count goes down as each element is done, so an exception
+ * part way through restarts the instruction with only what is left.
+ */
+
+func x86emu_str_index(r *reg) uint32 {
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		return r.Get32()
+	}
+	return uint32(r.Get16())
+}
+
+func x86emu_str_set_index(r *reg, v uint32) {
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		r.Set32(v)
+	} else {
+		r.Set16(uint16(v))
+	}
+}
+
+/* Moves an index register on by one element, backwards with DF set */
+func x86emu_str_step(r *reg, width uint) {
+	delta := uint32(width / 8)
+	if ACCESS_FLAG(F_DF) {
+		delta = -delta
+	}
+	x86emu_str_set_index(r, x86emu_str_index(r)+delta)
+}
+
+// PARAMETERS:
+// cmp - Whether REPE and REPNE end the loop on ZF, for CMPS and SCAS
+// op  - Does one element
+//
+// REMARKS:
+// Runs a string instruction once, or (E)CX times under a REP prefix.
+func x86emu_string_op(cmp bool, op func()) {
+	r := &M().x86
+	rep := r.mode & (SYSMODE_PREFIX_REPE | SYSMODE_PREFIX_REPNE)
+	if rep == 0 {
+		op()
+		return
+	}
+	for x86emu_str_index(&r.gen.C) != 0 {
+		op()
+		x86emu_str_set_index(&r.gen.C, x86emu_str_index(&r.gen.C)-1)
+		if cmp && ACCESS_FLAG(F_ZF) != (rep == SYSMODE_PREFIX_REPE) {
+			break
+		}
+	}
+}
+
+// REMARKS:
+// Handles opcodes 0x6c and 0x6d: INS to ES:(E)DI from port DX.
+func x86emuOp_ins(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("INS%s\n", map[uint]string{8: "B", 16: "W", 32: "D"}[width])
+	TRACE_AND_STEP()
+	x86emu_string_op(false, func() {
+		v := x86emu_port_in(r.gen.D.Get16(), int(width/8))
+		x86emu_data_write(SEG_ES, x86emu_str_index(&r.spc.DI), width, v)
+		x86emu_str_step(&r.spc.DI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x6e and 0x6f: OUTS to port DX from (E)SI in the data
+// segment, which can be overridden.
+func x86emuOp_outs(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("OUTS%s\n", map[uint]string{8: "B", 16: "W", 32: "D"}[width])
+	TRACE_AND_STEP()
+	x86emu_string_op(false, func() {
+		v := x86emu_data_read(get_data_segment_index(), x86emu_str_index(&r.spc.SI), width)
+		x86emu_port_out(r.gen.D.Get16(), int(width/8), v)
+		x86emu_str_step(&r.spc.SI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x70-0x7f
+func x86emuOp_jump_near_cond(op1 uint8) {
+	/* jump to byte offset if condition true */
+	disp := x86emu_sext(uint32(fetch_byte_imm()), 8)
+	cond := x86emu_check_jump_condition(op1 & 0xf)
+	target := M().x86.spc.IP.Get32() + disp
+	DECODE_PRINTF("J%s\t%04x\n", x86emu_cond_names[op1&0xf], target)
+	TRACE_AND_STEP()
+	if cond {
+		x86emu_set_ip(target)
+		JMP_TRACE(M().x86.saved_cs, M().x86.saved_ip, M().x86.seg.CS.Get(), M().x86.spc.IP.Get32(), " NEAR COND ")
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x80-0x83.  0x82 is the same as 0x80, and 0x83 sign
+// extends a byte immediate to the operand size.
+func x86emuOp_opc80_RM_IMM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	var imm uint32
+
+	rm := x86emu_decode_rm(width)
+	if op1 == 0x83 {
+		imm = x86emu_sext(uint32(fetch_byte_imm()), 8) & x86emu_width_mask(width)
+	} else {
+		imm = x86emu_fetch_imm(width)
+	}
+	DECODE_PRINTF(",%x\t%s\n", imm, x86emu_genop_names[rm.rh])
+	TRACE_AND_STEP()
+	res := x86emu_genop(uint8(rm.rh), rm.read(width), imm, width)
+	if rm.rh != 7 {
+		rm.write(width, res)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x84 and 0x85
+func x86emuOp_test_RM_R(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("TEST\t")
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	x86emu_logic(rm.read(width)&x86emu_reg_read(rm.rh, width), width)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x86 and 0x87
+func x86emuOp_xchg_RM_R(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("XCHG\t")
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	v := rm.read(width)
+	rm.write(width, x86emu_reg_read(rm.rh, width))
+	x86emu_reg_write(rm.rh, width, v)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x88-0x8b
+func x86emuOp_mov_RM_R(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("MOV\t")
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	if op1&2 == 0 {
+		rm.write(width, x86emu_reg_read(rm.rh, width))
+	} else {
+		x86emu_reg_write(rm.rh, width, rm.read(width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x8c.  A register destination takes the selector zero
+// extended to the operand size; memory always gets 16 bits.
+func x86emuOp_mov_word_RM_SR(_ uint8) {
+	DECODE_PRINTF("MOV\t")
+	rm := x86emu_decode_rm(x86emu_opsize())
+	if rm.rh > SEG_GS {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF(",%s\n", x86emu_seg_names[rm.rh])
+	TRACE_AND_STEP()
+	sel := uint32(x86emu_sreg(rm.rh).Get())
+	if rm.is_reg() {
+		rm.write(x86emu_opsize(), sel)
+	} else {
+		rm.write(16, sel)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x8d.  The offset is truncated to the operand size.
+func x86emuOp_lea_word_R_M(_ uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("LEA\t")
+	rm := x86emu_decode_rm(width)
+	rm.check_mem()
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	x86emu_reg_write(rm.rh, width, rm.offset)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x8f.  Only /0 is defined.
+func x86emuOp_pop_RM(_ uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("POP\t")
+	rm := x86emu_decode_rm(width)
+	if rm.rh != 0 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	rm.write(width, x86emu_pop())
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x90-0x97; 0x90 is XCHG AX,AX, or NOP.
+func x86emuOp_xchg_word_AX_register(op1 uint8) {
+	width := x86emu_opsize()
+	n := int(op1 & 7)
+	if n == 0 {
+		DECODE_PRINTF("NOP\n")
+	} else {
+		DECODE_PRINTF("XCHG\t%s,%s\n", x86emu_reg_name(0, width), x86emu_reg_name(n, width))
+	}
+	TRACE_AND_STEP()
+	v := x86emu_reg_read(n, width)
+	x86emu_reg_write(n, width, x86emu_reg_read(0, width))
+	x86emu_reg_write(0, width, v)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x98: CBW, or CWDE with a 32-bit operand size.
+func x86emuOp_cbw(_ uint8) {
+	r := &M().x86
+	if x86emu_opsize() == 32 {
+		DECODE_PRINTF("CWDE\n")
+		TRACE_AND_STEP()
+		r.gen.A.Set32(x86emu_sext(uint32(r.gen.A.Get16()), 16))
+	} else {
+		DECODE_PRINTF("CBW\n")
+		TRACE_AND_STEP()
+		r.gen.A.Set16(uint16(x86emu_sext(uint32(r.gen.A.Get8l()), 8)))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x99: CWD, or CDQ with a 32-bit operand size.
+func x86emuOp_cwd(_ uint8) {
+	r := &M().x86
+	if x86emu_opsize() == 32 {
+		DECODE_PRINTF("CDQ\n")
+		TRACE_AND_STEP()
+		r.gen.D.Set32(uint32(int32(r.gen.A.Get32()) >> 31))
+	} else {
+		DECODE_PRINTF("CWD\n")
+		TRACE_AND_STEP()
+		r.gen.D.Set16(uint16(int16(r.gen.A.Get16()) >> 15))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9a
+func x86emuOp_call_far_IMM(_ uint8) {
+	r := &M().x86
+	DECODE_PRINTF("CALL\t")
+	ip := x86emu_fetch_imm(x86emu_opsize())
+	cs := fetch_word_imm()
+	DECODE_PRINTF("%04x:%04x\n", cs, ip)
+	CALL_TRACE(r.saved_cs, r.saved_ip, cs, ip, "FAR ")
+	TRACE_AND_STEP()
+	x86emu_push(uint32(r.seg.CS.Get()))
+	x86emu_push(r.spc.IP.Get32())
+	x86emu_load_cs(cs, ip)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9b.  The coprocessor is never busy; x86emu_check_fpu
+// raises #NM when CR0 says so.
+func x86emuOp_wait(_ uint8) {
+	DECODE_PRINTF("WAIT\n")
+	TRACE_AND_STEP()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9e
+func x86emuOp_sahf(_ uint8) {
+	const mask = F_SF | F_ZF | F_AF | F_PF | F_CF
+	DECODE_PRINTF("SAHF\n")
+	TRACE_AND_STEP()
+	r := &M().x86
+	r.spc.FLAGS = r.spc.FLAGS&^mask | uint32(r.gen.A.Get8h())&mask
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x9f
+func x86emuOp_lahf(_ uint8) {
+	DECODE_PRINTF("LAHF\n")
+	TRACE_AND_STEP()
+	r := &M().x86
+	r.gen.A.Seth8(uint8(r.spc.FLAGS) | uint8(F_ALWAYS_ON))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xa0-0xa3: moves between the accumulator and memory at
+// an offset of the address size.
+func x86emuOp_mov_A_M_IMM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	var offset uint32
+	if M().x86.mode&SYSMODE_PREFIX_ADDR != 0 {
+		offset = fetch_long_imm()
+	} else {
+		offset = uint32(fetch_word_imm())
+	}
+	seg := get_data_segment_index()
+	TRACE_AND_STEP()
+	if op1 < 0xa2 {
+		DECODE_PRINTF("MOV\t%s,[%04x]\n", x86emu_reg_name(0, width), offset)
+		x86emu_reg_write(0, width, x86emu_data_read(seg, offset, width))
+	} else {
+		DECODE_PRINTF("MOV\t[%04x],%s\n", offset, x86emu_reg_name(0, width))
+		x86emu_data_write(seg, offset, width, x86emu_reg_read(0, width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xa4 and 0xa5
+func x86emuOp_movs(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("MOVS\n")
+	TRACE_AND_STEP()
+	x86emu_string_op(false, func() {
+		v := x86emu_data_read(get_data_segment_index(), x86emu_str_index(&r.spc.SI), width)
+		x86emu_data_write(SEG_ES, x86emu_str_index(&r.spc.DI), width, v)
+		x86emu_str_step(&r.spc.SI, width)
+		x86emu_str_step(&r.spc.DI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xa6 and 0xa7
+func x86emuOp_cmps(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("CMPS\n")
+	TRACE_AND_STEP()
+	x86emu_string_op(true, func() {
+		s := x86emu_data_read(get_data_segment_index(), x86emu_str_index(&r.spc.SI), width)
+		d := x86emu_data_read(SEG_ES, x86emu_str_index(&r.spc.DI), width)
+		x86emu_sub(s, d, 0, width)
+		x86emu_str_step(&r.spc.SI, width)
+		x86emu_str_step(&r.spc.DI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xa8 and 0xa9
+func x86emuOp_test_A_IMM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	imm := x86emu_fetch_imm(width)
+	DECODE_PRINTF("TEST\t%s,%x\n", x86emu_reg_name(0, width), imm)
+	TRACE_AND_STEP()
+	x86emu_logic(x86emu_reg_read(0, width)&imm, width)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xaa and 0xab
+func x86emuOp_stos(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("STOS\n")
+	TRACE_AND_STEP()
+	x86emu_string_op(false, func() {
+		x86emu_data_write(SEG_ES, x86emu_str_index(&r.spc.DI), width, x86emu_reg_read(0, width))
+		x86emu_str_step(&r.spc.DI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xac and 0xad
+func x86emuOp_lods(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("LODS\n")
+	TRACE_AND_STEP()
+	x86emu_string_op(false, func() {
+		x86emu_reg_write(0, width, x86emu_data_read(get_data_segment_index(), x86emu_str_index(&r.spc.SI), width))
+		x86emu_str_step(&r.spc.SI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xae and 0xaf
+func x86emuOp_scas(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("SCAS\n")
+	TRACE_AND_STEP()
+	x86emu_string_op(true, func() {
+		x86emu_sub(x86emu_reg_read(0, width), x86emu_data_read(SEG_ES, x86emu_str_index(&r.spc.DI), width), 0, width)
+		x86emu_str_step(&r.spc.DI, width)
+	})
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xb0-0xbf
+func x86emuOp_mov_register_IMM(op1 uint8) {
+	width := uint(8)
+	if op1 >= 0xb8 {
+		width = x86emu_opsize()
+	}
+	imm := x86emu_fetch_imm(width)
+	DECODE_PRINTF("MOV\t%s,%x\n", x86emu_reg_name(int(op1&7), width), imm)
+	TRACE_AND_STEP()
+	x86emu_reg_write(int(op1&7), width, imm)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xc0, 0xc1 and 0xd0-0xd3: rotates and shifts by an
+// immediate count, by one or by CL.
+func x86emuOp_shift_RM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	rm := x86emu_decode_rm(width)
+	var cnt uint8
+	switch {
+	case op1 < 0xd0:
+		cnt = fetch_byte_imm()
+		DECODE_PRINTF(",%x", cnt)
+	case op1 < 0xd2:
+		cnt = 1
+		DECODE_PRINTF(",1")
+	default:
+		cnt = M().x86.gen.C.Get8l()
+		DECODE_PRINTF(",CL")
+	}
+	DECODE_PRINTF("\t%s\n", x86emu_shift_names[rm.rh])
+	TRACE_AND_STEP()
+	rm.write(width, x86emu_shiftop(rm.rh, rm.read(width), cnt, width))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xc2 and 0xc3
+func x86emuOp_ret_near(op1 uint8) {
+	var imm uint16
+	if op1 == 0xc2 {
+		imm = fetch_word_imm()
+	}
+	DECODE_PRINTF("RET\t%x\n", imm)
+	r := &M().x86
+	RETURN_TRACE(r.saved_cs, r.saved_ip, r.seg.CS.Get(), r.spc.IP.Get32(), "")
+	TRACE_AND_STEP()
+	x86emu_set_ip(x86emu_pop())
+	x86emu_sp_adjust(int32(imm))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xc4, 0xc5 and the 0x0f,0xb2, 0xb4 and 0xb5 forms: load a
+// far pointer into a segment register and a general register.
+func x86emu_load_far_pointer(n int) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("L%s\t", x86emu_seg_names[n])
+	rm := x86emu_decode_rm(width)
+	rm.check_mem()
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	seg := get_data_segment_index()
+	off := x86emu_data_read(seg, rm.offset, width)
+	sel := fetch_data_word_abs(seg, rm.offset+uint32(width/8))
+	x86emu_load_seg(n, sel)
+	x86emu_reg_write(rm.rh, width, off)
+	if n == SEG_SS {
+		M().x86.mode |= SYSMODE_INTR_SHADOW
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func x86emuOp_les_R_IMM(_ uint8) {
+	x86emu_load_far_pointer(SEG_ES)
+}
+
+func x86emuOp_lds_R_IMM(_ uint8) {
+	x86emu_load_far_pointer(SEG_DS)
+}
+
+// REMARKS:
+// Handles opcodes 0xc6 and 0xc7.  Only /0 is defined.
+func x86emuOp_mov_RM_IMM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	DECODE_PRINTF("MOV\t")
+	rm := x86emu_decode_rm(width)
+	if rm.rh != 0 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	imm := x86emu_fetch_imm(width)
+	DECODE_PRINTF(",%x\n", imm)
+	TRACE_AND_STEP()
+	rm.write(width, imm)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+/* Frame and stack pointers at the stack width */
+func x86emu_stack_reg(r *reg) uint32 {
+	if x86emu_stack32() {
+		return r.Get32()
+	}
+	return uint32(r.Get16())
+}
+
+func x86emu_set_stack_reg(r *reg, v uint32) {
+	if x86emu_stack32() {
+		r.Set32(v)
+	} else {
+		r.Set16(uint16(v))
+	}
+}
+
+// REMARKS:
+// Handles opcode 0xc8
+func x86emuOp_enter(_ uint8) {
+	r := &M().x86
+	size := x86emu_opsize() / 8
+
+	local := fetch_word_imm()
+	nesting := fetch_byte_imm() & 0x1f
+	DECODE_PRINTF("ENTER %x,%x\n", local, nesting)
+	TRACE_AND_STEP()
+	x86emu_push(x86emu_reg_read(5, x86emu_opsize()))
+	frame := x86emu_stack_reg(&r.spc.SP)
+	if nesting > 0 {
+		bp := x86emu_stack_reg(&r.spc.BP)
+		for i := uint8(1); i < nesting; i++ {
+			bp -= uint32(size)
+			if !x86emu_stack32() {
+				bp &= 0xffff
+			}
+			x86emu_push(x86emu_data_read(SEG_SS, bp, size*8))
+		}
+		x86emu_push(frame)
+	}
+	x86emu_set_stack_reg(&r.spc.BP, frame)
+	x86emu_sp_adjust(-int32(local))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xc9
+func x86emuOp_leave(_ uint8) {
+	r := &M().x86
+	DECODE_PRINTF("LEAVE\n")
+	TRACE_AND_STEP()
+	x86emu_set_stack_reg(&r.spc.SP, x86emu_stack_reg(&r.spc.BP))
+	x86emu_reg_write(5, x86emu_opsize(), x86emu_pop())
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xca and 0xcb
+func x86emuOp_ret_far(op1 uint8) {
+	var imm uint16
+	if op1 == 0xca {
+		imm = fetch_word_imm()
+	}
+	DECODE_PRINTF("RETF\t%x\n", imm)
+	TRACE_AND_STEP()
+	ip := x86emu_pop()
+	cs := uint16(x86emu_pop())
+	r := &M().x86
+	RETURN_TRACE(r.saved_cs, r.saved_ip, cs, ip, "FAR")
+	x86emu_load_cs(cs, ip)
+	x86emu_sp_adjust(int32(imm))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xd4.  The immediate is the base, 10 in the usual encoding.
+func x86emuOp_aam(_ uint8) {
+	base := fetch_byte_imm()
+	DECODE_PRINTF("AAM\t%x\n", base)
+	TRACE_AND_STEP()
+	r := &M().x86
+	r.gen.A.Set16(aam_word(r.gen.A.Get8l(), base))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xd5
+func x86emuOp_aad(_ uint8) {
+	base := fetch_byte_imm()
+	DECODE_PRINTF("AAD\t%x\n", base)
+	TRACE_AND_STEP()
+	r := &M().x86
+	r.gen.A.Set16(aad_word(r.gen.A.Get16(), base))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xd7
+func x86emuOp_xlat(_ uint8) {
+	r := &M().x86
+	DECODE_PRINTF("XLAT\n")
+	TRACE_AND_STEP()
+	addr := x86emu_str_index(&r.gen.B) + uint32(r.gen.A.Get8l())
+	if r.mode&SYSMODE_PREFIX_ADDR == 0 {
+		addr &= 0xffff
+	}
+	r.gen.A.Setl8(fetch_data_byte(addr))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xd8-0xdf.  There is no coprocessor, but the ModR/M byte
+// and any displacement are decoded so that execution carries on after the
+// instruction.
+func x86emuOp_esc_coprocess(op1 uint8) {
+	DECODE_PRINTF("ESC %X\t", op1)
+	x86emu_decode_rm(32)
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xe0-0xe3: LOOPNE, LOOPE, LOOP and JCXZ.  The count is CX,
+// or ECX with a 32-bit address size.
+func x86emuOp_loop(op1 uint8) {
+	r := &M().x86
+	disp := x86emu_sext(uint32(fetch_byte_imm()), 8)
+	target := r.spc.IP.Get32() + disp
+	DECODE_PRINTF("%s\t%04x\n", [4]string{"LOOPNE", "LOOPE", "LOOP", "JCXZ"}[op1&3], target)
+	TRACE_AND_STEP()
+	var jump bool
+	if op1 == 0xe3 {
+		jump = x86emu_str_index(&r.gen.C) == 0
+	} else {
+		count := x86emu_str_index(&r.gen.C) - 1
+		x86emu_str_set_index(&r.gen.C, count)
+		jump = count != 0
+		if op1 == 0xe0 {
+			jump = jump && !ACCESS_FLAG(F_ZF)
+		} else if op1 == 0xe1 {
+			jump = jump && ACCESS_FLAG(F_ZF)
+		}
+	}
+	if jump {
+		x86emu_set_ip(target)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xe4-0xe7 and 0xec-0xef: IN and OUT with an immediate
+// port or the port in DX.
+func x86emuOp_in_out(op1 uint8) {
+	r := &M().x86
+	width := x86emu_opwidth(op1)
+	var port uint16
+	if op1 < 0xec {
+		port = uint16(fetch_byte_imm())
+	} else {
+		port = r.gen.D.Get16()
+	}
+	TRACE_AND_STEP()
+	if op1&2 == 0 {
+		DECODE_PRINTF("IN\t%s,%x\n", x86emu_reg_name(0, width), port)
+		x86emu_reg_write(0, width, x86emu_port_in(port, int(width/8)))
+	} else {
+		DECODE_PRINTF("OUT\t%x,%s\n", port, x86emu_reg_name(0, width))
+		x86emu_port_out(port, int(width/8), x86emu_reg_read(0, width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xe8
+func x86emuOp_call_near_IMM(_ uint8) {
+	r := &M().x86
+	disp := x86emu_fetch_imm(x86emu_opsize())
+	if x86emu_opsize() == 16 {
+		disp = x86emu_sext(disp, 16)
+	}
+	target := r.spc.IP.Get32() + disp
+	DECODE_PRINTF("CALL\t%04x\n", target)
+	CALL_TRACE(r.saved_cs, r.saved_ip, r.seg.CS.Get(), target, "")
+	TRACE_AND_STEP()
+	x86emu_push(r.spc.IP.Get32())
+	x86emu_set_ip(target)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xe9 and 0xeb
+func x86emuOp_jump_near_IMM(op1 uint8) {
+	r := &M().x86
+	var disp uint32
+	if op1 == 0xeb {
+		disp = x86emu_sext(uint32(fetch_byte_imm()), 8)
+	} else {
+		disp = x86emu_fetch_imm(x86emu_opsize())
+		if x86emu_opsize() == 16 {
+			disp = x86emu_sext(disp, 16)
+		}
+	}
+	target := r.spc.IP.Get32() + disp
+	DECODE_PRINTF("JMP\t%04x\n", target)
+	TRACE_AND_STEP()
+	x86emu_set_ip(target)
+	JMP_TRACE(r.saved_cs, r.saved_ip, r.seg.CS.Get(), r.spc.IP.Get32(), " NEAR ")
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xf0.  Every instruction is atomic here.
+func x86emuOp_lock(_ uint8) {
+	DECODE_PRINTF("LOCK:\n")
+	TRACE_AND_STEP()
+	/* note no DECODE_CLEAR_SEGOVR here. */
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xf2 and 0xf3.  The prefix applies to the string
+// instruction that follows, and like the others is cleared when it ends.
+func x86emuOp_rep(op1 uint8) {
+	r := &M().x86
+	r.mode &^= SYSMODE_PREFIX_REPE | SYSMODE_PREFIX_REPNE
+	if op1 == 0xf2 {
+		DECODE_PRINTF("REPNE\n")
+		r.mode |= SYSMODE_PREFIX_REPNE
+	} else {
+		DECODE_PRINTF("REPE\n")
+		r.mode |= SYSMODE_PREFIX_REPE
+	}
+	TRACE_AND_STEP()
+	/* note no DECODE_CLEAR_SEGOVR here. */
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xf5
+func x86emuOp_cmc(_ uint8) {
+	DECODE_PRINTF("CMC\n")
+	TRACE_AND_STEP()
+	TOGGLE_FLAG(F_CF)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xf6 and 0xf7.  /1 is an undocumented copy of TEST.
+func x86emuOp_opcF6_RM(op1 uint8) {
+	width := x86emu_opwidth(op1)
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF("\t%s", x86emu_opF6_names[rm.rh])
+	if rm.rh < 2 {
+		imm := x86emu_fetch_imm(width)
+		DECODE_PRINTF(",%x\n", imm)
+		TRACE_AND_STEP()
+		x86emu_logic(rm.read(width)&imm, width)
+		DecodeClearSegOVR()
+		END_OF_INSTR()
+		return
+	}
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	v := rm.read(width)
+	switch rm.rh {
+	case 2:
+		rm.write(width, ^v)
+	case 3:
+		rm.write(width, x86emu_sub(0, v, 0, width))
+	case 4:
+		switch width {
+		case 8:
+			mul_byte(uint8(v))
+		case 16:
+			mul_word(uint16(v))
+		default:
+			mul_long(v)
+		}
+	case 5:
+		switch width {
+		case 8:
+			imul_byte(uint8(v))
+		case 16:
+			imul_word(uint16(v))
+		default:
+			imul_long(v)
+		}
+	case 6:
+		switch width {
+		case 8:
+			div_byte(uint8(v))
+		case 16:
+			div_word(uint16(v))
+		default:
+			div_long(v)
+		}
+	case 7:
+		switch width {
+		case 8:
+			idiv_byte(uint8(v))
+		case 16:
+			idiv_word(uint16(v))
+		default:
+			idiv_long(v)
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0xf8-0xfd: CLC, STC, CLI, STI, CLD and STD.  STI holds
+// off interrupts until the instruction after it has run, so STI; HLT waits
+// for the next one.
+func x86emuOp_flag_op(op1 uint8) {
+	DECODE_PRINTF("%s\n", [6]string{"CLC", "STC", "CLI", "STI", "CLD", "STD"}[op1-0xf8])
+	TRACE_AND_STEP()
+	switch op1 {
+	case 0xf8:
+		CLEAR_FLAG(F_CF)
+	case 0xf9:
+		SET_FLAG(F_CF)
+	case 0xfa:
+		x86emu_check_iopl()
+		CLEAR_FLAG(F_IF)
+	case 0xfb:
+		x86emu_check_iopl()
+		if !ACCESS_FLAG(F_IF) {
+			M().x86.mode |= SYSMODE_INTR_SHADOW
+		}
+		SET_FLAG(F_IF)
+	case 0xfc:
+		CLEAR_FLAG(F_DF)
+	case 0xfd:
+		SET_FLAG(F_DF)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xfe: INC and DEC of a byte; the rest are undefined.
+func x86emuOp_opcFE_byte_RM(_ uint8) {
+	rm := x86emu_decode_rm(8)
+	if rm.rh > 1 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("\t%s\n", [2]string{"INC", "DEC"}[rm.rh])
+	TRACE_AND_STEP()
+	if rm.rh == 0 {
+		rm.write(8, x86emu_inc(rm.read(8), 8))
+	} else {
+		rm.write(8, x86emu_dec(rm.read(8), 8))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xff: INC, DEC, near and far CALL and JMP through a
+// register or memory, and PUSH.  The far forms take a pointer in memory.
+func x86emuOp_opcFF_word_RM(_ uint8) {
+	r := &M().x86
+	width := x86emu_opsize()
+	rm := x86emu_decode_rm(width)
+	if rm.rh == 7 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("\t%s\n", [7]string{"INC", "DEC", "CALL", "CALL FAR", "JMP", "JMP FAR", "PUSH"}[rm.rh])
+	TRACE_AND_STEP()
+	switch rm.rh {
+	case 0:
+		rm.write(width, x86emu_inc(rm.read(width), width))
+	case 1:
+		rm.write(width, x86emu_dec(rm.read(width), width))
+	case 2:
+		ip := rm.read(width)
+		CALL_TRACE(r.saved_cs, r.saved_ip, r.seg.CS.Get(), ip, "")
+		x86emu_push(r.spc.IP.Get32())
+		x86emu_set_ip(ip)
+	case 3, 5:
+		rm.check_mem()
+		seg := get_data_segment_index()
+		ip := x86emu_data_read(seg, rm.offset, width)
+		cs := fetch_data_word_abs(seg, rm.offset+uint32(width/8))
+		if rm.rh == 3 {
+			CALL_TRACE(r.saved_cs, r.saved_ip, cs, ip, "FAR ")
+			x86emu_push(uint32(r.seg.CS.Get()))
+			x86emu_push(r.spc.IP.Get32())
+		} else {
+			JMP_TRACE(r.saved_cs, r.saved_ip, cs, ip, " FAR ")
+		}
+		x86emu_load_cs(cs, ip)
+	case 4:
+		ip := rm.read(width)
+		JMP_TRACE(r.saved_cs, r.saved_ip, r.seg.CS.Get(), ip, " WORD ")
+		x86emu_set_ip(ip)
+	case 6:
+		x86emu_push(rm.read(width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// Single byte operation code table
+func init() {
+	for op := 0; op < 0x40; op += 8 {
+		for i := 0; i < 6; i++ {
+			x86emu_optab[uint8(op+i)] = x86emuOp_genop
+		}
+	}
+	for _, op := range []uint8{0x06, 0x0e, 0x16, 0x1e} {
+		x86emu_optab[op] = x86emuOp_push_seg
+	}
+	for _, op := range []uint8{0x07, 0x17, 0x1f} {
+		x86emu_optab[op] = x86emuOp_pop_seg
+	}
+	for _, op := range []uint8{0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65} {
+		x86emu_optab[op] = x86emuOp_segovr
+	}
+	for _, op := range []uint8{0x27, 0x2f, 0x37, 0x3f} {
+		x86emu_optab[op] = x86emuOp_bcd
+	}
+	for op := 0; op < 8; op++ {
+		x86emu_optab[uint8(0x40+op)] = x86emuOp_inc_dec_register
+		x86emu_optab[uint8(0x48+op)] = x86emuOp_inc_dec_register
+		x86emu_optab[uint8(0x50+op)] = x86emuOp_push_register
+		x86emu_optab[uint8(0x58+op)] = x86emuOp_pop_register
+		x86emu_optab[uint8(0x90+op)] = x86emuOp_xchg_word_AX_register
+		x86emu_optab[uint8(0xb0+op)] = x86emuOp_mov_register_IMM
+		x86emu_optab[uint8(0xb8+op)] = x86emuOp_mov_register_IMM
+		x86emu_optab[uint8(0xd8+op)] = x86emuOp_esc_coprocess
+	}
+	x86emu_optab[0x60] = x86emuOp_push_all
+	x86emu_optab[0x61] = x86emuOp_pop_all
+	x86emu_optab[0x68] = x86emuOp_push_IMM
+	x86emu_optab[0x69] = x86emuOp_imul_IMM
+	x86emu_optab[0x6a] = x86emuOp_push_IMM
+	x86emu_optab[0x6b] = x86emuOp_imul_IMM
+	x86emu_optab[0x6c] = x86emuOp_ins
+	x86emu_optab[0x6d] = x86emuOp_ins
+	x86emu_optab[0x6e] = x86emuOp_outs
+	x86emu_optab[0x6f] = x86emuOp_outs
+	for op := 0x70; op < 0x80; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_jump_near_cond
+	}
+	for op := 0x80; op < 0x84; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_opc80_RM_IMM
+	}
+	x86emu_optab[0x84] = x86emuOp_test_RM_R
+	x86emu_optab[0x85] = x86emuOp_test_RM_R
+	x86emu_optab[0x86] = x86emuOp_xchg_RM_R
+	x86emu_optab[0x87] = x86emuOp_xchg_RM_R
+	for op := 0x88; op < 0x8c; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_mov_RM_R
+	}
+	x86emu_optab[0x8c] = x86emuOp_mov_word_RM_SR
+	x86emu_optab[0x8d] = x86emuOp_lea_word_R_M
+	x86emu_optab[0x8f] = x86emuOp_pop_RM
+	x86emu_optab[0x98] = x86emuOp_cbw
+	x86emu_optab[0x99] = x86emuOp_cwd
+	x86emu_optab[0x9a] = x86emuOp_call_far_IMM
+	x86emu_optab[0x9b] = x86emuOp_wait
+	x86emu_optab[0x9e] = x86emuOp_sahf
+	x86emu_optab[0x9f] = x86emuOp_lahf
+	for op := 0xa0; op < 0xa4; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_mov_A_M_IMM
+	}
+	x86emu_optab[0xa4] = x86emuOp_movs
+	x86emu_optab[0xa5] = x86emuOp_movs
+	x86emu_optab[0xa6] = x86emuOp_cmps
+	x86emu_optab[0xa7] = x86emuOp_cmps
+	x86emu_optab[0xa8] = x86emuOp_test_A_IMM
+	x86emu_optab[0xa9] = x86emuOp_test_A_IMM
+	x86emu_optab[0xaa] = x86emuOp_stos
+	x86emu_optab[0xab] = x86emuOp_stos
+	x86emu_optab[0xac] = x86emuOp_lods
+	x86emu_optab[0xad] = x86emuOp_lods
+	x86emu_optab[0xae] = x86emuOp_scas
+	x86emu_optab[0xaf] = x86emuOp_scas
+	x86emu_optab[0xc0] = x86emuOp_shift_RM
+	x86emu_optab[0xc1] = x86emuOp_shift_RM
+	x86emu_optab[0xc2] = x86emuOp_ret_near
+	x86emu_optab[0xc3] = x86emuOp_ret_near
+	x86emu_optab[0xc4] = x86emuOp_les_R_IMM
+	x86emu_optab[0xc5] = x86emuOp_lds_R_IMM
+	x86emu_optab[0xc6] = x86emuOp_mov_RM_IMM
+	x86emu_optab[0xc7] = x86emuOp_mov_RM_IMM
+	x86emu_optab[0xc8] = x86emuOp_enter
+	x86emu_optab[0xc9] = x86emuOp_leave
+	x86emu_optab[0xca] = x86emuOp_ret_far
+	x86emu_optab[0xcb] = x86emuOp_ret_far
+	for op := 0xd0; op < 0xd4; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_shift_RM
+	}
+	x86emu_optab[0xd4] = x86emuOp_aam
+	x86emu_optab[0xd5] = x86emuOp_aad
+	x86emu_optab[0xd7] = x86emuOp_xlat
+	for op := 0xe0; op < 0xe4; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_loop
+	}
+	for _, op := range []uint8{0xe4, 0xe5, 0xe6, 0xe7, 0xec, 0xed, 0xee, 0xef} {
+		x86emu_optab[op] = x86emuOp_in_out
+	}
+	x86emu_optab[0xe8] = x86emuOp_call_near_IMM
+	x86emu_optab[0xe9] = x86emuOp_jump_near_IMM
+	x86emu_optab[0xeb] = x86emuOp_jump_near_IMM
+	x86emu_optab[0xf0] = x86emuOp_lock
+	x86emu_optab[0xf2] = x86emuOp_rep
+	x86emu_optab[0xf3] = x86emuOp_rep
+	x86emu_optab[0xf5] = x86emuOp_cmc
+	x86emu_optab[0xf6] = x86emuOp_opcF6_RM
+	x86emu_optab[0xf7] = x86emuOp_opcF6_RM
+	for op := 0xf8; op < 0xfe; op++ {
+		x86emu_optab[uint8(op)] = x86emuOp_flag_op
+	}
+	x86emu_optab[0xfe] = x86emuOp_opcFE_byte_RM
+	x86emu_optab[0xff] = x86emuOp_opcFF_word_RM
+}
@@ -0,0 +1,336 @@
+/****************************************************************************
+*
+*                       Realmode X86 Emulator Library
+*
+*               Copyright (C) 1991-2004 SciTech Software, Inc.
+*                    Copyright (C) David Mosberger-Tang
+*                      Copyright (C) 1999 Egbert Eich
+*
+*  ========================================================================
+*
+*  Permission to use, copy, modify, distribute, and sell this software and
+*  its documentation for any purpose is hereby granted without fee,
+*  provided that the above copyright notice appear in all copies and that
+*  both that copyright notice and this permission notice appear in
+*  supporting documentation, and that the name of the authors not be used
+*  in advertising or publicity pertaining to distribution of the software
+*  without specific, written prior permission.  The authors makes no
+*  representations about the suitability of this software for any purpose.
+*  It is provided "as is" without express or implied warranty.
+*
+*  THE AUTHORS DISCLAIMS ALL WARRANTIES WITH REGARD TO THIS SOFTWARE,
+*  INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS, IN NO
+*  EVENT SHALL THE AUTHORS BE LIABLE FOR ANY SPECIAL, INDIRECT OR
+*  CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM LOSS OF
+*  USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+*  OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+*  PERFORMANCE OF THIS SOFTWARE.
+*
+*  ========================================================================
+*
+* Language:     ANSI C
+* Environment:  Any
+* Developer:    Kendall Bennett
+*
+* Description:  This file includes subroutines to implement the decoding
+*               and emulation of all the x86 extended two-byte processor
+*               instructions.
+*
+* As in ops.go, a handler works on an operand width in bits rather than
+* having a word and a dword copy.
+*
+****************************************************************************/
+
+package main
+
+import "math/bits"
+
+/*----------------------------- Implementation ----------------------------*/
+
+// REMARKS:
+// Handles opcode 0x0f,0x08
+func x86emuOp2_invd(_ uint8) {
+	DECODE_PRINTF("INVD\n")
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x09
+func x86emuOp2_wbinvd(_ uint8) {
+	DECODE_PRINTF("WBINVD\n")
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0x80-0x8f
+func x86emuOp2_long_jump(op2 uint8) {
+	/* conditional jump to word offset. */
+	disp := x86emu_fetch_imm(x86emu_opsize())
+	if x86emu_opsize() == 16 {
+		disp = x86emu_sext(disp, 16)
+	}
+	cond := x86emu_check_jump_condition(op2 & 0xf)
+	target := M().x86.spc.IP.Get32() + disp
+	DECODE_PRINTF("J%s\t%04x\n", x86emu_cond_names[op2&0xf], target)
+	TRACE_AND_STEP()
+	if cond {
+		x86emu_set_ip(target)
+		JMP_TRACE(M().x86.saved_cs, M().x86.saved_ip, M().x86.seg.CS.Get(), M().x86.spc.IP.Get32(), " LONG COND ")
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0x90-0x9f
+func x86emuOp2_set_byte(op2 uint8) {
+	DECODE_PRINTF("SET%s\t", x86emu_cond_names[op2&0xf])
+	rm := x86emu_decode_rm(8)
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	if x86emu_check_jump_condition(op2 & 0xf) {
+		rm.write(8, 1)
+	} else {
+		rm.write(8, 0)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xa0 and 0x0f,0xa8
+func x86emuOp2_push_FS_GS(op2 uint8) {
+	if op2 == 0xa0 {
+		x86emu_push_seg(SEG_FS)
+	} else {
+		x86emu_push_seg(SEG_GS)
+	}
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xa1 and 0x0f,0xa9
+func x86emuOp2_pop_FS_GS(op2 uint8) {
+	if op2 == 0xa1 {
+		x86emu_pop_seg(SEG_FS)
+	} else {
+		x86emu_pop_seg(SEG_GS)
+	}
+}
+
+var x86emu_bt_names = [4]string{"BT", "BTS", "BTR", "BTC"}
+
+// PARAMETERS:
+// op  - 0 for BT, 1 BTS, 2 BTR, 3 BTC
+// rm  - Bit string operand
+// bit - Bit offset
+// imm - Whether the offset is an immediate, which stays within the operand
+//
+// REMARKS:
+// A register offset on a memory operand can reach outside it: the
+// operand at the offset divided by the operand width, signed, is used.
+func x86emu_bit_op(op int, rm *x86emu_rm, bit uint32, imm bool, width uint) {
+	if !rm.is_reg() && !imm {
+		rm.offset += uint32(int32(x86emu_sext(bit, width))>>bits.TrailingZeros(width)) * uint32(width/8)
+	}
+	bit &= uint32(width - 1)
+	v := rm.read(width)
+	CONDITIONAL_SET_FLAG(v>>bit&1 != 0, F_CF)
+	switch op {
+	case 1:
+		rm.write(width, v|1<<bit)
+	case 2:
+		rm.write(width, v&^(1<<bit))
+	case 3:
+		rm.write(width, v^1<<bit)
+	}
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xa3, 0x0f,0xab, 0x0f,0xb3 and 0x0f,0xbb
+func x86emuOp2_bt_R(op2 uint8) {
+	width := x86emu_opsize()
+	op := int(op2>>3) & 3
+	DECODE_PRINTF("%s\t", x86emu_bt_names[op])
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	x86emu_bit_op(op, &rm, x86emu_reg_read(rm.rh, width), false, width)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0xba.  /4-/7 are BT, BTS, BTR and BTC.
+func x86emuOp2_btX_I(_ uint8) {
+	width := x86emu_opsize()
+	rm := x86emu_decode_rm(width)
+	if rm.rh < 4 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	bit := fetch_byte_imm()
+	DECODE_PRINTF(",%x\t%s\n", bit, x86emu_bt_names[rm.rh-4])
+	TRACE_AND_STEP()
+	x86emu_bit_op(rm.rh-4, &rm, uint32(bit), true, width)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xa4, 0x0f,0xa5, 0x0f,0xac and 0x0f,0xad
+func x86emuOp2_shld_shrd(op2 uint8) {
+	width := x86emu_opsize()
+	name := "SHLD"
+	if op2 >= 0xac {
+		name = "SHRD"
+	}
+	DECODE_PRINTF("%s\t", name)
+	rm := x86emu_decode_rm(width)
+	var cnt uint8
+	if op2&1 == 0 {
+		cnt = fetch_byte_imm()
+		DECODE_PRINTF(",%s,%x\n", x86emu_reg_name(rm.rh, width), cnt)
+	} else {
+		cnt = M().x86.gen.C.Get8l()
+		DECODE_PRINTF(",%s,CL\n", x86emu_reg_name(rm.rh, width))
+	}
+	TRACE_AND_STEP()
+	cnt &= 0x1f
+	fill := x86emu_reg_read(rm.rh, width)
+	if op2 >= 0xac {
+		rm.write(width, x86emu_shrd(rm.read(width), fill, uint(cnt), width))
+	} else {
+		rm.write(width, x86emu_shld(rm.read(width), fill, uint(cnt), width))
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0xaf
+func x86emuOp2_imul_R_RM(_ uint8) {
+	width := x86emu_opsize()
+	DECODE_PRINTF("IMUL\t")
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	x86emu_reg_write(rm.rh, width, x86emu_imul(x86emu_reg_read(rm.rh, width), rm.read(width), width))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xb2, 0x0f,0xb4 and 0x0f,0xb5
+func x86emuOp2_lss_lfs_lgs(op2 uint8) {
+	switch op2 {
+	case 0xb2:
+		x86emu_load_far_pointer(SEG_SS)
+	case 0xb4:
+		x86emu_load_far_pointer(SEG_FS)
+	default:
+		x86emu_load_far_pointer(SEG_GS)
+	}
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xb6, 0x0f,0xb7, 0x0f,0xbe and 0x0f,0xbf
+func x86emuOp2_movx(op2 uint8) {
+	width := x86emu_opsize()
+	src := uint(8)
+	if op2&1 != 0 {
+		src = 16
+	}
+	if op2 < 0xb8 {
+		DECODE_PRINTF("MOVZX\t")
+	} else {
+		DECODE_PRINTF("MOVSX\t")
+	}
+	rm := x86emu_decode_rm(src)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	v := rm.read(src)
+	if op2 >= 0xb8 {
+		v = x86emu_sext(v, src)
+	}
+	x86emu_reg_write(rm.rh, width, v)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xbc and 0x0f,0xbd.  A zero source sets ZF and
+// leaves the destination alone.
+func x86emuOp2_bsf_bsr(op2 uint8) {
+	width := x86emu_opsize()
+	if op2 == 0xbc {
+		DECODE_PRINTF("BSF\t")
+	} else {
+		DECODE_PRINTF("BSR\t")
+	}
+	rm := x86emu_decode_rm(width)
+	DECODE_PRINTF(",%s\n", x86emu_reg_name(rm.rh, width))
+	TRACE_AND_STEP()
+	v := rm.read(width)
+	CONDITIONAL_SET_FLAG(v == 0, F_ZF)
+	if v != 0 {
+		if op2 == 0xbc {
+			x86emu_reg_write(rm.rh, width, uint32(bits.TrailingZeros32(v)))
+		} else {
+			x86emu_reg_write(rm.rh, width, uint32(31-bits.LeadingZeros32(v)))
+		}
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcodes 0x0f,0xc8-0x0f,0xcf
+func x86emuOp2_bswap(op2 uint8) {
+	r := x86emu_greg(int(op2 & 7))
+	DECODE_PRINTF("BSWAP\t%s\n", x86emu_greg32_names[op2&7])
+	TRACE_AND_STEP()
+	r.Set32(bits.ReverseBytes32(r.Get32()))
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// Double byte operation code table
+func init() {
+	x86emu_optab2[0x08] = x86emuOp2_invd
+	x86emu_optab2[0x09] = x86emuOp2_wbinvd
+	for op := 0; op < 0x10; op++ {
+		x86emu_optab2[uint8(0x80+op)] = x86emuOp2_long_jump
+		x86emu_optab2[uint8(0x90+op)] = x86emuOp2_set_byte
+	}
+	x86emu_optab2[0xa0] = x86emuOp2_push_FS_GS
+	x86emu_optab2[0xa1] = x86emuOp2_pop_FS_GS
+	x86emu_optab2[0xa3] = x86emuOp2_bt_R
+	x86emu_optab2[0xa4] = x86emuOp2_shld_shrd
+	x86emu_optab2[0xa5] = x86emuOp2_shld_shrd
+	x86emu_optab2[0xa8] = x86emuOp2_push_FS_GS
+	x86emu_optab2[0xa9] = x86emuOp2_pop_FS_GS
+	x86emu_optab2[0xab] = x86emuOp2_bt_R
+	x86emu_optab2[0xac] = x86emuOp2_shld_shrd
+	x86emu_optab2[0xad] = x86emuOp2_shld_shrd
+	x86emu_optab2[0xaf] = x86emuOp2_imul_R_RM
+	x86emu_optab2[0xb2] = x86emuOp2_lss_lfs_lgs
+	x86emu_optab2[0xb3] = x86emuOp2_bt_R
+	x86emu_optab2[0xb4] = x86emuOp2_lss_lfs_lgs
+	x86emu_optab2[0xb5] = x86emuOp2_lss_lfs_lgs
+	x86emu_optab2[0xb6] = x86emuOp2_movx
+	x86emu_optab2[0xb7] = x86emuOp2_movx
+	x86emu_optab2[0xba] = x86emuOp2_btX_I
+	x86emu_optab2[0xbb] = x86emuOp2_bt_R
+	x86emu_optab2[0xbc] = x86emuOp2_bsf_bsr
+	x86emu_optab2[0xbd] = x86emuOp2_bsf_bsr
+	x86emu_optab2[0xbe] = x86emuOp2_movx
+	x86emu_optab2[0xbf] = x86emuOp2_movx
+	for op := 0; op < 8; op++ {
+		x86emu_optab2[uint8(0xc8+op)] = x86emuOp2_bswap
+	}
+}
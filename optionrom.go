@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+/*
+ * Option ROM loader.
+ *
+ * An option ROM file may hold several images, each starting with 55AA, a
+ * size byte in 512 byte units and, for PCI, a pointer at 0x18 to the PCI
+ * Data Structure naming the device and the code type.  The x86 image is
+ * copied to the ROM area and initialised by a far call to offset 3 with
+ * AH=bus, AL=device/function, as the PCI Firmware Specification has the
+ * BIOS do.  The call returns to a Go trap, so a clean return can be told
+ * apart from a ROM that halted or crashed.
+ */
+
+const (
+	OPROM_SIGNATURE  = 0xaa55
+	OPROM_SEGMENT    = 0xc000  /* default load segment */
+	OPROM_AREA_END   = 0xf0000 /* ROMs must fit below the system BIOS */
+	PCIR_CODE_X86    = 0x00
+	PCIR_LAST_IMAGE  = 0x80
+	PCIR_PTR_OFFSET  = 0x18
+	PCIR_SIGNATURE   = 0x52494350 /* "PCIR" */
+	OPROM_NO_PCI_BDF = 0xffff
+)
+
+/* PCI Data Structure of an image */
+type X86EMU_pcir struct {
+	vendor    uint16
+	device    uint16
+	class     uint32 /* base class, subclass, prog-if */
+	image_len uint32 /* bytes */
+	revision  uint16 /* revision of the code */
+	code_type uint8
+	last      bool
+}
+
+type X86EMU_optionRom struct {
+	data   []byte /* the x86 image, size byte long */
+	offset int    /* of the image in the file */
+	pcir   *X86EMU_pcir
+	images int /* images up to and including this one */
+}
+
+/* Result of running the initialisation entry point */
+type X86EMU_romResult struct {
+	x86emu_call_result
+	ax       uint16
+	resident uint32 /* bytes the ROM kept, from its size byte */
+}
+
+func (r *X86EMU_pcir) String() string {
+	return fmt.Sprintf("%04x:%04x class %06x type %d%s", r.vendor, r.device, r.class,
+		r.code_type, map[bool]string{true: " last", false: ""}[r.last])
+}
+
+/* Parses the PCI Data Structure of the image at off, or returns nil. */
+func x86emu_parse_pcir(data []byte, off int) (*X86EMU_pcir, error) {
+	p := off + int(binary.LittleEndian.Uint16(data[off+PCIR_PTR_OFFSET:]))
+	if p+0x18 > len(data) || binary.LittleEndian.Uint32(data[p:]) != PCIR_SIGNATURE {
+		return nil, nil
+	}
+	if p&3 != 0 {
+		return nil, fmt.Errorf("image at %#x: PCI data structure at %#x is not dword aligned", off, p-off)
+	}
+	d := data[p:]
+	return &X86EMU_pcir{
+		vendor:    binary.LittleEndian.Uint16(d[4:]),
+		device:    binary.LittleEndian.Uint16(d[6:]),
+		class:     uint32(d[0xf])<<16 | uint32(d[0xe])<<8 | uint32(d[0xd]),
+		image_len: uint32(binary.LittleEndian.Uint16(d[0x10:])) * 512,
+		revision:  binary.LittleEndian.Uint16(d[0x12:]),
+		code_type: d[0x14],
+		last:      d[0x15]&PCIR_LAST_IMAGE != 0,
+	}, nil
+}
+
+// PARAMETERS:
+// data - Contents of an option ROM file
+//
+// RETURNS:
+// The x86 image of the ROM.
+//
+// REMARKS:
+// Walks the images of the file until one with code type 0, or an image
+// without a PCI Data Structure (an ISA ROM), is found, and checks its
+// signature, size and checksum.
+func X86EMU_parseOptionRom(data []byte) (*X86EMU_optionRom, error) {
+	rom := &X86EMU_optionRom{}
+	for off := 0; ; {
+		if off+0x1a > len(data) {
+			return nil, fmt.Errorf("no x86 image in %d images", rom.images)
+		}
+		if binary.LittleEndian.Uint16(data[off:]) != OPROM_SIGNATURE {
+			return nil, fmt.Errorf("image at %#x: no 55AA signature", off)
+		}
+		rom.images++
+		pcir, err := x86emu_parse_pcir(data, off)
+		if err != nil {
+			return nil, err
+		}
+		size := int(data[off+2]) * 512
+		if pcir == nil || pcir.code_type == PCIR_CODE_X86 {
+			if size == 0 {
+				return nil, fmt.Errorf("image at %#x: size byte is 0", off)
+			}
+			if off+size > len(data) {
+				return nil, fmt.Errorf("image at %#x: size %#x runs past the end of the file", off, size)
+			}
+			sum := uint8(0)
+			for _, b := range data[off : off+size] {
+				sum += b
+			}
+			if sum != 0 {
+				return nil, fmt.Errorf("image at %#x: bad checksum %#02x", off, sum)
+			}
+			rom.data = data[off : off+size]
+			rom.offset = off
+			rom.pcir = pcir
+			return rom, nil
+		}
+		if pcir.last || pcir.image_len == 0 {
+			return nil, fmt.Errorf("no x86 image in %d images", rom.images)
+		}
+		off += int(pcir.image_len)
+	}
+}
+
+/* Reads and parses an option ROM file. */
+func X86EMU_readOptionRom(path string) (*X86EMU_optionRom, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rom, err := X86EMU_parseOptionRom(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rom, nil
+}
+
+// PARAMETERS:
+// rom - Parsed ROM
+// seg - Segment to copy it to, normally OPROM_SEGMENT
+func X86EMU_copyOptionRom(rom *X86EMU_optionRom, seg uint16) error {
+	base := uint32(seg) << 4
+	if base&0x7ff != 0 {
+		return fmt.Errorf("segment %04x is not 2K aligned", seg)
+	}
+	if base+uint32(len(rom.data)) > OPROM_AREA_END {
+		return fmt.Errorf("%d byte ROM at %04x:0000 overlaps the system BIOS", len(rom.data), seg)
+	}
+	x86emu_phys_copy_in(base, rom.data)
+	return nil
+}
+
+// PARAMETERS:
+// seg - Segment the ROM was copied to
+//
+// RETURNS:
+// Bytes the ROM at seg claims: its size byte, or 0 if the signature is
+// gone.
+func x86emu_rom_resident(seg uint16) uint32 {
+	base := uint32(seg) << 4
+	if x86emu_phys_read(base, 2) != OPROM_SIGNATURE {
+		return 0
+	}
+	return x86emu_phys_read(base+2, 1) * 512
+}
+
+// PARAMETERS:
+// seg - Segment the ROM was copied to
+// bdf - Bus, device and function of the device, or OPROM_NO_PCI_BDF
+//
+// RETURNS:
+// How the initialisation call ended.
+func X86EMU_initOptionRom(seg uint16, bdf uint16) *X86EMU_romResult {
+	return x86emu_rom_call(seg, 3, bdf)
+}
+
+// PARAMETERS:
+// seg - Segment of the ROM
+// off - Entry point within the ROM
+// bdf - Bus, device and function of the device, or OPROM_NO_PCI_BDF
+//
+// REMARKS:
+// Far calls an entry point of the ROM and runs until it returns or the
+// emulator halts.  AX holds bdf; BX and DX are FFFF, which tells a PnP ROM
+// there is no ISA PnP card select number or read port.  ES:DI points to
+// the PnP installation check structure once X86EMU_setupPnpBios has
+// placed one.
+func x86emu_rom_call(seg uint16, off uint16, bdf uint16) *X86EMU_romResult {
+	r := &M().x86
+	r.gen.A.Set32(uint32(bdf))
+	r.gen.B.Set32(0xffff)
+	r.gen.D.Set32(0xffff)
+	if addr := x86emu_pnp_present(); addr != 0 {
+		x86emu_load_seg(SEG_ES, uint16(addr>>4))
+		r.spc.DI.Set32(addr & 0xf)
+	}
+	res := &X86EMU_romResult{x86emu_call_result: x86emu_call_far(seg, off)}
+	res.ax = r.gen.A.Get16()
+	res.resident = x86emu_rom_resident(seg)
+	return res
+}
+
+func (r *X86EMU_romResult) String() string {
+	how := "returned cleanly"
+	switch {
+	case !r.returned:
+		how = fmt.Sprintf("did not return; stopped at %04x:%04x", r.cs, r.ip)
+	case !r.clean:
+		how = "returned with an unbalanced stack"
+	}
+	return fmt.Sprintf("%s, ax=%04x, %d bytes resident", how, r.ax, r.resident)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Builds an option ROM image of blocks 512 byte blocks, with a PCI Data
+// Structure at 0x20 unless pcir is nil, and a good checksum.
+func x86emu_test_rom_image(blocks int, pcir *X86EMU_pcir) []byte {
+	d := make([]byte, blocks*512)
+	binary.LittleEndian.PutUint16(d, OPROM_SIGNATURE)
+	d[2] = uint8(blocks)
+	if pcir != nil {
+		p := d[0x20:]
+		binary.LittleEndian.PutUint16(d[PCIR_PTR_OFFSET:], 0x20)
+		binary.LittleEndian.PutUint32(p, PCIR_SIGNATURE)
+		binary.LittleEndian.PutUint16(p[4:], pcir.vendor)
+		binary.LittleEndian.PutUint16(p[6:], pcir.device)
+		binary.LittleEndian.PutUint16(p[0xa:], 0x18)
+		p[0xd], p[0xe], p[0xf] = uint8(pcir.class), uint8(pcir.class>>8), uint8(pcir.class>>16)
+		binary.LittleEndian.PutUint16(p[0x10:], uint16(pcir.image_len/512))
+		binary.LittleEndian.PutUint16(p[0x12:], pcir.revision)
+		p[0x14] = pcir.code_type
+		if pcir.last {
+			p[0x15] = PCIR_LAST_IMAGE
+		}
+	}
+	sum := uint8(0)
+	for _, b := range d {
+		sum += b
+	}
+	d[len(d)-1] = -sum
+	return d
+}
+
+func TestParseOptionRom(t *testing.T) {
+	vga := &X86EMU_pcir{vendor: 0x8086, device: 0x0166, class: 0x030000,
+		image_len: 0x400, revision: 0x0102, code_type: PCIR_CODE_X86, last: true}
+	efi := &X86EMU_pcir{vendor: 0x8086, device: 0x0166, class: 0x030000,
+		image_len: 0x600, code_type: 3}
+	efi_last := *efi
+	efi_last.last = true
+	cat := func(images ...[]byte) []byte {
+		var d []byte
+		for _, i := range images {
+			d = append(d, i...)
+		}
+		return d
+	}
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		offset int
+		pcir   *X86EMU_pcir
+		images int
+		err    bool
+	}{
+		{"isa", x86emu_test_rom_image(1, nil), 0, nil, 1, false},
+		{"pci", x86emu_test_rom_image(2, vga), 0, vga, 1, false},
+		{"efi then x86", cat(x86emu_test_rom_image(3, efi), x86emu_test_rom_image(2, vga)),
+			0x600, vga, 2, false},
+		{"efi only", x86emu_test_rom_image(3, &efi_last), 0, nil, 0, true},
+		{"trailing padding", cat(x86emu_test_rom_image(1, nil), make([]byte, 0x200)), 0, nil, 1, false},
+		{"too short", []byte{0x55, 0xaa, 1}, 0, nil, 0, true},
+		{"no signature", make([]byte, 0x200), 0, nil, 0, true},
+		{"bad checksum", func() []byte {
+			d := x86emu_test_rom_image(1, nil)
+			d[0x100]++
+			return d
+		}(), 0, nil, 0, true},
+		{"size byte 0", func() []byte {
+			d := x86emu_test_rom_image(1, nil)
+			d[2] = 0
+			return d
+		}(), 0, nil, 0, true},
+		{"size past the end", x86emu_test_rom_image(2, nil)[:0x200], 0, nil, 0, true},
+		{"pcir not dword aligned", func() []byte {
+			d := x86emu_test_rom_image(2, vga)
+			copy(d[0x22:], d[0x20:0x38])
+			d[PCIR_PTR_OFFSET] = 0x22
+			return d
+		}(), 0, nil, 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rom, err := X86EMU_parseOptionRom(tc.data)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rom.offset != tc.offset || rom.images != tc.images || len(rom.data) != int(tc.data[tc.offset+2])*512 {
+				t.Errorf("image at %#x, %d bytes, %d images; want %#x, %d images",
+					rom.offset, len(rom.data), rom.images, tc.offset, tc.images)
+			}
+			if !reflect.DeepEqual(rom.pcir, tc.pcir) {
+				t.Errorf("pcir %v, want %v", rom.pcir, tc.pcir)
+			}
+		})
+	}
+}
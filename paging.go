@@ -0,0 +1,245 @@
+package main
+
+/*
+ * 32-bit (non-PAE) paging.
+ *
+ * Everything the CPU does with a segment:offset ends up as a linear
+ * address; the x86emu_lin_* accessors translate that into a physical
+ * address through the page tables when CR0.PG is set and then make a
+ * physical access (see mmio.go).  Translations are cached in a software
+ * TLB that is flushed on CR3 writes and INVLPG, as on the real thing, so
+ * guests that edit page tables without flushing see stale mappings just
+ * as they would on hardware.
+ */
+
+/* CR4 bits */
+const (
+	CR4_VME uint32 = 0x00000001
+	CR4_PVI uint32 = 0x00000002
+	CR4_TSD uint32 = 0x00000004
+	CR4_DE  uint32 = 0x00000008
+	CR4_PSE uint32 = 0x00000010
+	CR4_PAE uint32 = 0x00000020
+	CR4_PGE uint32 = 0x00000080
+)
+
+/* Page directory and page table entry bits */
+const (
+	PTE_P   uint32 = 0x001
+	PTE_RW  uint32 = 0x002
+	PTE_US  uint32 = 0x004
+	PTE_PWT uint32 = 0x008
+	PTE_PCD uint32 = 0x010
+	PTE_A   uint32 = 0x020
+	PTE_D   uint32 = 0x040
+	PTE_PS  uint32 = 0x080
+)
+
+/* #PF error code bits */
+const (
+	PF_P    uint32 = 0x01
+	PF_W    uint32 = 0x02
+	PF_U    uint32 = 0x04
+	PF_RSVD uint32 = 0x08
+)
+
+/* A cached translation of one 4K linear page. */
+type x86emu_tlb_entry struct {
+	phys  uint32 /* physical page address */
+	rw    bool   /* writable at user level, and by supervisor when CR0.WP */
+	us    bool   /* accessible at user level */
+	dirty bool   /* D bit already set in memory */
+}
+
+func x86emu_tlb_flush() {
+	M().tlb = make(map[uint32]x86emu_tlb_entry)
+}
+
+func x86emu_tlb_flush_page(lin uint32) {
+	delete(M().tlb, lin>>12)
+}
+
+func x86emu_paging() bool {
+	return M().x86.cr[0]&CR0_PG != 0
+}
+
+func x86emu_page_fault(lin uint32, err uint32) {
+	M().x86.cr[2] = lin
+	x86emu_fault(EXC_PF, err)
+}
+
+// PARAMETERS:
+// lin   - Linear address
+// write - Whether the access is a write
+// user  - Whether the access is made at user level (CPL 3)
+//
+// RETURNS:
+// Physical address the linear address maps to.
+//
+// REMARKS:
+// Looks the page up in the TLB, walking the page tables and setting the
+// accessed and dirty bits on a miss.  Raises #PF with CR2 set for pages that
+// are not present or that the access is not allowed to.
+func x86emu_translate(lin uint32, write bool, user bool) uint32 {
+	if !x86emu_paging() {
+		return lin
+	}
+	page := lin >> 12
+	e, ok := M().tlb[page]
+	if !ok || (write && !e.dirty) {
+		e = x86emu_page_walk(lin, write, user)
+		M().tlb[page] = e
+	}
+	if (user && !e.us) || (write && !e.rw && (user || M().x86.cr[0]&CR0_WP != 0)) {
+		err := PF_P
+		if write {
+			err |= PF_W
+		}
+		if user {
+			err |= PF_U
+		}
+		x86emu_page_fault(lin, err)
+	}
+	return e.phys | lin&0xfff
+}
+
+func x86emu_page_walk(lin uint32, write bool, user bool) x86emu_tlb_entry {
+	var e x86emu_tlb_entry
+
+	err := uint32(0)
+	if write {
+		err |= PF_W
+	}
+	if user {
+		err |= PF_U
+	}
+
+	pde_addr := M().x86.cr[3]&0xfffff000 | (lin>>22)<<2
+	pde := sys_rdl(pde_addr)
+	if pde&PTE_P == 0 {
+		x86emu_page_fault(lin, err)
+	}
+	if pde&PTE_PS != 0 && M().x86.cr[4]&CR4_PSE != 0 {
+		/* 4MB page */
+		e.phys = pde&0xffc00000 | lin&0x003ff000
+		e.rw = pde&PTE_RW != 0
+		e.us = pde&PTE_US != 0
+		if x86emu_page_denied(e, write, user) {
+			x86emu_page_fault(lin, err|PF_P)
+		}
+		upd := pde | PTE_A
+		if write {
+			upd |= PTE_D
+		}
+		if upd != pde {
+			sys_wrl(pde_addr, upd)
+		}
+		e.dirty = upd&PTE_D != 0
+		return e
+	}
+
+	pte_addr := pde&0xfffff000 | ((lin>>12)&0x3ff)<<2
+	pte := sys_rdl(pte_addr)
+	if pte&PTE_P == 0 {
+		x86emu_page_fault(lin, err)
+	}
+	e.phys = pte & 0xfffff000
+	e.rw = pde&PTE_RW != 0 && pte&PTE_RW != 0
+	e.us = pde&PTE_US != 0 && pte&PTE_US != 0
+	if x86emu_page_denied(e, write, user) {
+		x86emu_page_fault(lin, err|PF_P)
+	}
+	if pde&PTE_A == 0 {
+		sys_wrl(pde_addr, pde|PTE_A)
+	}
+	upd := pte | PTE_A
+	if write {
+		upd |= PTE_D
+	}
+	if upd != pte {
+		sys_wrl(pte_addr, upd)
+	}
+	e.dirty = upd&PTE_D != 0
+	return e
+}
+
+func x86emu_page_denied(e x86emu_tlb_entry, write bool, user bool) bool {
+	if user && !e.us {
+		return true
+	}
+	return write && !e.rw && (user || M().x86.cr[0]&CR0_WP != 0)
+}
+
+/*
+ * Linear memory accesses.  Writes that straddle a page boundary translate
+ * both pages before touching either, so a fault on the second page leaves
+ * memory unmodified.  Reads go up from the lower page, so when both pages
+ * are missing CR2 reports the first one, as on the CPU.  sys is set for
+ * the CPU's own supervisor accesses to descriptor tables, which are never
+ * made at user level.
+ */
+func x86emu_lin_read(lin uint32, size uint32, sys bool) uint32 {
+	user := !sys && x86emu_cpl() == 3
+	if lin&0xfff+size <= 0x1000 {
+		return x86emu_phys_read(x86emu_translate(lin, false, user), size)
+	}
+	val := uint32(0)
+	for i := uint32(0); i < size; i++ {
+		val |= x86emu_phys_read(x86emu_translate(lin+i, false, user), 1) << (8 * i)
+	}
+	return val
+}
+
+func x86emu_lin_write(lin uint32, size uint32, val uint32, sys bool) {
+	user := !sys && x86emu_cpl() == 3
+	if lin&0xfff+size <= 0x1000 {
+		x86emu_phys_write(x86emu_translate(lin, true, user), size, val)
+		return
+	}
+	x86emu_translate(lin, true, user)
+	x86emu_translate((lin+size-1)&^0xfff, true, user)
+	for i := uint32(0); i < size; i++ {
+		x86emu_phys_write(x86emu_translate(lin+i, true, user), 1, val>>(8*i)&0xff)
+	}
+}
+
+func x86emu_lin_rdb(lin uint32) uint8 {
+	return uint8(x86emu_lin_read(lin, 1, false))
+}
+
+func x86emu_lin_rdw(lin uint32) uint16 {
+	return uint16(x86emu_lin_read(lin, 2, false))
+}
+
+func x86emu_lin_rdl(lin uint32) uint32 {
+	return x86emu_lin_read(lin, 4, false)
+}
+
+func x86emu_lin_wrb(lin uint32, val uint8) {
+	x86emu_lin_write(lin, 1, uint32(val), false)
+}
+
+func x86emu_lin_wrw(lin uint32, val uint16) {
+	x86emu_lin_write(lin, 2, uint32(val), false)
+}
+
+func x86emu_lin_wrl(lin uint32, val uint32) {
+	x86emu_lin_write(lin, 4, val, false)
+}
+
+/* Control register writes that change how addresses translate. */
+func x86emu_write_cr3(val uint32) {
+	M().x86.cr[3] = val
+	x86emu_tlb_flush()
+}
+
+func x86emu_write_cr4(val uint32) {
+	if val&^x86emu_cr4_supported() != 0 || val&CR4_PAE != 0 {
+		/* only 32-bit paging is modelled */
+		x86emu_fault(EXC_GP, 0)
+	}
+	if (val^M().x86.cr[4])&(CR4_PSE|CR4_PGE) != 0 {
+		x86emu_tlb_flush()
+	}
+	M().x86.cr[4] = val
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestPagingCrossPageFault(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lo    bool /* lower page mapped */
+		hi    bool /* upper page mapped */
+		write bool
+		cr2   uint32
+		mem   uint32 /* dword at 0x1ffc afterwards */
+	}{
+		{"read, both missing", false, false, false, 0x1ffe, 0},
+		{"read, upper missing", true, false, false, 0x2000, 0},
+		{"write, both missing", false, false, true, 0x1ffe, 0},
+		{"write, upper missing", true, false, true, 0x2000, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			/* page directory at 0x10000, one table at 0x11000 */
+			sys_wrl(0x10000, 0x11000|PTE_P|PTE_RW)
+			if tc.lo {
+				sys_wrl(0x11000+1*4, 0x1000|PTE_P|PTE_RW)
+			}
+			if tc.hi {
+				sys_wrl(0x11000+2*4, 0x2000|PTE_P|PTE_RW)
+			}
+			M().x86.cr[3] = 0x10000
+			M().x86.cr[0] |= CR0_PE | CR0_PG
+			defer func() {
+				e, ok := recover().(x86emu_exception)
+				if !ok || e.vec != EXC_PF {
+					t.Fatalf("raised %+v, want #PF", e)
+				}
+				if cr2 := M().x86.cr[2]; cr2 != tc.cr2 {
+					t.Errorf("CR2 %#x, want %#x", cr2, tc.cr2)
+				}
+				if m := sys_rdl(0x1ffc); m != tc.mem {
+					t.Errorf("memory at 1ffc is %#x, want %#x", m, tc.mem)
+				}
+			}()
+			if tc.write {
+				x86emu_lin_write(0x1ffe, 4, 0x12345678, true)
+			} else {
+				x86emu_lin_read(0x1ffe, 4, true)
+			}
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+ * PCI configuration space, reached through configuration mechanism #1:
+ * a dword address written to 0xCF8 selects bus, device, function and
+ * register, and 0xCFC-0xCFF read or write the data with any width.
+ *
+ * Each device has a 256 byte header plus masks of the bits software can
+ * write and the bits that are cleared by writing 1.  BARs get these masks
+ * from their size, so the usual sizing sequence (write all ones, read back)
+ * works without special cases.  Whenever the command register or a BAR
+ * changes, the regions of the device are moved in the port and MMIO maps
+ * and the device's remap callback is told about it.
+ */
+
+/* Configuration header registers */
+const (
+	PCI_VENDOR_ID      = 0x00
+	PCI_DEVICE_ID      = 0x02
+	PCI_COMMAND        = 0x04
+	PCI_STATUS         = 0x06
+	PCI_REVISION_ID    = 0x08
+	PCI_CLASS_PROG     = 0x09
+	PCI_CLASS_DEVICE   = 0x0a
+	PCI_CACHE_LINE     = 0x0c
+	PCI_LATENCY_TIMER  = 0x0d
+	PCI_HEADER_TYPE    = 0x0e
+	PCI_BASE_ADDRESS_0 = 0x10
+	PCI_SUBSYSTEM_VID  = 0x2c
+	PCI_SUBSYSTEM_ID   = 0x2e
+	PCI_ROM_ADDRESS    = 0x30
+	PCI_INTERRUPT_LINE = 0x3c
+	PCI_INTERRUPT_PIN  = 0x3d
+
+	PCI_COMMAND_IO     = 0x0001
+	PCI_COMMAND_MEMORY = 0x0002
+	PCI_COMMAND_MASTER = 0x0004
+
+	PCI_BAR_IO       = 0x1 /* BAR flags, as in the low bits of the BAR */
+	PCI_BAR_MEM64    = 0x4
+	PCI_BAR_PREFETCH = 0x8
+	PCI_ROM_ENABLE   = 0x1
+
+	PCI_ROM_SLOT = 6 /* index of the expansion ROM in the BAR array */
+	PCI_NO_ADDR  = ^uint64(0)
+)
+
+/* Handlers for the contents of a BAR; offset is from the start of the BAR. */
+type X86EMU_barRead func(offset uint32, size int) uint32
+type X86EMU_barWrite func(offset uint32, size int, val uint32)
+
+// PARAMETERS:
+// d       - Device whose BAR moved
+// bar     - BAR index, or PCI_ROM_SLOT for the expansion ROM
+// addr    - Address the BAR now decodes, or PCI_NO_ADDR if it is off
+//
+// REMARKS:
+// Called after the emulator has moved the BAR in its own maps.
+type X86EMU_pciRemap func(d *X86EMU_pciDev, bar int, addr uint64)
+
+type x86emu_pci_bar struct {
+	size  uint32 /* 0 if not implemented */
+	flags uint32
+	addr  uint64 /* address currently mapped, or PCI_NO_ADDR */
+	rd    X86EMU_barRead
+	wr    X86EMU_barWrite
+}
+
+type X86EMU_pciDev struct {
+	bus, dev, fn uint8
+	name         string
+	cfg          [256]uint8
+	wmask        [256]uint8 /* bits software can change */
+	w1cmask      [256]uint8 /* bits cleared by writing 1 */
+	bars         [7]x86emu_pci_bar
+	rom          []byte
+	remap        X86EMU_pciRemap
+}
+
+var x86emu_pci_devs = make(map[uint16]*X86EMU_pciDev)
+
+/* Address latched in 0xCF8 */
+var x86emu_pci_addr uint32
+
+func x86emu_pci_bdf(bus, dev, fn uint8) uint16 {
+	return uint16(bus)<<8 | uint16(dev&0x1f)<<3 | uint16(fn&7)
+}
+
+func (d *X86EMU_pciDev) String() string {
+	return fmt.Sprintf("%02x:%02x.%x", d.bus, d.dev, d.fn)
+}
+
+func (d *X86EMU_pciDev) get16(off int) uint16 {
+	return uint16(d.cfg[off]) | uint16(d.cfg[off+1])<<8
+}
+
+func (d *X86EMU_pciDev) get32(off int) uint32 {
+	return uint32(d.get16(off)) | uint32(d.get16(off+2))<<16
+}
+
+func (d *X86EMU_pciDev) set16(off int, v uint16) {
+	d.cfg[off] = uint8(v)
+	d.cfg[off+1] = uint8(v >> 8)
+}
+
+func (d *X86EMU_pciDev) set32(off int, v uint32) {
+	d.set16(off, uint16(v))
+	d.set16(off+2, uint16(v>>16))
+}
+
+func (d *X86EMU_pciDev) set_wmask32(off int, v uint32) {
+	for i := 0; i < 4; i++ {
+		d.wmask[off+i] = uint8(v >> (8 * uint(i)))
+	}
+}
+
+// PARAMETERS:
+// bus, dev, fn - Location of the device
+// vendor       - Vendor ID
+// device       - Device ID
+// class        - Class code, revision in the low byte: 0xCCSSPPRR
+// name         - Name used in traces
+//
+// RETURNS:
+// A type 0 function with no BARs, to be set up further and then added
+// with X86EMU_pciAddDev.
+func X86EMU_newPciDev(bus, dev, fn uint8, vendor, device uint16, class uint32, name string) *X86EMU_pciDev {
+	d := &X86EMU_pciDev{bus: bus, dev: dev, fn: fn, name: name}
+	for i := range d.bars {
+		d.bars[i].addr = PCI_NO_ADDR
+	}
+	d.set16(PCI_VENDOR_ID, vendor)
+	d.set16(PCI_DEVICE_ID, device)
+	d.set32(PCI_REVISION_ID, class)
+	d.wmask[PCI_COMMAND] = 0x47 /* I/O, memory, master, parity, SERR */
+	d.wmask[PCI_COMMAND+1] = 0x05
+	d.w1cmask[PCI_STATUS+1] = 0xf9
+	d.wmask[PCI_CACHE_LINE] = 0xff
+	d.wmask[PCI_LATENCY_TIMER] = 0xff
+	d.wmask[PCI_INTERRUPT_LINE] = 0xff
+	return d
+}
+
+// PARAMETERS:
+// d     - Device
+// n     - BAR index 0-5; a 64-bit BAR also uses n+1
+// size  - Size in bytes, a power of two
+// flags - PCI_BAR_IO, or PCI_BAR_MEM64 and PCI_BAR_PREFETCH for memory
+// rd    - Read handler for the region
+// wr    - Write handler for the region
+//
+// REMARKS:
+// Implements a BAR: the address bits below the size read as zero, which is
+// what BAR sizing code looks for.
+func X86EMU_pciSetBar(d *X86EMU_pciDev, n int, size uint32, flags uint32, rd X86EMU_barRead, wr X86EMU_barWrite) {
+	min := uint32(16)
+	if flags&PCI_BAR_IO != 0 {
+		min = 4
+		flags = PCI_BAR_IO
+	}
+	if size < min {
+		size = min
+	}
+	b := &d.bars[n]
+	b.size, b.flags, b.rd, b.wr = size, flags, rd, wr
+	off := PCI_BASE_ADDRESS_0 + 4*n
+	d.set32(off, flags)
+	d.set_wmask32(off, ^(size - 1))
+	if flags&PCI_BAR_MEM64 != 0 {
+		d.set32(off+4, 0)
+		d.set_wmask32(off+4, 0xffffffff)
+	}
+}
+
+// PARAMETERS:
+// d   - Device
+// rom - Expansion ROM image
+//
+// REMARKS:
+// Gives the device an expansion ROM BAR decoding the image, rounded up to
+// a power of two of at least 2K.
+func X86EMU_pciSetRom(d *X86EMU_pciDev, rom []byte) {
+	size := uint32(2048)
+	for int(size) < len(rom) {
+		size <<= 1
+	}
+	d.rom = rom
+	b := &d.bars[PCI_ROM_SLOT]
+	b.size = size
+	b.rd = func(off uint32, n int) uint32 {
+		val := uint32(0)
+		for i := 0; i < n; i++ {
+			if int(off)+i < len(d.rom) {
+				val |= uint32(d.rom[int(off)+i]) << (8 * uint(i))
+			}
+		}
+		return val
+	}
+	b.wr = nil
+	d.set32(PCI_ROM_ADDRESS, 0)
+	d.set_wmask32(PCI_ROM_ADDRESS, ^(size-1)|PCI_ROM_ENABLE)
+}
+
+/* Sets the callback run when software moves one of the device's BARs. */
+func X86EMU_pciSetRemap(d *X86EMU_pciDev, fn X86EMU_pciRemap) {
+	d.remap = fn
+}
+
+/* Plugs a device in, replacing any at the same location. */
+func X86EMU_pciAddDev(d *X86EMU_pciDev) {
+	x86emu_pci_devs[x86emu_pci_bdf(d.bus, d.dev, d.fn)] = d
+	/* function 0 says whether scanners should look at functions 1-7 */
+	if d.fn != 0 {
+		if f0 := x86emu_pci_devs[x86emu_pci_bdf(d.bus, d.dev, 0)]; f0 != nil {
+			f0.cfg[PCI_HEADER_TYPE] |= 0x80
+		}
+	} else {
+		for fn := uint8(1); fn < 8; fn++ {
+			if x86emu_pci_devs[x86emu_pci_bdf(d.bus, d.dev, fn)] != nil {
+				d.cfg[PCI_HEADER_TYPE] |= 0x80
+				break
+			}
+		}
+	}
+	x86emu_pci_update_bars(d)
+}
+
+/* The device at bus:dev.fn, or nil. */
+func X86EMU_pciFindDev(bus, dev, fn uint8) *X86EMU_pciDev {
+	return x86emu_pci_devs[x86emu_pci_bdf(bus, dev, fn)]
+}
+
+/* Devices ordered by bus, device and function. */
+func x86emu_pci_list() []*X86EMU_pciDev {
+	var l []*X86EMU_pciDev
+	for _, d := range x86emu_pci_devs {
+		l = append(l, d)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return x86emu_pci_bdf(l[i].bus, l[i].dev, l[i].fn) < x86emu_pci_bdf(l[j].bus, l[j].dev, l[j].fn)
+	})
+	return l
+}
+
+// PARAMETERS:
+// d     - Device
+// level - Level of its INTx line
+//
+// REMARKS:
+// Drives the IRQ the BIOS routed the device to, as recorded in its
+// interrupt line register.
+func X86EMU_pciSetIrq(d *X86EMU_pciDev, level bool) {
+	if line := d.cfg[PCI_INTERRUPT_LINE]; line < 16 {
+		X86EMU_setIrq(int(line), level)
+	}
+}
+
+/* Address BAR n decodes given the command register, or PCI_NO_ADDR. */
+func (d *X86EMU_pciDev) bar_addr(n int) uint64 {
+	b := &d.bars[n]
+	if b.size == 0 {
+		return PCI_NO_ADDR
+	}
+	cmd := d.get16(PCI_COMMAND)
+	var addr, limit uint64
+	switch {
+	case n == PCI_ROM_SLOT:
+		v := d.get32(PCI_ROM_ADDRESS)
+		if cmd&PCI_COMMAND_MEMORY == 0 || v&PCI_ROM_ENABLE == 0 {
+			return PCI_NO_ADDR
+		}
+		addr, limit = uint64(v&^0x7ff), 1<<32
+	case b.flags&PCI_BAR_IO != 0:
+		if cmd&PCI_COMMAND_IO == 0 {
+			return PCI_NO_ADDR
+		}
+		addr, limit = uint64(d.get32(PCI_BASE_ADDRESS_0+4*n)&^0x3), 1<<16
+	default:
+		if cmd&PCI_COMMAND_MEMORY == 0 {
+			return PCI_NO_ADDR
+		}
+		addr, limit = uint64(d.get32(PCI_BASE_ADDRESS_0+4*n)&^0xf), 1<<32
+		if b.flags&PCI_BAR_MEM64 != 0 {
+			addr |= uint64(d.get32(PCI_BASE_ADDRESS_0+4*n+4)) << 32
+		}
+	}
+	/* unassigned, or still holding the sizing pattern, which ends at the limit */
+	if addr == 0 || addr+uint64(b.size) >= limit {
+		return PCI_NO_ADDR
+	}
+	return addr
+}
+
+/* Moves the regions of the device to where its BARs now point. */
+func x86emu_pci_update_bars(d *X86EMU_pciDev) {
+	for n := range d.bars {
+		b := &d.bars[n]
+		addr := d.bar_addr(n)
+		if addr == b.addr {
+			continue
+		}
+		name := fmt.Sprintf("%s %s BAR%d", d, d.name, n)
+		if n == PCI_ROM_SLOT {
+			name = fmt.Sprintf("%s %s ROM", d, d.name)
+		}
+		io := b.flags&PCI_BAR_IO != 0 && n != PCI_ROM_SLOT
+		if b.addr != PCI_NO_ADDR {
+			if io {
+				X86EMU_setupPorts(uint16(b.addr), int(b.size), "", nil, nil)
+			} else {
+				X86EMU_removeMmio(uint32(b.addr), b.size)
+			}
+		}
+		b.addr = addr
+		if addr != PCI_NO_ADDR {
+			base := addr
+			rd, wr := b.rd, b.wr
+			if io {
+				var prd X86EMU_portRead
+				var pwr X86EMU_portWrite
+				if rd != nil {
+					prd = func(port uint16, size int) uint32 {
+						return rd(uint32(uint64(port)-base), size)
+					}
+				}
+				if wr != nil {
+					pwr = func(port uint16, size int, val uint32) {
+						wr(uint32(uint64(port)-base), size, val)
+					}
+				}
+				if prd == nil && pwr == nil {
+					/* claim the range anyway so it floats as this device's */
+					prd = func(uint16, int) uint32 { return 0xffffffff }
+				}
+				X86EMU_setupPorts(uint16(addr), int(b.size), name, prd, pwr)
+			} else {
+				X86EMU_setupMmio(uint32(addr), b.size, name, X86EMU_mmioRead(rd), X86EMU_mmioWrite(wr))
+			}
+		}
+		if DEBUG_IO_TRACE() {
+			if addr == PCI_NO_ADDR {
+				fmt.Printf("pci: %s unmapped\n", name)
+			} else {
+				fmt.Printf("pci: %s at %#x\n", name, addr)
+			}
+		}
+		if d.remap != nil {
+			d.remap(d, n, addr)
+		}
+	}
+}
+
+// PARAMETERS:
+// d    - Device
+// off  - Register offset
+// size - 1, 2 or 4 bytes
+//
+// RETURNS:
+// Value read from configuration space.
+func x86emu_pci_cfg_read(d *X86EMU_pciDev, off int, size int) uint32 {
+	val := uint32(0)
+	for i := 0; i < size && off+i < len(d.cfg); i++ {
+		val |= uint32(d.cfg[off+i]) << (8 * uint(i))
+	}
+	return val
+}
+
+func x86emu_pci_cfg_write(d *X86EMU_pciDev, off int, size int, val uint32) {
+	for i := 0; i < size && off+i < len(d.cfg); i++ {
+		v := uint8(val >> (8 * uint(i)))
+		o := off + i
+		d.cfg[o] = d.cfg[o]&^d.wmask[o] | v&d.wmask[o]
+		d.cfg[o] &^= v & d.w1cmask[o]
+	}
+	x86emu_pci_update_bars(d)
+}
+
+/* Device selected by the address in 0xCF8, or nil. */
+func x86emu_pci_selected() *X86EMU_pciDev {
+	a := x86emu_pci_addr
+	if a&0x80000000 == 0 {
+		return nil
+	}
+	return x86emu_pci_devs[uint16(a>>8)]
+}
+
+func x86emu_pci_read(port uint16, size int) uint32 {
+	if port < 0xcfc {
+		if port == 0xcf8 && size == 4 {
+			return x86emu_pci_addr
+		}
+		return ^uint32(0)
+	}
+	d := x86emu_pci_selected()
+	if d == nil {
+		return ^uint32(0)
+	}
+	off := int(x86emu_pci_addr&0xfc) + int(port&3)
+	val := x86emu_pci_cfg_read(d, off, size)
+	if DEBUG_IO_TRACE() {
+		fmt.Printf("pci: %s read%d %#02x -> %#x\n", d, 8*size, off, val)
+	}
+	return val
+}
+
+func x86emu_pci_write(port uint16, size int, val uint32) {
+	if port < 0xcfc {
+		/* only dword accesses hit the address register */
+		if port == 0xcf8 && size == 4 {
+			x86emu_pci_addr = val & 0x80fffffc
+		}
+		return
+	}
+	d := x86emu_pci_selected()
+	if d == nil {
+		return
+	}
+	off := int(x86emu_pci_addr&0xfc) + int(port&3)
+	if DEBUG_IO_TRACE() {
+		fmt.Printf("pci: %s write%d %#02x <- %#x\n", d, 8*size, off, val)
+	}
+	x86emu_pci_cfg_write(d, off, size, val)
+}
+
+func init() {
+	X86EMU_setupPorts(0xcf8, 8, "pci", x86emu_pci_read, x86emu_pci_write)
+
+	/* host bridge: an i440FX */
+	hb := X86EMU_newPciDev(0, 0, 0, 0x8086, 0x1237, 0x06000002, "host bridge")
+	hb.set16(PCI_COMMAND, PCI_COMMAND_MEMORY|PCI_COMMAND_MASTER)
+	X86EMU_pciAddDev(hb)
+}
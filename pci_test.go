@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestPciBarAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int    /* BAR, or PCI_ROM_SLOT */
+		cmd  uint16 /* command register */
+		v    uint32 /* BAR contents */
+		want uint64
+	}{
+		{"memory", 0, PCI_COMMAND_MEMORY, 0xfebf0000, 0xfebf0000},
+		{"memory unassigned", 0, PCI_COMMAND_MEMORY, 0, PCI_NO_ADDR},
+		{"memory sizing pattern", 0, PCI_COMMAND_MEMORY, 0xfffff000, PCI_NO_ADDR},
+		{"memory decode off", 0, PCI_COMMAND_IO, 0xfebf0000, PCI_NO_ADDR},
+		{"io", 1, PCI_COMMAND_IO, 0xe001, 0xe000},
+		{"io sizing pattern", 1, PCI_COMMAND_IO, 0xffffffe1, PCI_NO_ADDR},
+		{"io decode off", 1, PCI_COMMAND_MEMORY, 0xe001, PCI_NO_ADDR},
+		{"rom", PCI_ROM_SLOT, PCI_COMMAND_MEMORY, 0xfeb00001, 0xfeb00000},
+		{"rom disabled", PCI_ROM_SLOT, PCI_COMMAND_MEMORY, 0xfeb00000, PCI_NO_ADDR},
+		{"rom sizing pattern", PCI_ROM_SLOT, PCI_COMMAND_MEMORY, 0xfffff801, PCI_NO_ADDR},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := X86EMU_newPciDev(0, 3, 0, 0x8086, 0x100e, 0x02000000, "test")
+			X86EMU_pciSetBar(d, 0, 0x1000, 0, nil, nil)
+			X86EMU_pciSetBar(d, 1, 0x20, PCI_BAR_IO, nil, nil)
+			X86EMU_pciSetRom(d, make([]byte, 0x800))
+			d.set16(PCI_COMMAND, tc.cmd)
+			if tc.n == PCI_ROM_SLOT {
+				d.set32(PCI_ROM_ADDRESS, tc.v)
+			} else {
+				d.set32(PCI_BASE_ADDRESS_0+4*tc.n, tc.v)
+			}
+			if a := d.bar_addr(tc.n); a != tc.want {
+				t.Errorf("decodes %#x, want %#x", a, tc.want)
+			}
+		})
+	}
+}
+
+func TestPciMultifunction(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		order []uint8 /* functions, in the order they are added */
+		want  uint8   /* function 0 header type */
+	}{
+		{"single function", []uint8{0}, 0x00},
+		{"function 0 first", []uint8{0, 1}, 0x80},
+		{"function 0 last", []uint8{2, 0}, 0x80},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, fn := range tc.order {
+				X86EMU_pciAddDev(X86EMU_newPciDev(0, 7, fn, 0x8086, 0x7000, 0x06010000, "test"))
+			}
+			defer func() {
+				for _, fn := range tc.order {
+					delete(x86emu_pci_devs, x86emu_pci_bdf(0, 7, fn))
+				}
+			}()
+			if h := X86EMU_pciFindDev(0, 7, 0).cfg[PCI_HEADER_TYPE]; h != tc.want {
+				t.Errorf("header type %#x, want %#x", h, tc.want)
+			}
+		})
+	}
+}
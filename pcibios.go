@@ -0,0 +1,160 @@
+package main
+
+import "fmt"
+
+/*
+ * PCI BIOS, int 1Ah with AH=B1h, as described in the PCI BIOS
+ * Specification 2.1.  The services work directly on the emulated bus, so
+ * option ROMs can find their device and program it before any BIOS image
+ * is loaded.  On return AH holds the status and CF is set for anything but
+ * success.
+ */
+
+const (
+	PCIBIOS_SUCCESSFUL          = 0x00
+	PCIBIOS_FUNC_NOT_SUPPORTED  = 0x81
+	PCIBIOS_BAD_VENDOR_ID       = 0x83
+	PCIBIOS_DEVICE_NOT_FOUND    = 0x86
+	PCIBIOS_BAD_REGISTER_NUMBER = 0x87
+
+	PCIBIOS_SIGNATURE = 0x20494350 /* "PCI " */
+	PCIBIOS_VERSION   = 0x0210
+)
+
+var x86emu_pcibios_names = map[uint8]string{
+	0x01: "PCI_BIOS_PRESENT",
+	0x02: "FIND_PCI_DEVICE",
+	0x03: "FIND_PCI_CLASS_CODE",
+	0x06: "GENERATE_SPECIAL_CYCLE",
+	0x08: "READ_CONFIG_BYTE",
+	0x09: "READ_CONFIG_WORD",
+	0x0a: "READ_CONFIG_DWORD",
+	0x0b: "WRITE_CONFIG_BYTE",
+	0x0c: "WRITE_CONFIG_WORD",
+	0x0d: "WRITE_CONFIG_DWORD",
+	0x0e: "GET_IRQ_ROUTING_OPTIONS",
+	0x0f: "SET_PCI_IRQ",
+}
+
+/* Whether int 1Ah has the PCI BIOS services */
+var x86emu_pcibios_on bool
+
+/* Installs int 1Ah with the PCI BIOS services next to the time of day. */
+func X86EMU_setupPciBios() error {
+	x86emu_pcibios_on = true
+	_, err := X86EMU_setupBiosVector(0x1a, "int1a", x86emu_int1a)
+	return err
+}
+
+// REMARKS:
+// Int 1Ah, shared with the time of day services: X86EMU_setupPciBios and
+// X86EMU_setupTimeBios both install it, in either order.
+func x86emu_int1a() {
+	if M().x86.gen.A.Get8h() == 0xb1 && x86emu_pcibios_on {
+		x86emu_pcibios()
+		return
+	}
+	x86emu_int1a_time()
+}
+
+// RETURNS:
+// The index'th device, in bus order, for which match is true.
+func x86emu_pcibios_find(index uint16, match func(d *X86EMU_pciDev) bool) *X86EMU_pciDev {
+	for _, d := range x86emu_pci_list() {
+		if !match(d) {
+			continue
+		}
+		if index == 0 {
+			return d
+		}
+		index--
+	}
+	return nil
+}
+
+/* Returns the device found in BH/BL, or DEVICE_NOT_FOUND. */
+func x86emu_pcibios_found(d *X86EMU_pciDev) uint8 {
+	if d == nil {
+		return PCIBIOS_DEVICE_NOT_FOUND
+	}
+	M().x86.gen.B.Seth8(d.bus)
+	M().x86.gen.B.Setl8(d.dev<<3 | d.fn)
+	return PCIBIOS_SUCCESSFUL
+}
+
+func x86emu_pcibios() {
+	r := &M().x86
+	fn := r.gen.A.Get8l()
+	name := x86emu_pcibios_names[fn]
+	if name == "" {
+		name = fmt.Sprintf("unknown function %02x", fn)
+	}
+	status := uint8(PCIBIOS_SUCCESSFUL)
+
+	switch fn {
+	case 0x01:
+		last := uint8(0)
+		for _, d := range x86emu_pci_list() {
+			if d.bus > last {
+				last = d.bus
+			}
+		}
+		r.gen.D.Set32(PCIBIOS_SIGNATURE)
+		r.gen.A.Setl8(0x01) /* configuration mechanism #1 */
+		r.gen.B.Set16(PCIBIOS_VERSION)
+		r.gen.C.Setl8(last)
+		r.spc.DI.Set32(0) /* no protected mode entry point */
+
+	case 0x02:
+		vendor, device := r.gen.D.Get16(), r.gen.C.Get16()
+		if vendor == 0xffff {
+			status = PCIBIOS_BAD_VENDOR_ID
+			break
+		}
+		status = x86emu_pcibios_found(x86emu_pcibios_find(r.spc.SI.Get16(), func(d *X86EMU_pciDev) bool {
+			return d.get16(PCI_VENDOR_ID) == vendor && d.get16(PCI_DEVICE_ID) == device
+		}))
+
+	case 0x03:
+		class := r.gen.C.Get32() & 0xffffff
+		status = x86emu_pcibios_found(x86emu_pcibios_find(r.spc.SI.Get16(), func(d *X86EMU_pciDev) bool {
+			return d.get32(PCI_REVISION_ID)>>8 == class
+		}))
+
+	case 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d:
+		size := 1 << ((fn - 0x08) % 3)
+		reg := r.spc.DI.Get16()
+		if reg > 0xff || int(reg)&(size-1) != 0 {
+			status = PCIBIOS_BAD_REGISTER_NUMBER
+			break
+		}
+		d := X86EMU_pciFindDev(r.gen.B.Get8h(), r.gen.B.Get8l()>>3, r.gen.B.Get8l()&7)
+		if fn <= 0x0a {
+			/* nothing answers for an empty slot, so the read floats */
+			val := ^uint32(0)
+			if d != nil {
+				val = x86emu_pci_cfg_read(d, int(reg), size)
+			}
+			switch size {
+			case 1:
+				r.gen.C.Setl8(uint8(val))
+			case 2:
+				r.gen.C.Set16(uint16(val))
+			default:
+				r.gen.C.Set32(val)
+			}
+		} else if d != nil {
+			x86emu_pci_cfg_write(d, int(reg), size, r.gen.C.Get32())
+		}
+
+	default:
+		/* special cycles and IRQ routing are not provided */
+		status = PCIBIOS_FUNC_NOT_SUPPORTED
+	}
+
+	x86emu_bios_status(status)
+	if DEBUG_SVC() {
+		fmt.Printf("int1a: pcibios %s bx=%04x cx=%08x di=%04x -> ah=%02x\n",
+			name, r.gen.B.Get16(), r.gen.C.Get32(), r.spc.DI.Get16(), status)
+	}
+}
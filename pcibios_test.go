@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestPciBios(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		ax             uint16
+		bx             uint16
+		ecx            uint32
+		dx             uint16 /* vendor for find device */
+		si, di         uint16
+		status         uint8
+		want_bx        uint16 /* checked on success if set */
+		want_ecx       uint32 /* for reads */
+		check_ecx      bool
+		reg            int    /* config register written, 0 for none */
+		want_reg_val   uint32 /* and its value afterwards */
+		want_signature bool
+	}{
+		{name: "bios present", ax: 0xb101, status: PCIBIOS_SUCCESSFUL,
+			want_bx: PCIBIOS_VERSION, want_ecx: 1, check_ecx: true, want_signature: true},
+		{name: "find device", ax: 0xb102, ecx: 0x100e, dx: 0x8086, status: PCIBIOS_SUCCESSFUL,
+			want_bx: 0x0018},
+		{name: "find second device", ax: 0xb102, ecx: 0x100e, dx: 0x8086, si: 1, status: PCIBIOS_SUCCESSFUL,
+			want_bx: 0x0028},
+		{name: "find past the last device", ax: 0xb102, ecx: 0x100e, dx: 0x8086, si: 2,
+			status: PCIBIOS_DEVICE_NOT_FOUND},
+		{name: "find with bad vendor", ax: 0xb102, ecx: 0x100e, dx: 0xffff, si: 0,
+			status: PCIBIOS_BAD_VENDOR_ID},
+		{name: "find class", ax: 0xb103, ecx: 0x030000, status: PCIBIOS_SUCCESSFUL,
+			want_bx: 0x0100},
+		{name: "find second of a class", ax: 0xb103, ecx: 0x020000, si: 1, status: PCIBIOS_SUCCESSFUL,
+			want_bx: 0x0028},
+		{name: "find missing class", ax: 0xb103, ecx: 0x0c0300,
+			status: PCIBIOS_DEVICE_NOT_FOUND},
+		{name: "read byte", ax: 0xb108, bx: 0x0018, di: PCI_VENDOR_ID, status: PCIBIOS_SUCCESSFUL,
+			want_ecx: 0x86, check_ecx: true},
+		{name: "read word", ax: 0xb109, bx: 0x0018, di: PCI_DEVICE_ID, status: PCIBIOS_SUCCESSFUL,
+			want_ecx: 0x100e, check_ecx: true},
+		{name: "read dword", ax: 0xb10a, bx: 0x0018, di: PCI_VENDOR_ID, status: PCIBIOS_SUCCESSFUL,
+			want_ecx: 0x100e8086, check_ecx: true},
+		{name: "read an empty slot", ax: 0xb10a, bx: 0x0020, di: PCI_VENDOR_ID, status: PCIBIOS_SUCCESSFUL,
+			want_ecx: 0xffffffff, check_ecx: true},
+		{name: "misaligned word", ax: 0xb109, bx: 0x0018, di: 1, status: PCIBIOS_BAD_REGISTER_NUMBER},
+		{name: "misaligned dword", ax: 0xb10d, bx: 0x0018, di: 2, status: PCIBIOS_BAD_REGISTER_NUMBER},
+		{name: "register past 0ffh", ax: 0xb108, bx: 0x0018, di: 0x100, status: PCIBIOS_BAD_REGISTER_NUMBER},
+		{name: "write byte", ax: 0xb10b, bx: 0x0018, ecx: 0x0b, di: PCI_INTERRUPT_LINE,
+			status: PCIBIOS_SUCCESSFUL, reg: PCI_INTERRUPT_LINE, want_reg_val: 0x0b},
+		{name: "special cycle", ax: 0xb106, status: PCIBIOS_FUNC_NOT_SUPPORTED},
+		{name: "unknown function", ax: 0xb1ff, status: PCIBIOS_FUNC_NOT_SUPPORTED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(m map[uint16]*X86EMU_pciDev) { x86emu_pci_devs = m }(x86emu_pci_devs)
+			x86emu_pci_devs = make(map[uint16]*X86EMU_pciDev)
+			X86EMU_pciAddDev(X86EMU_newPciDev(0, 3, 0, 0x8086, 0x100e, 0x02000000, "nic0"))
+			X86EMU_pciAddDev(X86EMU_newPciDev(0, 5, 0, 0x8086, 0x100e, 0x02000000, "nic1"))
+			X86EMU_pciAddDev(X86EMU_newPciDev(1, 0, 0, 0x10de, 0x1234, 0x03000000, "vga"))
+			x86emu_test_bios(t)
+			if err := X86EMU_setupPciBios(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &M().x86
+			r.gen.A.Set16(tc.ax)
+			r.gen.B.Set16(tc.bx)
+			r.gen.C.Set32(tc.ecx)
+			r.gen.D.Set32(uint32(tc.dx))
+			r.spc.SI.Set16(tc.si)
+			r.spc.DI.Set16(tc.di)
+			x86emu_test_int(t, 0x1a)
+
+			if ah, cf := r.gen.A.Get8h(), ACCESS_FLAG(F_CF); ah != tc.status || cf != (tc.status != 0) {
+				t.Fatalf("AH %02x CF %v, want %02x", ah, cf, tc.status)
+			}
+			if tc.want_bx != 0 && r.gen.B.Get16() != tc.want_bx {
+				t.Errorf("BX %04x, want %04x", r.gen.B.Get16(), tc.want_bx)
+			}
+			if tc.check_ecx && r.gen.C.Get32() != tc.want_ecx {
+				t.Errorf("ECX %08x, want %08x", r.gen.C.Get32(), tc.want_ecx)
+			}
+			if tc.want_signature && (r.gen.D.Get32() != PCIBIOS_SIGNATURE || r.gen.A.Get8l() != 0x01) {
+				t.Errorf("EDX %08x AL %02x", r.gen.D.Get32(), r.gen.A.Get8l())
+			}
+			if tc.reg != 0 {
+				if v := x86emu_pci_cfg_read(X86EMU_pciFindDev(0, 3, 0), tc.reg, 1); v != tc.want_reg_val {
+					t.Errorf("register %02x is %02x, want %02x", tc.reg, v, tc.want_reg_val)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Importing PCI devices captured on a real machine.
+ *
+ * The configuration space comes from "lspci -xxx" or "lspci -xxxx" output
+ * or a raw copy of /sys/bus/pci/devices/<slot>/config.  Neither records the
+ * size of the BARs, which is only visible by writing all ones, so sizes are
+ * taken from "lspci -v" output or the sysfs resource file of the device,
+ * and otherwise guessed.  The BARs of an imported device have nothing
+ * behind them: reads return all ones and writes are dropped, apart from
+ * the expansion ROM when an image is given.
+ */
+
+const (
+	PCI_DEFAULT_MEM_SIZE = 0x100000 /* BAR sizes used with no description */
+	PCI_DEFAULT_IO_SIZE  = 0x100
+)
+
+var (
+	x86emu_pci_slot_re = regexp.MustCompile(`^(?:[0-9a-fA-F]{4}:)?([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])$`)
+	x86emu_pci_head_re = regexp.MustCompile(`^((?:[0-9a-fA-F]{4}:)?[0-9a-fA-F]{2}:[0-9a-fA-F]{2}\.[0-7])\s`)
+	x86emu_pci_hex_re  = regexp.MustCompile(`^([0-9a-fA-F]{2,3}):((?:\s+[0-9a-fA-F]{2})+)\s*$`)
+	x86emu_pci_size_re = regexp.MustCompile(`\[size=([0-9]+)([KMG]?)\]`)
+	x86emu_pci_reg_re  = regexp.MustCompile(`^Region ([0-5]):`)
+)
+
+// PARAMETERS:
+// s - Slot as printed by lspci, "bb:dd.f" or "dddd:bb:dd.f"
+//
+// RETURNS:
+// Bus, device and function.  Only PCI domain 0 exists here, so a domain
+// is accepted and ignored.
+func x86emu_parse_slot(s string) (bus, dev, fn uint8, err error) {
+	m := x86emu_pci_slot_re.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("bad PCI slot %q", s)
+	}
+	b, _ := strconv.ParseUint(m[1], 16, 8)
+	d, _ := strconv.ParseUint(m[2], 16, 8)
+	f, _ := strconv.ParseUint(m[3], 16, 8)
+	if d > 0x1f {
+		return 0, 0, 0, fmt.Errorf("bad PCI slot %q", s)
+	}
+	return uint8(b), uint8(d), uint8(f), nil
+}
+
+/* Splits lspci output into the text of each device, keyed by slot. */
+func x86emu_lspci_blocks(text string) (map[string][]string, []string) {
+	blocks := make(map[string][]string)
+	var order []string
+	cur := ""
+	for _, line := range strings.Split(text, "\n") {
+		if m := x86emu_pci_head_re.FindStringSubmatch(line); m != nil {
+			cur = m[1]
+			if len(cur) > 7 {
+				cur = cur[5:] /* drop the domain */
+			}
+			order = append(order, cur)
+			continue
+		}
+		blocks[cur] = append(blocks[cur], strings.TrimSpace(line))
+	}
+	return blocks, order
+}
+
+/* Picks the block for slot, or the only one if the file has just one. */
+func x86emu_lspci_block(blocks map[string][]string, order []string, slot string) ([]string, bool) {
+	if b, ok := blocks[slot]; ok && slot != "" {
+		return b, true
+	}
+	if len(order) == 1 {
+		return blocks[order[0]], true
+	}
+	if len(order) == 0 && len(blocks[""]) > 0 {
+		return blocks[""], true
+	}
+	return nil, false
+}
+
+// PARAMETERS:
+// path - lspci -xxx/-xxxx output or a binary sysfs config file
+// slot - Device to take from lspci output listing several, or ""
+//
+// RETURNS:
+// The configuration space and the slot named in the dump, if any.
+func x86emu_read_pci_config(path string, slot string) ([]byte, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if !x86emu_is_text(data) {
+		/* sysfs config: 64 bytes unless read as root, 4096 for PCIe */
+		if len(data) < 64 {
+			return nil, "", fmt.Errorf("%s: only %d bytes of config space", path, len(data))
+		}
+		return data, "", nil
+	}
+
+	blocks, order := x86emu_lspci_blocks(string(data))
+	lines, ok := x86emu_lspci_block(blocks, order, slot)
+	if !ok {
+		return nil, "", fmt.Errorf("%s: no device %q in dump", path, slot)
+	}
+	src := slot
+	if len(order) == 1 {
+		src = order[0]
+	}
+	var cfg []byte
+	for _, line := range lines {
+		m := x86emu_pci_hex_re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		off, _ := strconv.ParseUint(m[1], 16, 16)
+		for i, fld := range strings.Fields(m[2]) {
+			v, _ := strconv.ParseUint(fld, 16, 8)
+			o := int(off) + i
+			for len(cfg) <= o {
+				cfg = append(cfg, 0xff)
+			}
+			cfg[o] = uint8(v)
+		}
+	}
+	if len(cfg) < 64 {
+		return nil, "", fmt.Errorf("%s: no hex dump of the config space; use lspci -xxx", path)
+	}
+	return cfg, src, nil
+}
+
+func x86emu_is_text(data []byte) bool {
+	return bytes.IndexFunc(data, func(r rune) bool {
+		return r != '\n' && r != '\r' && r != '\t' && (r < ' ' || r > '~')
+	}) < 0
+}
+
+/* Parses the n of "[size=n]" with its K, M or G suffix. */
+func x86emu_lspci_size(line string) uint64 {
+	m := x86emu_pci_size_re.FindStringSubmatch(line)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(m[1], 10, 64)
+	switch m[2] {
+	case "K":
+		n <<= 10
+	case "M":
+		n <<= 20
+	case "G":
+		n <<= 30
+	}
+	return n
+}
+
+// PARAMETERS:
+// path  - lspci -v output or a sysfs resource file
+// slot  - Device to take from lspci output listing several
+// bars  - Indices of the BARs the device implements, in order
+//
+// RETURNS:
+// Sizes of BARs 0-5 and of the expansion ROM (index PCI_ROM_SLOT); 0 where
+// the description says nothing.  Also whether path was a resource file.
+//
+// REMARKS:
+// A sysfs resource file has one "start end flags" line per BAR with the
+// ROM on line 7, and a size for every BAR that exists, assigned or not.  lspci -v lists "Memory at", "I/O ports at" and
+// "Expansion ROM at" lines in BAR order, skipping unimplemented BARs;
+// with -vv they are prefixed by "Region n:".
+func x86emu_read_pci_sizes(path string, slot string, bars []int) ([7]uint64, bool, error) {
+	var sizes [7]uint64
+	f, err := os.Open(path)
+	if err != nil {
+		return sizes, false, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return sizes, false, err
+	}
+
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "0x") {
+		for i, line := range lines {
+			fields := strings.Fields(line)
+			if i >= len(sizes) || len(fields) != 3 {
+				break
+			}
+			start, err1 := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+			end, err2 := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+			if err1 != nil || err2 != nil {
+				return sizes, true, fmt.Errorf("%s:%d: bad resource line", path, i+1)
+			}
+			if end > start {
+				sizes[i] = end - start + 1
+			}
+		}
+		return sizes, true, nil
+	}
+
+	blocks, order := x86emu_lspci_blocks(strings.Join(lines, "\n"))
+	block, ok := x86emu_lspci_block(blocks, order, slot)
+	if !ok {
+		return sizes, false, fmt.Errorf("%s: no device %q in description", path, slot)
+	}
+	next := 0
+	for _, line := range block {
+		if strings.HasPrefix(line, "Expansion ROM at") {
+			sizes[PCI_ROM_SLOT] = x86emu_lspci_size(line)
+			continue
+		}
+		n := -1
+		if m := x86emu_pci_reg_re.FindStringSubmatch(line); m != nil {
+			n = int(m[1][0] - '0')
+			line = strings.TrimSpace(line[len(m[0]):])
+		}
+		if !strings.HasPrefix(line, "Memory at") && !strings.HasPrefix(line, "I/O ports at") {
+			continue
+		}
+		if n < 0 {
+			if next >= len(bars) {
+				continue
+			}
+			n = bars[next]
+		}
+		for next < len(bars) && bars[next] <= n {
+			next++
+		}
+		sizes[n] = x86emu_lspci_size(line)
+	}
+	return sizes, false, nil
+}
+
+/* Largest power of two BAR size the address allows, up to max. */
+func x86emu_bar_fit(addr uint64, max uint64) uint64 {
+	if addr != 0 && addr&-addr < max {
+		return addr & -addr
+	}
+	return max
+}
+
+// PARAMETERS:
+// config - lspci -xxx/-xxxx output or a copy of the sysfs config file
+// slot   - Where to plug the device in, "bb:dd.f"; "" for lspci's slot
+// desc   - lspci -v output or sysfs resource file; "" to guess BAR sizes
+// rom    - Expansion ROM image, or ""
+//
+// RETURNS:
+// The device, already plugged into the bus.
+//
+// REMARKS:
+// The device keeps the captured configuration space, including its BAR
+// addresses and command register, so it decodes where it did on the real
+// machine until software moves it.  Without a sysfs resource file a BAR
+// that reads 0 is taken to be unimplemented.  Without a description BARs
+// are 1M of memory or 256 ports, or less if the captured address is not
+// aligned to that.  A ROM image with no ROM size in the description is rounded up to
+// a power of two; without one the device has no ROM.  Only BAR 0 and 1 of
+// bridges are imported.
+func X86EMU_importPciDev(config, slot, desc, rom string) (*X86EMU_pciDev, error) {
+	cfg, src, err := x86emu_read_pci_config(config, slot)
+	if err != nil {
+		return nil, err
+	}
+	if slot == "" {
+		slot = src
+	}
+	if slot == "" {
+		return nil, fmt.Errorf("%s: no slot given for the device", config)
+	}
+	bus, dev, fn, err := x86emu_parse_slot(slot)
+	if err != nil {
+		return nil, err
+	}
+	if src == "" {
+		src = slot
+	}
+
+	d := X86EMU_newPciDev(bus, dev, fn, 0, 0, 0, config)
+	copy(d.cfg[:], cfg)
+	if vid := d.get16(PCI_VENDOR_ID); vid == 0xffff || vid == 0 {
+		return nil, fmt.Errorf("%s: no device in dump (vendor %#04x)", config, vid)
+	}
+	d.name = fmt.Sprintf("%04x:%04x", d.get16(PCI_VENDOR_ID), d.get16(PCI_DEVICE_ID))
+	nbars := 6
+	if d.cfg[PCI_HEADER_TYPE]&0x7f != 0 {
+		nbars = 2
+	}
+
+	/* which BARs exist, and their captured values */
+	var bars []int
+	var vals [6]uint64
+	scan := func(exists func(n int, v uint32) bool) {
+		bars = bars[:0]
+		for n := 0; n < nbars; n++ {
+			v := uint64(d.get32(PCI_BASE_ADDRESS_0 + 4*n))
+			if !exists(n, uint32(v)) {
+				continue
+			}
+			bars = append(bars, n)
+			vals[n] = v
+			if v&PCI_BAR_IO == 0 && v&0x6 == PCI_BAR_MEM64 && n+1 < nbars {
+				vals[n] |= uint64(d.get32(PCI_BASE_ADDRESS_0+4*n+4)) << 32
+				n++
+			}
+		}
+	}
+	scan(func(_ int, v uint32) bool { return v != 0 })
+
+	var sizes [7]uint64
+	if desc != "" {
+		var sysfs bool
+		if sizes, sysfs, err = x86emu_read_pci_sizes(desc, src, bars); err != nil {
+			return nil, err
+		}
+		if sysfs {
+			/* an unassigned BAR reads 0 as well; the size says it is there */
+			scan(func(n int, _ uint32) bool { return sizes[n] != 0 })
+		}
+	}
+
+	for _, n := range bars {
+		v := vals[n]
+		flags := uint32(v & 0xf)
+		addr := v &^ 0xf
+		def := uint64(PCI_DEFAULT_MEM_SIZE)
+		if flags&PCI_BAR_IO != 0 {
+			flags = PCI_BAR_IO
+			addr = v &^ 0x3
+			def = PCI_DEFAULT_IO_SIZE
+		}
+		size := sizes[n]
+		if size == 0 || size&(size-1) != 0 {
+			size = x86emu_bar_fit(addr, def)
+		}
+		if size > 1<<31 {
+			/* larger than a BAR of this emulator can be */
+			size = 1 << 31
+		}
+		X86EMU_pciSetBar(d, n, uint32(size), flags, nil, nil)
+		d.set32(PCI_BASE_ADDRESS_0+4*n, uint32(v))
+		if flags&PCI_BAR_MEM64 != 0 {
+			d.set32(PCI_BASE_ADDRESS_0+4*n+4, uint32(v>>32))
+		}
+	}
+
+	if nbars == 6 {
+		d.set32(PCI_ROM_ADDRESS, 0)
+	}
+	if rom != "" && nbars == 6 {
+		img, err := os.ReadFile(rom)
+		if err != nil {
+			return nil, err
+		}
+		if size := sizes[PCI_ROM_SLOT]; size > uint64(len(img)) && size&(size-1) == 0 {
+			img = append(img, make([]byte, size-uint64(len(img)))...)
+		}
+		romreg := uint32(cfg[PCI_ROM_ADDRESS]) | uint32(cfg[PCI_ROM_ADDRESS+1])<<8 |
+			uint32(cfg[PCI_ROM_ADDRESS+2])<<16 | uint32(cfg[PCI_ROM_ADDRESS+3])<<24
+		X86EMU_pciSetRom(d, img)
+		/* keep the captured address, as far as the ROM size allows */
+		d.set32(PCI_ROM_ADDRESS, romreg&(^(d.bars[PCI_ROM_SLOT].size-1)|PCI_ROM_ENABLE))
+	}
+
+	X86EMU_pciAddDev(d)
+	return d, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportPciDevBars(t *testing.T) {
+	/* BAR 0 implemented but unassigned, BAR 1 absent, BAR 2 assigned */
+	cfg := make([]byte, 64)
+	binary.LittleEndian.PutUint16(cfg[PCI_VENDOR_ID:], 0x8086)
+	binary.LittleEndian.PutUint16(cfg[PCI_DEVICE_ID:], 0x100e)
+	binary.LittleEndian.PutUint32(cfg[PCI_BASE_ADDRESS_0+8:], 0xfebf0000)
+	resource := "0x0000000000000000 0x0000000000000fff 0x0000000000040200\n" +
+		"0x0000000000000000 0x0000000000000000 0x0000000000000000\n" +
+		"0x00000000febf0000 0x00000000febfffff 0x0000000000040200\n"
+	for i := 0; i < 4; i++ {
+		resource += "0x0000000000000000 0x0000000000000000 0x0000000000000000\n"
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config")
+	desc := filepath.Join(dir, "resource")
+	if err := os.WriteFile(config, cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(desc, []byte(resource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		desc  string
+		sizes [3]uint32 /* of BARs 0-2, 0 where there is none */
+	}{
+		{"sysfs resource", desc, [3]uint32{0x1000, 0, 0x10000}},
+		{"no description", "", [3]uint32{0, 0, 0x10000}}, /* fitted to the address */
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := X86EMU_importPciDev(config, "00:09.0", tc.desc, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer delete(x86emu_pci_devs, x86emu_pci_bdf(0, 9, 0))
+			for n, want := range tc.sizes {
+				if size := d.bars[n].size; size != want {
+					t.Errorf("BAR %d size %#x, want %#x", n, size, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+/*
+ * Dual 8259A programmable interrupt controller, as in the PC/AT: a master
+ * at ports 0x20/0x21 and a slave at 0xA0/0xA1 cascaded on master IRQ 2.
+ * The ELCR registers at 0x4D0/0x4D1 select level triggering per IRQ.
+ *
+ * Devices drive IRQ lines with X86EMU_setIrq.  Whenever the master has an
+ * unmasked request of higher priority than the one in service, INTR_ASYNCH
+ * is set and the CPU acknowledges the interrupt before the next instruction
+ * executed with IF=1.
+ */
+
+type x86emu_i8259 struct {
+	irr        uint8 /* interrupt request register */
+	isr        uint8 /* in-service register */
+	imr        uint8 /* interrupt mask register */
+	lines      uint8 /* current level of the IR inputs */
+	elcr       uint8 /* level triggered inputs */
+	base       uint8 /* vector of IR0, from ICW2 */
+	prio_add   uint8 /* IR with the highest priority */
+	icw_step   int   /* next initialization word expected; 0 when done */
+	icw4       bool  /* ICW4 will be sent */
+	single     bool  /* no cascade, so no ICW3 */
+	ltim       bool  /* level triggered mode from ICW1 */
+	auto_eoi   bool
+	rotate_eoi bool /* rotate priorities on automatic EOI */
+	smm        bool /* special mask mode */
+	read_isr   bool /* reads of the command port return ISR, not IRR */
+	poll       bool
+	icw3       uint8
+}
+
+const (
+	PIC_MASTER      = 0
+	PIC_SLAVE       = 1
+	PIC_CASCADE_IRQ = 2
+)
+
+func x86emu_pic_reset() {
+	for i := range M().pic {
+		M().pic[i] = x86emu_i8259{}
+	}
+	/* what the BIOS programs: vectors 8 and 0x70 */
+	M().pic[PIC_MASTER].base = 0x08
+	M().pic[PIC_SLAVE].base = 0x70
+	x86emu_pic_update()
+}
+
+func init() {
+	x86emu_pic_reset()
+	X86EMU_setupPorts(0x20, 2, "pic1", x86emu_pic_read, x86emu_pic_write)
+	X86EMU_setupPorts(0xa0, 2, "pic2", x86emu_pic_read, x86emu_pic_write)
+	X86EMU_setupPorts(0x4d0, 2, "elcr", x86emu_elcr_read, x86emu_elcr_write)
+	x86emu_optab[0xf4] = x86emuOp_halt
+}
+
+func x86emu_pic_chip(port uint16) *x86emu_i8259 {
+	if port&0x80 != 0 {
+		return &M().pic[PIC_SLAVE]
+	}
+	return &M().pic[PIC_MASTER]
+}
+
+/* Priority (0 highest) of the highest priority bit set in mask, or 8. */
+func (p *x86emu_i8259) priority(mask uint8) uint8 {
+	if mask == 0 {
+		return 8
+	}
+	prio := uint8(0)
+	for mask&(1<<((prio+p.prio_add)&7)) == 0 {
+		prio++
+	}
+	return prio
+}
+
+/* IR of the interrupt to signal, or -1. */
+func (p *x86emu_i8259) pending() int {
+	prio := p.priority(p.irr &^ p.imr)
+	if prio == 8 {
+		return -1
+	}
+	isr := p.isr
+	if p.smm {
+		isr &^= p.imr
+	}
+	if prio < p.priority(isr) {
+		return int((prio + p.prio_add) & 7)
+	}
+	return -1
+}
+
+// PARAMETERS:
+// irq   - IRQ number, 0-15
+// level - New level of the line
+//
+// REMARKS:
+// Drives an IRQ line.  Edge triggered inputs latch a request on the rising
+// edge; level triggered ones request for as long as the line stays high.
+func X86EMU_setIrq(irq int, level bool) {
+	p := &M().pic[irq>>3]
+	x86emu_pic_line(p, uint8(irq&7), level)
+	x86emu_pic_update()
+}
+
+/* A rising and falling edge on an IRQ line, for edge triggered devices. */
+func x86emu_pic_pulse(irq int) {
+	X86EMU_setIrq(irq, true)
+	X86EMU_setIrq(irq, false)
+}
+
+func x86emu_pic_line(p *x86emu_i8259, ir uint8, level bool) {
+	bit := uint8(1) << ir
+	if level {
+		if p.lines&bit == 0 || p.ltim || p.elcr&bit != 0 {
+			p.irr |= bit
+		}
+		p.lines |= bit
+	} else {
+		if p.ltim || p.elcr&bit != 0 {
+			p.irr &^= bit
+		}
+		p.lines &^= bit
+	}
+}
+
+/* Propagates the slave output to master IR2 and the master to the CPU. */
+func x86emu_pic_update() {
+	m := &M().pic[PIC_MASTER]
+	s := &M().pic[PIC_SLAVE]
+	x86emu_pic_line(m, PIC_CASCADE_IRQ, s.pending() >= 0)
+	if m.pending() >= 0 {
+		M().x86.intr |= int(INTR_ASYNCH)
+	} else {
+		M().x86.intr &^= int(INTR_ASYNCH)
+	}
+}
+
+/* Whether any IRQ line is unmasked all the way to the CPU. */
+func x86emu_pic_unmasked() bool {
+	m := &M().pic[PIC_MASTER]
+	s := &M().pic[PIC_SLAVE]
+	if m.imr|1<<PIC_CASCADE_IRQ != 0xff {
+		return true
+	}
+	return m.imr&(1<<PIC_CASCADE_IRQ) == 0 && !m.single && s.imr != 0xff
+}
+
+/* INTA cycle on one chip: moves the request to in-service. */
+func (p *x86emu_i8259) ack(ir int) {
+	bit := uint8(1) << uint(ir)
+	if p.ltim || p.elcr&bit == 0 {
+		p.irr &^= bit
+	}
+	if p.auto_eoi {
+		if p.rotate_eoi {
+			p.prio_add = uint8(ir+1) & 7
+		}
+	} else {
+		p.isr |= bit
+	}
+}
+
+// RETURNS:
+// Vector of the interrupt the PIC presents to the CPU.
+//
+// REMARKS:
+// Performs the interrupt acknowledge cycle.  A request that went away
+// before being acknowledged gives the spurious vector of IR7.
+func x86emu_pic_ack() uint8 {
+	m := &M().pic[PIC_MASTER]
+	s := &M().pic[PIC_SLAVE]
+	var vec uint8
+
+	ir := m.pending()
+	if ir < 0 {
+		vec = m.base + 7
+	} else {
+		m.ack(ir)
+		vec = m.base + uint8(ir)
+		if ir == PIC_CASCADE_IRQ && !m.single {
+			sir := s.pending()
+			if sir < 0 {
+				vec = s.base + 7
+			} else {
+				s.ack(sir)
+				vec = s.base + uint8(sir)
+			}
+		}
+	}
+	x86emu_pic_update()
+	return vec
+}
+
+/*
+ * Set while an interrupt hook is called for a hardware interrupt, so that a
+ * hook passing the interrupt on to the guest can deliver it as one.
+ */
+var x86emu_intr_hw bool
+
+/*
+ * Called by the execution loop with INTR_ASYNCH set and IF=1: acknowledges
+ * the interrupt and delivers its vector.
+ */
+func x86emu_intr_async() {
+	vec := x86emu_pic_ack()
+	if _X86EMU_intrTab[vec] != nil {
+		x86emu_intr_hw = true
+		_X86EMU_intrTab[vec](int(vec))
+		x86emu_intr_hw = false
+		return
+	}
+	x86emu_deliver(vec, true, false, 0)
+}
+
+func (p *x86emu_i8259) eoi(ir int, rotate bool) {
+	if ir < 0 {
+		return
+	}
+	p.isr &^= 1 << uint(ir)
+	if rotate {
+		p.prio_add = uint8(ir+1) & 7
+	}
+}
+
+func x86emu_pic_write(port uint16, _ int, val uint32) {
+	p := x86emu_pic_chip(port)
+	v := uint8(val)
+
+	if port&1 == 0 {
+		switch {
+		case v&0x10 != 0:
+			/* ICW1 */
+			*p = x86emu_i8259{lines: p.lines, elcr: p.elcr, base: p.base}
+			p.icw4 = v&0x01 != 0
+			p.single = v&0x02 != 0
+			p.ltim = v&0x08 != 0
+			p.icw_step = 2
+		case v&0x08 != 0:
+			/* OCW3 */
+			if v&0x02 != 0 {
+				p.read_isr = v&0x01 != 0
+			}
+			p.poll = v&0x04 != 0
+			if v&0x40 != 0 {
+				p.smm = v&0x20 != 0
+			}
+		default:
+			/* OCW2 */
+			switch v >> 5 {
+			case 0: /* rotate in automatic EOI mode (clear) */
+				p.rotate_eoi = false
+			case 4: /* rotate in automatic EOI mode (set) */
+				p.rotate_eoi = true
+			case 1: /* non-specific EOI */
+				p.eoi(p.in_service(), false)
+			case 5: /* rotate on non-specific EOI */
+				p.eoi(p.in_service(), true)
+			case 3: /* specific EOI */
+				p.eoi(int(v&7), false)
+			case 7: /* rotate on specific EOI */
+				p.eoi(int(v&7), true)
+			case 6: /* set priority */
+				p.prio_add = (v + 1) & 7
+			}
+		}
+		x86emu_pic_update()
+		return
+	}
+
+	switch p.icw_step {
+	case 2:
+		p.base = v & 0xf8
+		switch {
+		case !p.single:
+			p.icw_step = 3
+		case p.icw4:
+			p.icw_step = 4
+		default:
+			p.icw_step = 0
+		}
+	case 3:
+		p.icw3 = v
+		p.icw_step = 0
+		if p.icw4 {
+			p.icw_step = 4
+		}
+	case 4:
+		p.auto_eoi = v&0x02 != 0
+		p.icw_step = 0
+	default:
+		/* OCW1 */
+		p.imr = v
+	}
+	x86emu_pic_update()
+}
+
+/* IR of the highest priority interrupt in service, or -1. */
+func (p *x86emu_i8259) in_service() int {
+	prio := p.priority(p.isr)
+	if prio == 8 {
+		return -1
+	}
+	return int((prio + p.prio_add) & 7)
+}
+
+func x86emu_pic_read(port uint16, _ int) uint32 {
+	p := x86emu_pic_chip(port)
+
+	if p.poll {
+		/* poll command: acknowledge as an INTA cycle would */
+		p.poll = false
+		ir := p.pending()
+		if ir < 0 {
+			return 0
+		}
+		p.ack(ir)
+		x86emu_pic_update()
+		return 0x80 | uint32(ir)
+	}
+	if port&1 != 0 {
+		return uint32(p.imr)
+	}
+	if p.read_isr {
+		return uint32(p.isr)
+	}
+	return uint32(p.irr)
+}
+
+func x86emu_elcr_read(port uint16, _ int) uint32 {
+	return uint32(M().pic[port&1].elcr)
+}
+
+func x86emu_elcr_write(port uint16, _ int, val uint32) {
+	p := &M().pic[port&1]
+	p.elcr = uint8(val)
+	if port&1 == PIC_MASTER {
+		/* IRQ 0, 1 and 2 are always edge triggered */
+		p.elcr &^= 0x07
+	} else {
+		/* as are IRQ 8 and 13 */
+		p.elcr &^= 0x21
+	}
+	x86emu_pic_update()
+}
+
+// REMARKS:
+// Handles opcode 0xf4.  With interrupts enabled HLT waits for one, moving
+// the virtual clock forward to the next timer event; if interrupts are
+// disabled, every IRQ is masked or no timer is left to raise one, the
+// emulator halts as before.
+func x86emuOp_halt(_ uint8) {
+	DECODE_PRINTF("HALT\n")
+	TRACE_AND_STEP()
+	if x86emu_cpl() != 0 {
+		x86emu_fault(EXC_GP, 0)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+	if !ACCESS_FLAG(F_IF) || !x86emu_pic_unmasked() {
+		HALT_SYS()
+		return
+	}
+	for M().x86.intr&int(INTR_ASYNCH) == 0 {
+		if !x86emu_clock_idle() {
+			HALT_SYS()
+			return
+		}
+	}
+}
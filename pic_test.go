@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestPicIrqWakesHlt(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		irqs  bool  /* IF set before the HLT */
+		imr   uint8 /* master interrupt mask */
+		calls int
+		ip    uint16 /* where the emulator stopped */
+		ns    uint64 /* virtual time the HLT took at least */
+	}{
+		/*
+		 * IRQ 0 is requested once before the HLT runs and again by a
+		 * timer 1ms later, which the HLT waits for; the CLI;HLT after
+		 * it stops the emulator.
+		 */
+		{"interrupts enabled", true, 0x00, 2, 0x1003, 1000000},
+		{"interrupts disabled", false, 0x00, 0, 0x1001, 0},
+		/* the timer is still armed, but nothing can reach the CPU */
+		{"all irqs masked", true, 0xff, 0, 0x1001, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			sys_wrl(8*4, 0x0500) /* IRQ0 at 0000:0500 */
+			for i, b := range []uint8{
+				0xfe, 0x06, 0x00, 0x06, /* INC BYTE [0600] */
+				0xb0, 0x20, /* MOV AL,20 */
+				0xe6, 0x20, /* OUT 20,AL */
+				0xcf, /* IRET */
+			} {
+				sys_wrb(0x500+uint32(i), b)
+			}
+			sys_wrb(0x1000, 0xf4)   /* HLT */
+			sys_wrw(0x1001, 0xf4fa) /* CLI; HLT */
+
+			sys_outb(0x21, tc.imr)
+			x86emu_pic_pulse(0)
+			x86emu_clock_arm(1000000, func() { x86emu_pic_pulse(0) })
+			if tc.irqs {
+				SET_FLAG(F_IF)
+			}
+
+			X86EMU_exec()
+
+			if calls := int(sys_rdb(0x600)); calls != tc.calls {
+				t.Errorf("irq0 handler ran %d times, want %d", calls, tc.calls)
+			}
+			if ip := M().x86.spc.IP.Get16(); ip != tc.ip {
+				t.Errorf("stopped at %04x, want %04x", ip, tc.ip)
+			}
+			if ns := x86emu_clock_ns(); ns < tc.ns {
+				t.Errorf("halted for %dns, want at least %dns", ns, tc.ns)
+			}
+		})
+	}
+}
+
+func TestPicIrqOnExceptionVector(t *testing.T) {
+	/*
+	 * The BIOS leaves IRQ0-7 on vectors 08h-0Fh.  A fault delivering one
+	 * of them is an ordinary fault, not a double fault.
+	 */
+	for _, tc := range []struct {
+		name string
+		irq  int
+	}{
+		{"irq0 on the #DF vector", 0},
+		{"irq5 on the #GP vector", 5},
+		{"irq6 on the #PF vector", 6},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			vec := uint8(8 + tc.irq)
+			x86emu_test_gate(vec, TEST_CODE16, 0x1810, GATE_INT16, 0, false)
+			x86emu_test_gate(EXC_NP, TEST_CODE16, 0x1800, GATE_INT16, 0, true)
+			if vec != EXC_DF {
+				x86emu_test_gate(EXC_DF, TEST_CODE16, 0x1810, GATE_INT16, 0, true)
+			}
+			sys_wrb(0x1800, 0xf4)
+			sys_wrb(0x1810, 0xf4)
+
+			x86emu_pic_pulse(tc.irq)
+			SET_FLAG(F_IF)
+			x86emu_test_run(t, []byte{0x90, 0xf4})
+
+			if ip := M().x86.spc.IP.Get16(); ip != 0x1801 {
+				t.Fatalf("stopped at %04x, want the #NP handler", ip)
+			}
+			sp := M().x86.spc.SP.Get32()
+			if err, ip := sys_rdw(sp), sys_rdw(sp+2); err != uint16(vec)*8+3 || ip != 0x1000 {
+				t.Errorf("#NP error %04x returning to %04x", err, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+/*
+ * 8254 programmable interval timer and the system control port at 0x61.
+ *
+ * The three counters run at 1.193182 MHz of virtual time.  Nothing is
+ * stepped per tick: a counter remembers when it was loaded and its value
+ * and output are computed from the virtual clock when read.  Channel 0
+ * drives IRQ 0 by arming a clock event at each transition of its output;
+ * channel 2 is gated and read back through port 0x61, which is how BIOS
+ * delay loops measure microseconds.
+ *
+ * Writing a control word stops the counter with OUT at the new mode's
+ * initial level until a count is loaded.  Modes 1 and 5 then wait for a
+ * rising edge of the gate before they start counting.
+ */
+
+const (
+	PIT_HZ       = 1193182
+	PIT_IRQ      = 0
+	REFRESH_NS   = 15085 /* period of the port 0x61 refresh toggle */
+	PORT61_GATE2 = 0x01
+	PORT61_SPKR  = 0x02
+	PORT61_REFR  = 0x10
+	PORT61_OUT2  = 0x20
+)
+
+/* rw_mode and read/write states */
+const (
+	PIT_RW_LATCH = 0
+	PIT_RW_LSB   = 1
+	PIT_RW_MSB   = 2
+	PIT_RW_WORD  = 3
+	PIT_RW_WORD1 = 4 /* second byte of PIT_RW_WORD */
+)
+
+type x86emu_pit_channel struct {
+	count        uint32 /* initial count; 0 loads as 0x10000 (10000 in BCD) */
+	next         uint32 /* count register; the next trigger loads it (modes 1, 5) */
+	running      bool   /* counting since the last load or gate trigger */
+	load_time    uint64 /* ns of virtual time the count was loaded */
+	held         uint64 /* ticks counted before the gate went low (modes 0, 4) */
+	mode         uint8
+	bcd          bool
+	gate         bool
+	rw_mode      uint8
+	read_state   uint8
+	write_state  uint8
+	write_latch  uint8 /* first byte of a word write */
+	latched      bool
+	latch        uint16
+	latch_state  uint8 /* read state of the latched count */
+	status_latch bool
+	status       uint8
+	null_count   bool /* count written but not yet loaded */
+	timer        *x86emu_timer
+}
+
+type x86emu_i8254 struct {
+	ch     [3]x86emu_pit_channel
+	port61 uint8 /* writable bits of port 0x61 */
+}
+
+func x86emu_pit_reset() {
+	p := &M().pit
+	if p.ch[0].timer != nil {
+		x86emu_clock_cancel(p.ch[0].timer)
+	}
+	*p = x86emu_i8254{}
+	for i := range p.ch {
+		ch := &p.ch[i]
+		ch.mode = 3
+		ch.gate = i != 2
+		ch.rw_mode = PIT_RW_WORD
+		ch.read_state = PIT_RW_WORD
+		ch.write_state = PIT_RW_WORD
+		ch.count = 0x10000
+		ch.next = 0x10000
+		ch.running = true
+	}
+}
+
+func init() {
+	x86emu_pit_reset()
+	X86EMU_setupPorts(0x40, 4, "pit", x86emu_pit_read, x86emu_pit_write)
+	X86EMU_setupPorts(0x61, 1, "port61", x86emu_port61_read, x86emu_port61_write)
+}
+
+/* Counter ticks since the count was loaded. */
+func (ch *x86emu_pit_channel) elapsed(now uint64) uint64 {
+	if !ch.gate && (ch.mode == 0 || ch.mode == 4) {
+		/* gate low: counting is suspended */
+		return ch.held
+	}
+	return x86emu_muldiv(now-ch.load_time, PIT_HZ, NS_PER_SEC)
+}
+
+/* Current value of the counting element. */
+func (ch *x86emu_pit_channel) get_count(now uint64) uint32 {
+	if !ch.running {
+		return ch.count & 0xffff
+	}
+	d := ch.elapsed(now)
+	c := uint64(ch.count)
+	var v uint64
+	switch ch.mode {
+	case 2:
+		v = c - d%c
+	case 3:
+		/* counts down by two, twice per period */
+		v = c - (2*d)%c
+	default:
+		v = (c - d) & 0xffff
+	}
+	if ch.bcd {
+		v %= 10000
+	}
+	return uint32(v)
+}
+
+func (ch *x86emu_pit_channel) get_out(now uint64) bool {
+	if !ch.running {
+		/* mode 0 starts low, the others high */
+		return ch.mode != 0
+	}
+	d := ch.elapsed(now)
+	c := uint64(ch.count)
+	switch ch.mode {
+	case 0, 1:
+		/* low until terminal count */
+		return d >= c
+	case 2:
+		/* low for the one tick the count is 1 */
+		return !ch.gate || d%c != c-1
+	case 3:
+		/* high for the first half of each period */
+		return !ch.gate || d%c < (c+1)>>1
+	}
+	/* modes 4 and 5: low for the one tick at terminal count */
+	return d != c
+}
+
+// RETURNS:
+// Time of the next change of the channel's output, or false if there is
+// none.
+func (ch *x86emu_pit_channel) next_transition(now uint64) (uint64, bool) {
+	if !ch.running || !ch.gate && ch.mode != 1 && ch.mode != 5 {
+		return 0, false
+	}
+	d := ch.elapsed(now)
+	c := uint64(ch.count)
+	base := d / c * c
+	var next uint64
+	switch ch.mode {
+	case 0, 1:
+		if d >= c {
+			return 0, false
+		}
+		next = c
+	case 2:
+		if d-base < c-1 {
+			next = base + c - 1
+		} else {
+			next = base + c
+		}
+	case 3:
+		if half := (c + 1) >> 1; d-base < half {
+			next = base + half
+		} else {
+			next = base + c
+		}
+	default:
+		switch {
+		case d < c:
+			next = c
+		case d == c:
+			next = c + 1
+		default:
+			return 0, false
+		}
+	}
+	t := ch.load_time + x86emu_clock_after(next, PIT_HZ)
+	if x86emu_muldiv(t-ch.load_time, PIT_HZ, NS_PER_SEC) < next {
+		t++
+	}
+	return t, true
+}
+
+/* Drives IRQ 0 from channel 0 and arms the clock for its next edge. */
+func x86emu_pit_irq_update() {
+	ch := &M().pit.ch[0]
+	if ch.timer != nil {
+		x86emu_clock_cancel(ch.timer)
+		ch.timer = nil
+	}
+	now := x86emu_clock_ns()
+	X86EMU_setIrq(PIT_IRQ, ch.get_out(now))
+	if t, ok := ch.next_transition(now); ok {
+		ch.timer = x86emu_clock_arm(t, x86emu_pit_irq_update)
+	}
+}
+
+func x86emu_bcd_encode(v uint32) uint32 {
+	return v/1000%10<<12 | v/100%10<<8 | v/10%10<<4 | v%10
+}
+
+func x86emu_bcd_decode(v uint32) uint32 {
+	return v>>12&0xf*1000 + v>>8&0xf*100 + v>>4&0xf*10 + v&0xf
+}
+
+func (ch *x86emu_pit_channel) load(n int, val uint32) {
+	if ch.bcd {
+		val = x86emu_bcd_decode(val)
+		if val == 0 {
+			val = 10000
+		}
+	} else if val == 0 {
+		val = 0x10000
+	}
+	ch.next = val
+	if ch.mode == 1 || ch.mode == 5 {
+		/* the count is transferred by the next gate trigger */
+		return
+	}
+	ch.start(x86emu_clock_ns())
+	if n == 0 {
+		x86emu_pit_irq_update()
+	}
+}
+
+/* Transfers the count register to the counting element. */
+func (ch *x86emu_pit_channel) start(now uint64) {
+	ch.count = ch.next
+	ch.load_time = now
+	ch.held = 0
+	ch.null_count = false
+	ch.running = true
+}
+
+func (ch *x86emu_pit_channel) latch_count(now uint64) {
+	if ch.latched {
+		return
+	}
+	v := ch.get_count(now)
+	if ch.bcd {
+		v = x86emu_bcd_encode(v)
+	}
+	ch.latch = uint16(v)
+	ch.latch_state = ch.rw_mode
+	ch.latched = true
+}
+
+func (ch *x86emu_pit_channel) latch_status(now uint64) {
+	if ch.status_latch {
+		return
+	}
+	ch.status = ch.rw_mode<<4 | ch.mode<<1
+	if ch.bcd {
+		ch.status |= 0x01
+	}
+	if ch.null_count {
+		ch.status |= 0x40
+	}
+	if ch.get_out(now) {
+		ch.status |= 0x80
+	}
+	ch.status_latch = true
+}
+
+func x86emu_pit_write(port uint16, _ int, val uint32) {
+	p := &M().pit
+	v := uint8(val)
+	now := x86emu_clock_ns()
+
+	if port&3 != 3 {
+		n := int(port & 3)
+		ch := &p.ch[n]
+		switch ch.write_state {
+		case PIT_RW_LSB:
+			ch.load(n, uint32(v))
+		case PIT_RW_MSB:
+			ch.load(n, uint32(v)<<8)
+		case PIT_RW_WORD:
+			ch.write_latch = v
+			ch.write_state = PIT_RW_WORD1
+		case PIT_RW_WORD1:
+			ch.load(n, uint32(ch.write_latch)|uint32(v)<<8)
+			ch.write_state = PIT_RW_WORD
+		}
+		return
+	}
+
+	/* control word */
+	n := int(v >> 6)
+	if n == 3 {
+		/* read-back: bits 3-1 select the channels */
+		for i := range p.ch {
+			if v&(2<<uint(i)) == 0 {
+				continue
+			}
+			if v&0x20 == 0 {
+				p.ch[i].latch_count(now)
+			}
+			if v&0x10 == 0 {
+				p.ch[i].latch_status(now)
+			}
+		}
+		return
+	}
+	ch := &p.ch[n]
+	rw := (v >> 4) & 3
+	if rw == PIT_RW_LATCH {
+		ch.latch_count(now)
+		return
+	}
+	ch.rw_mode = rw
+	ch.read_state = rw
+	ch.write_state = rw
+	ch.mode = (v >> 1) & 7
+	if ch.mode >= 6 {
+		ch.mode -= 4
+	}
+	ch.bcd = v&1 != 0
+	ch.null_count = true
+	ch.next = 0
+	ch.running = false
+	if n == 0 {
+		x86emu_pit_irq_update()
+	}
+}
+
+func x86emu_pit_read(port uint16, _ int) uint32 {
+	if port&3 == 3 {
+		/* the control register is write only */
+		return 0xff
+	}
+	ch := &M().pit.ch[port&3]
+
+	if ch.status_latch {
+		ch.status_latch = false
+		return uint32(ch.status)
+	}
+	var v uint16
+	var state *uint8
+	if ch.latched {
+		v = ch.latch
+		state = &ch.latch_state
+	} else {
+		c := ch.get_count(x86emu_clock_ns())
+		if ch.bcd {
+			c = x86emu_bcd_encode(c)
+		}
+		v = uint16(c)
+		state = &ch.read_state
+	}
+	var ret uint8
+	switch *state {
+	case PIT_RW_LSB:
+		ret = uint8(v)
+		ch.latched = false
+	case PIT_RW_MSB:
+		ret = uint8(v >> 8)
+		ch.latched = false
+	case PIT_RW_WORD:
+		ret = uint8(v)
+		*state = PIT_RW_WORD1
+	default:
+		ret = uint8(v >> 8)
+		*state = PIT_RW_WORD
+		ch.latched = false
+	}
+	return uint32(ret)
+}
+
+/* Gate input of channel 2, from port 0x61 bit 0. */
+func x86emu_pit_set_gate(n int, gate bool) {
+	ch := &M().pit.ch[n]
+	if ch.gate == gate {
+		return
+	}
+	now := x86emu_clock_ns()
+	switch ch.mode {
+	case 0, 4:
+		if gate {
+			/* resume counting where it stopped */
+			ch.load_time = now - x86emu_clock_after(ch.held, PIT_HZ)
+		} else {
+			ch.held = ch.elapsed(now)
+		}
+	case 1, 5:
+		/* a rising edge (re)triggers the count, once one is loaded */
+		if gate && ch.next != 0 {
+			ch.start(now)
+		}
+	default:
+		/* a rising edge (re)starts the count */
+		if gate && ch.running {
+			ch.load_time = now
+		}
+	}
+	ch.gate = gate
+	if n == 0 {
+		x86emu_pit_irq_update()
+	}
+}
+
+// REMARKS:
+// Port 0x61 reads back the channel 2 gate and speaker enable, the channel
+// 2 output in bit 5 and the DRAM refresh toggle in bit 4, which flips
+// every 15.085us of virtual time.
+func x86emu_port61_read(_ uint16, _ int) uint32 {
+	p := &M().pit
+	now := x86emu_clock_ns()
+	v := p.port61 & 0x0f
+	if (now/REFRESH_NS)&1 != 0 {
+		v |= PORT61_REFR
+	}
+	if p.ch[2].get_out(now) {
+		v |= PORT61_OUT2
+	}
+	return uint32(v)
+}
+
+func x86emu_port61_write(_ uint16, _ int, val uint32) {
+	p := &M().pit
+	p.port61 = uint8(val) & 0x0f
+	x86emu_pit_set_gate(2, val&PORT61_GATE2 != 0)
+}
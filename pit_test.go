@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestPitControlWordAndGate(t *testing.T) {
+	type step struct {
+		port uint16 /* 0 waits ns instead of writing */
+		val  uint8
+		ns   uint64
+		out  bool /* channel 2 OUT afterwards, from port 0x61 */
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{"mode 0 drives out low", []step{
+			{0x61, 0x01, 0, true},
+			{0x43, 0xb0, 0, false}, /* channel 2, word, mode 0 */
+			{0, 0, 1000000, false}, /* no count: stopped */
+			{0x42, 0x10, 0, false},
+			{0x42, 0x00, 0, false},
+			{0, 0, 20000, true}, /* 16 ticks is 13.4us */
+		}},
+		{"mode 2 starts high", []step{
+			{0x61, 0x01, 0, true},
+			{0x43, 0xb4, 0, true},
+			{0, 0, 1000000, true},
+		}},
+		{"mode 1 waits for the gate", []step{
+			{0x43, 0xb2, 0, true},
+			{0x42, 0x10, 0, true},
+			{0x42, 0x00, 0, true},
+			{0, 0, 1000000, true},
+			{0x61, 0x01, 0, false}, /* trigger */
+			{0, 0, 5000, false},
+			{0, 0, 15000, true},
+			{0x61, 0x00, 0, true},  /* gate low does not stop mode 1 */
+			{0x61, 0x01, 0, false}, /* retrigger */
+			{0, 0, 5000, false},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			for i, s := range tc.steps {
+				if s.port == 0 {
+					x86emu_clock_wait(s.ns)
+				} else {
+					sys_outb(s.port, s.val)
+				}
+				if out := sys_inb(0x61)&PORT61_OUT2 != 0; out != s.out {
+					t.Errorf("step %d: out %v, want %v", i, out, s.out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+ * POST Memory Manager, version 1.01.
+ *
+ * A $PMM structure in the F segment gives option ROMs a far entry point
+ * for allocating memory during POST.  The entry point is a Go trap; the
+ * function and its arguments are on the stack, C style, and the result is
+ * returned in DX:AX.  Conventional memory comes from below the EBDA and
+ * extended memory from everything above 1M.  Each allocation is recorded
+ * with the CS:IP of the call.
+ */
+
+const (
+	PMM_SIGNATURE    = 0x4d4d5024 /* "$PMM" */
+	PMM_SIZE         = 0x10
+	PMM_ALLOCATE     = 0
+	PMM_FIND         = 1
+	PMM_DEALLOCATE   = 2
+	PMM_CONVENTIONAL = 0x1 /* pmmAllocate flags */
+	PMM_EXTENDED     = 0x2
+	PMM_ALIGNED      = 0x4
+	PMM_ANONYMOUS    = 0xffffffff
+	PMM_ERROR        = 0xffffffff
+
+	PMM_CONV_BASE = 0x20000 /* above the option ROM stack */
+	PMM_EXT_BASE  = 0x100000
+)
+
+const BDA_BASE_MEMORY = 0x413 /* KB of conventional memory */
+
+type x86emu_pmm_block struct {
+	addr   uint32
+	size   uint32 /* bytes */
+	handle uint32
+	cs, ip uint16 /* caller */
+}
+
+type x86emu_pmm_pool struct {
+	base, end uint32
+	blocks    []*x86emu_pmm_block /* sorted by address */
+}
+
+var x86emu_pmm struct {
+	addr  uint32 /* of the $PMM structure, 0 until set up */
+	pools [2]x86emu_pmm_pool
+	log   []*x86emu_pmm_block /* every allocation made, freed or not */
+}
+
+/* Top of conventional memory, from the BIOS data area. */
+func x86emu_base_memory() uint32 {
+	top := x86emu_phys_read(BDA_BASE_MEMORY, 2) << 10
+	if top == 0 || top > 0xa0000 {
+		top = 0x9fc00
+	}
+	if top > M().mem_size {
+		top = M().mem_size
+	}
+	return top
+}
+
+// REMARKS:
+// Places a new $PMM structure in the F segment, with empty pools.  The
+// conventional memory pool ends at the top of base memory in the BDA,
+// below the EBDA, and the extended memory pool covers all RAM above 1M, so
+// set up the BIOS data area and the memory size first.
+func X86EMU_setupPmm() error {
+	p := &x86emu_pmm
+	p.log = nil
+	conv_end := x86emu_base_memory() &^ 0xf
+	if conv_end < PMM_CONV_BASE {
+		conv_end = PMM_CONV_BASE
+	}
+	p.pools[0] = x86emu_pmm_pool{base: PMM_CONV_BASE, end: conv_end}
+	p.pools[1] = x86emu_pmm_pool{base: PMM_EXT_BASE, end: PMM_EXT_BASE}
+	if M().mem_size > PMM_EXT_BASE {
+		p.pools[1].end = M().mem_size
+	}
+
+	addr, err := x86emu_fseg_alloc(PMM_SIZE+1, 16)
+	if err != nil {
+		return err
+	}
+	entry := addr + PMM_SIZE
+	x86emu_phys_write(addr, 4, PMM_SIGNATURE)
+	x86emu_phys_write(addr+0x04, 1, 0x01) /* revision */
+	x86emu_phys_write(addr+0x05, 1, PMM_SIZE/16)
+	x86emu_phys_write(addr+0x07, 2, entry-FSEG_BASE)
+	x86emu_phys_write(addr+0x09, 2, FSEG_BASE>>4)
+	x86emu_fix_checksum(addr, PMM_SIZE, 0x06)
+	x86emu_phys_write(entry, 1, 0xcb) /* RETF, should the trap go away */
+	X86EMU_setupTrap(entry, "pmm", x86emu_pmm_entry)
+	p.addr = addr
+	return nil
+}
+
+/* Start of the free space of at least size bytes aligned to align, or 0. */
+func (p *x86emu_pmm_pool) fit(size uint32, align uint32) uint32 {
+	addr := p.base
+	for i := 0; i <= len(p.blocks); i++ {
+		end := p.end
+		if i < len(p.blocks) {
+			end = p.blocks[i].addr
+		}
+		a := (addr + align - 1) &^ (align - 1)
+		if a >= addr && uint64(a)+uint64(size) <= uint64(end) {
+			return a
+		}
+		if i < len(p.blocks) {
+			addr = p.blocks[i].addr + p.blocks[i].size
+		}
+	}
+	return 0
+}
+
+/* Largest free block, in bytes. */
+func (p *x86emu_pmm_pool) largest() uint32 {
+	best, addr := uint32(0), p.base
+	for i := 0; i <= len(p.blocks); i++ {
+		end := p.end
+		if i < len(p.blocks) {
+			end = p.blocks[i].addr
+		}
+		if end-addr > best {
+			best = end - addr
+		}
+		if i < len(p.blocks) {
+			addr = p.blocks[i].addr + p.blocks[i].size
+		}
+	}
+	return best
+}
+
+func (p *x86emu_pmm_pool) insert(b *x86emu_pmm_block) {
+	p.blocks = append(p.blocks, b)
+	sort.Slice(p.blocks, func(i, j int) bool { return p.blocks[i].addr < p.blocks[j].addr })
+}
+
+/* Pools to try for the memory type bits of the flags, in order. */
+func x86emu_pmm_pools(flags uint16) []*x86emu_pmm_pool {
+	p := &x86emu_pmm
+	switch flags & 3 {
+	case PMM_CONVENTIONAL:
+		return []*x86emu_pmm_pool{&p.pools[0]}
+	case PMM_EXTENDED:
+		return []*x86emu_pmm_pool{&p.pools[1]}
+	case PMM_CONVENTIONAL | PMM_EXTENDED:
+		return []*x86emu_pmm_pool{&p.pools[1], &p.pools[0]}
+	}
+	return nil
+}
+
+// PARAMETERS:
+// paras  - Length in paragraphs; 0 asks for the largest free block
+// handle - Handle for pmmFind, or PMM_ANONYMOUS
+// flags  - Memory type and alignment
+// cs, ip - Caller
+//
+// RETURNS:
+// Physical address of the block, its size in paragraphs for a query, or 0.
+func x86emu_pmm_allocate(paras uint32, handle uint32, flags uint16, cs, ip uint16) uint32 {
+	pools := x86emu_pmm_pools(flags)
+	if paras == 0 {
+		best := uint32(0)
+		for _, p := range pools {
+			if n := p.largest() / 16; n > best {
+				best = n
+			}
+		}
+		return best
+	}
+	if handle != PMM_ANONYMOUS && x86emu_pmm_find(handle) != 0 {
+		/* handles must be unique */
+		return 0
+	}
+	if paras > 0xffffffff/16 {
+		return 0
+	}
+	size := paras * 16
+	align := uint32(16)
+	if flags&PMM_ALIGNED != 0 {
+		for align < size && align < 1<<31 {
+			align <<= 1
+		}
+	}
+	for _, p := range pools {
+		if addr := p.fit(size, align); addr != 0 {
+			b := &x86emu_pmm_block{addr: addr, size: size, handle: handle, cs: cs, ip: ip}
+			p.insert(b)
+			x86emu_pmm.log = append(x86emu_pmm.log, b)
+			return addr
+		}
+	}
+	return 0
+}
+
+func x86emu_pmm_find(handle uint32) uint32 {
+	if handle == PMM_ANONYMOUS {
+		return 0
+	}
+	for _, p := range x86emu_pmm.pools {
+		for _, b := range p.blocks {
+			if b.handle == handle {
+				return b.addr
+			}
+		}
+	}
+	return 0
+}
+
+/* Frees the block at addr; returns 0 on success. */
+func x86emu_pmm_deallocate(addr uint32) uint32 {
+	for i := range x86emu_pmm.pools {
+		p := &x86emu_pmm.pools[i]
+		for j, b := range p.blocks {
+			if b.addr == addr {
+				p.blocks = append(p.blocks[:j], p.blocks[j+1:]...)
+				return 0
+			}
+		}
+	}
+	return PMM_ERROR
+}
+
+/* Far call to the $PMM entry point. */
+func x86emu_pmm_entry() {
+	r := &M().x86
+	sp := uint32(r.spc.SP.Get16())
+	arg := func(off uint32, size uint32) uint32 {
+		return x86emu_phys_read(x86emu_seg_linear(SEG_SS, uint32(uint16(sp+off)), size, false), size)
+	}
+	ip, cs := uint16(arg(0, 2)), uint16(arg(2, 2))
+	fn := arg(4, 2)
+
+	var ret uint32
+	switch fn {
+	case PMM_ALLOCATE:
+		paras, handle, flags := arg(6, 4), arg(10, 4), uint16(arg(14, 2))
+		ret = x86emu_pmm_allocate(paras, handle, flags, cs, ip)
+		if DEBUG_SVC() {
+			fmt.Printf("%04x:%04x: pmmAllocate(%#x paragraphs, handle %08x, flags %x) = %#x\n",
+				cs, ip, paras, handle, flags, ret)
+		}
+	case PMM_FIND:
+		handle := arg(6, 4)
+		ret = x86emu_pmm_find(handle)
+		if DEBUG_SVC() {
+			fmt.Printf("%04x:%04x: pmmFind(handle %08x) = %#x\n", cs, ip, handle, ret)
+		}
+	case PMM_DEALLOCATE:
+		addr := arg(6, 4)
+		ret = x86emu_pmm_deallocate(addr)
+		if DEBUG_SVC() {
+			fmt.Printf("%04x:%04x: pmmDeallocate(%#x) = %#x\n", cs, ip, addr, ret)
+		}
+	default:
+		ret = PMM_ERROR
+		if DEBUG_SVC() {
+			fmt.Printf("%04x:%04x: pmm function %x not supported\n", cs, ip, fn)
+		}
+	}
+	r.gen.A.Set16(uint16(ret))
+	r.gen.D.Set16(uint16(ret >> 16))
+	x86emu_trap_retf(0)
+}
+
+/* Lines describing every allocation made so far, in order. */
+func X86EMU_pmmLog() []string {
+	var l []string
+	for _, b := range x86emu_pmm.log {
+		h := fmt.Sprintf("handle %08x", b.handle)
+		if b.handle == PMM_ANONYMOUS {
+			h = "anonymous"
+		}
+		state := "freed"
+		if x86emu_pmm_live(b) {
+			state = "live"
+		}
+		l = append(l, fmt.Sprintf("%04x:%04x: %#x bytes at %#x, %s, %s", b.cs, b.ip, b.size, b.addr, h, state))
+	}
+	return l
+}
+
+func x86emu_pmm_live(b *x86emu_pmm_block) bool {
+	for _, p := range x86emu_pmm.pools {
+		for _, c := range p.blocks {
+			if c == b {
+				return true
+			}
+		}
+	}
+	return false
+}
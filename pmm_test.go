@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPmmFit(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		base, end   uint32
+		blocks      [][2]uint32 /* addr, size */
+		size, align uint32
+		want        uint32
+	}{
+		{"empty pool", 0x20000, 0x30000, nil, 0x100, 16, 0x20000},
+		{"whole pool", 0x20000, 0x30000, nil, 0x10000, 16, 0x20000},
+		{"too big", 0x20000, 0x30000, nil, 0x10010, 16, 0},
+		{"after a block", 0x20000, 0x30000, [][2]uint32{{0x20000, 0x100}}, 0x100, 16, 0x20100},
+		{"gap too small", 0x20000, 0x30000,
+			[][2]uint32{{0x20000, 0x100}, {0x20180, 0x80}}, 0x100, 16, 0x20200},
+		{"gap fits", 0x20000, 0x30000,
+			[][2]uint32{{0x20000, 0x100}, {0x20180, 0x80}}, 0x80, 16, 0x20100},
+		{"aligned", 0x20000, 0x30000, [][2]uint32{{0x20000, 0x100}}, 0x1000, 0x1000, 0x21000},
+		{"alignment runs past the end", 0x20000, 0x30000,
+			[][2]uint32{{0x20000, 0xf100}}, 0x10, 0x1000, 0},
+		{"alignment wraps at 4G", 0xffff8000, 0xffffff00, nil, 0x10, 0x10000, 0},
+		{"end of 4G", 0xffff0000, 0xffffffff, nil, 0xfff0, 16, 0xffff0000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &x86emu_pmm_pool{base: tc.base, end: tc.end}
+			for _, b := range tc.blocks {
+				p.insert(&x86emu_pmm_block{addr: b[0], size: b[1]})
+			}
+			if a := p.fit(tc.size, tc.align); a != tc.want {
+				t.Errorf("fit at %#x, want %#x", a, tc.want)
+			}
+		})
+	}
+}
+
+func TestPmmSetup(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		mem       uint32
+		base_kb   uint32 /* stored at 0040:0013 before the setup, 0 to leave it */
+		conv, ext uint32 /* ends of the pools */
+	}{
+		{"1M", 0x100000, 0, 0x9fc00, 0x100000},
+		{"16M", 0x1000000, 0, 0x9fc00, 0x1000000},
+		{"base memory lowered", 0x1000000, 512, 0x80000, 0x1000000},
+		{"base memory below the pool", 0x100000, 64, PMM_CONV_BASE, 0x100000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			X86EMU_setMemBase(make([]byte, tc.mem))
+			x86emu_test_setup_bios(t)
+			if tc.base_kb != 0 {
+				x86emu_phys_write(BDA_BASE_MEMORY, 2, tc.base_kb)
+			}
+			if err := X86EMU_setupPmm(); err != nil {
+				t.Fatal(err)
+			}
+			p := &x86emu_pmm
+			if p.pools[0].end != tc.conv || p.pools[1].end != tc.ext {
+				t.Errorf("pools end at %#x and %#x, want %#x and %#x",
+					p.pools[0].end, p.pools[1].end, tc.conv, tc.ext)
+			}
+			if x86emu_phys_read(p.addr, 4) != PMM_SIGNATURE {
+				t.Fatalf("no $PMM at %#x", p.addr)
+			}
+			sum := uint8(0)
+			for _, b := range x86emu_phys_copy_out(p.addr, PMM_SIZE) {
+				sum += b
+			}
+			if sum != 0 {
+				t.Errorf("$PMM checksum %#02x", sum)
+			}
+		})
+	}
+}
+
+func TestPmmAllocate(t *testing.T) {
+	x86emu_test_machine(t)
+	X86EMU_setMemBase(make([]byte, 0x1000000))
+	x86emu_test_setup_bios(t)
+	if err := X86EMU_setupPmm(); err != nil {
+		t.Fatal(err)
+	}
+	/* each step sees the blocks of the ones before */
+	for _, s := range []struct {
+		name   string
+		paras  uint32
+		handle uint32
+		flags  uint16
+		want   uint32
+	}{
+		{"largest conventional", 0, PMM_ANONYMOUS, PMM_CONVENTIONAL, (0x9fc00 - PMM_CONV_BASE) / 16},
+		{"conventional", 0x10, 1, PMM_CONVENTIONAL, 0x20000},
+		{"handle in use", 0x10, 1, PMM_CONVENTIONAL, 0},
+		{"extended aligned", 0x100, 2, PMM_EXTENDED | PMM_ALIGNED, 0x100000},
+		{"either takes extended first", 1, PMM_ANONYMOUS, PMM_CONVENTIONAL | PMM_EXTENDED, 0x101000},
+		{"conventional aligned", 0x10, PMM_ANONYMOUS, PMM_CONVENTIONAL | PMM_ALIGNED, 0x20100},
+		{"anonymous twice", 1, PMM_ANONYMOUS, PMM_CONVENTIONAL, 0x20200},
+		{"too big", 0x8000, PMM_ANONYMOUS, PMM_CONVENTIONAL, 0},
+		{"no memory type", 1, PMM_ANONYMOUS, 0, 0},
+	} {
+		if a := x86emu_pmm_allocate(s.paras, s.handle, s.flags, 0xc000, 0x100); a != s.want {
+			t.Errorf("%s: %#x, want %#x", s.name, a, s.want)
+		}
+	}
+	if a := x86emu_pmm_find(2); a != 0x100000 {
+		t.Errorf("handle 2 at %#x, want 0x100000", a)
+	}
+}
+
+func TestPmmEntry(t *testing.T) {
+	x86emu_test_machine(t)
+	X86EMU_setMemBase(make([]byte, 0x1000000))
+	x86emu_test_setup_bios(t)
+	if err := X86EMU_setupPmm(); err != nil {
+		t.Fatal(err)
+	}
+	off, seg := x86emu_phys_read(x86emu_pmm.addr+7, 2), x86emu_phys_read(x86emu_pmm.addr+9, 2)
+
+	/* an option ROM at C000:0100 allocating, finding and freeing a block */
+	var code []byte
+	var ret []uint16
+	call := func(args int, result uint16) {
+		code = append(code, 0x9a, uint8(off), uint8(off>>8), uint8(seg), uint8(seg>>8)) /* CALL far */
+		ret = append(ret, 0x100+uint16(len(code)))
+		code = append(code,
+			0x83, 0xc4, uint8(args), /* ADD SP,args */
+			0xa3, uint8(result), uint8(result>>8), /* MOV [result],AX */
+			0x89, 0x16, uint8(result+2), uint8((result+2)>>8)) /* MOV [result+2],DX */
+	}
+	code = append(code,
+		0x6a, PMM_CONVENTIONAL, /* PUSH flags */
+		0x66, 0x68, 0x44, 0x33, 0x22, 0x11, /* PUSH DWORD handle */
+		0x66, 0x6a, 0x10, /* PUSH DWORD paragraphs */
+		0x6a, PMM_ALLOCATE)
+	call(12, 0x4000)
+	code = append(code,
+		0x66, 0x68, 0x44, 0x33, 0x22, 0x11, /* PUSH DWORD handle */
+		0x6a, PMM_FIND)
+	call(6, 0x4004)
+	code = append(code,
+		0x52, 0x50, /* PUSH DX; PUSH AX */
+		0x6a, PMM_DEALLOCATE)
+	call(6, 0x4008)
+	code = append(code, 0xf4)
+
+	x86emu_phys_copy_in(0xc0100, code)
+	x86emu_load_cs(0xc000, 0x100)
+	M().x86.intr &^= int(INTR_HALTED)
+	X86EMU_exec()
+
+	if ip := M().x86.spc.IP.Get16(); ip != 0x100+uint16(len(code)) {
+		t.Fatalf("stopped at %04x", ip)
+	}
+	if sp := M().x86.spc.SP.Get16(); sp != 0x800 {
+		t.Errorf("SP %04x", sp)
+	}
+	for _, r := range []struct {
+		name string
+		addr uint32
+		want uint32
+	}{
+		{"pmmAllocate", 0x4000, 0x20000},
+		{"pmmFind", 0x4004, 0x20000},
+		{"pmmDeallocate", 0x4008, 0},
+	} {
+		if v := x86emu_phys_read(r.addr, 4); v != r.want {
+			t.Errorf("%s returned DX:AX %#x, want %#x", r.name, v, r.want)
+		}
+	}
+	want := fmt.Sprintf("c000:%04x: 0x100 bytes at 0x20000, handle 11223344, freed", ret[0])
+	if l := X86EMU_pmmLog(); len(l) != 1 || l[0] != want {
+		t.Errorf("log %q, want %q", l, want)
+	}
+}
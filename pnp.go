@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * PnP option ROM expansion headers and the BIOS Boot Specification flow.
+ *
+ * A ROM lists its boot devices in a chain of $PnP headers, the first at the
+ * offset stored at 0x1A of the ROM.  Each may have a Boot Connection Vector,
+ * which a disk ROM uses to hook int 13h, and a Bootstrap Entry Vector, which
+ * a network ROM uses to boot.  ROMs only follow this flow when the BIOS
+ * passes them a PnP installation check structure in ES:DI at init;
+ * otherwise they hook int 13h and int 19h there and then.
+ */
+
+const (
+	PNP_SIGNATURE     = 0x506e5024 /* "$PnP" */
+	PNP_PTR_OFFSET    = 0x1a
+	PNP_CHECK_SIZE    = 0x21
+	PNP_NOT_SUPPORTED = 0x82 /* PnP BIOS FUNCTION_NOT_SUPPORTED */
+	BDA_HDD_COUNT     = 0x475
+)
+
+/* A $PnP expansion header, as found in the ROM after init */
+type X86EMU_pnpHeader struct {
+	offset       uint16 /* of the header in the ROM */
+	device_id    uint32
+	manufacturer string
+	product      string
+	type_code    uint32 /* base type, subtype, interface */
+	indicators   uint8
+	bcv          uint16 /* entry points; 0 if absent */
+	dv           uint16
+	bev          uint16
+}
+
+/* Linear address of the PnP installation check structure, or 0. */
+var x86emu_pnp_check uint32
+
+func (h *X86EMU_pnpHeader) String() string {
+	var s []string
+	if h.manufacturer != "" {
+		s = append(s, h.manufacturer)
+	}
+	if h.product != "" {
+		s = append(s, h.product)
+	}
+	name := strings.Join(s, " ")
+	if name == "" {
+		name = "unnamed"
+	}
+	return fmt.Sprintf("%q id %08x type %06x bcv %04x dv %04x bev %04x",
+		name, h.device_id, h.type_code, h.bcv, h.dv, h.bev)
+}
+
+/* ASCIIZ string at seg:off, or "" for a null pointer. */
+func x86emu_rom_string(seg uint16, off uint16) string {
+	if off == 0 {
+		return ""
+	}
+	return x86emu_phys_string(uint32(seg)<<4 + uint32(off))
+}
+
+/* ASCIIZ string at a linear address, up to 256 characters. */
+func x86emu_phys_string(addr uint32) string {
+	var b []byte
+	for ; len(b) < 256; addr++ {
+		c := uint8(x86emu_phys_read(addr, 1))
+		if c == 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// PARAMETERS:
+// seg - Segment of a ROM in memory
+//
+// RETURNS:
+// The $PnP headers of the ROM, in chain order.
+//
+// REMARKS:
+// Reads the headers from memory, since ROMs often fill them in during
+// init.  A header with a bad signature, length or checksum ends the chain
+// with an error.
+func X86EMU_romPnpHeaders(seg uint16) ([]*X86EMU_pnpHeader, error) {
+	base := uint32(seg) << 4
+	size := x86emu_rom_resident(seg)
+	if size == 0 {
+		return nil, fmt.Errorf("no ROM at %04x:0000", seg)
+	}
+	rd := func(off uint32, n uint32) uint32 { return x86emu_phys_read(base+off, n) }
+
+	var hdrs []*X86EMU_pnpHeader
+	seen := make(map[uint32]bool)
+	for off := rd(PNP_PTR_OFFSET, 2); off != 0; off = rd(off+6, 2) {
+		if seen[off] || off+0x20 > size {
+			return hdrs, fmt.Errorf("$PnP header at %04x:%04x is outside the ROM", seg, off)
+		}
+		seen[off] = true
+		if rd(off, 4) != PNP_SIGNATURE {
+			return hdrs, fmt.Errorf("no $PnP signature at %04x:%04x", seg, off)
+		}
+		n := rd(off+5, 1) * 16
+		if n < 0x20 || off+n > size {
+			return hdrs, fmt.Errorf("$PnP header at %04x:%04x: bad length %d", seg, off, n)
+		}
+		sum := uint8(0)
+		for _, b := range x86emu_phys_copy_out(base+off, int(n)) {
+			sum += b
+		}
+		if sum != 0 {
+			return hdrs, fmt.Errorf("$PnP header at %04x:%04x: bad checksum %#02x", seg, off, sum)
+		}
+		hdrs = append(hdrs, &X86EMU_pnpHeader{
+			offset:       uint16(off),
+			device_id:    rd(off+0x0a, 4),
+			manufacturer: x86emu_rom_string(seg, uint16(rd(off+0x0e, 2))),
+			product:      x86emu_rom_string(seg, uint16(rd(off+0x10, 2))),
+			type_code:    rd(off+0x12, 1)<<16 | rd(off+0x13, 1)<<8 | rd(off+0x14, 1),
+			indicators:   uint8(rd(off+0x15, 1)),
+			bcv:          uint16(rd(off+0x16, 2)),
+			dv:           uint16(rd(off+0x18, 2)),
+			bev:          uint16(rd(off+0x1a, 2)),
+		})
+	}
+	return hdrs, nil
+}
+
+// REMARKS:
+// Places a PnP BIOS installation check structure in the F segment, so
+// that ROMs initialised afterwards see a BBS capable BIOS.  The PnP BIOS
+// entry point answers every call with FUNCTION_NOT_SUPPORTED.
+func X86EMU_setupPnpBios() error {
+	addr, err := x86emu_fseg_alloc(PNP_CHECK_SIZE+1, 16)
+	if err != nil {
+		return err
+	}
+	entry := addr + PNP_CHECK_SIZE
+	x86emu_phys_write(addr, 4, PNP_SIGNATURE)
+	x86emu_phys_write(addr+0x04, 1, 0x10) /* version 1.0 */
+	x86emu_phys_write(addr+0x05, 1, PNP_CHECK_SIZE)
+	x86emu_phys_write(addr+0x0d, 2, entry-FSEG_BASE) /* real mode entry */
+	x86emu_phys_write(addr+0x0f, 2, FSEG_BASE>>4)
+	x86emu_phys_write(addr+0x11, 2, entry-FSEG_BASE) /* 16-bit protected mode entry */
+	x86emu_phys_write(addr+0x13, 4, FSEG_BASE)
+	x86emu_phys_write(addr+0x1b, 2, FSEG_BASE>>4)
+	x86emu_phys_write(addr+0x1d, 4, FSEG_BASE)
+	x86emu_fix_checksum(addr, PNP_CHECK_SIZE, 0x08)
+	x86emu_phys_write(entry, 1, 0xcb) /* RETF, should the trap go away */
+	X86EMU_setupTrap(entry, "pnp bios", x86emu_pnp_bios)
+	x86emu_pnp_check = addr
+	return nil
+}
+
+// RETURNS:
+// Linear address of the PnP installation check structure, or 0 if there
+// is none in the memory of the current machine.
+func x86emu_pnp_present() uint32 {
+	addr := x86emu_pnp_check
+	if addr == 0 || addr+PNP_CHECK_SIZE > M().mem_size || x86emu_phys_read(addr, 4) != PNP_SIGNATURE {
+		return 0
+	}
+	sum := uint8(0)
+	for _, b := range x86emu_phys_copy_out(addr, PNP_CHECK_SIZE) {
+		sum += b
+	}
+	if sum != 0 {
+		return 0
+	}
+	return addr
+}
+
+/* PnP BIOS entry: the function number is the first argument on the stack. */
+func x86emu_pnp_bios() {
+	fn := x86emu_lin_rdw(x86emu_seg_linear(SEG_SS, uint32(M().x86.spc.SP.Get16()+4), 2, false))
+	if DEBUG_SVC() {
+		fmt.Printf("pnp bios: function %02x not supported\n", fn)
+	}
+	M().x86.gen.A.Set16(PNP_NOT_SUPPORTED)
+	x86emu_trap_retf(0)
+}
+
+/* What a BCV call did to the disk services */
+type X86EMU_bcvResult struct {
+	X86EMU_romResult
+	int13_before uint32 /* int 13h vector, segment:offset */
+	int13_after  uint32
+	disks_before uint8 /* hard disk count in the BDA */
+	disks_after  uint8
+}
+
+func (r *X86EMU_bcvResult) String() string {
+	s := r.X86EMU_romResult.String()
+	if r.int13_after != r.int13_before {
+		s += fmt.Sprintf(", hooked int 13h: %04x:%04x -> %04x:%04x",
+			r.int13_before>>16, r.int13_before&0xffff, r.int13_after>>16, r.int13_after&0xffff)
+	} else {
+		s += ", int 13h not hooked"
+	}
+	if r.disks_after != r.disks_before {
+		s += fmt.Sprintf(", %d -> %d hard disks", r.disks_before, r.disks_after)
+	}
+	return s
+}
+
+// PARAMETERS:
+// seg - Segment of the ROM
+// h   - Header whose BCV to call
+// bdf - Bus, device and function of the device, or OPROM_NO_PCI_BDF
+//
+// RETURNS:
+// How the call ended and whether the ROM hooked int 13h.
+func X86EMU_callBcv(seg uint16, h *X86EMU_pnpHeader, bdf uint16) (*X86EMU_bcvResult, error) {
+	if h.bcv == 0 {
+		return nil, fmt.Errorf("%04x:%04x: $PnP header has no BCV", seg, h.offset)
+	}
+	res := &X86EMU_bcvResult{
+		int13_before: x86emu_phys_read(0x13*4, 4),
+		disks_before: uint8(x86emu_phys_read(BDA_HDD_COUNT, 1)),
+	}
+	res.X86EMU_romResult = *x86emu_rom_call(seg, h.bcv, bdf)
+	res.int13_after = x86emu_phys_read(0x13*4, 4)
+	res.disks_after = uint8(x86emu_phys_read(BDA_HDD_COUNT, 1))
+	return res, nil
+}
+
+// PARAMETERS:
+// seg - Segment of the ROM
+// h   - Header whose BEV to call
+// bdf - Bus, device and function of the device, or OPROM_NO_PCI_BDF
+//
+// RETURNS:
+// How the call ended.  A BEV only returns when booting failed; a
+// successful boot runs the loaded code until the emulator halts.
+func X86EMU_callBev(seg uint16, h *X86EMU_pnpHeader, bdf uint16) (*X86EMU_romResult, error) {
+	if h.bev == 0 {
+		return nil, fmt.Errorf("%04x:%04x: $PnP header has no BEV", seg, h.offset)
+	}
+	return x86emu_rom_call(seg, h.bev, bdf), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Writes a 2K ROM at C000:0000 with $PnP headers at 0x40 and 0x60, the
+// first for a disk with a BCV, the second for a network boot with a BEV.
+func x86emu_test_pnp_rom() uint32 {
+	base := uint32(OPROM_SEGMENT) << 4
+	x86emu_phys_copy_in(base, make([]byte, 0x800))
+	x86emu_phys_write(base, 2, OPROM_SIGNATURE)
+	x86emu_phys_write(base+2, 1, 4)
+	x86emu_phys_write(base+PNP_PTR_OFFSET, 2, 0x40)
+	x86emu_phys_copy_in(base+0x100, []byte("ACME\x00Disk\x00Net\x00"))
+	for _, h := range []struct {
+		off, next, product uint32
+		id, bcv, bev       uint32
+		typ                [3]uint8
+	}{
+		{0x40, 0x60, 0x105, 0x1234d041, 0x0200, 0, [3]uint8{0x01, 0x04, 0x00}},
+		{0x60, 0, 0x10a, 0x5678d041, 0, 0x0300, [3]uint8{0x02, 0x00, 0x00}},
+	} {
+		a := base + h.off
+		x86emu_phys_write(a, 4, PNP_SIGNATURE)
+		x86emu_phys_write(a+0x04, 1, 1)
+		x86emu_phys_write(a+0x05, 1, 2)
+		x86emu_phys_write(a+0x06, 2, h.next)
+		x86emu_phys_write(a+0x0a, 4, h.id)
+		x86emu_phys_write(a+0x0e, 2, 0x100)
+		x86emu_phys_write(a+0x10, 2, h.product)
+		x86emu_phys_copy_in(a+0x12, h.typ[:])
+		x86emu_phys_write(a+0x15, 1, 0x14)
+		x86emu_phys_write(a+0x16, 2, h.bcv)
+		x86emu_phys_write(a+0x1a, 2, h.bev)
+		x86emu_fix_checksum(a, 0x20, 0x09)
+	}
+	return base
+}
+
+func TestRomPnpHeaders(t *testing.T) {
+	disk := &X86EMU_pnpHeader{offset: 0x40, device_id: 0x1234d041, manufacturer: "ACME",
+		product: "Disk", type_code: 0x010400, indicators: 0x14, bcv: 0x0200}
+	net := &X86EMU_pnpHeader{offset: 0x60, device_id: 0x5678d041, manufacturer: "ACME",
+		product: "Net", type_code: 0x020000, indicators: 0x14, bev: 0x0300}
+	for _, tc := range []struct {
+		name  string
+		patch func(base uint32)
+		want  []*X86EMU_pnpHeader
+		err   bool
+	}{
+		{"chain", func(uint32) {}, []*X86EMU_pnpHeader{disk, net}, false},
+		{"no headers", func(base uint32) {
+			x86emu_phys_write(base+PNP_PTR_OFFSET, 2, 0)
+		}, nil, false},
+		{"no rom", func(base uint32) {
+			x86emu_phys_write(base, 2, 0)
+		}, nil, true},
+		{"bad signature", func(base uint32) {
+			x86emu_phys_write(base+0x60, 1, 'X')
+		}, []*X86EMU_pnpHeader{disk}, true},
+		{"bad checksum", func(base uint32) {
+			x86emu_phys_write(base+0x6a, 1, 0)
+		}, []*X86EMU_pnpHeader{disk}, true},
+		{"zero length", func(base uint32) {
+			x86emu_phys_write(base+0x65, 1, 0)
+			x86emu_fix_checksum(base+0x60, 0x20, 0x09)
+		}, []*X86EMU_pnpHeader{disk}, true},
+		{"length past the rom", func(base uint32) {
+			x86emu_phys_write(base+0x65, 1, 0x80)
+			x86emu_fix_checksum(base+0x60, 0x20, 0x09)
+		}, []*X86EMU_pnpHeader{disk}, true},
+		{"loop", func(base uint32) {
+			x86emu_phys_write(base+0x66, 2, 0x40)
+			x86emu_fix_checksum(base+0x60, 0x20, 0x09)
+		}, []*X86EMU_pnpHeader{disk, net}, true},
+		{"outside the rom", func(base uint32) {
+			x86emu_phys_write(base+0x46, 2, 0x7f0)
+			x86emu_fix_checksum(base+0x40, 0x20, 0x09)
+		}, []*X86EMU_pnpHeader{disk}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			tc.patch(x86emu_test_pnp_rom())
+			hdrs, err := X86EMU_romPnpHeaders(OPROM_SEGMENT)
+			if tc.err != (err != nil) {
+				t.Errorf("error %v, want one: %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(hdrs, tc.want) {
+				t.Errorf("headers %v, want %v", hdrs, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import "fmt"
+
+/*
+ * The legacy environment a BIOS leaves behind after POST.
+ *
+ * X86EMU_setupBios builds it in emulated memory: an IVT whose every entry
+ * leads somewhere sensible, the BIOS data area and a 1K extended BIOS data
+ * area at the top of conventional memory, int 11h and 12h, and the fixed
+ * bytes at the top of the F segment (reset vector, BIOS date and model).
+ * It does not provide services; X86EMU_setupVideoBios, X86EMU_setupDiskBios
+ * and the rest replace the default vectors when called afterwards.
+ *
+ * The defaults are chosen so that guest code which calls something that is
+ * not there gets a BIOS-style failure instead of running into 0000:0000:
+ * service interrupts return AH=86h with CF set, hardware interrupts get an
+ * EOI, and the vectors that only a broken program reaches halt.
+ */
+
+const (
+	BDA_EBDA_SEG = 0x40e
+
+	EBDA_SIZE = 0x400
+
+	BIOS_RESET_VECTOR = 0xffff0
+	BIOS_DATE         = 0xffff5 /* "mm/dd/yy" */
+	BIOS_MODEL        = 0xffffe
+	BIOS_MODEL_AT     = 0xfc
+)
+
+/* Equipment word bits */
+const (
+	EQUIP_FPU      = 0x0002
+	EQUIP_VIDEO_80 = 0x0020 /* initial video mode 80x25 colour */
+)
+
+var x86emu_bios struct {
+	iret uint32 /* linear address of the shared IRET */
+}
+
+// REMARKS:
+// Puts the CPU into its power-on state: real mode, CS:IP at F000:FFF0,
+// EFLAGS 2, the other registers clear but for EDX, which holds the CPUID
+// signature (family, model, stepping) or 0 on models without CPUID.  CS
+// is based at 0xF0000 as a real mode load would make it; a boot from the
+// reset vector moves the base up to 0xFFFF0000 itself.  The MSR table is
+// reset too, so MSR profiles are loaded after this.
+func X86EMU_resetCpu() {
+	r := &M().x86
+	r.gen = i386_general_regs{}
+	r.spc = i386_special_regs{FLAGS: F_ALWAYS_ON}
+	r.seg = i386_segment_regs{}
+	r.seg.CS.Set(0xf000)
+	r.spc.IP.Set32(BIOS_RESET_VECTOR & 0xffff)
+	if x86emu_cpu.cpuid {
+		sig, _, _, _ := x86emu_cpu.query(1, 0)
+		r.gen.D.Set32(sig)
+	}
+	r.mode = 0
+	r.intr = 0
+	x86emu_reset_sysregs()
+	x86emu_msr_reset()
+}
+
+// REMARKS:
+// Resets the CPU and lays out the IVT, BDA, EBDA and F segment as a BIOS
+// would before loading option ROMs.  Call it first, once the memory is
+// set: it starts the F segment afresh and overwrites every vector, and the
+// services set up later put theirs on top.
+func X86EMU_setupBios() error {
+	X86EMU_resetCpu()
+	x86emu_phys_copy_in(0, make([]byte, 0x500))
+	x86emu_fseg_reset()
+	_X86EMU_intrTab = [256]X86EMU_intrFuncs{} /* hooks of the last machine */
+	x86emu_pcibios_on = false
+	x86emu_int15.hooks, x86emu_int15.extra = nil, nil
+
+	b := &x86emu_bios
+	iret, err := x86emu_fseg_alloc(1, 1)
+	if err != nil {
+		return err
+	}
+	b.iret = iret
+	x86emu_phys_write(b.iret, 1, 0xcf)
+	for vec := 0; vec < 256; vec++ {
+		x86emu_set_vector(uint8(vec), b.iret)
+	}
+	for _, vec := range []uint8{0x1d, 0x1e, 0x1f, 0x41, 0x43, 0x46} {
+		/* table pointers, not code */
+		x86emu_phys_write(uint32(vec)*4, 4, 0)
+	}
+
+	vector := func(vec uint8, name string, fn X86EMU_trapFunc) {
+		if err == nil {
+			_, err = X86EMU_setupBiosVector(vec, name, fn)
+		}
+	}
+	for irq := 0; irq < 16; irq++ {
+		irq := irq
+		vec := M().pic[PIC_MASTER].base + uint8(irq)
+		if irq >= 8 {
+			vec = M().pic[PIC_SLAVE].base + uint8(irq-8)
+		}
+		vector(vec, fmt.Sprintf("irq%d", irq), func() { x86emu_bios_irq(irq, vec) })
+	}
+	for _, vec := range []uint8{EXC_DE, EXC_UD} {
+		/* an IRET would run the faulting instruction again, forever */
+		vec := vec
+		vector(vec, x86emu_exc_name(vec), func() { x86emu_bios_halt(vec) })
+	}
+	for _, vec := range []uint8{0x10, 0x13, 0x14, 0x15, 0x16, 0x17, 0x1a} {
+		vec := vec
+		vector(vec, fmt.Sprintf("int%02x", vec), func() { x86emu_bios_unsupported(vec) })
+	}
+	for _, vec := range []uint8{0x18, 0x19} {
+		vec := vec
+		vector(vec, fmt.Sprintf("int%02x", vec), func() { x86emu_bios_halt(vec) })
+	}
+	vector(0x11, "int11", func() {
+		M().x86.gen.A.Set16(uint16(x86emu_phys_read(BDA_EQUIPMENT, 2)))
+	})
+	vector(0x12, "int12", func() {
+		M().x86.gen.A.Set16(uint16(x86emu_phys_read(BDA_BASE_MEMORY, 2)))
+	})
+	if err != nil {
+		return err
+	}
+
+	x86emu_bios_data()
+
+	/* a jump to the reset vector is a request to reboot */
+	x86emu_phys_write(BIOS_RESET_VECTOR, 1, 0xf4) /* HLT, should the trap go away */
+	X86EMU_setupTrap(BIOS_RESET_VECTOR, "reset", func() {
+		if DEBUG_SVC() {
+			fmt.Printf("bios: jump to the reset vector, halting\n")
+		}
+		HALT_SYS()
+	})
+	x86emu_phys_copy_in(BIOS_DATE, []byte("01/01/99"))
+	x86emu_phys_write(BIOS_MODEL, 1, BIOS_MODEL_AT)
+	return nil
+}
+
+// REMARKS:
+// Fills in the BIOS data area, cleared beforehand, and the EBDA.  The EBDA takes the last 1K of
+// conventional memory, which is what int 12h reports as its top.
+func x86emu_bios_data() {
+	top := uint32(0xa0000)
+	if M().mem_size < top {
+		top = M().mem_size &^ 0x3ff
+	}
+	ebda := top - EBDA_SIZE
+	x86emu_phys_copy_in(ebda, make([]byte, EBDA_SIZE))
+	x86emu_phys_write(ebda, 1, EBDA_SIZE>>10)
+	x86emu_phys_write(BDA_EBDA_SEG, 2, ebda>>4)
+	x86emu_phys_write(BDA_BASE_MEMORY, 2, ebda>>10)
+
+	eq := uint32(EQUIP_VIDEO_80)
+	if x86emu_cpu_features()&CPUID_FPU != 0 {
+		eq |= EQUIP_FPU
+	}
+	x86emu_phys_write(BDA_EQUIPMENT, 2, eq)
+	x86emu_video_set_mode(0x03)
+}
+
+// PARAMETERS:
+// irq - IRQ the vector belongs to
+// vec - Its vector
+//
+// REMARKS:
+// Default handler of a hardware interrupt: acknowledges it and returns.
+// The master's vectors are shared with exceptions and INT instructions,
+// so when the IRQ is not in service the entry is taken for one of those
+// and halts, as for #DE.  IRQ 7 and 15 are the PIC's spurious vectors
+// instead, which a BIOS returns from without an EOI, but for the cascade.
+func x86emu_bios_irq(irq int, vec uint8) {
+	p, ir := &M().pic[PIC_MASTER], irq
+	if irq >= 8 {
+		p, ir = &M().pic[PIC_SLAVE], irq-8
+	}
+	if p.isr&(1<<uint(ir)) == 0 && !p.auto_eoi {
+		if irq != 7 && irq != 15 {
+			x86emu_bios_halt(vec)
+			return
+		}
+		if DEBUG_SVC() {
+			fmt.Printf("irq%d: spurious\n", irq)
+		}
+		if irq == 15 {
+			sys_outb(0x20, 0x20) /* the master took the cascade */
+		}
+		return
+	}
+	if DEBUG_SVC() {
+		fmt.Printf("irq%d: no handler\n", irq)
+	}
+	if irq >= 8 {
+		sys_outb(0xa0, 0x20)
+	}
+	sys_outb(0x20, 0x20)
+}
+
+/* Default handler of a BIOS service nothing has been set up for. */
+func x86emu_bios_unsupported(vec uint8) {
+	if DEBUG_SVC() {
+		fmt.Printf("int%02x: ax=%04x, no handler\n", vec, M().x86.gen.A.Get16())
+	}
+	x86emu_bios_status(BIOS_UNSUPPORTED)
+}
+
+// REMARKS:
+// Halts at a vector there is no sensible way to carry on from, a fault or
+// a boot request.  The stub's IRET still runs, so the emulator stops at
+// the faulting instruction or just after the INT.
+func x86emu_bios_halt(vec uint8) {
+	if DEBUG_SVC() {
+		r := &M().x86
+		sp := uint32(r.seg.SS.Get())<<4 + uint32(r.spc.SP.Get16())
+		what := fmt.Sprintf("int%02x", vec)
+		if vec == EXC_DE || vec == EXC_UD {
+			what = x86emu_exc_name(vec)
+		}
+		fmt.Printf("bios: %s from %04x:%04x, halting\n", what,
+			x86emu_phys_read(sp+2, 2), x86emu_phys_read(sp, 2))
+	}
+	HALT_SYS()
+}
@@ -0,0 +1,628 @@
+/****************************************************************************
+*
+*                       Realmode X86 Emulator Library
+*
+*               Copyright (C) 1991-2004 SciTech Software, Inc.
+*                    Copyright (C) David Mosberger-Tang
+*                      Copyright (C) 1999 Egbert Eich
+*
+*  ========================================================================
+*
+*  Permission to use, copy, modify, distribute, and sell this software and
+*  its documentation for any purpose is hereby granted without fee,
+*  provided that the above copyright notice appear in all copies and that
+*  both that copyright notice and this permission notice appear in
+*  supporting documentation, and that the name of the authors not be used
+*  in advertising or publicity pertaining to distribution of the software
+*  without specific, written prior permission.  The authors makes no
+*  representations about the suitability of this software for any purpose.
+*  It is provided "as is" without express or implied warranty.
+*
+*  THE AUTHORS DISCLAIMS ALL WARRANTIES WITH REGARD TO THIS SOFTWARE,
+*  INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS, IN NO
+*  EVENT SHALL THE AUTHORS BE LIABLE FOR ANY SPECIAL, INDIRECT OR
+*  CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM LOSS OF
+*  USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+*  OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+*  PERFORMANCE OF THIS SOFTWARE.
+*
+*  ========================================================================
+*
+* Language:     ANSI C
+* Environment:  Any
+* Developer:    Kendall Bennett
+*
+* Description:  This file contains the code to implement the primitive
+*               machine operations used by the emulation code in ops.go
+*
+* Carry Chain Calculation
+*
+* The overflow flag is the XOR of the top two bits of the carry chain for
+* an addition (similar for subtraction), and the auxiliary flag is bit 3
+* of it.  Given the two operands and the result, the carry chain is
+*
+*       cc = ab + r'(a + b)
+*
+* and the borrow chain of a subtraction is
+*
+*       bc = a'b + r(a' + b)
+*
+* The byte, word and long operations below all share one implementation
+* that takes the operand width in bits; the results are computed in 64
+* bits so that the carry out of a long operation is simply bit 32.
+*
+****************************************************************************/
+
+package main
+
+import "math/bits"
+
+/*----------------------------- Implementation ----------------------------*/
+
+/* even parity of the low byte of x */
+func PARITY(x uint32) bool {
+	return bits.OnesCount8(uint8(x))&1 == 0
+}
+
+func XOR2(x uint32) bool {
+	return (x^(x>>1))&1 != 0
+}
+
+/* mask and sign bit of an operand of the given width */
+func x86emu_width_mask(width uint) uint32 {
+	return uint32(uint64(1)<<width - 1)
+}
+
+func x86emu_width_sign(width uint) uint32 {
+	return 1 << (width - 1)
+}
+
+/*--------- Side effects helper functions -------*/
+
+func set_szp_flags(res uint32, width uint) {
+	CONDITIONAL_SET_FLAG(res&x86emu_width_sign(width) != 0, F_SF)
+	CONDITIONAL_SET_FLAG(res&x86emu_width_mask(width) == 0, F_ZF)
+	CONDITIONAL_SET_FLAG(PARITY(res), F_PF)
+}
+
+// REMARKS:
+// implements side effects for operations that don't overflow
+func no_carry_side_eff(res uint32, width uint) {
+	CLEAR_FLAG(F_OF)
+	CLEAR_FLAG(F_CF)
+	CLEAR_FLAG(F_AF)
+	set_szp_flags(res, width)
+}
+
+func calc_carry_chain(width uint, d, s, res uint32) {
+	cc := (s & d) | (^res & (s | d))
+	CONDITIONAL_SET_FLAG(XOR2(cc>>(width-2)), F_OF)
+	CONDITIONAL_SET_FLAG(cc&0x8 != 0, F_AF)
+}
+
+func calc_borrow_chain(width uint, d, s, res uint32, set_carry bool) {
+	bc := (res & (^d | s)) | (^d & s)
+	CONDITIONAL_SET_FLAG(XOR2(bc>>(width-2)), F_OF)
+	CONDITIONAL_SET_FLAG(bc&0x8 != 0, F_AF)
+	if set_carry {
+		CONDITIONAL_SET_FLAG(bc&x86emu_width_sign(width) != 0, F_CF)
+	}
+}
+
+/*--------- Width independent operations -------*/
+
+func x86emu_add(d, s, carry uint32, width uint) uint32 {
+	sum := uint64(d) + uint64(s) + uint64(carry)
+	res := uint32(sum) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(sum>>width&1 != 0, F_CF)
+	set_szp_flags(res, width)
+	calc_carry_chain(width, d, s, res)
+	return res
+}
+
+func x86emu_sub(d, s, borrow uint32, width uint) uint32 {
+	res := (d - s - borrow) & x86emu_width_mask(width)
+	set_szp_flags(res, width)
+	calc_borrow_chain(width, d, s, res, true)
+	return res
+}
+
+func x86emu_inc(d uint32, width uint) uint32 {
+	res := (d + 1) & x86emu_width_mask(width)
+	set_szp_flags(res, width)
+	calc_carry_chain(width, d, 1, res)
+	return res
+}
+
+func x86emu_dec(d uint32, width uint) uint32 {
+	res := (d - 1) & x86emu_width_mask(width)
+	set_szp_flags(res, width)
+	calc_borrow_chain(width, d, 1, res, false)
+	return res
+}
+
+func x86emu_logic(res uint32, width uint) uint32 {
+	res &= x86emu_width_mask(width)
+	no_carry_side_eff(res, width)
+	return res
+}
+
+/*
+ * Rotates and shifts.  The count has been masked to 5 bits by the caller,
+ * as every CPU since the 286 does.  A count of zero changes no flags, and
+ * OF is only defined for a count of one.
+ */
+
+func x86emu_rol(d uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	mask := x86emu_width_mask(width)
+	n := cnt % width
+	res := (d<<n | d>>(width-n)) & mask
+	CONDITIONAL_SET_FLAG(res&1 != 0, F_CF)
+	if cnt == 1 {
+		CONDITIONAL_SET_FLAG((res&x86emu_width_sign(width) != 0) != ACCESS_FLAG(F_CF), F_OF)
+	}
+	return res
+}
+
+func x86emu_ror(d uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	mask := x86emu_width_mask(width)
+	n := cnt % width
+	res := (d>>n | d<<(width-n)) & mask
+	CONDITIONAL_SET_FLAG(res&x86emu_width_sign(width) != 0, F_CF)
+	if cnt == 1 {
+		CONDITIONAL_SET_FLAG(XOR2(res>>(width-2)), F_OF)
+	}
+	return res
+}
+
+func x86emu_rcl(d uint32, cnt uint, width uint) uint32 {
+	n := cnt % (width + 1)
+	if n == 0 {
+		return d
+	}
+	v := uint64(d)
+	if ACCESS_FLAG(F_CF) {
+		v |= 1 << width
+	}
+	v = (v<<n | v>>(width+1-n)) & (1<<(width+1) - 1)
+	res := uint32(v) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>width&1 != 0, F_CF)
+	if cnt == 1 {
+		CONDITIONAL_SET_FLAG((res&x86emu_width_sign(width) != 0) != ACCESS_FLAG(F_CF), F_OF)
+	}
+	return res
+}
+
+func x86emu_rcr(d uint32, cnt uint, width uint) uint32 {
+	n := cnt % (width + 1)
+	if n == 0 {
+		return d
+	}
+	v := uint64(d)
+	if ACCESS_FLAG(F_CF) {
+		v |= 1 << width
+	}
+	v = (v>>n | v<<(width+1-n)) & (1<<(width+1) - 1)
+	res := uint32(v) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>width&1 != 0, F_CF)
+	if cnt == 1 {
+		CONDITIONAL_SET_FLAG(XOR2(res>>(width-2)), F_OF)
+	}
+	return res
+}
+
+func x86emu_shl(d uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	v := uint64(d) << cnt
+	res := uint32(v) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>width&1 != 0, F_CF)
+	CONDITIONAL_SET_FLAG((res&x86emu_width_sign(width) != 0) != ACCESS_FLAG(F_CF), F_OF)
+	set_szp_flags(res, width)
+	return res
+}
+
+func x86emu_shr(d uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	res := uint32(uint64(d) >> cnt)
+	CONDITIONAL_SET_FLAG(uint64(d)>>(cnt-1)&1 != 0, F_CF)
+	CONDITIONAL_SET_FLAG(d&x86emu_width_sign(width) != 0, F_OF)
+	set_szp_flags(res, width)
+	return res
+}
+
+func x86emu_sar(d uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	/* sign extend to 64 bits, so any count shifts in copies of the sign */
+	v := int64(d) << (64 - width) >> (64 - width)
+	res := uint32(v>>cnt) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>(cnt-1)&1 != 0, F_CF)
+	CLEAR_FLAG(F_OF)
+	set_szp_flags(res, width)
+	return res
+}
+
+func x86emu_shld(d, fill uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	v := (uint64(d)<<width | uint64(fill)) << cnt
+	res := uint32(v>>width) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>(2*width)&1 != 0, F_CF)
+	CONDITIONAL_SET_FLAG((res^d)&x86emu_width_sign(width) != 0, F_OF)
+	set_szp_flags(res, width)
+	return res
+}
+
+func x86emu_shrd(d, fill uint32, cnt uint, width uint) uint32 {
+	if cnt == 0 {
+		return d
+	}
+	v := uint64(fill)<<width | uint64(d)
+	res := uint32(v>>cnt) & x86emu_width_mask(width)
+	CONDITIONAL_SET_FLAG(v>>(cnt-1)&1 != 0, F_CF)
+	CONDITIONAL_SET_FLAG((res^d)&x86emu_width_sign(width) != 0, F_OF)
+	set_szp_flags(res, width)
+	return res
+}
+
+// REMARKS:
+// Implements the AAA instruction and side effects.
+func aaa_word(d uint16) uint16 {
+	if d&0xf > 0x9 || ACCESS_FLAG(F_AF) {
+		d += 0x106
+		SET_FLAG(F_AF)
+		SET_FLAG(F_CF)
+	} else {
+		CLEAR_FLAG(F_CF)
+		CLEAR_FLAG(F_AF)
+	}
+	res := d & 0xff0f
+	set_szp_flags(uint32(res), 16)
+	return res
+}
+
+// REMARKS:
+// Implements the AAS instruction and side effects.
+func aas_word(d uint16) uint16 {
+	if d&0xf > 0x9 || ACCESS_FLAG(F_AF) {
+		d -= 0x106
+		SET_FLAG(F_AF)
+		SET_FLAG(F_CF)
+	} else {
+		CLEAR_FLAG(F_CF)
+		CLEAR_FLAG(F_AF)
+	}
+	res := d & 0xff0f
+	set_szp_flags(uint32(res), 16)
+	return res
+}
+
+// REMARKS:
+// Implements the AAD instruction and side effects.  base is the immediate
+// byte of the instruction, 10 for the usual encoding.
+func aad_word(d uint16, base uint8) uint16 {
+	l := uint16(uint8(d) + uint8(d>>8)*base)
+	no_carry_side_eff(uint32(l), 8)
+	return l
+}
+
+// REMARKS:
+// Implements the AAM instruction and side effects.  A base of zero raises
+// #DE, as dividing by it would.
+func aam_word(d uint8, base uint8) uint16 {
+	if base == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	l := uint16(d/base)<<8 | uint16(d%base)
+	no_carry_side_eff(uint32(l), 8)
+	return l
+}
+
+// REMARKS:
+// Implements the DAA instruction and side effects.
+func daa_byte(d uint8) uint8 {
+	res := uint32(d)
+	if d&0xf > 9 || ACCESS_FLAG(F_AF) {
+		res += 6
+		SET_FLAG(F_AF)
+	} else {
+		CLEAR_FLAG(F_AF)
+	}
+	if d > 0x99 || ACCESS_FLAG(F_CF) {
+		res += 0x60
+		SET_FLAG(F_CF)
+	} else {
+		CLEAR_FLAG(F_CF)
+	}
+	set_szp_flags(res&0xff, 8)
+	return uint8(res)
+}
+
+// REMARKS:
+// Implements the DAS instruction and side effects.
+func das_byte(d uint8) uint8 {
+	res := d
+	if d&0xf > 9 || ACCESS_FLAG(F_AF) {
+		res -= 6
+		SET_FLAG(F_AF)
+	} else {
+		CLEAR_FLAG(F_AF)
+	}
+	if d > 0x99 || ACCESS_FLAG(F_CF) {
+		res -= 0x60
+		SET_FLAG(F_CF)
+	} else {
+		CLEAR_FLAG(F_CF)
+	}
+	set_szp_flags(uint32(res), 8)
+	return res
+}
+
+/* carry into ADC, or borrow into SBB */
+func x86emu_cf() uint32 {
+	if ACCESS_FLAG(F_CF) {
+		return 1
+	}
+	return 0
+}
+
+// REMARKS:
+// Implement the ADD, ADC, SUB, SBB, CMP, AND, OR, XOR and TEST instructions
+// and side effects.
+
+func add_byte(d, s uint8) uint8   { return uint8(x86emu_add(uint32(d), uint32(s), 0, 8)) }
+func add_word(d, s uint16) uint16 { return uint16(x86emu_add(uint32(d), uint32(s), 0, 16)) }
+func add_long(d, s uint32) uint32 { return x86emu_add(d, s, 0, 32) }
+func adc_byte(d, s uint8) uint8   { return uint8(x86emu_add(uint32(d), uint32(s), x86emu_cf(), 8)) }
+func adc_word(d, s uint16) uint16 { return uint16(x86emu_add(uint32(d), uint32(s), x86emu_cf(), 16)) }
+func adc_long(d, s uint32) uint32 { return x86emu_add(d, s, x86emu_cf(), 32) }
+func sub_byte(d, s uint8) uint8   { return uint8(x86emu_sub(uint32(d), uint32(s), 0, 8)) }
+func sub_word(d, s uint16) uint16 { return uint16(x86emu_sub(uint32(d), uint32(s), 0, 16)) }
+func sub_long(d, s uint32) uint32 { return x86emu_sub(d, s, 0, 32) }
+func sbb_byte(d, s uint8) uint8   { return uint8(x86emu_sub(uint32(d), uint32(s), x86emu_cf(), 8)) }
+func sbb_word(d, s uint16) uint16 { return uint16(x86emu_sub(uint32(d), uint32(s), x86emu_cf(), 16)) }
+func sbb_long(d, s uint32) uint32 { return x86emu_sub(d, s, x86emu_cf(), 32) }
+func cmp_byte(d, s uint8) uint8   { x86emu_sub(uint32(d), uint32(s), 0, 8); return d }
+func cmp_word(d, s uint16) uint16 { x86emu_sub(uint32(d), uint32(s), 0, 16); return d }
+func cmp_long(d, s uint32) uint32 { x86emu_sub(d, s, 0, 32); return d }
+func and_byte(d, s uint8) uint8   { return uint8(x86emu_logic(uint32(d&s), 8)) }
+func and_word(d, s uint16) uint16 { return uint16(x86emu_logic(uint32(d&s), 16)) }
+func and_long(d, s uint32) uint32 { return x86emu_logic(d&s, 32) }
+func or_byte(d, s uint8) uint8    { return uint8(x86emu_logic(uint32(d|s), 8)) }
+func or_word(d, s uint16) uint16  { return uint16(x86emu_logic(uint32(d|s), 16)) }
+func or_long(d, s uint32) uint32  { return x86emu_logic(d|s, 32) }
+func xor_byte(d, s uint8) uint8   { return uint8(x86emu_logic(uint32(d^s), 8)) }
+func xor_word(d, s uint16) uint16 { return uint16(x86emu_logic(uint32(d^s), 16)) }
+func xor_long(d, s uint32) uint32 { return x86emu_logic(d^s, 32) }
+func test_byte(d, s uint8)        { x86emu_logic(uint32(d&s), 8) }
+func test_word(d, s uint16)       { x86emu_logic(uint32(d&s), 16) }
+func test_long(d, s uint32)       { x86emu_logic(d&s, 32) }
+
+// REMARKS:
+// Implement the INC, DEC, NEG and NOT instructions and side effects.
+func inc_byte(d uint8) uint8   { return uint8(x86emu_inc(uint32(d), 8)) }
+func inc_word(d uint16) uint16 { return uint16(x86emu_inc(uint32(d), 16)) }
+func inc_long(d uint32) uint32 { return x86emu_inc(d, 32) }
+func dec_byte(d uint8) uint8   { return uint8(x86emu_dec(uint32(d), 8)) }
+func dec_word(d uint16) uint16 { return uint16(x86emu_dec(uint32(d), 16)) }
+func dec_long(d uint32) uint32 { return x86emu_dec(d, 32) }
+func neg_byte(s uint8) uint8   { return uint8(x86emu_sub(0, uint32(s), 0, 8)) }
+func neg_word(s uint16) uint16 { return uint16(x86emu_sub(0, uint32(s), 0, 16)) }
+func neg_long(s uint32) uint32 { return x86emu_sub(0, s, 0, 32) }
+func not_byte(s uint8) uint8   { return ^s }
+func not_word(s uint16) uint16 { return ^s }
+func not_long(s uint32) uint32 { return ^s }
+
+// REMARKS:
+// Implement the rotate and shift instructions and side effects.
+func rol_byte(d, s uint8) uint8         { return uint8(x86emu_rol(uint32(d), uint(s), 8)) }
+func rol_word(d uint16, s uint8) uint16 { return uint16(x86emu_rol(uint32(d), uint(s), 16)) }
+func rol_long(d uint32, s uint8) uint32 { return x86emu_rol(d, uint(s), 32) }
+func ror_byte(d, s uint8) uint8         { return uint8(x86emu_ror(uint32(d), uint(s), 8)) }
+func ror_word(d uint16, s uint8) uint16 { return uint16(x86emu_ror(uint32(d), uint(s), 16)) }
+func ror_long(d uint32, s uint8) uint32 { return x86emu_ror(d, uint(s), 32) }
+func rcl_byte(d, s uint8) uint8         { return uint8(x86emu_rcl(uint32(d), uint(s), 8)) }
+func rcl_word(d uint16, s uint8) uint16 { return uint16(x86emu_rcl(uint32(d), uint(s), 16)) }
+func rcl_long(d uint32, s uint8) uint32 { return x86emu_rcl(d, uint(s), 32) }
+func rcr_byte(d, s uint8) uint8         { return uint8(x86emu_rcr(uint32(d), uint(s), 8)) }
+func rcr_word(d uint16, s uint8) uint16 { return uint16(x86emu_rcr(uint32(d), uint(s), 16)) }
+func rcr_long(d uint32, s uint8) uint32 { return x86emu_rcr(d, uint(s), 32) }
+func shl_byte(d, s uint8) uint8         { return uint8(x86emu_shl(uint32(d), uint(s), 8)) }
+func shl_word(d uint16, s uint8) uint16 { return uint16(x86emu_shl(uint32(d), uint(s), 16)) }
+func shl_long(d uint32, s uint8) uint32 { return x86emu_shl(d, uint(s), 32) }
+func shr_byte(d, s uint8) uint8         { return uint8(x86emu_shr(uint32(d), uint(s), 8)) }
+func shr_word(d uint16, s uint8) uint16 { return uint16(x86emu_shr(uint32(d), uint(s), 16)) }
+func shr_long(d uint32, s uint8) uint32 { return x86emu_shr(d, uint(s), 32) }
+func sar_byte(d, s uint8) uint8         { return uint8(x86emu_sar(uint32(d), uint(s), 8)) }
+func sar_word(d uint16, s uint8) uint16 { return uint16(x86emu_sar(uint32(d), uint(s), 16)) }
+func sar_long(d uint32, s uint8) uint32 { return x86emu_sar(d, uint(s), 32) }
+
+func shld_word(d, fill uint16, s uint8) uint16 {
+	return uint16(x86emu_shld(uint32(d), uint32(fill), uint(s), 16))
+}
+func shld_long(d, fill uint32, s uint8) uint32 { return x86emu_shld(d, fill, uint(s), 32) }
+func shrd_word(d, fill uint16, s uint8) uint16 {
+	return uint16(x86emu_shrd(uint32(d), uint32(fill), uint(s), 16))
+}
+func shrd_long(d, fill uint32, s uint8) uint32 { return x86emu_shrd(d, fill, uint(s), 32) }
+
+// REMARKS:
+// Implements the IMUL instruction forms with an explicit destination: the
+// product of d and s truncated to the operand width, with CF and OF set when
+// the truncation lost significant bits.
+func x86emu_imul(d, s uint32, width uint) uint32 {
+	sh := 64 - width
+	prod := (int64(d) << sh >> sh) * (int64(s) << sh >> sh)
+	res := uint32(prod) & x86emu_width_mask(width)
+	lost := int64(res)<<sh>>sh != prod
+	CONDITIONAL_SET_FLAG(lost, F_CF)
+	CONDITIONAL_SET_FLAG(lost, F_OF)
+	return res
+}
+
+func imul_long_direct(d, s uint32) (res_lo, res_hi uint32) {
+	prod := int64(int32(d)) * int64(int32(s))
+	return uint32(prod), uint32(uint64(prod) >> 32)
+}
+
+// REMARKS:
+// Implements the one operand IMUL and MUL instructions and side effects:
+// AX = AL * s, DX:AX = AX * s or EDX:EAX = EAX * s.
+func imul_byte(s uint8) {
+	r := &M().x86
+	res := int16(int8(r.gen.A.Get8l())) * int16(int8(s))
+	r.gen.A.Set16(uint16(res))
+	lost := int16(int8(res)) != res
+	CONDITIONAL_SET_FLAG(lost, F_CF)
+	CONDITIONAL_SET_FLAG(lost, F_OF)
+}
+
+func imul_word(s uint16) {
+	r := &M().x86
+	res := int32(int16(r.gen.A.Get16())) * int32(int16(s))
+	r.gen.A.Set16(uint16(res))
+	r.gen.D.Set16(uint16(res >> 16))
+	lost := int32(int16(res)) != res
+	CONDITIONAL_SET_FLAG(lost, F_CF)
+	CONDITIONAL_SET_FLAG(lost, F_OF)
+}
+
+func imul_long(s uint32) {
+	r := &M().x86
+	lo, hi := imul_long_direct(r.gen.A.Get32(), s)
+	r.gen.A.Set32(lo)
+	r.gen.D.Set32(hi)
+	lost := int64(int32(lo)) != int64(hi)<<32|int64(lo)
+	CONDITIONAL_SET_FLAG(lost, F_CF)
+	CONDITIONAL_SET_FLAG(lost, F_OF)
+}
+
+func mul_byte(s uint8) {
+	r := &M().x86
+	res := uint16(r.gen.A.Get8l()) * uint16(s)
+	r.gen.A.Set16(res)
+	CONDITIONAL_SET_FLAG(res>>8 != 0, F_CF)
+	CONDITIONAL_SET_FLAG(res>>8 != 0, F_OF)
+}
+
+func mul_word(s uint16) {
+	r := &M().x86
+	res := uint32(r.gen.A.Get16()) * uint32(s)
+	r.gen.A.Set16(uint16(res))
+	r.gen.D.Set16(uint16(res >> 16))
+	CONDITIONAL_SET_FLAG(res>>16 != 0, F_CF)
+	CONDITIONAL_SET_FLAG(res>>16 != 0, F_OF)
+}
+
+func mul_long(s uint32) {
+	r := &M().x86
+	res := uint64(r.gen.A.Get32()) * uint64(s)
+	r.gen.A.Set32(uint32(res))
+	r.gen.D.Set32(uint32(res >> 32))
+	CONDITIONAL_SET_FLAG(res>>32 != 0, F_CF)
+	CONDITIONAL_SET_FLAG(res>>32 != 0, F_OF)
+}
+
+// REMARKS:
+// Implements the IDIV and DIV instructions and side effects.  Dividing by
+// zero, or a quotient that does not fit the destination, raises #DE before
+// any register is changed.
+func idiv_byte(s uint8) {
+	r := &M().x86
+	dvd := int64(int16(r.gen.A.Get16()))
+	div := int64(int8(s))
+	if div == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	q := dvd / div
+	if q < -0x80 || q > 0x7f {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Setl8(uint8(q))
+	r.gen.A.Seth8(uint8(dvd % div))
+}
+
+func idiv_word(s uint16) {
+	r := &M().x86
+	dvd := int64(int32(uint32(r.gen.D.Get16())<<16 | uint32(r.gen.A.Get16())))
+	div := int64(int16(s))
+	if div == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	q := dvd / div
+	if q < -0x8000 || q > 0x7fff {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Set16(uint16(q))
+	r.gen.D.Set16(uint16(dvd % div))
+}
+
+func idiv_long(s uint32) {
+	r := &M().x86
+	dvd := int64(uint64(r.gen.D.Get32())<<32 | uint64(r.gen.A.Get32()))
+	div := int64(int32(s))
+	if div == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	/* the most negative dividend over -1 wraps to itself, out of range too */
+	q := dvd / div
+	if q < -0x80000000 || q > 0x7fffffff {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Set32(uint32(q))
+	r.gen.D.Set32(uint32(dvd % div))
+}
+
+func div_byte(s uint8) {
+	r := &M().x86
+	dvd := uint32(r.gen.A.Get16())
+	if s == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	q := dvd / uint32(s)
+	if q > 0xff {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Setl8(uint8(q))
+	r.gen.A.Seth8(uint8(dvd % uint32(s)))
+}
+
+func div_word(s uint16) {
+	r := &M().x86
+	dvd := uint32(r.gen.D.Get16())<<16 | uint32(r.gen.A.Get16())
+	if s == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	q := dvd / uint32(s)
+	if q > 0xffff {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Set16(uint16(q))
+	r.gen.D.Set16(uint16(dvd % uint32(s)))
+}
+
+func div_long(s uint32) {
+	r := &M().x86
+	dvd := uint64(r.gen.D.Get32())<<32 | uint64(r.gen.A.Get32())
+	if s == 0 {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	q := dvd / uint64(s)
+	if q > 0xffffffff {
+		x86emu_fault_noerr(EXC_DE)
+	}
+	r.gen.A.Set32(uint32(q))
+	r.gen.D.Set32(uint32(dvd % uint64(s)))
+}
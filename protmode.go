@@ -0,0 +1,844 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+ * Protected mode support: control registers, descriptor tables, segment
+ * loads with protection checks and interrupt/exception delivery through
+ * the IDT.
+ *
+ * Only what firmware needs is modelled.  There are no LDTs, task switches
+ * or inner-privilege stack switches; those raise #GP instead.
+ */
+
+/* CR0 bits */
+const (
+	CR0_PE uint32 = 0x00000001
+	CR0_MP uint32 = 0x00000002
+	CR0_EM uint32 = 0x00000004
+	CR0_TS uint32 = 0x00000008
+	CR0_ET uint32 = 0x00000010
+	CR0_NE uint32 = 0x00000020
+	CR0_WP uint32 = 0x00010000
+	CR0_AM uint32 = 0x00040000
+	CR0_NW uint32 = 0x20000000
+	CR0_CD uint32 = 0x40000000
+	CR0_PG uint32 = 0x80000000
+)
+
+/* CR0 after reset: caches disabled, ET hardwired to 1. */
+const CR0_RESET = CR0_CD | CR0_NW | CR0_ET
+
+/* EFLAGS bits beyond the 8086 ones */
+const (
+	F_IOPL uint32 = 0x00003000
+	F_NT   uint32 = 0x00004000
+	F_RF   uint32 = 0x00010000
+	F_VM   uint32 = 0x00020000
+	F_AC   uint32 = 0x00040000
+	F_VIF  uint32 = 0x00080000
+	F_VIP  uint32 = 0x00100000
+	F_ID   uint32 = 0x00200000
+)
+
+/* Gate types in the IDT */
+const (
+	GATE_TASK   = 0x05
+	GATE_INT16  = 0x06
+	GATE_TRAP16 = 0x07
+	GATE_INT32  = 0x0e
+	GATE_TRAP32 = 0x0f
+)
+
+/* A segment descriptor unpacked from a descriptor table. */
+type x86emu_desc struct {
+	base  uint32
+	limit uint32
+	attr  uint16
+	addr  uint32 /* linear address of the descriptor */
+}
+
+// REMARKS:
+// Puts the control and descriptor table registers into their reset state:
+// real mode, IVT at 0 and all segment caches describing 64K segments.
+func x86emu_reset_sysregs() {
+	M().x86.cr = [5]uint32{CR0_RESET, 0, 0, 0, 0}
+	M().x86.gdtr = x86emu_dtr{base: 0, limit: 0xffff}
+	M().x86.idtr = x86emu_dtr{base: 0, limit: 0x3ff}
+	M().x86.dr = [8]uint32{6: DR6_RESET, 7: DR7_RESET}
+	x86emu_tlb_flush()
+	for n := range M().x86.segcache {
+		x86emu_reset_seg(n, x86emu_sreg(n).Get())
+	}
+}
+
+func init() {
+	x86emu_reset_sysregs()
+}
+
+func x86emu_unpack_desc(lo, hi uint32) x86emu_desc {
+	d := x86emu_desc{
+		base:  lo>>16 | (hi&0xff)<<16 | hi&0xff000000,
+		limit: lo&0xffff | hi&0x000f0000,
+		attr:  uint16((hi>>8)&0xff) | uint16((hi>>20)&0xf)<<8,
+	}
+	if d.attr&SEG_ATTR_G != 0 {
+		d.limit = d.limit<<12 | 0xfff
+	}
+	return d
+}
+
+// PARAMETERS:
+// sel - Selector naming the descriptor
+//
+// RETURNS:
+// The unpacked descriptor.
+//
+// REMARKS:
+// Raises #GP(selector) if the selector lies outside the GDT or refers to the
+// LDT, which is not supported.
+func x86emu_read_desc(sel uint16) x86emu_desc {
+	index := uint32(sel &^ 7)
+	if sel&4 != 0 || index+7 > uint32(M().x86.gdtr.limit) {
+		x86emu_fault(EXC_GP, uint32(sel&0xfffc))
+	}
+	addr := M().x86.gdtr.base + index
+	d := x86emu_unpack_desc(x86emu_lin_read(addr, 4, true), x86emu_lin_read(addr+4, 4, true))
+	d.addr = addr
+	return d
+}
+
+/* Sets the accessed bit of a code or data descriptor, as the CPU does. */
+func x86emu_mark_accessed(d *x86emu_desc) {
+	if d.attr&SEG_ATTR_ACCESSED == 0 {
+		d.attr |= SEG_ATTR_ACCESSED
+		x86emu_lin_write(d.addr+5, 1, uint32(d.attr), true)
+	}
+}
+
+func x86emu_load_seg_prot(n int, sel uint16) {
+	c := &M().x86.segcache[n]
+	cpl := x86emu_cpl()
+	rpl := sel & 3
+	errc := uint32(sel & 0xfffc)
+
+	if sel&0xfffc == 0 {
+		if n == SEG_CS || n == SEG_SS {
+			x86emu_fault(EXC_GP, 0)
+		}
+		/* null selector: loads fine, faults on use */
+		*c = x86emu_seg_cache{sel: sel, loaded: true}
+		return
+	}
+	d := x86emu_read_desc(sel)
+	dpl := (d.attr & SEG_ATTR_DPL) >> 5
+	if d.attr&SEG_ATTR_S == 0 {
+		x86emu_fault(EXC_GP, errc)
+	}
+	switch n {
+	case SEG_CS:
+		if d.attr&SEG_ATTR_CODE == 0 {
+			x86emu_fault(EXC_GP, errc)
+		}
+		/*
+		 * The RPL is the privilege level being entered: the CPL for a
+		 * far jump or call, an outer level for IRET.
+		 */
+		if rpl < cpl {
+			x86emu_fault(EXC_GP, errc)
+		}
+		if d.attr&SEG_ATTR_DC != 0 {
+			if dpl > rpl {
+				x86emu_fault(EXC_GP, errc)
+			}
+		} else if dpl != rpl {
+			x86emu_fault(EXC_GP, errc)
+		}
+		if d.attr&SEG_ATTR_P == 0 {
+			x86emu_fault(EXC_NP, errc)
+		}
+	case SEG_SS:
+		if d.attr&(SEG_ATTR_CODE|SEG_ATTR_RW) != SEG_ATTR_RW ||
+			rpl != cpl || dpl != cpl {
+			x86emu_fault(EXC_GP, errc)
+		}
+		if d.attr&SEG_ATTR_P == 0 {
+			x86emu_fault(EXC_SS, errc)
+		}
+	default:
+		if d.attr&(SEG_ATTR_CODE|SEG_ATTR_RW) == SEG_ATTR_CODE {
+			x86emu_fault(EXC_GP, errc)
+		}
+		conforming := d.attr&(SEG_ATTR_CODE|SEG_ATTR_DC) == SEG_ATTR_CODE|SEG_ATTR_DC
+		if !conforming && (dpl < cpl || dpl < rpl) {
+			x86emu_fault(EXC_GP, errc)
+		}
+		if d.attr&SEG_ATTR_P == 0 {
+			x86emu_fault(EXC_NP, errc)
+		}
+	}
+	x86emu_mark_accessed(&d)
+	*c = x86emu_seg_cache{
+		sel:    sel,
+		base:   d.base,
+		limit:  d.limit,
+		attr:   d.attr,
+		loaded: true,
+	}
+}
+
+/*
+ * Loads CS for a far transfer to the same privilege level.  The RPL of the
+ * loaded selector becomes the CPL, so it is forced to the current one.
+ */
+func x86emu_load_cs(sel uint16, ip uint32) {
+	if x86emu_protected_mode() {
+		sel = sel&^3 | x86emu_cpl()
+	}
+	x86emu_load_seg(SEG_CS, sel)
+	if !x86emu_code32() {
+		ip &= 0xffff
+	}
+	if x86emu_protected_mode() && ip > M().x86.segcache[SEG_CS].limit {
+		x86emu_fault(EXC_GP, 0)
+	}
+	M().x86.spc.IP.Set32(ip)
+}
+
+// PARAMETERS:
+// vec     - Interrupt vector
+// soft    - Raised by INT n/INT3/INTO rather than by hardware or a fault
+// has_err - Whether an error code is pushed
+// err     - Error code
+//
+// REMARKS:
+// Transfers control to an interrupt handler, through the IVT in real mode and
+// the IDT in protected mode.  May itself raise an exception.
+func x86emu_int_deliver(vec uint8, soft bool, has_err bool, err uint32) {
+	if !x86emu_protected_mode() {
+		x86emu_int_deliver_real(vec)
+		return
+	}
+	x86emu_int_deliver_prot(vec, soft, has_err, err)
+}
+
+func x86emu_int_deliver_real(vec uint8) {
+	addr := uint32(vec) * 4
+	if addr+3 > uint32(M().x86.idtr.limit) {
+		x86emu_fault(EXC_GP, 0)
+	}
+	addr += M().x86.idtr.base
+	push_word(uint16(M().x86.spc.FLAGS))
+	CLEAR_FLAG(F_IF)
+	CLEAR_FLAG(F_TF)
+	push_word(M().x86.seg.CS.Get())
+	push_word(M().x86.spc.IP.Get16())
+	x86emu_load_seg(SEG_CS, x86emu_lin_rdw(addr+2))
+	M().x86.spc.IP.Set32(uint32(x86emu_lin_rdw(addr)))
+}
+
+func x86emu_int_deliver_prot(vec uint8, soft bool, has_err bool, err uint32) {
+	errc := uint32(vec)*8 + 2
+	if !soft {
+		errc |= 1 /* EXT */
+	}
+	index := uint32(vec) * 8
+	if index+7 > uint32(M().x86.idtr.limit) {
+		x86emu_fault(EXC_GP, errc)
+	}
+	lo := x86emu_lin_read(M().x86.idtr.base+index, 4, true)
+	hi := x86emu_lin_read(M().x86.idtr.base+index+4, 4, true)
+	gtype := (hi >> 8) & 0x1f
+	dpl := uint16((hi >> 13) & 3)
+	switch gtype {
+	case GATE_INT16, GATE_TRAP16, GATE_INT32, GATE_TRAP32:
+	default:
+		/* task gates need a TSS, which we don't model */
+		x86emu_fault(EXC_GP, errc)
+	}
+	if soft && dpl < x86emu_cpl() {
+		x86emu_fault(EXC_GP, errc)
+	}
+	if hi&0x8000 == 0 {
+		x86emu_fault(EXC_NP, errc)
+	}
+	sel := uint16(lo >> 16)
+	off := lo&0xffff | hi&0xffff0000
+	gate32 := gtype&0x08 != 0
+	if !gate32 {
+		off &= 0xffff
+	}
+
+	d := x86emu_read_desc(sel)
+	if d.attr&(SEG_ATTR_S|SEG_ATTR_CODE) != SEG_ATTR_S|SEG_ATTR_CODE {
+		x86emu_fault(EXC_GP, uint32(sel&0xfffc))
+	}
+	if d.attr&SEG_ATTR_DC == 0 && (d.attr&SEG_ATTR_DPL)>>5 != x86emu_cpl() {
+		/* would need a stack switch through the TSS */
+		x86emu_fault(EXC_GP, uint32(sel&0xfffc))
+	}
+
+	flags := M().x86.spc.FLAGS
+	cs := M().x86.seg.CS.Get()
+	ip := M().x86.spc.IP.Get32()
+	if gate32 {
+		push_long(flags)
+		push_long(uint32(cs))
+		push_long(ip)
+		if has_err {
+			push_long(err)
+		}
+	} else {
+		push_word(uint16(flags))
+		push_word(cs)
+		push_word(uint16(ip))
+		if has_err {
+			push_word(uint16(err))
+		}
+	}
+	x86emu_load_cs(sel, off)
+	M().x86.spc.FLAGS &^= F_TF | F_NT | F_RF | F_VM
+	if gtype == GATE_INT16 || gtype == GATE_INT32 {
+		M().x86.spc.FLAGS &^= F_IF
+	}
+}
+
+// REMARKS:
+// Executes one instruction (or prefix byte) at CS:EIP.  At the start of each
+// instruction the position is saved so that faults can restart it, and the
+// default operand and address size of 32-bit code segments is applied.
+// A Go trap at CS:EIP runs in place of the instruction.
+func x86emu_exec_insn() {
+	var trap *x86emu_trap
+	if M().x86.mode&SYSMODE_INSN_SAVED == 0 {
+		M().x86.insn_cs = M().x86.seg.CS.Get()
+		M().x86.insn_csc = M().x86.segcache[SEG_CS]
+		M().x86.insn_ip = M().x86.spc.IP.Get32()
+		M().x86.insn_sp = M().x86.spc.SP.Get32()
+		M().x86.insn_tf = ACCESS_FLAG(F_TF)
+		M().x86.mode |= SYSMODE_INSN_SAVED
+		M().x86.mode &^= SYSMODE_INTR_SHADOW
+		x86emu_clock_tick()
+		if x86emu_code32() {
+			M().x86.mode |= SYSMODE_PREFIX_DATA | SYSMODE_PREFIX_ADDR
+		}
+		trap = x86emu_trap_find()
+	}
+	faulted := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				e, ok := r.(x86emu_exception)
+				if !ok {
+					panic(r)
+				}
+				faulted = true
+				/*
+				 * Put the CS cache back as it was rather than reloading
+				 * it: the GDT may have changed since CS was loaded.
+				 */
+				x86emu_sreg(SEG_CS).Set(M().x86.insn_cs)
+				M().x86.segcache[SEG_CS] = M().x86.insn_csc
+				M().x86.spc.IP.Set32(M().x86.insn_ip)
+				M().x86.spc.SP.Set32(M().x86.insn_sp)
+				DecodeClearSegOVR()
+				x86emu_end_instr()
+				if DEBUG_TRACE() {
+					fmt.Printf("%04x:%08x: exception %x error %x\n",
+						M().x86.insn_cs, M().x86.insn_ip, e.vec, e.err)
+				}
+				x86emu_handle_fault(e)
+			}
+		}()
+		if trap != nil {
+			trap.fn()
+			DecodeClearSegOVR()
+			x86emu_end_instr()
+			return
+		}
+		op1 := x86emu_lin_rdb(x86emu_ip_advance(1))
+		x86emu_check_fpu(op1)
+		if h := x86emu_optab[op1]; h != nil {
+			h(op1)
+		} else {
+			x86emuOp_illegal_op(op1)
+		}
+	}()
+	/* traps are taken once the whole instruction, prefixes included, is done */
+	if !faulted && M().x86.mode&(SYSMODE_INSN_SAVED|SYSMODE_INTR_SHADOW) == 0 && M().x86.insn_tf {
+		x86emu_single_step_trap()
+	}
+}
+
+// PARAMETERS:
+// intno - Interrupt number
+//
+// REMARKS:
+// Software interrupt: calls the hook registered for the vector, if any, and
+// otherwise delivers it through the IVT or IDT.
+func x86emu_soft_int(intno uint8) {
+	if _X86EMU_intrTab[intno] != nil {
+		x86emu_intr_hw = false
+		_X86EMU_intrTab[intno](int(intno))
+		return
+	}
+	x86emu_int_deliver(intno, true, false, 0)
+}
+
+/*----------------------------- Instructions -----------------------------*/
+
+// REMARKS:
+// Handles opcode 0x0f: fetch the second opcode byte and dispatch.
+func x86emuOp_two_byte(_ uint8) {
+	op2 := x86emu_lin_rdb(x86emu_ip_advance(1))
+	x86emu_inc_decoded_inst_len(1)
+	if h := x86emu_optab2[op2]; h != nil {
+		h(op2)
+	} else {
+		x86emuOp2_illegal_op(op2)
+	}
+}
+
+// REMARKS:
+// Handles opcode 0x66.  In a 32-bit code segment the prefix selects 16-bit
+// operands, so it clears the bit the segment default set.
+func x86emuOp_prefix_data(_ uint8) {
+	DECODE_PRINTF("DATA:\n")
+	TRACE_AND_STEP()
+	if x86emu_code32() {
+		M().x86.mode &^= SYSMODE_PREFIX_DATA
+	} else {
+		M().x86.mode |= SYSMODE_PREFIX_DATA
+	}
+	/* note no DECODE_CLEAR_SEGOVR here. */
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x67; see x86emuOp_prefix_data.
+func x86emuOp_prefix_addr(_ uint8) {
+	DECODE_PRINTF("ADDR:\n")
+	TRACE_AND_STEP()
+	if x86emu_code32() {
+		M().x86.mode &^= SYSMODE_PREFIX_ADDR
+	} else {
+		M().x86.mode |= SYSMODE_PREFIX_ADDR
+	}
+	/* note no DECODE_CLEAR_SEGOVR here. */
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x8e
+func x86emuOp_mov_word_SR_RM(_ uint8) {
+	var mod, rh, rl int
+	var srcval uint16
+
+	DECODE_PRINTF("MOV\t")
+	fetch_decode_modrm(&mod, &rh, &rl)
+	if rh == SEG_CS || rh > SEG_GS {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("%s,", x86emu_seg_names[rh])
+	if mod < 3 {
+		srcval = fetch_data_word(decode_rmXX_address(mod, rl))
+	} else {
+		srcval = x86emu_greg(rl).Get16()
+	}
+	DECODE_PRINTF("\n")
+	TRACE_AND_STEP()
+	x86emu_load_seg(rh, srcval)
+	if rh == SEG_SS {
+		/* the next instruction is expected to load SP */
+		M().x86.mode |= SYSMODE_INTR_SHADOW
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xcc
+func x86emuOp_int3(_ uint8) {
+	DECODE_PRINTF("INT 3\n")
+	TRACE_AND_STEP()
+	x86emu_soft_int(3)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xcd
+func x86emuOp_int_IMM(_ uint8) {
+	intnum := fetch_byte_imm()
+	DECODE_PRINTF("INT\t%x\n", intnum)
+	TRACE_AND_STEP()
+	x86emu_soft_int(intnum)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xce
+func x86emuOp_into(_ uint8) {
+	DECODE_PRINTF("INTO\n")
+	TRACE_AND_STEP()
+	if ACCESS_FLAG(F_OF) {
+		x86emu_soft_int(4)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xcf.  In protected mode this may also return to an outer
+// privilege level, popping SS:ESP.
+func x86emuOp_iret(_ uint8) {
+	var ip, cs, flags uint32
+
+	DECODE_PRINTF("IRET\n")
+	TRACE_AND_STEP()
+	op32 := M().x86.mode&SYSMODE_PREFIX_DATA != 0
+	if op32 {
+		ip = pop_long()
+		cs = pop_long() & 0xffff
+		flags = pop_long()
+	} else {
+		ip = uint32(pop_word())
+		cs = uint32(pop_word())
+		flags = M().x86.spc.FLAGS&0xffff0000 | uint32(pop_word())
+	}
+	if !x86emu_protected_mode() {
+		M().x86.spc.FLAGS = flags
+		x86emu_load_seg(SEG_CS, uint16(cs))
+		M().x86.spc.IP.Set32(ip & 0xffff)
+	} else if rpl := uint16(cs & 3); rpl > x86emu_cpl() {
+		var sp, ss uint32
+		if op32 {
+			sp = pop_long()
+			ss = pop_long() & 0xffff
+		} else {
+			sp = uint32(pop_word())
+			ss = uint32(pop_word())
+		}
+		if x86emu_cpl() != 0 {
+			flags = flags&^F_IF | M().x86.spc.FLAGS&F_IF
+		}
+		M().x86.spc.FLAGS = flags &^ F_VM
+		x86emu_load_seg(SEG_CS, uint16(cs))
+		M().x86.spc.IP.Set32(ip)
+		x86emu_load_seg(SEG_SS, uint16(ss))
+		M().x86.spc.SP.Set32(sp)
+		for _, n := range []int{SEG_ES, SEG_DS, SEG_FS, SEG_GS} {
+			c := &M().x86.segcache[n]
+			dpl := (c.attr & SEG_ATTR_DPL) >> 5
+			conforming := c.attr&(SEG_ATTR_CODE|SEG_ATTR_DC) == SEG_ATTR_CODE|SEG_ATTR_DC
+			if !conforming && dpl < rpl {
+				*c = x86emu_seg_cache{loaded: true}
+				x86emu_sreg(n).Set(0)
+			}
+		}
+	} else {
+		if x86emu_cpl() != 0 {
+			flags = flags&^F_IF | M().x86.spc.FLAGS&F_IF
+		}
+		M().x86.spc.FLAGS = flags &^ F_VM
+		x86emu_load_cs(uint16(cs), ip)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0xea
+func x86emuOp_jump_far_IMM(_ uint8) {
+	var ip uint32
+
+	DECODE_PRINTF("JMP\tFAR ")
+	if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+		ip = fetch_long_imm()
+	} else {
+		ip = uint32(fetch_word_imm())
+	}
+	cs := fetch_word_imm()
+	DECODE_PRINTF("%04x:%04x\n", cs, ip)
+	if DEBUG_TRACEJMPREGS() {
+		x86emu_dump_regs()
+	}
+	if DEBUG_TRACEJMP() {
+		fmt.Printf("%04x:%04x: JMP FAR %04x:%04x\n", M().x86.saved_cs, M().x86.saved_ip, cs, ip)
+	}
+	TRACE_AND_STEP()
+	x86emu_load_cs(cs, ip)
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x01: SGDT, SIDT, LGDT, LIDT, SMSW, LMSW and INVLPG.
+func x86emuOp2_opc_01(op2 uint8) {
+	var mod, rh, rl int
+	var off uint32
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	op32 := M().x86.mode&SYSMODE_PREFIX_DATA != 0
+	if (rh <= 3 || rh == 7) && mod == 3 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	if mod < 3 {
+		off = decode_rmXX_address(mod, rl)
+	}
+	switch rh {
+	case 0, 1: /* SGDT, SIDT */
+		dtr := &M().x86.gdtr
+		DECODE_PRINTF("SGDT\n")
+		if rh == 1 {
+			dtr = &M().x86.idtr
+			DECODE_PRINTF("SIDT\n")
+		}
+		TRACE_AND_STEP()
+		base := dtr.base
+		if !op32 {
+			base &= 0x00ffffff
+		}
+		store_data_word(off, dtr.limit)
+		store_data_long(off+2, base)
+	case 2, 3: /* LGDT, LIDT */
+		dtr := &M().x86.gdtr
+		DECODE_PRINTF("LGDT\n")
+		if rh == 3 {
+			dtr = &M().x86.idtr
+			DECODE_PRINTF("LIDT\n")
+		}
+		TRACE_AND_STEP()
+		x86emu_check_cpl0()
+		limit := fetch_data_word(off)
+		base := fetch_data_long(off + 2)
+		if !op32 {
+			base &= 0x00ffffff
+		}
+		*dtr = x86emu_dtr{base: base, limit: limit}
+	case 4: /* SMSW */
+		DECODE_PRINTF("SMSW\n")
+		TRACE_AND_STEP()
+		if mod == 3 {
+			if op32 {
+				x86emu_greg(rl).Set32(M().x86.cr[0])
+			} else {
+				x86emu_greg(rl).Set16(uint16(M().x86.cr[0]))
+			}
+		} else {
+			store_data_word(off, uint16(M().x86.cr[0]))
+		}
+	case 6: /* LMSW */
+		var msw uint16
+		DECODE_PRINTF("LMSW\n")
+		TRACE_AND_STEP()
+		x86emu_check_cpl0()
+		if mod == 3 {
+			msw = x86emu_greg(rl).Get16()
+		} else {
+			msw = fetch_data_word(off)
+		}
+		/* LMSW can set PE but never clear it */
+		cr0 := M().x86.cr[0]
+		x86emu_write_cr0(cr0&^0xe | uint32(msw)&0xf | cr0&CR0_PE)
+	case 7: /* INVLPG */
+		DECODE_PRINTF("INVLPG\n")
+		TRACE_AND_STEP()
+		x86emu_check_cpl0()
+		x86emu_tlb_flush_page(x86emu_seg_sync(get_data_segment_index()).base + off)
+	default:
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x00: SLDT, STR, LLDT, LTR, VERR and VERW.  There is
+// no LDT or TSS, so LDTR and TR always hold the null selector and loading
+// anything else raises #GP.
+func x86emuOp2_opc_00(_ uint8) {
+	var mod, rh, rl int
+	var off uint32
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	if !x86emu_protected_mode() || rh > 5 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	if mod < 3 {
+		off = decode_rmXX_address(mod, rl)
+	}
+	switch rh {
+	case 0, 1: /* SLDT, STR */
+		if rh == 0 {
+			DECODE_PRINTF("SLDT\n")
+		} else {
+			DECODE_PRINTF("STR\n")
+		}
+		TRACE_AND_STEP()
+		if mod == 3 {
+			if M().x86.mode&SYSMODE_PREFIX_DATA != 0 {
+				x86emu_greg(rl).Set32(0)
+			} else {
+				x86emu_greg(rl).Set16(0)
+			}
+		} else {
+			store_data_word(off, 0)
+		}
+	case 2, 3: /* LLDT, LTR */
+		var sel uint16
+		if rh == 2 {
+			DECODE_PRINTF("LLDT\n")
+		} else {
+			DECODE_PRINTF("LTR\n")
+		}
+		TRACE_AND_STEP()
+		x86emu_check_cpl0()
+		if mod == 3 {
+			sel = x86emu_greg(rl).Get16()
+		} else {
+			sel = fetch_data_word(off)
+		}
+		if rh == 3 || sel&0xfffc != 0 {
+			x86emu_fault(EXC_GP, uint32(sel&0xfffc))
+		}
+	case 4, 5: /* VERR, VERW */
+		var sel uint16
+		if rh == 4 {
+			DECODE_PRINTF("VERR\n")
+		} else {
+			DECODE_PRINTF("VERW\n")
+		}
+		TRACE_AND_STEP()
+		if mod == 3 {
+			sel = x86emu_greg(rl).Get16()
+		} else {
+			sel = fetch_data_word(off)
+		}
+		CONDITIONAL_SET_FLAG(x86emu_verify_seg(sel, rh == 5), F_ZF)
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+/*
+ * Whether the segment sel names can be read (or written) at the current
+ * privilege level, for VERR and VERW.  Unlike a segment load this never
+ * faults on the selector itself.
+ */
+func x86emu_verify_seg(sel uint16, write bool) bool {
+	index := uint32(sel &^ 7)
+	if sel&0xfffc == 0 || sel&4 != 0 || index+7 > uint32(M().x86.gdtr.limit) {
+		return false
+	}
+	addr := M().x86.gdtr.base + index
+	d := x86emu_unpack_desc(x86emu_lin_read(addr, 4, true), x86emu_lin_read(addr+4, 4, true))
+	if d.attr&SEG_ATTR_S == 0 {
+		return false
+	}
+	code := d.attr&SEG_ATTR_CODE != 0
+	if write {
+		if code || d.attr&SEG_ATTR_RW == 0 {
+			return false
+		}
+	} else if code && d.attr&SEG_ATTR_RW == 0 {
+		return false
+	}
+	if code && d.attr&SEG_ATTR_DC != 0 {
+		/* conforming code is readable from any level */
+		return true
+	}
+	dpl := (d.attr & SEG_ATTR_DPL) >> 5
+	return dpl >= x86emu_cpl() && dpl >= sel&3
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x06
+func x86emuOp2_clts(_ uint8) {
+	DECODE_PRINTF("CLTS\n")
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	M().x86.cr[0] &^= CR0_TS
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func x86emu_check_cpl0() {
+	if x86emu_cpl() != 0 {
+		x86emu_fault(EXC_GP, 0)
+	}
+}
+
+func x86emu_write_cr0(val uint32) {
+	if val&CR0_PG != 0 && val&CR0_PE == 0 {
+		x86emu_fault(EXC_GP, 0)
+	}
+	if (val^M().x86.cr[0])&(CR0_PG|CR0_WP|CR0_PE) != 0 {
+		x86emu_tlb_flush()
+	}
+	M().x86.cr[0] = val | CR0_ET
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x20: MOV r32,CRn
+func x86emuOp2_mov_R_CR(_ uint8) {
+	var mod, rh, rl int
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	if rh == 1 || rh > 4 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("MOV\tCR%d\n", rh)
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	x86emu_greg(rl).Set32(M().x86.cr[rh])
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+// REMARKS:
+// Handles opcode 0x0f,0x22: MOV CRn,r32
+func x86emuOp2_mov_CR_R(_ uint8) {
+	var mod, rh, rl int
+
+	fetch_decode_modrm(&mod, &rh, &rl)
+	if rh == 1 || rh > 4 {
+		x86emu_fault_noerr(EXC_UD)
+	}
+	DECODE_PRINTF("MOV\tCR%d\n", rh)
+	TRACE_AND_STEP()
+	x86emu_check_cpl0()
+	val := x86emu_greg(rl).Get32()
+	switch rh {
+	case 0:
+		x86emu_write_cr0(val)
+	case 3:
+		x86emu_write_cr3(val)
+	case 4:
+		x86emu_write_cr4(val)
+	default:
+		M().x86.cr[rh] = val
+	}
+	DecodeClearSegOVR()
+	END_OF_INSTR()
+}
+
+func init() {
+	x86emu_optab[0x0f] = x86emuOp_two_byte
+	x86emu_optab[0x66] = x86emuOp_prefix_data
+	x86emu_optab[0x67] = x86emuOp_prefix_addr
+	x86emu_optab[0x8e] = x86emuOp_mov_word_SR_RM
+	x86emu_optab[0xcc] = x86emuOp_int3
+	x86emu_optab[0xcd] = x86emuOp_int_IMM
+	x86emu_optab[0xce] = x86emuOp_into
+	x86emu_optab[0xcf] = x86emuOp_iret
+	x86emu_optab[0xea] = x86emuOp_jump_far_IMM
+	x86emu_optab2[0x00] = x86emuOp2_opc_00
+	x86emu_optab2[0x01] = x86emuOp2_opc_01
+	x86emu_optab2[0x06] = x86emuOp2_clts
+	x86emu_optab2[0x20] = x86emuOp2_mov_R_CR
+	x86emu_optab2[0x22] = x86emuOp2_mov_CR_R
+}
@@ -0,0 +1,459 @@
+package main
+
+import "testing"
+
+/* Where the protected mode tests keep their descriptor tables */
+const (
+	TEST_GDT = 0x2000
+	TEST_IDT = 0x3000
+)
+
+/* Selectors in the test GDT */
+const (
+	TEST_CODE16  = 0x08
+	TEST_DATA16  = 0x10
+	TEST_CODE32  = 0x18 /* 4G flat */
+	TEST_DATA32  = 0x20 /* 4G flat */
+	TEST_RODATA  = 0x28 /* read-only */
+	TEST_XCODE   = 0x30 /* execute-only */
+	TEST_NPDATA  = 0x38 /* not present */
+	TEST_SYSTEM  = 0x40 /* an LDT descriptor */
+	TEST_CODE3   = 0x48 /* DPL 3, 4G flat */
+	TEST_DATA3   = 0x50 /* DPL 3, 4G flat */
+	TEST_EXPDOWN = 0x58 /* expand-down above 0x0fff */
+	TEST_GDT_END = 0x60
+)
+
+const (
+	TEST_ATTR_DATA = SEG_ATTR_P | SEG_ATTR_S | SEG_ATTR_RW
+	TEST_ATTR_CODE = SEG_ATTR_P | SEG_ATTR_S | SEG_ATTR_CODE | SEG_ATTR_RW
+)
+
+// Writes a descriptor into the test GDT.  Limits above 1M are stored page
+// granular.
+func x86emu_test_desc(sel uint16, base, limit uint32, attr uint16) {
+	if limit > 0xfffff {
+		limit >>= 12
+		attr |= SEG_ATTR_G
+	}
+	lo := limit&0xffff | base<<16
+	hi := base>>16&0xff | uint32(attr&0xff)<<8 | limit&0xf0000 |
+		uint32(attr>>8&0xf)<<20 | base&0xff000000
+	sys_wrl(TEST_GDT+uint32(sel&^7), lo)
+	sys_wrl(TEST_GDT+uint32(sel&^7)+4, hi)
+}
+
+// Writes an interrupt, trap or task gate into the test IDT.
+func x86emu_test_gate(vec uint8, sel uint16, off uint32, gtype uint32, dpl uint32, present bool) {
+	hi := off&0xffff0000 | dpl<<13 | gtype<<8
+	if present {
+		hi |= 0x8000
+	}
+	sys_wrl(TEST_IDT+uint32(vec)*8, uint32(sel)<<16|off&0xffff)
+	sys_wrl(TEST_IDT+uint32(vec)*8+4, hi)
+}
+
+// Gives the tests the test machine switched to protected mode with the test
+// GDT, an empty IDT, and CS, DS, ES and SS loaded from 16-bit descriptors
+// based at 0, so code and data stay where the real mode tests put them.
+func x86emu_test_protmode(t *testing.T) {
+	t.Helper()
+	x86emu_test_machine(t)
+	x86emu_test_enter_protmode()
+}
+
+/* Switches the machine as it is to protected mode, as x86emu_test_protmode. */
+func x86emu_test_enter_protmode() {
+	x86emu_test_desc(TEST_CODE16, 0, 0xffff, TEST_ATTR_CODE)
+	x86emu_test_desc(TEST_DATA16, 0, 0xffff, TEST_ATTR_DATA)
+	x86emu_test_desc(TEST_CODE32, 0, 0xffffffff, TEST_ATTR_CODE|SEG_ATTR_DB)
+	x86emu_test_desc(TEST_DATA32, 0, 0xffffffff, TEST_ATTR_DATA|SEG_ATTR_DB)
+	x86emu_test_desc(TEST_RODATA, 0, 0xffff, TEST_ATTR_DATA&^SEG_ATTR_RW)
+	x86emu_test_desc(TEST_XCODE, 0, 0xffff, TEST_ATTR_CODE&^SEG_ATTR_RW)
+	x86emu_test_desc(TEST_NPDATA, 0, 0xffff, TEST_ATTR_DATA&^SEG_ATTR_P)
+	x86emu_test_desc(TEST_SYSTEM, 0, 0xffff, SEG_ATTR_P|0x2)
+	x86emu_test_desc(TEST_CODE3, 0, 0xffffffff, TEST_ATTR_CODE|SEG_ATTR_DB|SEG_ATTR_DPL)
+	x86emu_test_desc(TEST_DATA3, 0, 0xffffffff, TEST_ATTR_DATA|SEG_ATTR_DB|SEG_ATTR_DPL)
+	x86emu_test_desc(TEST_EXPDOWN, 0, 0x0fff, TEST_ATTR_DATA|SEG_ATTR_DC)
+	M().x86.gdtr = x86emu_dtr{base: TEST_GDT, limit: TEST_GDT_END - 1}
+	M().x86.idtr = x86emu_dtr{base: TEST_IDT, limit: 0x7ff}
+	M().x86.cr[0] |= CR0_PE
+	x86emu_load_cs(TEST_CODE16, 0x1000)
+	for _, n := range []int{SEG_DS, SEG_ES, SEG_SS} {
+		x86emu_load_seg(n, TEST_DATA16)
+	}
+}
+
+/* The name of the exception e, or "" for none. */
+func x86emu_test_exc_name(e *x86emu_exception) string {
+	if e == nil {
+		return ""
+	}
+	return x86emu_exc_name(e.vec)
+}
+
+func TestProtmodeTableRegisters(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func()
+		code  []byte
+		check func(t *testing.T)
+		ud    bool /* stops in the #UD handler */
+	}{
+		{"lgdt keeps 24 bits of the base", nil,
+			[]byte{0x0f, 0x01, 0x16, 0x00, 0x40}, /* LGDT [4000] */
+			func(t *testing.T) {
+				if g := M().x86.gdtr; g != (x86emu_dtr{base: 0xbbccdd, limit: 0x0123}) {
+					t.Errorf("GDTR %+v", g)
+				}
+			}, false},
+		{"lidt with a 32-bit operand size", nil,
+			[]byte{0x66, 0x0f, 0x01, 0x1e, 0x00, 0x40}, /* LIDT [4000] */
+			func(t *testing.T) {
+				if g := M().x86.idtr; g != (x86emu_dtr{base: 0xaabbccdd, limit: 0x0123}) {
+					t.Errorf("IDTR %+v", g)
+				}
+			}, false},
+		{"sgdt stores 24 bits of the base",
+			func() { M().x86.gdtr = x86emu_dtr{base: 0x12345678, limit: 0x3ff} },
+			[]byte{0x0f, 0x01, 0x06, 0x10, 0x40}, /* SGDT [4010] */
+			func(t *testing.T) {
+				if l, b := sys_rdw(0x4010), sys_rdl(0x4012); l != 0x3ff || b != 0x345678 {
+					t.Errorf("stored %04x %08x", l, b)
+				}
+			}, false},
+		{"sidt with a 32-bit operand size",
+			func() { M().x86.idtr = x86emu_dtr{base: 0x12345678, limit: 0x7ff} },
+			[]byte{0x66, 0x0f, 0x01, 0x0e, 0x10, 0x40}, /* SIDT [4010] */
+			func(t *testing.T) {
+				if l, b := sys_rdw(0x4010), sys_rdl(0x4012); l != 0x7ff || b != 0x12345678 {
+					t.Errorf("stored %04x %08x", l, b)
+				}
+			}, false},
+		{"lmsw sets pe", nil,
+			[]byte{0xb8, 0x01, 0x00, 0x0f, 0x01, 0xf0}, /* MOV AX,1; LMSW AX */
+			func(t *testing.T) {
+				if !x86emu_protected_mode() {
+					t.Errorf("CR0 %08x", M().x86.cr[0])
+				}
+			}, false},
+		{"lmsw does not clear pe",
+			func() { M().x86.cr[0] |= CR0_PE },
+			[]byte{0x31, 0xc0, 0x0f, 0x01, 0xf0}, /* XOR AX,AX; LMSW AX */
+			func(t *testing.T) {
+				if !x86emu_protected_mode() {
+					t.Errorf("CR0 %08x", M().x86.cr[0])
+				}
+			}, false},
+		{"smsw", nil,
+			[]byte{0x0f, 0x01, 0xe3}, /* SMSW BX */
+			func(t *testing.T) {
+				if bx := M().x86.gen.B.Get16(); bx != uint16(M().x86.cr[0]) {
+					t.Errorf("BX %04x", bx)
+				}
+			}, false},
+		{"lgdt of a register is #UD", nil,
+			[]byte{0x0f, 0x01, 0xd0}, /* LGDT AX */
+			func(t *testing.T) {
+				if ip := sys_rdw(0x800 - 6); ip != 0x1000 {
+					t.Errorf("#UD returns to %04x", ip)
+				}
+			}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			sys_wrw(0x4000, 0x0123)
+			sys_wrl(0x4002, 0xaabbccdd)
+			/* #UD handler: HLT at 0000:1800 */
+			sys_wrl(uint32(EXC_UD)*4, 0x1800)
+			sys_wrb(0x1800, 0xf4)
+			if tc.setup != nil {
+				tc.setup()
+			}
+			x86emu_test_run(t, append(tc.code, 0xf4))
+			want := uint16(0x1001 + len(tc.code))
+			if tc.ud {
+				want = 0x1801
+			}
+			if ip := M().x86.spc.IP.Get16(); ip != want {
+				t.Fatalf("stopped at %04x, want %04x", ip, want)
+			}
+			tc.check(t)
+		})
+	}
+}
+
+func TestProtmodeSegmentLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cpl3 bool
+		n    int
+		sel  uint16
+		exc  string
+		err  uint32
+	}{
+		{"data into ds", false, SEG_DS, TEST_DATA16, "", 0},
+		{"readable code into ds", false, SEG_DS, TEST_CODE16, "", 0},
+		{"null into ds", false, SEG_DS, 0, "", 0},
+		{"null into ss", false, SEG_SS, 0, "#GP", 0},
+		{"beyond the gdt limit", false, SEG_DS, TEST_GDT_END, "#GP", TEST_GDT_END},
+		{"ldt selector", false, SEG_DS, TEST_DATA16 | 4, "#GP", TEST_DATA16 | 4},
+		{"system descriptor", false, SEG_DS, TEST_SYSTEM, "#GP", TEST_SYSTEM},
+		{"execute-only code into ds", false, SEG_DS, TEST_XCODE, "#GP", TEST_XCODE},
+		{"read-only data into ss", false, SEG_SS, TEST_RODATA, "#GP", TEST_RODATA},
+		{"not present data into ds", false, SEG_DS, TEST_NPDATA, "#NP", TEST_NPDATA},
+		{"not present data into ss", false, SEG_SS, TEST_NPDATA, "#SS", TEST_NPDATA},
+		{"rpl 3 for dpl 0 data", false, SEG_DS, TEST_DATA16 | 3, "#GP", TEST_DATA16},
+		{"dpl 3 data at cpl 0", false, SEG_DS, TEST_DATA3, "", 0},
+		{"dpl 3 stack at cpl 0", false, SEG_SS, TEST_DATA3, "#GP", TEST_DATA3},
+		{"dpl 0 data at cpl 3", true, SEG_DS, TEST_DATA16 | 3, "#GP", TEST_DATA16},
+		{"dpl 3 stack at cpl 3", true, SEG_SS, TEST_DATA3 | 3, "", 0},
+		{"data into cs", false, SEG_CS, TEST_DATA16, "#GP", TEST_DATA16},
+		{"dpl 3 code into cs at cpl 0", false, SEG_CS, TEST_CODE3, "#GP", TEST_CODE3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			if tc.cpl3 {
+				x86emu_load_seg(SEG_CS, TEST_CODE3|3)
+			}
+			e := x86emu_test_fault(func() { x86emu_load_seg(tc.n, tc.sel) })
+			if name := x86emu_test_exc_name(e); name != tc.exc || e != nil && e.err != tc.err {
+				t.Fatalf("raised %q %+v, want %q error %#x", name, e, tc.exc, tc.err)
+			}
+			if e != nil || tc.sel&0xfffc == 0 {
+				return
+			}
+			c := M().x86.segcache[tc.n]
+			if c.sel != tc.sel || x86emu_sreg(tc.n).Get() != tc.sel {
+				t.Errorf("loaded selector %04x, cache %04x", x86emu_sreg(tc.n).Get(), c.sel)
+			}
+			if c.attr&SEG_ATTR_ACCESSED == 0 || sys_rdb(TEST_GDT+uint32(tc.sel&^7)+5)&1 == 0 {
+				t.Errorf("accessed bit not set")
+			}
+		})
+	}
+}
+
+func TestProtmodeSegmentLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		n     int
+		sel   uint16
+		off   uint32
+		size  uint32
+		write bool
+		exc   string
+	}{
+		{"last word of a 64K segment", SEG_DS, TEST_DATA16, 0xfffe, 2, false, ""},
+		{"word across the limit", SEG_DS, TEST_DATA16, 0xffff, 2, false, "#GP"},
+		{"stack across the limit", SEG_SS, TEST_DATA16, 0xffff, 2, true, "#SS"},
+		{"top of a 4G segment", SEG_DS, TEST_DATA32, 0xfffffffc, 4, true, ""},
+		{"write to read-only data", SEG_DS, TEST_RODATA, 0, 1, true, "#GP"},
+		{"read of readable code", SEG_DS, TEST_CODE16, 0, 1, false, ""},
+		{"write to code", SEG_DS, TEST_CODE16, 0, 1, true, "#GP"},
+		{"null selector", SEG_DS, 0, 0, 1, false, "#GP"},
+		{"expand-down at its limit", SEG_DS, TEST_EXPDOWN, 0x0fff, 1, false, "#GP"},
+		{"expand-down above its limit", SEG_DS, TEST_EXPDOWN, 0x1000, 1, false, ""},
+		{"expand-down past 64K", SEG_DS, TEST_EXPDOWN, 0xffff, 2, false, "#GP"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			x86emu_load_seg(tc.n, tc.sel)
+			e := x86emu_test_fault(func() { x86emu_seg_linear(tc.n, tc.off, tc.size, tc.write) })
+			if name := x86emu_test_exc_name(e); name != tc.exc || e != nil && e.err != 0 {
+				t.Errorf("raised %q %+v, want %q", name, e, tc.exc)
+			}
+		})
+	}
+}
+
+func TestProtmodeIdtDelivery(t *testing.T) {
+	const vec = 0x20
+	for _, tc := range []struct {
+		name    string
+		gtype   uint32
+		dpl     uint32
+		present bool
+		sel     uint16 /* handler code segment */
+		limit   uint16 /* of the IDT */
+		soft    bool
+		cpl3    bool
+		has_err bool
+		exc     string
+		err     uint32
+		frame   []uint32 /* dwords from ESP up, or words for 16-bit gates */
+		if_set  bool
+	}{
+		{name: "32-bit interrupt gate", gtype: GATE_INT32, present: true, sel: TEST_CODE32,
+			limit: 0x7ff, frame: []uint32{0x1000, TEST_CODE32, 0x202}},
+		{name: "32-bit trap gate keeps IF", gtype: GATE_TRAP32, present: true, sel: TEST_CODE32,
+			limit: 0x7ff, frame: []uint32{0x1000, TEST_CODE32, 0x202}, if_set: true},
+		{name: "error code", gtype: GATE_INT32, present: true, sel: TEST_CODE32,
+			limit: 0x7ff, has_err: true, frame: []uint32{0x1234, 0x1000, TEST_CODE32, 0x202}},
+		{name: "16-bit interrupt gate", gtype: GATE_INT16, present: true, sel: TEST_CODE32,
+			limit: 0x7ff, frame: []uint32{0x1000, TEST_CODE32, 0x202}},
+		{name: "beyond the idt limit", gtype: GATE_INT32, present: true, sel: TEST_CODE32,
+			limit: vec*8 + 6, exc: "#GP", err: vec*8 + 3},
+		{name: "software int beyond the idt limit", gtype: GATE_INT32, present: true, sel: TEST_CODE32,
+			limit: vec*8 + 6, soft: true, exc: "#GP", err: vec*8 + 2},
+		{name: "not present", gtype: GATE_INT32, sel: TEST_CODE32,
+			limit: 0x7ff, exc: "#NP", err: vec*8 + 3},
+		{name: "task gate", gtype: GATE_TASK, present: true, sel: TEST_CODE32,
+			limit: 0x7ff, exc: "#GP", err: vec*8 + 3},
+		{name: "handler in a data segment", gtype: GATE_INT32, present: true, sel: TEST_DATA32,
+			limit: 0x7ff, exc: "#GP", err: TEST_DATA32},
+		{name: "software int through a dpl 0 gate at cpl 3", gtype: GATE_INT32, present: true,
+			sel: TEST_CODE3, limit: 0x7ff, soft: true, cpl3: true, exc: "#GP", err: vec*8 + 2},
+		{name: "hardware int through a dpl 0 gate at cpl 3", gtype: GATE_INT32, present: true,
+			sel: TEST_CODE3 | 3, limit: 0x7ff, cpl3: true,
+			frame: []uint32{0x1000, TEST_CODE3 | 3, 0x202}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			cs, ss := uint16(TEST_CODE32), uint16(TEST_DATA32)
+			if tc.cpl3 {
+				cs, ss = TEST_CODE3|3, TEST_DATA3|3
+			}
+			x86emu_load_seg(SEG_CS, cs)
+			x86emu_load_seg(SEG_SS, ss)
+			M().x86.spc.IP.Set32(0x1000)
+			M().x86.spc.SP.Set32(0x800)
+			SET_FLAG(F_IF)
+			x86emu_test_gate(vec, tc.sel, 0x5000, tc.gtype, tc.dpl, tc.present)
+			M().x86.idtr.limit = tc.limit
+
+			e := x86emu_test_fault(func() { x86emu_int_deliver(vec, tc.soft, tc.has_err, 0x1234) })
+			if name := x86emu_test_exc_name(e); name != tc.exc || e != nil && e.err != tc.err {
+				t.Fatalf("raised %q %+v, want %q error %#x", name, e, tc.exc, tc.err)
+			}
+			if e != nil {
+				return
+			}
+			if cs, ip := M().x86.seg.CS.Get(), M().x86.spc.IP.Get32(); cs != tc.sel || ip != 0x5000 {
+				t.Errorf("entered at %04x:%08x", cs, ip)
+			}
+			if ACCESS_FLAG(F_IF) != tc.if_set {
+				t.Errorf("IF %v, want %v", ACCESS_FLAG(F_IF), tc.if_set)
+			}
+			size := uint32(4)
+			if tc.gtype == GATE_INT16 || tc.gtype == GATE_TRAP16 {
+				size = 2
+			}
+			sp := M().x86.spc.SP.Get32()
+			if want := 0x800 - size*uint32(len(tc.frame)); sp != want {
+				t.Fatalf("ESP %#x, want %#x", sp, want)
+			}
+			for i, want := range tc.frame {
+				got := sys_rdl(sp + uint32(i)*size)
+				if size == 2 {
+					got &= 0xffff
+				}
+				if got != want {
+					t.Errorf("frame[%d] %#x, want %#x", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProtmodeIret(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		real  bool
+		frame []uint32 /* pushed last to first */
+		cs    uint16   /* where execution continues, at 1100 */
+		ss    uint16
+		sp    uint32
+		ds    uint16 /* after the return */
+		exc   bool   /* #GP at the IRET instead */
+	}{
+		{name: "real mode", real: true, frame: []uint32{0x1100, 0, 0x0002},
+			sp: 0x800, ds: 0},
+		{name: "same level", frame: []uint32{0x1100, TEST_CODE32, 0x0002},
+			cs: TEST_CODE32, ss: TEST_DATA32, sp: 0x800, ds: TEST_DATA16},
+		{name: "outer level", frame: []uint32{0x1100, TEST_CODE3 | 3, 0x0002, 0x700, TEST_DATA3 | 3},
+			cs: TEST_CODE3 | 3, ss: TEST_DATA3 | 3, sp: 0x700, ds: 0},
+		{name: "to a data segment", frame: []uint32{0x1100, TEST_DATA32, 0x0002},
+			cs: TEST_CODE32, ss: TEST_DATA32, sp: 0x800 - 12 - 16, exc: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := []byte{0x66, 0xcf} /* IRETD, from a 16-bit segment */
+			if tc.real {
+				x86emu_test_machine(t)
+				code = []byte{0xcf}
+				for i := len(tc.frame) - 1; i >= 0; i-- {
+					push_word(uint16(tc.frame[i]))
+				}
+			} else {
+				x86emu_test_protmode(t)
+				x86emu_load_seg(SEG_SS, TEST_DATA32)
+				M().x86.spc.SP.Set32(0x800)
+				for i := len(tc.frame) - 1; i >= 0; i-- {
+					push_long(tc.frame[i])
+				}
+				/* #GP handler */
+				x86emu_test_gate(EXC_GP, TEST_CODE32, 0x1200, GATE_INT32, 0, true)
+			}
+			X86EMU_setupTrap(0x1100, "returned", func() { HALT_SYS() })
+			X86EMU_setupTrap(0x1200, "#GP", func() { HALT_SYS() })
+			x86emu_test_run(t, code)
+
+			r := &M().x86
+			want := uint32(0x1100)
+			if tc.exc {
+				want = 0x1200
+				if err := sys_rdl(r.spc.SP.Get32()); err != uint32(tc.frame[1]) {
+					t.Errorf("#GP error code %#x", err)
+				}
+			}
+			if cs, ip := r.seg.CS.Get(), r.spc.IP.Get32(); cs != tc.cs || ip != want {
+				t.Errorf("stopped at %04x:%08x, want %04x:%08x", cs, ip, tc.cs, want)
+			}
+			if ss, sp := r.seg.SS.Get(), r.spc.SP.Get32(); ss != tc.ss || sp != tc.sp {
+				t.Errorf("stack %04x:%08x, want %04x:%08x", ss, sp, tc.ss, tc.sp)
+			}
+			if !tc.exc && r.seg.DS.Get() != tc.ds {
+				t.Errorf("DS %04x, want %04x", r.seg.DS.Get(), tc.ds)
+			}
+		})
+	}
+}
+
+func TestProtmodeDefaultOperandSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cs   uint16
+		code []byte
+	}{
+		{"32-bit code segment", TEST_CODE32, []byte{
+			0xb8, 0x78, 0x56, 0x34, 0x12, /* MOV EAX,12345678 */
+			0x66, 0xbb, 0x34, 0x12, /* MOV BX,1234 */
+			0x50, /* PUSH EAX */
+		}},
+		{"16-bit code segment", TEST_CODE16, []byte{
+			0x66, 0xb8, 0x78, 0x56, 0x34, 0x12, /* MOV EAX,12345678 */
+			0xbb, 0x34, 0x12, /* MOV BX,1234 */
+			0x66, 0x50, /* PUSH EAX */
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			x86emu_load_cs(tc.cs, 0x1000)
+			x86emu_load_seg(SEG_SS, TEST_DATA32)
+			M().x86.spc.SP.Set32(0x800)
+			M().x86.gen.B.Set32(0xffff0000)
+			x86emu_test_run(t, append(tc.code, 0xf4))
+
+			r := &M().x86
+			if ip := r.spc.IP.Get32(); ip != 0x1001+uint32(len(tc.code)) {
+				t.Errorf("stopped at %08x", ip)
+			}
+			if eax, ebx := r.gen.A.Get32(), r.gen.B.Get32(); eax != 0x12345678 || ebx != 0xffff1234 {
+				t.Errorf("EAX %08x EBX %08x", eax, ebx)
+			}
+			if esp, top := r.spc.SP.Get32(), sys_rdl(0x7fc); esp != 0x7fc || top != 0x12345678 {
+				t.Errorf("ESP %08x, top of stack %08x", esp, top)
+			}
+		})
+	}
+}
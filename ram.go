@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+ * Guest RAM: the rdb/rdw/rdl and wrb/wrw/wrl functions of sys.c.
+ *
+ * Memory is a byte slice handed over with X86EMU_setMemBase.  As in the C
+ * version an access beyond its end halts the emulator; reads then return
+ * all ones.
+ */
+
+// PARAMETERS:
+// mem - Guest RAM, starting at physical address 0
+//
+// REMARKS:
+// Sets the memory the emulator runs in.
+func X86EMU_setMemBase(mem []byte) {
+	M().mem = mem
+	M().mem_size = uint32(len(mem))
+}
+
+/* Slice of size bytes of RAM at addr, or nil if out of range. */
+func mem_ptr(addr uint32, size uint32) []byte {
+	if uint64(addr)+uint64(size) > uint64(len(M().mem)) {
+		if DEBUG_MEM_TRACE() {
+			fmt.Printf("mem_ptr: address %#x out of range!\n", addr)
+		}
+		HALT_SYS()
+		return nil
+	}
+	return M().mem[addr : addr+size]
+}
+
+func sys_rdb(addr uint32) uint8 {
+	val := uint8(0xff)
+	if p := mem_ptr(addr, 1); p != nil {
+		val = p[0]
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 1 -> %#x\n", addr, val)
+	}
+	return val
+}
+
+func sys_rdw(addr uint32) uint16 {
+	val := uint16(0xffff)
+	if p := mem_ptr(addr, 2); p != nil {
+		val = binary.LittleEndian.Uint16(p)
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 2 -> %#x\n", addr, val)
+	}
+	return val
+}
+
+func sys_rdl(addr uint32) uint32 {
+	val := uint32(0xffffffff)
+	if p := mem_ptr(addr, 4); p != nil {
+		val = binary.LittleEndian.Uint32(p)
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 4 -> %#x\n", addr, val)
+	}
+	return val
+}
+
+func sys_wrb(addr uint32, val uint8) {
+	if p := mem_ptr(addr, 1); p != nil {
+		p[0] = val
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 1 <- %#x\n", addr, val)
+	}
+}
+
+func sys_wrw(addr uint32, val uint16) {
+	if p := mem_ptr(addr, 2); p != nil {
+		binary.LittleEndian.PutUint16(p, val)
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 2 <- %#x\n", addr, val)
+	}
+}
+
+func sys_wrl(addr uint32, val uint32) {
+	if p := mem_ptr(addr, 4); p != nil {
+		binary.LittleEndian.PutUint32(p, val)
+	}
+	if DEBUG_MEM_TRACE() {
+		fmt.Printf("%#08x 4 <- %#x\n", addr, val)
+	}
+}
+
+/* Copies data to physical memory, through any device mapped there. */
+func x86emu_phys_copy_in(addr uint32, data []byte) {
+	for i, b := range data {
+		x86emu_phys_write(addr+uint32(i), 1, uint32(b))
+	}
+}
+
+/* Reads n bytes of physical memory. */
+func x86emu_phys_copy_out(addr uint32, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = uint8(x86emu_phys_read(addr+uint32(i), 1))
+	}
+	return data
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+ * MC146818 real time clock and CMOS RAM.
+ *
+ * Port 0x70 selects a register (bit 7 masks NMI) and 0x71 accesses it;
+ * ports 0x72/0x73 reach the upper 128 bytes when 256 bytes are configured.
+ * The clock runs on the virtual clock, starting from a settable date, so
+ * BIOS code sees the same time on every run.  Flags in register C (periodic,
+ * alarm, update ended) are worked out from the virtual time that passed
+ * since C was last read; IRQ 8 is raised through clock events only while
+ * the matching interrupt enable is set.
+ */
+
+const (
+	RTC_SECONDS       = 0x00
+	RTC_SECONDS_ALARM = 0x01
+	RTC_MINUTES       = 0x02
+	RTC_MINUTES_ALARM = 0x03
+	RTC_HOURS         = 0x04
+	RTC_HOURS_ALARM   = 0x05
+	RTC_DAY_OF_WEEK   = 0x06
+	RTC_DAY_OF_MONTH  = 0x07
+	RTC_MONTH         = 0x08
+	RTC_YEAR          = 0x09
+	RTC_REG_A         = 0x0a
+	RTC_REG_B         = 0x0b
+	RTC_REG_C         = 0x0c
+	RTC_REG_D         = 0x0d
+	RTC_CENTURY       = 0x32
+
+	RTC_A_UIP  = 0x80
+	RTC_B_SET  = 0x80
+	RTC_B_PIE  = 0x40
+	RTC_B_AIE  = 0x20
+	RTC_B_UIE  = 0x10
+	RTC_B_DM   = 0x04 /* binary rather than BCD */
+	RTC_B_24H  = 0x02
+	RTC_C_IRQF = 0x80
+	RTC_C_PF   = 0x40
+	RTC_C_AF   = 0x20
+	RTC_C_UF   = 0x10
+	RTC_D_VRT  = 0x80
+
+	RTC_IRQ     = 8
+	RTC_UIP_NS  = 244000 /* update in progress lasts 244us before each second */
+	RTC_BASE_HZ = 32768
+)
+
+type x86emu_rtc struct {
+	cmos       [256]uint8
+	size       int /* 128 or 256 bytes */
+	index      uint8
+	index_hi   uint8 /* index for ports 0x72/0x73 */
+	nmi_masked bool
+	base       time.Time /* RTC time at base_ns */
+	base_ns    uint64
+	frozen     time.Time /* time while RTC_B_SET stops updates */
+	last_c     uint64    /* ns when register C was last read */
+	timer      *x86emu_timer
+}
+
+/* Default start date, chosen so that runs are reproducible. */
+var x86emu_rtc_epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func x86emu_rtc_reset() {
+	r := &M().rtc
+	if r.timer != nil {
+		x86emu_clock_cancel(r.timer)
+	}
+	cmos, size := r.cmos, r.size
+	*r = x86emu_rtc{cmos: cmos, size: size}
+	if r.size == 0 {
+		r.size = 128
+	}
+	r.base = x86emu_rtc_epoch
+	r.frozen = x86emu_rtc_epoch
+	r.base_ns = x86emu_clock_ns()
+	r.last_c = r.base_ns
+	r.cmos[RTC_REG_A] = 0x26 /* 32.768kHz time base, 1024Hz periodic rate */
+	r.cmos[RTC_REG_B] = RTC_B_24H
+	r.cmos[RTC_REG_C] = 0
+	r.cmos[RTC_REG_D] = RTC_D_VRT
+}
+
+func init() {
+	x86emu_rtc_reset()
+	X86EMU_setupPorts(0x70, 2, "rtc", x86emu_rtc_read, x86emu_rtc_write)
+}
+
+// PARAMETERS:
+// t - Date and time the RTC shows now
+//
+// REMARKS:
+// Sets the RTC.  It starts out at 2020-01-01 00:00:00 rather than the host
+// time to keep runs deterministic; pass time.Now() for the real date.
+func X86EMU_setRtcTime(t time.Time) {
+	r := &M().rtc
+	r.base = t
+	r.base_ns = x86emu_clock_ns()
+	r.frozen = t
+}
+
+// PARAMETERS:
+// path - File holding the CMOS RAM, 128 or 256 bytes
+//
+// REMARKS:
+// Loads NVRAM contents.  A 256 byte file also enables the upper bank at
+// ports 0x72/0x73.  Registers A-D are not taken from the file.
+func X86EMU_loadCmos(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) != 128 && len(data) != 256 {
+		return fmt.Errorf("%s: CMOS image must be 128 or 256 bytes, not %d", path, len(data))
+	}
+	r := &M().rtc
+	var regs [4]uint8
+	copy(regs[:], r.cmos[RTC_REG_A:])
+	copy(r.cmos[:], data)
+	copy(r.cmos[RTC_REG_A:], regs[:])
+	X86EMU_setCmosSize(len(data))
+	x86emu_rtc_rearm()
+	return nil
+}
+
+// PARAMETERS:
+// size - 128, or 256 for the upper bank at ports 0x72/0x73
+func X86EMU_setCmosSize(size int) {
+	r := &M().rtc
+	if size == 256 {
+		r.size = 256
+		X86EMU_setupPorts(0x72, 2, "cmos-hi", x86emu_cmos_hi_read, x86emu_cmos_hi_write)
+	} else {
+		r.size = 128
+		X86EMU_setupPorts(0x72, 2, "", nil, nil)
+	}
+}
+
+// PARAMETERS:
+// path - File to write the CMOS RAM to
+//
+// REMARKS:
+// Saves NVRAM contents, including the current time, for a later
+// X86EMU_loadCmos.
+func X86EMU_saveCmos(path string) error {
+	r := &M().rtc
+	x86emu_rtc_store_time(x86emu_rtc_now())
+	return os.WriteFile(path, r.cmos[:r.size], 0644)
+}
+
+/* Whether the NMI mask bit of port 0x70 is clear. */
+func x86emu_nmi_enabled() bool {
+	return !M().rtc.nmi_masked
+}
+
+func x86emu_rtc_now() time.Time {
+	r := &M().rtc
+	if r.cmos[RTC_REG_B]&RTC_B_SET != 0 || r.cmos[RTC_REG_A]&0x70 != 0x20 {
+		/* updates are stopped by SET, or the divider is not running */
+		return r.frozen
+	}
+	return r.base.Add(time.Duration(x86emu_clock_ns() - r.base_ns))
+}
+
+func (r *x86emu_rtc) to_bcd(v int) uint8 {
+	if r.cmos[RTC_REG_B]&RTC_B_DM != 0 {
+		return uint8(v)
+	}
+	return uint8(x86emu_bcd_encode(uint32(v)))
+}
+
+func (r *x86emu_rtc) from_bcd(v uint8) int {
+	if r.cmos[RTC_REG_B]&RTC_B_DM != 0 {
+		return int(v)
+	}
+	return int(x86emu_bcd_decode(uint32(v)))
+}
+
+func (r *x86emu_rtc) to_hour(h int) uint8 {
+	if r.cmos[RTC_REG_B]&RTC_B_24H != 0 {
+		return r.to_bcd(h)
+	}
+	pm := uint8(0)
+	if h >= 12 {
+		pm = 0x80
+	}
+	h %= 12
+	if h == 0 {
+		h = 12
+	}
+	return r.to_bcd(h) | pm
+}
+
+func (r *x86emu_rtc) from_hour(v uint8) int {
+	if r.cmos[RTC_REG_B]&RTC_B_24H != 0 {
+		return r.from_bcd(v)
+	}
+	h := r.from_bcd(v&0x7f) % 12
+	if v&0x80 != 0 {
+		h += 12
+	}
+	return h
+}
+
+/* Writes t into the time and date registers. */
+func x86emu_rtc_store_time(t time.Time) {
+	r := &M().rtc
+	r.cmos[RTC_SECONDS] = r.to_bcd(t.Second())
+	r.cmos[RTC_MINUTES] = r.to_bcd(t.Minute())
+	r.cmos[RTC_HOURS] = r.to_hour(t.Hour())
+	r.cmos[RTC_DAY_OF_WEEK] = r.to_bcd(int(t.Weekday()) + 1)
+	r.cmos[RTC_DAY_OF_MONTH] = r.to_bcd(t.Day())
+	r.cmos[RTC_MONTH] = r.to_bcd(int(t.Month()))
+	r.cmos[RTC_YEAR] = r.to_bcd(t.Year() % 100)
+	r.cmos[RTC_CENTURY] = r.to_bcd(t.Year() / 100)
+}
+
+/* Reads the time and date registers, as written by software under SET. */
+func x86emu_rtc_load_time() time.Time {
+	r := &M().rtc
+	year := r.from_bcd(r.cmos[RTC_CENTURY])*100 + r.from_bcd(r.cmos[RTC_YEAR])
+	return time.Date(year, time.Month(r.from_bcd(r.cmos[RTC_MONTH])),
+		r.from_bcd(r.cmos[RTC_DAY_OF_MONTH]), r.from_hour(r.cmos[RTC_HOURS]),
+		r.from_bcd(r.cmos[RTC_MINUTES]), r.from_bcd(r.cmos[RTC_SECONDS]), 0, time.UTC)
+}
+
+/* Virtual ns since the start of the second the RTC showed at base_ns. */
+func x86emu_rtc_ns(now uint64) uint64 {
+	r := &M().rtc
+	if now < r.base_ns {
+		now = r.base_ns
+	}
+	return now - r.base_ns + uint64(r.base.Nanosecond())
+}
+
+/* Periodic interrupt period in ns, or 0 if disabled by RS = 0. */
+func x86emu_rtc_period() uint64 {
+	rs := uint(M().rtc.cmos[RTC_REG_A] & 0x0f)
+	if rs == 0 {
+		return 0
+	}
+	if rs <= 2 {
+		rs += 7
+	}
+	return x86emu_clock_after(1<<(rs-1), RTC_BASE_HZ)
+}
+
+/* Whether the alarm registers match t; values 0xC0-0xFF match anything. */
+func x86emu_rtc_alarm(t time.Time) bool {
+	r := &M().rtc
+	match := func(alarm, v uint8) bool {
+		return alarm&0xc0 == 0xc0 || alarm == v
+	}
+	return match(r.cmos[RTC_SECONDS_ALARM], r.to_bcd(t.Second())) &&
+		match(r.cmos[RTC_MINUTES_ALARM], r.to_bcd(t.Minute())) &&
+		match(r.cmos[RTC_HOURS_ALARM], r.to_hour(t.Hour()))
+}
+
+/* Sets the flags in register C for what happened since it was last read. */
+func x86emu_rtc_update_flags() {
+	r := &M().rtc
+	now := x86emu_clock_ns()
+	if p := x86emu_rtc_period(); p != 0 && now/p > r.last_c/p {
+		r.cmos[RTC_REG_C] |= RTC_C_PF
+	}
+	if r.cmos[RTC_REG_B]&RTC_B_SET == 0 {
+		t := x86emu_rtc_now()
+		secs := int64(x86emu_rtc_ns(now)/NS_PER_SEC) - int64(x86emu_rtc_ns(r.last_c)/NS_PER_SEC)
+		if secs > 0 {
+			r.cmos[RTC_REG_C] |= RTC_C_UF
+		}
+		if secs > 86400 {
+			secs = 86400
+		}
+		for i := int64(0); i < secs; i++ {
+			if x86emu_rtc_alarm(t.Add(-time.Duration(i) * time.Second)) {
+				r.cmos[RTC_REG_C] |= RTC_C_AF
+				break
+			}
+		}
+	}
+	r.last_c = now
+
+	b := r.cmos[RTC_REG_B]
+	c := r.cmos[RTC_REG_C]
+	if (b&RTC_B_PIE != 0 && c&RTC_C_PF != 0) || (b&RTC_B_AIE != 0 && c&RTC_C_AF != 0) ||
+		(b&RTC_B_UIE != 0 && c&RTC_C_UF != 0) {
+		if c&RTC_C_IRQF == 0 {
+			r.cmos[RTC_REG_C] |= RTC_C_IRQF
+			X86EMU_setIrq(RTC_IRQ, true)
+		}
+	}
+}
+
+/* Arms a clock event for the next interrupt the RTC may raise. */
+func x86emu_rtc_rearm() {
+	r := &M().rtc
+	if r.timer != nil {
+		x86emu_clock_cancel(r.timer)
+		r.timer = nil
+	}
+	now := x86emu_clock_ns()
+	b := r.cmos[RTC_REG_B]
+	var next uint64
+	if p := x86emu_rtc_period(); p != 0 && b&RTC_B_PIE != 0 {
+		next = (now/p + 1) * p
+	}
+	if b&(RTC_B_AIE|RTC_B_UIE) != 0 && b&RTC_B_SET == 0 {
+		sec := now + NS_PER_SEC - x86emu_rtc_ns(now)%NS_PER_SEC
+		if next == 0 || sec < next {
+			next = sec
+		}
+	}
+	if next != 0 {
+		r.timer = x86emu_clock_arm(next, func() {
+			r.timer = nil
+			x86emu_rtc_update_flags()
+			x86emu_rtc_rearm()
+		})
+	}
+}
+
+func x86emu_rtc_read(port uint16, _ int) uint32 {
+	r := &M().rtc
+	if port == 0x70 {
+		/* the index register is write only */
+		return 0xff
+	}
+	idx := r.index
+	switch idx {
+	case RTC_SECONDS, RTC_MINUTES, RTC_HOURS, RTC_DAY_OF_WEEK,
+		RTC_DAY_OF_MONTH, RTC_MONTH, RTC_YEAR, RTC_CENTURY:
+		if r.cmos[RTC_REG_B]&RTC_B_SET == 0 {
+			x86emu_rtc_store_time(x86emu_rtc_now())
+		}
+	case RTC_REG_A:
+		v := r.cmos[RTC_REG_A] &^ RTC_A_UIP
+		if r.cmos[RTC_REG_B]&RTC_B_SET == 0 &&
+			x86emu_rtc_ns(x86emu_clock_ns())%NS_PER_SEC >= NS_PER_SEC-RTC_UIP_NS {
+			v |= RTC_A_UIP
+		}
+		return uint32(v)
+	case RTC_REG_C:
+		x86emu_rtc_update_flags()
+		v := r.cmos[RTC_REG_C]
+		r.cmos[RTC_REG_C] = 0
+		X86EMU_setIrq(RTC_IRQ, false)
+		return uint32(v)
+	}
+	return uint32(r.cmos[idx])
+}
+
+func x86emu_rtc_write(port uint16, _ int, val uint32) {
+	r := &M().rtc
+	v := uint8(val)
+	if port == 0x70 {
+		r.nmi_masked = v&0x80 != 0
+		r.index = v & 0x7f
+		return
+	}
+	switch r.index {
+	case RTC_REG_A:
+		/* UIP is read only; stopping or starting the divider keeps the time */
+		t := x86emu_rtc_now()
+		r.cmos[RTC_REG_A] = v &^ RTC_A_UIP
+		r.frozen, r.base, r.base_ns = t, t, x86emu_clock_ns()
+	case RTC_REG_B:
+		old := r.cmos[RTC_REG_B]
+		if v&RTC_B_SET != 0 && old&RTC_B_SET == 0 {
+			r.frozen = x86emu_rtc_now()
+			x86emu_rtc_store_time(r.frozen)
+			v &^= RTC_B_UIE
+		}
+		r.cmos[RTC_REG_B] = v
+		if v&RTC_B_SET == 0 && old&RTC_B_SET != 0 {
+			/* the registers software wrote while updates were stopped */
+			r.frozen = x86emu_rtc_load_time()
+			r.base, r.base_ns = r.frozen, x86emu_clock_ns()
+		}
+	case RTC_REG_C, RTC_REG_D:
+		/* read only */
+	default:
+		r.cmos[r.index] = v
+	}
+	x86emu_rtc_rearm()
+}
+
+/* Upper bank of a 256 byte CMOS RAM. */
+func x86emu_cmos_hi_read(port uint16, _ int) uint32 {
+	r := &M().rtc
+	if port == 0x72 {
+		return 0xff
+	}
+	return uint32(r.cmos[0x80|r.index_hi])
+}
+
+func x86emu_cmos_hi_write(port uint16, _ int, val uint32) {
+	r := &M().rtc
+	if port == 0x72 {
+		r.index_hi = uint8(val) & 0x7f
+		return
+	}
+	r.cmos[0x80|r.index_hi] = uint8(val)
+}
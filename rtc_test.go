@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func x86emu_test_cmos_read(idx uint8) uint8 {
+	sys_outb(0x70, idx)
+	return sys_inb(0x71)
+}
+
+func x86emu_test_cmos_write(idx uint8, v uint8) {
+	sys_outb(0x70, idx)
+	sys_outb(0x71, v)
+}
+
+/* Time and date registers, seconds to year, then the century */
+var x86emu_test_rtc_regs = []uint8{
+	RTC_SECONDS, RTC_MINUTES, RTC_HOURS, RTC_DAY_OF_WEEK,
+	RTC_DAY_OF_MONTH, RTC_MONTH, RTC_YEAR, RTC_CENTURY,
+}
+
+func TestRtcTimeRegisters(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    uint8 /* register B, data mode and 24 hour bits */
+		t    time.Time
+		want [8]uint8
+	}{
+		{"bcd 24h", RTC_B_24H, time.Date(2024, 3, 9, 13, 45, 7, 0, time.UTC),
+			[8]uint8{0x07, 0x45, 0x13, 0x07, 0x09, 0x03, 0x24, 0x20}},
+		{"binary 24h", RTC_B_24H | RTC_B_DM, time.Date(2024, 3, 9, 13, 45, 7, 0, time.UTC),
+			[8]uint8{7, 45, 13, 7, 9, 3, 24, 20}},
+		{"bcd 12h pm", 0, time.Date(2024, 3, 9, 13, 45, 7, 0, time.UTC),
+			[8]uint8{0x07, 0x45, 0x81, 0x07, 0x09, 0x03, 0x24, 0x20}},
+		{"binary 12h pm", RTC_B_DM, time.Date(2024, 3, 9, 23, 45, 7, 0, time.UTC),
+			[8]uint8{7, 45, 0x8b, 7, 9, 3, 24, 20}},
+		{"bcd 12h midnight", 0, time.Date(1999, 12, 31, 0, 30, 59, 0, time.UTC),
+			[8]uint8{0x59, 0x30, 0x12, 0x06, 0x31, 0x12, 0x99, 0x19}},
+		{"bcd 12h noon", 0, time.Date(1999, 12, 31, 12, 30, 59, 0, time.UTC),
+			[8]uint8{0x59, 0x30, 0x92, 0x06, 0x31, 0x12, 0x99, 0x19}},
+		{"binary 12h midnight", RTC_B_DM, time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC),
+			[8]uint8{0, 0, 12, 1, 2, 1, 0, 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_machine(t)
+			x86emu_rtc_reset()
+			x86emu_test_cmos_write(RTC_REG_B, tc.b)
+			X86EMU_setRtcTime(tc.t)
+			for i, idx := range x86emu_test_rtc_regs {
+				if v := x86emu_test_cmos_read(idx); v != tc.want[i] {
+					t.Errorf("register %02x reads %#02x, want %#02x", idx, v, tc.want[i])
+				}
+			}
+
+			/* the same values written under SET give the time back */
+			X86EMU_setRtcTime(time.Date(2010, 6, 15, 8, 0, 0, 0, time.UTC))
+			x86emu_test_cmos_write(RTC_REG_B, tc.b|RTC_B_SET)
+			for i, idx := range x86emu_test_rtc_regs {
+				x86emu_test_cmos_write(idx, tc.want[i])
+			}
+			x86emu_test_cmos_write(RTC_REG_B, tc.b)
+			if now := x86emu_rtc_now(); !now.Equal(tc.t) {
+				t.Errorf("set to %v, want %v", now, tc.t)
+			}
+		})
+	}
+}
+
+func TestRtcResetAfterSet(t *testing.T) {
+	x86emu_test_machine(t)
+	X86EMU_setRtcTime(time.Date(2024, 3, 9, 13, 45, 7, 0, time.UTC))
+	x86emu_rtc_reset()
+	if now := x86emu_rtc_now(); !now.Equal(x86emu_rtc_epoch) {
+		t.Errorf("reset rtc at %v, want %v", now, x86emu_rtc_epoch)
+	}
+}
+
+func TestInt1aTime(t *testing.T) {
+	at := time.Date(2024, 3, 9, 13, 45, 7, 0, time.UTC)
+	for _, b := range []uint8{RTC_B_24H, RTC_B_DM} {
+		for _, tc := range []struct {
+			name string
+			ax   uint16
+			ret  [2]uint16 /* CX and DX returned, if not zero */
+			now  time.Time
+		}{
+			{"read time", 0x0200, [2]uint16{0x1345, 0x0700}, at},
+			{"read date", 0x0400, [2]uint16{0x2024, 0x0309}, at},
+			{"set time", 0x0300, [2]uint16{}, time.Date(2024, 3, 9, 23, 59, 58, 0, time.UTC)},
+			{"set date", 0x0500, [2]uint16{}, time.Date(1999, 12, 31, 13, 45, 7, 0, time.UTC)},
+		} {
+			x86emu_test_bios(t)
+			x86emu_test_cmos_write(RTC_REG_B, b)
+			X86EMU_setRtcTime(at)
+			if err := X86EMU_setupTimeBios(false); err != nil {
+				t.Fatal(err)
+			}
+			r := &M().x86
+			r.gen.A.Set16(tc.ax)
+			switch tc.ax {
+			case 0x0300:
+				r.gen.C.Set16(0x2359)
+				r.gen.D.Set16(0x5800)
+			case 0x0500:
+				r.gen.C.Set16(0x1999)
+				r.gen.D.Set16(0x1231)
+			}
+			x86emu_test_int(t, 0x1a)
+			if ACCESS_FLAG(F_CF) {
+				t.Fatalf("register b %02x, %s: cf set", b, tc.name)
+			}
+			if tc.ret != [2]uint16{} {
+				if cx, dx := r.gen.C.Get16(), r.gen.D.Get16(); cx != tc.ret[0] || dx != tc.ret[1] {
+					t.Errorf("register b %02x, %s: cx %04x dx %04x, want %04x %04x",
+						b, tc.name, cx, dx, tc.ret[0], tc.ret[1])
+				}
+			}
+			/* the INT itself takes some virtual time */
+			if now := x86emu_rtc_now().Truncate(time.Second); !now.Equal(tc.now) {
+				t.Errorf("register b %02x, %s: rtc at %v, want %v", b, tc.name, now, tc.now)
+			}
+		}
+	}
+}
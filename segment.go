@@ -0,0 +1,333 @@
+package main
+
+/*
+ * Segment registers and their hidden descriptor caches.
+ *
+ * Every segment register has a visible selector (M().x86.seg) and a hidden
+ * part (M().x86.segcache) holding the base, limit and attributes the CPU
+ * actually uses for address calculation.  In real mode loading a selector
+ * computes the base as selector << 4; in protected mode it loads the
+ * descriptor from the GDT.
+ *
+ * Much of the instruction set still writes the visible selector directly,
+ * so the cache remembers which selector it was built from and is reloaded
+ * lazily when the two disagree.
+ */
+
+/* Segment register numbers, as encoded in the reg field of a ModRM byte. */
+const (
+	SEG_ES = 0
+	SEG_CS = 1
+	SEG_SS = 2
+	SEG_DS = 3
+	SEG_FS = 4
+	SEG_GS = 5
+)
+
+var x86emu_seg_names = [6]string{"ES", "CS", "SS", "DS", "FS", "GS"}
+
+/* Segment attribute bits: the descriptor access byte plus flags << 8. */
+const (
+	SEG_ATTR_ACCESSED uint16 = 0x0001
+	SEG_ATTR_RW       uint16 = 0x0002 /* readable code / writable data */
+	SEG_ATTR_DC       uint16 = 0x0004 /* conforming code / expand-down data */
+	SEG_ATTR_CODE     uint16 = 0x0008
+	SEG_ATTR_S        uint16 = 0x0010
+	SEG_ATTR_DPL      uint16 = 0x0060
+	SEG_ATTR_P        uint16 = 0x0080
+	SEG_ATTR_DB       uint16 = 0x0400
+	SEG_ATTR_G        uint16 = 0x0800
+)
+
+/* Attributes a segment register has after reset or a real mode load. */
+const (
+	SEG_ATTR_REAL_DATA = SEG_ATTR_P | SEG_ATTR_S | SEG_ATTR_RW | SEG_ATTR_ACCESSED
+	SEG_ATTR_REAL_CODE = SEG_ATTR_REAL_DATA | SEG_ATTR_CODE
+)
+
+/* Exception vectors raised by the emulator itself. */
+const (
+	EXC_DE uint8 = 0
+	EXC_DB uint8 = 1
+	EXC_BP uint8 = 3
+	EXC_OF uint8 = 4
+	EXC_BR uint8 = 5
+	EXC_UD uint8 = 6
+	EXC_NM uint8 = 7
+	EXC_DF uint8 = 8
+	EXC_TS uint8 = 10
+	EXC_NP uint8 = 11
+	EXC_SS uint8 = 12
+	EXC_GP uint8 = 13
+	EXC_PF uint8 = 14
+)
+
+/*
+ * An exception raised in the middle of an instruction.  Handlers panic with
+ * one of these; x86emu_exec_insn recovers it, rolls CS:EIP and ESP back to
+ * the start of the instruction and delivers the exception.
+ */
+type x86emu_exception struct {
+	vec     uint8
+	err     uint32
+	has_err bool
+}
+
+func x86emu_fault(vec uint8, err uint32) {
+	panic(x86emu_exception{vec: vec, err: err, has_err: true})
+}
+
+func x86emu_fault_noerr(vec uint8) {
+	panic(x86emu_exception{vec: vec})
+}
+
+/* Visible selector of segment register n. */
+func x86emu_sreg(n int) *reg16 {
+	switch n {
+	case SEG_ES:
+		return &M().x86.seg.ES
+	case SEG_CS:
+		return &M().x86.seg.CS
+	case SEG_SS:
+		return &M().x86.seg.SS
+	case SEG_DS:
+		return &M().x86.seg.DS
+	case SEG_FS:
+		return &M().x86.seg.FS
+	case SEG_GS:
+		return &M().x86.seg.GS
+	}
+	x86emu_fault_noerr(EXC_UD)
+	return nil
+}
+
+/* General register n, in ModRM order. */
+func x86emu_greg(n int) *reg {
+	switch n & 7 {
+	case 0:
+		return &M().x86.gen.A
+	case 1:
+		return &M().x86.gen.C
+	case 2:
+		return &M().x86.gen.D
+	case 3:
+		return &M().x86.gen.B
+	case 4:
+		return &M().x86.spc.SP
+	case 5:
+		return &M().x86.spc.BP
+	case 6:
+		return &M().x86.spc.SI
+	}
+	return &M().x86.spc.DI
+}
+
+func x86emu_protected_mode() bool {
+	return M().x86.cr[0]&CR0_PE != 0
+}
+
+/* Current privilege level; always 0 outside protected mode. */
+func x86emu_cpl() uint16 {
+	if !x86emu_protected_mode() {
+		return 0
+	}
+	return M().x86.segcache[SEG_CS].sel & 3
+}
+
+/* Reset state: a 64K read/write segment based at selector << 4. */
+func x86emu_reset_seg(n int, sel uint16) {
+	c := &M().x86.segcache[n]
+	c.sel = sel
+	c.base = uint32(sel) << 4
+	c.limit = 0xffff
+	c.attr = SEG_ATTR_REAL_DATA
+	if n == SEG_CS {
+		c.attr = SEG_ATTR_REAL_CODE
+	}
+	c.loaded = true
+}
+
+/*
+ * Real mode load.  Only the base follows the selector; the limit and
+ * attributes are whatever was last loaded, which is what makes "unreal"
+ * mode work: load a 4G data segment in protected mode, drop back to real
+ * mode and the 4G limit stays until the register is reloaded in protected
+ * mode again.
+ */
+func x86emu_load_seg_real(n int, sel uint16) {
+	c := &M().x86.segcache[n]
+	if !c.loaded {
+		x86emu_reset_seg(n, sel)
+		return
+	}
+	c.sel = sel
+	c.base = uint32(sel) << 4
+}
+
+// PARAMETERS:
+// n   - Segment register number
+// sel - Selector to load
+//
+// REMARKS:
+// Loads a segment register and its hidden descriptor cache, as MOV Sreg, POP
+// Sreg and far transfers do.  In protected mode the descriptor is checked and
+// a #GP, #SS or #NP raised if it cannot be loaded into that register.
+func x86emu_load_seg(n int, sel uint16) {
+	if x86emu_protected_mode() {
+		x86emu_load_seg_prot(n, sel)
+	} else {
+		x86emu_load_seg_real(n, sel)
+	}
+	x86emu_sreg(n).Set(sel)
+}
+
+/*
+ * Returns the descriptor cache of segment register n, reloading it if the
+ * visible selector was changed behind our back.
+ */
+func x86emu_seg_sync(n int) *x86emu_seg_cache {
+	c := &M().x86.segcache[n]
+	sel := x86emu_sreg(n).Get()
+	if !c.loaded || c.sel != sel {
+		x86emu_load_seg(n, sel)
+	}
+	return c
+}
+
+func x86emu_code32() bool {
+	return x86emu_protected_mode() && x86emu_seg_sync(SEG_CS).attr&SEG_ATTR_DB != 0
+}
+
+func x86emu_stack32() bool {
+	return x86emu_protected_mode() && x86emu_seg_sync(SEG_SS).attr&SEG_ATTR_DB != 0
+}
+
+// PARAMETERS:
+// n     - Segment register number
+// off   - Offset within the segment
+// size  - Size of the access in bytes
+// write - Whether the access is a write
+//
+// RETURNS:
+// Linear address of the access.
+//
+// REMARKS:
+// Applies the base and limit of the hidden descriptor cache, and in
+// protected mode its type checks too.  The limit is checked in real mode as
+// well, so 32-bit offsets only work once a big limit has been loaded.
+// Violations raise #SS for the stack segment and #GP for everything else.
+func x86emu_seg_linear(n int, off uint32, size uint32, write bool) uint32 {
+	c := x86emu_seg_sync(n)
+	vec := EXC_GP
+	if n == SEG_SS {
+		vec = EXC_SS
+	}
+	if !x86emu_protected_mode() {
+		if last := off + size - 1; last > c.limit || last < off {
+			x86emu_fault(vec, 0)
+		}
+		return c.base + off
+	}
+	if c.attr&SEG_ATTR_P == 0 {
+		x86emu_fault(vec, 0)
+	}
+	if write && (c.attr&SEG_ATTR_CODE != 0 || c.attr&SEG_ATTR_RW == 0) {
+		x86emu_fault(vec, 0)
+	}
+	if !write && c.attr&(SEG_ATTR_CODE|SEG_ATTR_RW) == SEG_ATTR_CODE && n != SEG_CS {
+		x86emu_fault(vec, 0)
+	}
+	last := off + size - 1
+	if c.attr&(SEG_ATTR_CODE|SEG_ATTR_DC) == SEG_ATTR_DC {
+		/* expand-down: valid offsets are above the limit */
+		upper := uint32(0xffff)
+		if c.attr&SEG_ATTR_DB != 0 {
+			upper = 0xffffffff
+		}
+		if off <= c.limit || last > upper || last < off {
+			x86emu_fault(vec, 0)
+		}
+	} else if last > c.limit || last < off {
+		x86emu_fault(vec, 0)
+	}
+	return c.base + off
+}
+
+// PARAMETERS:
+// n - Number of instruction bytes being fetched
+//
+// RETURNS:
+// Linear address of the bytes at CS:EIP.
+//
+// REMARKS:
+// Advances EIP past the fetched bytes.  IP wraps at 64K in 16-bit code
+// segments; fetching past the CS limit in protected mode raises #GP(0).
+func x86emu_ip_advance(n uint32) uint32 {
+	ip := M().x86.spc.IP.Get32()
+	if !x86emu_code32() {
+		ip &= 0xffff
+		M().x86.spc.IP.Set16(uint16(ip + n))
+	} else {
+		M().x86.spc.IP.Set32(ip + n)
+	}
+	return x86emu_seg_linear(SEG_CS, ip, n, false)
+}
+
+/*
+ * Stack accesses.  These honour the B bit of the stack segment, using ESP
+ * for 32-bit stacks and SP otherwise.
+ */
+func x86emu_sp_adjust(delta int32) uint32 {
+	sp := M().x86.spc.SP.Get32()
+	if x86emu_stack32() {
+		sp = uint32(int32(sp) + delta)
+		M().x86.spc.SP.Set32(sp)
+	} else {
+		sp = uint32(uint16(int32(sp) + delta))
+		M().x86.spc.SP.Set16(uint16(sp))
+	}
+	return sp
+}
+
+func mem_access_word(addr int) uint16 {
+	if CHECK_MEM_ACCESS() {
+		x86emu_check_mem_access(uint32(addr))
+	}
+	return x86emu_lin_rdw(uint32(addr))
+}
+
+func push_word(w uint16) {
+	if CHECK_SP_ACCESS() {
+		x86emu_check_sp_access()
+	}
+	sp := x86emu_sp_adjust(-2)
+	x86emu_lin_wrw(x86emu_seg_linear(SEG_SS, sp, 2, true), w)
+}
+
+func push_long(w uint32) {
+	if CHECK_SP_ACCESS() {
+		x86emu_check_sp_access()
+	}
+	sp := x86emu_sp_adjust(-4)
+	x86emu_lin_wrl(x86emu_seg_linear(SEG_SS, sp, 4, true), w)
+}
+
+func pop_word() uint16 {
+	if CHECK_SP_ACCESS() {
+		x86emu_check_sp_access()
+	}
+	sp := x86emu_sp_adjust(0)
+	res := x86emu_lin_rdw(x86emu_seg_linear(SEG_SS, sp, 2, false))
+	x86emu_sp_adjust(2)
+	return res
+}
+
+func pop_long() uint32 {
+	if CHECK_SP_ACCESS() {
+		x86emu_check_sp_access()
+	}
+	sp := x86emu_sp_adjust(0)
+	res := x86emu_lin_rdl(x86emu_seg_linear(SEG_SS, sp, 4, false))
+	x86emu_sp_adjust(4)
+	return res
+}
@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestUnrealMode(t *testing.T) {
+	enter := []byte{
+		0x0f, 0x20, 0xc0, /* MOV EAX,CR0 */
+		0x66, 0x83, 0xc8, 0x01, /* OR EAX,1 */
+		0x0f, 0x22, 0xc0, /* MOV CR0,EAX */
+		0xbb, TEST_DATA32, 0x00, /* MOV BX,TEST_DATA32 */
+		0x8e, 0xdb, /* MOV DS,BX */
+		0x8e, 0xd3, /* MOV SS,BX */
+		0x66, 0x83, 0xe0, 0xfe, /* AND EAX,-2 */
+		0x0f, 0x22, 0xc0, /* MOV CR0,EAX */
+		0x31, 0xdb, /* XOR BX,BX */
+		0x8e, 0xdb, /* MOV DS,BX */
+		0x8e, 0xd3, /* MOV SS,BX */
+	}
+	for _, tc := range []struct {
+		name   string
+		unreal bool
+		code   []byte
+		stop   uint16 /* IP after the final HLT */
+		eax    uint32
+	}{
+		{"ds offset above 64K in unreal mode", true,
+			[]byte{0x67, 0x66, 0x8b, 0x06}, /* MOV EAX,[ESI] */
+			0, 0x12345678},
+		{"ss offset above 64K in unreal mode", true,
+			[]byte{0x67, 0x66, 0x8b, 0x45, 0x00}, /* MOV EAX,[EBP+0] */
+			0, 0x12345678},
+		{"ds offset above 64K is #GP", false,
+			[]byte{0x67, 0x66, 0x8b, 0x06}, /* MOV EAX,[ESI] */
+			0x1801, 0},
+		{"ss offset above 64K is #SS", false,
+			[]byte{0x67, 0x66, 0x8b, 0x45, 0x00}, /* MOV EAX,[EBP+0] */
+			0x1811, 0},
+		{"word across 64K is #GP", false,
+			[]byte{0x8b, 0x07}, /* MOV AX,[BX] with BX=FFFF */
+			0x1801, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_protmode(t)
+			/* back to the reset state, with the test GDT still in place */
+			M().x86.cr[0] &^= CR0_PE
+			M().x86.idtr = x86emu_dtr{base: 0, limit: 0x3ff}
+			for n := SEG_ES; n <= SEG_GS; n++ {
+				x86emu_reset_seg(n, 0)
+				x86emu_sreg(n).Set(0)
+			}
+			sys_wrl(0x12340, 0x12345678)
+			/* #GP and #SS handlers: HLT at 0000:1800 and 0000:1810 */
+			sys_wrl(uint32(EXC_GP)*4, 0x1800)
+			sys_wrl(uint32(EXC_SS)*4, 0x1810)
+			sys_wrb(0x1800, 0xf4)
+			sys_wrb(0x1810, 0xf4)
+
+			code := tc.code
+			if tc.unreal {
+				code = append(append([]byte{}, enter...), code...)
+			}
+			M().x86.spc.SI.Set32(0x12340)
+			M().x86.spc.BP.Set32(0x12340)
+			M().x86.gen.B.Set32(0xffff)
+			x86emu_test_run(t, append(code, 0xf4))
+
+			r := &M().x86
+			if x86emu_protected_mode() {
+				t.Fatalf("still in protected mode")
+			}
+			if tc.unreal {
+				for _, n := range []int{SEG_DS, SEG_SS} {
+					if c := r.segcache[n]; c.sel != 0 || c.base != 0 || c.limit != 0xffffffff {
+						t.Errorf("%s cache %+v", x86emu_seg_names[n], c)
+					}
+				}
+			}
+			stop := tc.stop
+			if stop == 0 {
+				stop = 0x1001 + uint16(len(code))
+			}
+			if ip := r.spc.IP.Get16(); ip != stop {
+				t.Fatalf("stopped at %04x, want %04x", ip, stop)
+			}
+			if tc.stop != 0 {
+				if ip := sys_rdw(0x800 - 6); ip != 0x1000 {
+					t.Errorf("fault returns to %04x", ip)
+				}
+				return
+			}
+			if eax := r.gen.A.Get32(); eax != tc.eax {
+				t.Errorf("EAX %08x, want %08x", eax, tc.eax)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+ * The BIOS tick counter and int 1Ah time of day services.
+ *
+ * The tick count at 0040:006C is worked out from virtual time, 65536 PIT
+ * periods per tick, so it is right however long the CPU went without
+ * taking IRQ 0.  It is brought up to date by the int 08h handler, which
+ * then calls int 1Ch as a real BIOS does, or, for guests that run with
+ * interrupts off or platforms without a PIC, directly by a clock event on
+ * every tick.  Either way timeouts measured in ticks expire.  Guest code
+ * that stores a new count, through int 1Ah or into the BIOS data area,
+ * moves the counter to it.
+ *
+ * Time and date come from the RTC, in BCD whatever mode the RTC is in.
+ */
+
+const (
+	BDA_TICKS    = 0x46c
+	BDA_MIDNIGHT = 0x470
+
+	TICKS_PER_DAY = 0x1800b0
+)
+
+var x86emu_ticks struct {
+	base    uint32 /* count at base_ns */
+	base_ns uint64
+	last    uint32 /* count last stored in the BIOS data area */
+	days    uint64 /* midnights passed since base_ns */
+	direct  bool
+}
+
+// PARAMETERS:
+// irq0 - Count ticks in the int 08h handler rather than from clock events
+//
+// REMARKS:
+// Starts the tick count at the RTC time of day and installs int 08h, 1Ch
+// and 1Ah.  With irq0, PIT channel 0 is programmed for the 18.2Hz tick and
+// the count advances when the CPU takes the interrupt.
+func X86EMU_setupTimeBios(irq0 bool) error {
+	t := x86emu_rtc_now()
+	secs := uint64(t.Hour()*3600 + t.Minute()*60 + t.Second())
+	x86emu_tick_set(uint32(x86emu_muldiv(secs, PIT_HZ, 0x10000)))
+
+	/* int 08h: count, then call int 1Ch and return */
+	addr, err := x86emu_fseg_alloc(5, 1)
+	if err != nil {
+		return err
+	}
+	x86emu_phys_copy_in(addr, []byte{0x90, 0xcd, 0x1c, 0xcf}) /* NOP; INT 1Ch; IRET */
+	X86EMU_setupTrap(addr, "int08", x86emu_int08)
+	x86emu_set_vector(0x08, addr)
+	x86emu_phys_write(addr+4, 1, 0xcf) /* int 1Ch: IRET */
+	x86emu_set_vector(0x1c, addr+4)
+
+	if _, err := X86EMU_setupBiosVector(0x1a, "int1a", x86emu_int1a); err != nil {
+		return err
+	}
+
+	x86emu_ticks.direct = !irq0
+	if irq0 {
+		sys_outb(0x43, 0x36) /* channel 0, LSB then MSB, mode 3 */
+		sys_outb(0x40, 0)
+		sys_outb(0x40, 0)
+	} else {
+		x86emu_tick_arm()
+	}
+	return nil
+}
+
+/* Ticks since the base, from the virtual clock. */
+func x86emu_tick_elapsed() uint64 {
+	return x86emu_muldiv(x86emu_clock_ns()-x86emu_ticks.base_ns, PIT_HZ, 0x10000*NS_PER_SEC)
+}
+
+/* Restarts the count at n ticks. */
+func x86emu_tick_set(n uint32) {
+	k := &x86emu_ticks
+	k.base, k.base_ns, k.last, k.days = n%TICKS_PER_DAY, x86emu_clock_ns(), n%TICKS_PER_DAY, 0
+	x86emu_phys_write(BDA_TICKS, 4, k.last)
+}
+
+// REMARKS:
+// Stores the current count in the BIOS data area, setting the midnight
+// flag when it wraps, unless guest code stored a count of its own there,
+// which becomes the new base.
+func x86emu_tick_update() {
+	k := &x86emu_ticks
+	if cur := x86emu_phys_read(BDA_TICKS, 4); cur != k.last {
+		x86emu_tick_set(cur)
+		return
+	}
+	n := uint64(k.base) + x86emu_tick_elapsed()
+	if days := n / TICKS_PER_DAY; days > k.days {
+		x86emu_phys_write(BDA_MIDNIGHT, 1, 1)
+		k.days = days
+	}
+	k.last = uint32(n % TICKS_PER_DAY)
+	x86emu_phys_write(BDA_TICKS, 4, k.last)
+}
+
+/* Arms the clock event for the next tick of the direct mode. */
+func x86emu_tick_arm() {
+	next := x86emu_tick_elapsed() + 1
+	when := x86emu_ticks.base_ns + x86emu_muldiv(next, 0x10000*NS_PER_SEC, PIT_HZ)
+	x86emu_clock_arm(when, func() {
+		x86emu_tick_update()
+		x86emu_tick_arm()
+	})
+}
+
+// REMARKS:
+// Trap on the first byte of the int 08h handler; the INT 1Ch and IRET
+// after it are guest code.
+func x86emu_int08() {
+	if !x86emu_ticks.direct {
+		x86emu_tick_update()
+	}
+	sys_outb(0x20, 0x20) /* EOI */
+	ip := M().x86.spc.IP.Get16()
+	M().x86.spc.IP.Set16(ip + 1)
+}
+
+func x86emu_int1a_time() {
+	r := &M().x86
+	ah := r.gen.A.Get8h()
+	bcd := func(v int) uint8 { return uint8(x86emu_bcd_encode(uint32(v))) }
+	if DEBUG_SVC() {
+		fmt.Printf("int1a: ax=%04x cx=%04x dx=%04x\n", r.gen.A.Get16(), r.gen.C.Get16(), r.gen.D.Get16())
+	}
+
+	switch ah {
+	case 0x00: /* read tick count */
+		x86emu_tick_update()
+		n := x86emu_phys_read(BDA_TICKS, 4)
+		r.gen.C.Set16(uint16(n >> 16))
+		r.gen.D.Set16(uint16(n))
+		r.gen.A.Setl8(uint8(x86emu_phys_read(BDA_MIDNIGHT, 1)))
+		x86emu_phys_write(BDA_MIDNIGHT, 1, 0)
+		CLEAR_FLAG(F_CF)
+
+	case 0x01: /* set tick count */
+		x86emu_tick_set(uint32(r.gen.C.Get16())<<16 | uint32(r.gen.D.Get16()))
+		x86emu_phys_write(BDA_MIDNIGHT, 1, 0)
+		x86emu_bios_status(0)
+
+	case 0x02: /* read RTC time */
+		t := x86emu_rtc_now()
+		r.gen.C.Seth8(bcd(t.Hour()))
+		r.gen.C.Setl8(bcd(t.Minute()))
+		r.gen.D.Seth8(bcd(t.Second()))
+		r.gen.D.Setl8(M().rtc.cmos[RTC_REG_B] & 0x01) /* daylight saving */
+		x86emu_bios_status(0)
+
+	case 0x03: /* set RTC time */
+		t := x86emu_rtc_now()
+		h := int(x86emu_bcd_decode(uint32(r.gen.C.Get8h())))
+		m := int(x86emu_bcd_decode(uint32(r.gen.C.Get8l())))
+		s := int(x86emu_bcd_decode(uint32(r.gen.D.Get8h())))
+		X86EMU_setRtcTime(time.Date(t.Year(), t.Month(), t.Day(), h, m, s, 0, t.Location()))
+		x86emu_bios_status(0)
+
+	case 0x04: /* read RTC date */
+		t := x86emu_rtc_now()
+		r.gen.C.Seth8(bcd(t.Year() / 100))
+		r.gen.C.Setl8(bcd(t.Year() % 100))
+		r.gen.D.Seth8(bcd(int(t.Month())))
+		r.gen.D.Setl8(bcd(t.Day()))
+		x86emu_bios_status(0)
+
+	case 0x05: /* set RTC date */
+		t := x86emu_rtc_now()
+		y := int(x86emu_bcd_decode(uint32(r.gen.C.Get8h())))*100 +
+			int(x86emu_bcd_decode(uint32(r.gen.C.Get8l())))
+		mon := time.Month(x86emu_bcd_decode(uint32(r.gen.D.Get8h())))
+		d := int(x86emu_bcd_decode(uint32(r.gen.D.Get8l())))
+		X86EMU_setRtcTime(time.Date(y, mon, d, t.Hour(), t.Minute(), t.Second(), 0, t.Location()))
+		x86emu_bios_status(0)
+
+	default:
+		if DEBUG_SVC() {
+			fmt.Printf("int1a: function %02x not supported\n", ah)
+		}
+		x86emu_bios_status(BIOS_UNSUPPORTED)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+/* ns in one BIOS tick, rounded down */
+const TEST_TICK_NS = 0x10000 * NS_PER_SEC / PIT_HZ
+
+// Sets the time BIOS up on a 1MHz machine, so that guest code polling the
+// tick count gets through a few ticks of virtual time quickly, with the
+// RTC at midnight.
+func x86emu_test_time(t *testing.T, irq0 bool) {
+	t.Helper()
+	x86emu_test_bios(t)
+	X86EMU_setClockMHz(1)
+	if err := X86EMU_setupTimeBios(irq0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeBiosTicks(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		irq0  bool
+		sti   bool
+		calls uint16 /* of the guest's int 1Ch handler */
+	}{
+		/* one per tick, and one for the edge of programming channel 0 */
+		{"irq0", true, true, 5},
+		{"direct", false, false, 0},
+		{"direct with interrupts on", false, true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_time(t, tc.irq0)
+			defer X86EMU_setClockMHz(X86EMU_DEFAULT_MHZ)
+			sys_outb(0x21, 0xfe)
+			if ticks := sys_rdl(BDA_TICKS); ticks != 0 {
+				t.Fatalf("ticks at midnight %d", ticks)
+			}
+			/* int 1Ch at 0000:0500 counts its calls at 0000:0600 */
+			sys_wrl(0x1c*4, 0x0500)
+			x86emu_phys_copy_in(0x500, []byte{0xff, 0x06, 0x00, 0x06, 0xcf}) /* INC WORD [0600]; IRET */
+			sys_wrw(0x600, 0)
+
+			irqs := uint8(0xfa) /* CLI */
+			if tc.sti {
+				irqs = 0xfb
+			}
+			start := x86emu_clock_ns()
+			x86emu_test_run(t, []byte{
+				irqs,
+				0x81, 0x3e, 0x6c, 0x04, 0x04, 0x00, /* CMP WORD [046C],4 */
+				0x72, 0xf8, /* JB the CMP */
+				0xfa, 0xf4, /* CLI; HLT */
+			})
+
+			if ip := M().x86.spc.IP.Get16(); ip != 0x100b {
+				t.Fatalf("stopped at %04x", ip)
+			}
+			if d := x86emu_clock_ns() - start; d < 4*TEST_TICK_NS || d >= 5*TEST_TICK_NS {
+				t.Errorf("4 ticks took %d ns", d)
+			}
+			if calls := sys_rdw(0x600); calls != tc.calls {
+				t.Errorf("int 1Ch called %d times, want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestTimeBiosInt1a(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		irq0  bool
+		set   uint32 /* count set with AH=01h */
+		store bool   /* guest stores the count in the BDA instead */
+		wait  uint64 /* ns of virtual time before reading it */
+		ticks uint32
+		al    uint8 /* midnight flag */
+	}{
+		{"read back", true, 0x1234, false, 0, 0x1234, 0},
+		{"read back direct", false, 0x1234, false, 0, 0x1234, 0},
+		{"one second", true, 0x1234, false, NS_PER_SEC, 0x1234 + 18, 0},
+		{"one second direct", false, 0x1234, false, NS_PER_SEC, 0x1234 + 18, 0},
+		{"guest store", true, 0x5000, true, 0, 0x5000, 0},
+		{"midnight", true, TICKS_PER_DAY - 2, false, 3 * TEST_TICK_NS, 1, 1},
+		{"midnight direct", false, TICKS_PER_DAY - 2, false, 3 * TEST_TICK_NS, 1, 1},
+		{"set past a day", true, TICKS_PER_DAY + 5, false, 0, 5, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_time(t, tc.irq0)
+			defer X86EMU_setClockMHz(X86EMU_DEFAULT_MHZ)
+			r := &M().x86
+			if tc.store {
+				sys_wrl(BDA_TICKS, tc.set)
+			} else {
+				r.gen.A.Set16(0x0100)
+				r.gen.C.Set16(uint16(tc.set >> 16))
+				r.gen.D.Set16(uint16(tc.set))
+				x86emu_test_int(t, 0x1a)
+				if ACCESS_FLAG(F_CF) {
+					t.Fatalf("ah=01h failed")
+				}
+			}
+			x86emu_clock_wait(tc.wait)
+
+			for i, al := range []uint8{tc.al, 0} {
+				r.gen.A.Set16(0x0000)
+				x86emu_test_int(t, 0x1a)
+				ticks := uint32(r.gen.C.Get16())<<16 | uint32(r.gen.D.Get16())
+				if ACCESS_FLAG(F_CF) || ticks != tc.ticks || r.gen.A.Get8l() != al {
+					t.Errorf("read %d: cx:dx %x al %d cf %v, want %x al %d",
+						i, ticks, r.gen.A.Get8l(), ACCESS_FLAG(F_CF), tc.ticks, al)
+				}
+			}
+			if b := sys_rdl(BDA_TICKS); b != tc.ticks {
+				t.Errorf("bda ticks %x, want %x", b, tc.ticks)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import "fmt"
+
+/*
+ * Go traps.
+ *
+ * A trap is a linear address which, when execution reaches it, runs a Go
+ * function instead of the instruction there.  They are how guest code calls
+ * into the emulator: return sentinels for far calls made from Go, BIOS
+ * entry points and default interrupt handlers.  The function sees the
+ * registers as the guest left them and has to move CS:IP on itself,
+ * usually by returning to the caller with x86emu_trap_retf or
+ * x86emu_trap_iret.
+ */
+
+type X86EMU_trapFunc func()
+
+type x86emu_trap struct {
+	name string
+	fn   X86EMU_trapFunc
+}
+
+var x86emu_traps = make(map[uint32]*x86emu_trap)
+
+// PARAMETERS:
+// addr - Linear address of the trap
+// name - Name used in traces
+// fn   - Go function to run there; nil removes the trap
+func X86EMU_setupTrap(addr uint32, name string, fn X86EMU_trapFunc) {
+	if fn == nil {
+		delete(x86emu_traps, addr)
+		return
+	}
+	x86emu_traps[addr] = &x86emu_trap{name: name, fn: fn}
+}
+
+/* Trap at CS:EIP, if any; called at the start of each instruction. */
+func x86emu_trap_find() *x86emu_trap {
+	if len(x86emu_traps) == 0 {
+		return nil
+	}
+	ip := M().x86.spc.IP.Get32()
+	if !x86emu_code32() {
+		ip &= 0xffff
+	}
+	t := x86emu_traps[x86emu_seg_sync(SEG_CS).base+ip]
+	if t != nil && DEBUG_TRACE() {
+		fmt.Printf("%04x:%04x: trap %s\n", M().x86.seg.CS.Get(), ip, t.name)
+	}
+	return t
+}
+
+/* Far return to the caller of a trap, dropping n bytes of arguments. */
+func x86emu_trap_retf(n uint16) {
+	ip := pop_word()
+	cs := pop_word()
+	x86emu_sp_adjust(int32(n))
+	x86emu_load_cs(cs, uint32(ip))
+}
+
+// REMARKS:
+// Returns from a trap entered as an interrupt handler.  The arithmetic
+// flags are returned as the trap left them, so a handler can report a
+// result in CF the way BIOS services do; IF and TF come off the stack.
+func x86emu_trap_iret() {
+	ip := pop_word()
+	cs := pop_word()
+	flags := uint32(pop_word())
+	keep := uint32(F_CF | F_PF | F_AF | F_ZF | F_SF | F_OF)
+	M().x86.spc.FLAGS = M().x86.spc.FLAGS&keep | flags&^keep | F_ALWAYS_ON
+	x86emu_load_cs(cs, uint32(ip))
+}
@@ -28,34 +28,34 @@ type reg16 struct {
 	reg uint16
 }
 
-func (r reg) Set32(i uint32) {
+func (r *reg) Set32(i uint32) {
 	r.reg = i
 }
 func (r reg) Get32() uint32 {
 	return r.reg
 }
 
-func (r reg) Set16(i uint16) {
-	r.reg = uint32(i)
+func (r *reg) Set16(i uint16) {
+	r.reg = (r.reg & 0xffff0000) | uint32(i)
 }
 func (r reg) Get16() uint16 {
 	return uint16(r.reg)
 }
 
-func (r reg) Seth8(i uint8) {
-	r.reg = (r.reg & 0x0000ff00) | uint32(i)<<8
+func (r *reg) Seth8(i uint8) {
+	r.reg = (r.reg & 0xffff00ff) | uint32(i)<<8
 }
 func (r reg) Get8h() uint8 {
 	return uint8(r.reg>>8)
 }
-func (r reg) Setl8(i uint8) {
+func (r *reg) Setl8(i uint8) {
 	r.reg = (r.reg & 0xffffff00) | uint32(i)
 }
 func (r reg) Get8l() uint8 {
-	return uint8(r.reg>>8)
+	return uint8(r.reg)
 }
 
-func (r reg16) Set(i uint16) {
+func (r *reg16) Set(i uint16) {
 	r.reg = i
 }
 func (r reg16) Get() uint16 {
@@ -87,10 +87,35 @@ type i386_segment_regs struct {
 	GS reg16
 }
 
+/* Hidden part of a segment register, filled in when the selector is loaded. */
+type x86emu_seg_cache struct {
+	sel    uint16
+	base   uint32
+	limit  uint32
+	attr   uint16
+	loaded bool
+}
+
+/* Base and limit loaded by LGDT/LIDT. */
+type x86emu_dtr struct {
+	base  uint32
+	limit uint16
+}
+
 type X86EMU_regs struct {
 	gen         i386_general_regs
 	spc         i386_special_regs
 	seg         i386_segment_regs
+	segcache    [6]x86emu_seg_cache
+	cr          [5]uint32
+	dr          [8]uint32
+	gdtr        x86emu_dtr
+	idtr        x86emu_dtr
+	insn_cs     uint16
+	insn_csc    x86emu_seg_cache /* CS descriptor cache at insn_cs:insn_ip */
+	insn_ip     uint32
+	insn_sp     uint32
+	insn_tf     bool
 	mode        uint32
 	intr        int
 	debug       uint32
@@ -107,14 +132,19 @@ type X86EMU_regs struct {
 type X86EMU_sysEnv struct {
 	mem_base uint32
 	mem_size uint32
+	mem      []byte /* guest RAM, from X86EMU_setMemBase */
 	abseg    uint32
 	private  []byte
 	x86      X86EMU_regs
+	clock    x86emu_clock
+	pic      [2]x86emu_i8259
+	pit      x86emu_i8254
+	rtc      x86emu_rtc
+	tlb      map[uint32]x86emu_tlb_entry /* cached translations, by linear page */
+	a20_off  bool /* A20 gate closed: address line 20 held low */
 }
 
-type X86EMU_intrFuncs struct {
-	f uint32
-}
+type X86EMU_intrFuncs func(num int)
 
 type __int128_t int64
 type __uint128_t uint64
@@ -3,7 +3,7 @@ package main
 
 var Gen_reg_t i386_general_regs
 var _X86EMU_env X86EMU_sysEnv
-var _X86EMU_intrTab [][]byte
+var _X86EMU_intrTab [256]X86EMU_intrFuncs
 var DEBUG_SYS_F uint32
 
 var (
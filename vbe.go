@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+ * VESA BIOS Extensions client.
+ *
+ * Runs int 10h AX=4Fxx calls against whatever int 10h handler is installed,
+ * normally a vendor VGA ROM, with a scratch buffer in conventional memory,
+ * and decodes what comes back.  Besides the decoded values each result
+ * lists the ways the ROM strays from the VBE 2.0/3.0 specification.
+ */
+
+const (
+	VBE_SCRATCH     = 0x7000 /* 0700:0000, 3K below the boot sector */
+	VBE_SUCCESS     = 0x004f
+	VBE_SIGNATURE   = 0x41534556 /* "VESA" */
+	VBE2_SIGNATURE  = 0x32454256 /* "VBE2" */
+	VBE_MODE_LFB    = 0x4000     /* 4F02h: use the linear framebuffer */
+	VBE_MODE_NOCLR  = 0x8000     /* 4F02h: keep the display memory */
+	VBE_MAX_MODES   = 512
+	VBE_ATTR_LFB    = 0x80
+	EDID_BLOCK_SIZE = 128
+)
+
+type X86EMU_vbeInfo struct {
+	version      uint16 /* BCD, 0x0300 for 3.0 */
+	capabilities uint32
+	modes        []uint16
+	memory       uint32 /* bytes */
+	oem          string
+	oem_rev      uint16
+	vendor       string
+	product      string
+	product_rev  string
+	problems     []string /* deviations from the specification */
+}
+
+type X86EMU_vbeModeInfo struct {
+	mode         uint16
+	attributes   uint16
+	width        uint16
+	height       uint16
+	pitch        uint16 /* bytes per scan line, banked */
+	lin_pitch    uint16 /* bytes per scan line, linear (VBE 3.0) */
+	bpp          uint8
+	planes       uint8
+	memory_model uint8
+	red_size     uint8
+	red_pos      uint8
+	green_size   uint8
+	green_pos    uint8
+	blue_size    uint8
+	blue_pos     uint8
+	win_a_seg    uint16
+	win_gran     uint16 /* KB */
+	win_size     uint16 /* KB */
+	framebuffer  uint32
+	problems     []string
+}
+
+type X86EMU_edid struct {
+	raw          []byte /* base block and extensions */
+	manufacturer string /* three letter PnP ID */
+	product      uint16
+	serial       uint32
+	week, year   int
+	version      string
+	problems     []string
+}
+
+var x86emu_vbe_models = map[uint8]string{
+	0x00: "text", 0x01: "CGA", 0x02: "hercules", 0x03: "planar",
+	0x04: "packed", 0x05: "non-chain 4", 0x06: "direct", 0x07: "YUV",
+}
+
+func (m *X86EMU_vbeModeInfo) String() string {
+	model := x86emu_vbe_models[m.memory_model]
+	if model == "" {
+		model = fmt.Sprintf("model %02x", m.memory_model)
+	}
+	s := fmt.Sprintf("%04x: %dx%dx%d %s pitch %d", m.mode, m.width, m.height, m.bpp, model, m.pitch)
+	if m.attributes&VBE_ATTR_LFB != 0 {
+		s += fmt.Sprintf(" lfb %#x", m.framebuffer)
+	}
+	return s
+}
+
+// RETURNS:
+// Whether a far pointer from the ROM points at memory worth reading:
+// conventional RAM, the ROM area, or the scratch buffer.
+func x86emu_vbe_ptr_ok(ptr uint32) bool {
+	lin := ptr>>16<<4 + ptr&0xffff
+	switch {
+	case lin >= M().mem_size:
+		return false
+	case lin >= 0x500 && lin < 0xa0000:
+		return true
+	case lin >= 0xc0000 && lin < 0x100000:
+		return true
+	}
+	return false
+}
+
+/* ASCIIZ string at a far pointer; unlike in $PnP headers offset 0 is valid. */
+func x86emu_far_string(ptr uint32) string {
+	return x86emu_phys_string(ptr>>16<<4 + ptr&0xffff)
+}
+
+// PARAMETERS:
+// ax, bx, cx, dx - Registers for the call; ES:DI is the scratch buffer
+//
+// RETURNS:
+// AX and BX after the call, or an error if it did not return.
+func x86emu_vbe_call(ax, bx, cx, dx uint16) (uint16, uint16, error) {
+	r := &M().x86
+	r.gen.A.Set16(ax)
+	r.gen.B.Set16(bx)
+	r.gen.C.Set16(cx)
+	r.gen.D.Set16(dx)
+	x86emu_load_seg(SEG_ES, VBE_SCRATCH>>4)
+	r.spc.DI.Set16(VBE_SCRATCH & 0xf)
+	res := x86emu_call_int(0x10)
+	if !res.returned {
+		return 0, 0, fmt.Errorf("int 10h ax=%04x did not return; stopped at %04x:%04x", ax, res.cs, res.ip)
+	}
+	if DEBUG_SVC() {
+		fmt.Printf("vbe: ax=%04x bx=%04x cx=%04x dx=%04x -> ax=%04x\n", ax, bx, cx, dx, r.gen.A.Get16())
+	}
+	if r.gen.A.Get16() != VBE_SUCCESS {
+		return r.gen.A.Get16(), r.gen.B.Get16(), fmt.Errorf("int 10h ax=%04x failed: ax=%04x", ax, r.gen.A.Get16())
+	}
+	return r.gen.A.Get16(), r.gen.B.Get16(), nil
+}
+
+// RETURNS:
+// The controller information of int 10h AX=4F00h, asked for with the
+// "VBE2" signature so that VBE 2.0 fields are filled in.
+func X86EMU_vbeGetInfo() (*X86EMU_vbeInfo, error) {
+	x86emu_phys_copy_in(VBE_SCRATCH, make([]byte, 512))
+	x86emu_phys_write(VBE_SCRATCH, 4, VBE2_SIGNATURE)
+	if _, _, err := x86emu_vbe_call(0x4f00, 0, 0, 0); err != nil {
+		return nil, err
+	}
+	b := x86emu_phys_copy_out(VBE_SCRATCH, 512)
+	if binary.LittleEndian.Uint32(b) != VBE_SIGNATURE {
+		return nil, fmt.Errorf("4F00h: signature %q, not VESA", b[:4])
+	}
+	info := &X86EMU_vbeInfo{
+		version:      binary.LittleEndian.Uint16(b[4:]),
+		capabilities: binary.LittleEndian.Uint32(b[0x0a:]),
+		memory:       uint32(binary.LittleEndian.Uint16(b[0x12:])) << 16,
+	}
+	str := func(off int, name string) string {
+		ptr := binary.LittleEndian.Uint32(b[off:])
+		if ptr == 0 && name != "OEM string" {
+			return ""
+		}
+		if !x86emu_vbe_ptr_ok(ptr) {
+			info.problems = append(info.problems, fmt.Sprintf("%s pointer %04x:%04x is not in valid memory", name, ptr>>16, ptr&0xffff))
+			return ""
+		}
+		return x86emu_far_string(ptr)
+	}
+	info.oem = str(0x06, "OEM string")
+	if info.version >= 0x0200 {
+		info.oem_rev = binary.LittleEndian.Uint16(b[0x14:])
+		info.vendor = str(0x16, "vendor name")
+		info.product = str(0x1a, "product name")
+		info.product_rev = str(0x1e, "product revision")
+	}
+
+	ptr := binary.LittleEndian.Uint32(b[0x0e:])
+	if !x86emu_vbe_ptr_ok(ptr) {
+		info.problems = append(info.problems, fmt.Sprintf("mode list pointer %04x:%04x is not in valid memory", ptr>>16, ptr&0xffff))
+		return info, nil
+	}
+	list := ptr>>16<<4 + ptr&0xffff
+	for i := uint32(0); ; i++ {
+		if i == VBE_MAX_MODES {
+			info.problems = append(info.problems, "mode list has no FFFF terminator")
+			break
+		}
+		mode := uint16(x86emu_phys_read(list+2*i, 2))
+		if mode == 0xffff {
+			break
+		}
+		info.modes = append(info.modes, mode)
+	}
+	if info.version < 0x0102 || info.version > 0x0300 || info.version&0xff > 0x09 {
+		info.problems = append(info.problems, fmt.Sprintf("unexpected version %04x", info.version))
+	}
+	if info.memory == 0 {
+		info.problems = append(info.problems, "reports no video memory")
+	}
+	return info, nil
+}
+
+// PARAMETERS:
+// mode - VBE mode number
+//
+// RETURNS:
+// The mode information of int 10h AX=4F01h.
+func X86EMU_vbeGetModeInfo(mode uint16) (*X86EMU_vbeModeInfo, error) {
+	x86emu_phys_copy_in(VBE_SCRATCH, make([]byte, 256))
+	if _, _, err := x86emu_vbe_call(0x4f01, 0, mode, 0); err != nil {
+		return nil, err
+	}
+	b := x86emu_phys_copy_out(VBE_SCRATCH, 256)
+	u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(b[off:]) }
+	m := &X86EMU_vbeModeInfo{
+		mode:         mode,
+		attributes:   u16(0x00),
+		win_gran:     u16(0x04),
+		win_size:     u16(0x06),
+		win_a_seg:    u16(0x08),
+		pitch:        u16(0x10),
+		width:        u16(0x12),
+		height:       u16(0x14),
+		planes:       b[0x18],
+		bpp:          b[0x19],
+		memory_model: b[0x1b],
+		red_size:     b[0x1f],
+		red_pos:      b[0x20],
+		green_size:   b[0x21],
+		green_pos:    b[0x22],
+		blue_size:    b[0x23],
+		blue_pos:     b[0x24],
+		framebuffer:  binary.LittleEndian.Uint32(b[0x28:]),
+		lin_pitch:    u16(0x32),
+	}
+	if m.attributes&0x01 == 0 {
+		m.problems = append(m.problems, "mode is listed but not supported by the hardware")
+	}
+	if m.attributes&VBE_ATTR_LFB != 0 && m.framebuffer == 0 {
+		m.problems = append(m.problems, "linear framebuffer attribute set but no framebuffer address")
+	}
+	if m.width == 0 || m.height == 0 || m.bpp == 0 {
+		m.problems = append(m.problems, "resolution or depth is zero")
+	}
+	if m.memory_model != 0 && m.pitch < uint16(uint32(m.width)*uint32(m.bpp)/8) && m.planes <= 1 {
+		m.problems = append(m.problems, fmt.Sprintf("pitch %d is less than a line of %d pixels", m.pitch, m.width))
+	}
+	return m, nil
+}
+
+// PARAMETERS:
+// mode - VBE mode number, with VBE_MODE_LFB and VBE_MODE_NOCLR as wanted
+func X86EMU_vbeSetMode(mode uint16) error {
+	_, _, err := x86emu_vbe_call(0x4f02, mode, 0, 0)
+	return err
+}
+
+// RETURNS:
+// The EDID of the display on DDC port 0, read with int 10h AX=4F15h,
+// including its extension blocks.
+func X86EMU_vbeReadEdid() (*X86EMU_edid, error) {
+	if _, _, err := x86emu_vbe_call(0x4f15, 0x0000, 0, 0); err != nil {
+		return nil, fmt.Errorf("no DDC support: %v", err)
+	}
+	e := &X86EMU_edid{}
+	for block := uint16(0); ; block++ {
+		x86emu_phys_copy_in(VBE_SCRATCH, make([]byte, EDID_BLOCK_SIZE))
+		if _, _, err := x86emu_vbe_call(0x4f15, 0x0001, 0, block); err != nil {
+			if block == 0 {
+				return nil, err
+			}
+			e.problems = append(e.problems, fmt.Sprintf("extension block %d: %v", block, err))
+			break
+		}
+		b := x86emu_phys_copy_out(VBE_SCRATCH, EDID_BLOCK_SIZE)
+		sum := uint8(0)
+		for _, c := range b {
+			sum += c
+		}
+		if sum != 0 {
+			e.problems = append(e.problems, fmt.Sprintf("block %d: bad checksum", block))
+		}
+		e.raw = append(e.raw, b...)
+		if int(block) >= int(e.raw[126]) || block == 255 {
+			break
+		}
+	}
+	b := e.raw
+	if string(b[:8]) != "\x00\xff\xff\xff\xff\xff\xff\x00" {
+		e.problems = append(e.problems, "no EDID header")
+	}
+	id := binary.BigEndian.Uint16(b[8:])
+	e.manufacturer = string([]byte{
+		'@' + byte(id>>10&0x1f), '@' + byte(id>>5&0x1f), '@' + byte(id&0x1f)})
+	e.product = binary.LittleEndian.Uint16(b[10:])
+	e.serial = binary.LittleEndian.Uint32(b[12:])
+	e.week = int(b[16])
+	e.year = 1990 + int(b[17])
+	e.version = fmt.Sprintf("%d.%d", b[18], b[19])
+	return e, nil
+}
+
+func (e *X86EMU_edid) String() string {
+	return fmt.Sprintf("%s %04x serial %d, week %d of %d, EDID %s, %d blocks",
+		e.manufacturer, e.product, e.serial, e.week, e.year, e.version, len(e.raw)/EDID_BLOCK_SIZE)
+}
+
+func (v *X86EMU_vbeInfo) String() string {
+	var names []string
+	for _, s := range []string{v.oem, v.vendor, v.product, v.product_rev} {
+		if s = strings.TrimSpace(s); s != "" {
+			names = append(names, s)
+		}
+	}
+	return fmt.Sprintf("VBE %d.%d %q, %dK, %d modes", v.version>>8, v.version&0xff,
+		strings.Join(names, " / "), v.memory>>10, len(v.modes))
+}
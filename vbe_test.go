@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+/* Where the test int 10h keeps the strings and mode list it points at */
+const (
+	TEST_VBE_STRINGS = 0x8000
+	TEST_VBE_MODES   = 0x8100
+)
+
+/*
+ * Installs the int 10h of the VBE tests on the BIOS: 4F00h, 4F01h and 4F15h
+ * answer with the given blocks, and anything else fails.  edid holds one
+ * block per entry.
+ */
+func x86emu_test_vbe(t *testing.T, info, mode_info []byte, edid [][]byte) {
+	t.Helper()
+	_, err := X86EMU_setupBiosVector(0x10, "int10", func() {
+		r := &M().x86
+		buf := uint32(r.seg.ES.Get())<<4 + uint32(r.spc.DI.Get16())
+		var b []byte
+		switch r.gen.A.Get16() {
+		case 0x4f00:
+			b = info
+		case 0x4f01:
+			b = mode_info
+		case 0x4f15:
+			switch {
+			case r.gen.B.Get8l() == 0 && len(edid) > 0:
+				r.gen.A.Set16(VBE_SUCCESS)
+				return
+			case r.gen.B.Get8l() == 1 && int(r.gen.D.Get16()) < len(edid):
+				b = edid[r.gen.D.Get16()]
+			}
+		}
+		if b == nil {
+			r.gen.A.Set16(0x014f)
+			return
+		}
+		x86emu_phys_copy_in(buf, b)
+		r.gen.A.Set16(VBE_SUCCESS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* A VBE 3.0 controller information block with two modes. */
+func x86emu_test_vbe_info() []byte {
+	b := make([]byte, 512)
+	le := binary.LittleEndian
+	le.PutUint32(b[0x00:], VBE_SIGNATURE)
+	le.PutUint16(b[0x04:], 0x0300)
+	le.PutUint32(b[0x06:], TEST_VBE_STRINGS<<12)      /* OEM */
+	le.PutUint32(b[0x0e:], TEST_VBE_MODES<<12)        /* modes */
+	le.PutUint16(b[0x12:], 256)                       /* 16M */
+	le.PutUint16(b[0x14:], 0x0102)                    /* OEM revision */
+	le.PutUint32(b[0x16:], TEST_VBE_STRINGS<<12|0x10) /* vendor */
+	le.PutUint32(b[0x1a:], TEST_VBE_STRINGS<<12|0x20) /* product */
+	le.PutUint32(b[0x1e:], TEST_VBE_STRINGS<<12|0x30) /* revision */
+	x86emu_phys_copy_in(TEST_VBE_STRINGS, []byte("OEM\x00"))
+	x86emu_phys_copy_in(TEST_VBE_STRINGS+0x10, []byte("Vendor\x00"))
+	x86emu_phys_copy_in(TEST_VBE_STRINGS+0x20, []byte("Product\x00"))
+	x86emu_phys_copy_in(TEST_VBE_STRINGS+0x30, []byte("Rev\x00"))
+	x86emu_phys_copy_in(TEST_VBE_MODES, []byte{0x01, 0x01, 0x12, 0x01, 0xff, 0xff})
+	return b
+}
+
+func TestVbePtrOk(t *testing.T) {
+	x86emu_test_machine(t)
+	for _, tc := range []struct {
+		ptr  uint32
+		want bool
+	}{
+		{0x00000400, false}, /* BDA */
+		{0x00000500, true},
+		{0x9fff000f, true},
+		{0xa0000000, false}, /* video memory */
+		{0xb8000000, false},
+		{0xc0000000, true}, /* ROMs */
+		{0xf000ffff, true},
+		{0xffff0010, false}, /* above 1M */
+	} {
+		if ok := x86emu_vbe_ptr_ok(tc.ptr); ok != tc.want {
+			t.Errorf("%04x:%04x ok %v, want %v", tc.ptr>>16, tc.ptr&0xffff, ok, tc.want)
+		}
+	}
+}
+
+func TestVbeGetInfo(t *testing.T) {
+	le := binary.LittleEndian
+	for _, tc := range []struct {
+		name     string
+		mutate   func(b []byte)
+		err      bool
+		names    []string /* OEM, vendor, product and revision */
+		modes    []uint16
+		problems []string
+	}{
+		{name: "good", names: []string{"OEM", "Vendor", "Product", "Rev"},
+			modes: []uint16{0x101, 0x112}},
+		{name: "wrong signature", err: true,
+			mutate: func(b []byte) { copy(b, "VBE2") }},
+		{name: "oem string in video memory", modes: []uint16{0x101, 0x112},
+			mutate:   func(b []byte) { le.PutUint32(b[0x06:], 0xa0000000) },
+			problems: []string{"OEM string pointer a000:0000 is not in valid memory"}},
+		{name: "null vendor name", names: []string{"OEM", "", "Product", "Rev"},
+			modes:  []uint16{0x101, 0x112},
+			mutate: func(b []byte) { le.PutUint32(b[0x16:], 0) }},
+		{name: "mode list in the bda",
+			mutate:   func(b []byte) { le.PutUint32(b[0x0e:], 0x00400000) },
+			problems: []string{"mode list pointer 0040:0000 is not in valid memory"}},
+		{name: "mode list without terminator",
+			mutate: func(b []byte) {
+				for i := 0; i < VBE_MAX_MODES; i++ {
+					x86emu_phys_write(TEST_VBE_MODES+uint32(i)*2, 2, 0x0101)
+				}
+			},
+			problems: []string{"mode list has no FFFF terminator"}},
+		{name: "unexpected version", modes: []uint16{0x101, 0x112},
+			mutate:   func(b []byte) { le.PutUint16(b[0x04:], 0x0400) },
+			problems: []string{"unexpected version 0400"}},
+		{name: "no video memory", modes: []uint16{0x101, 0x112},
+			mutate:   func(b []byte) { le.PutUint16(b[0x12:], 0) },
+			problems: []string{"reports no video memory"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			b := x86emu_test_vbe_info()
+			if tc.mutate != nil {
+				tc.mutate(b)
+			}
+			x86emu_test_vbe(t, b, nil, nil)
+			info, err := X86EMU_vbeGetInfo()
+			if (err != nil) != tc.err {
+				t.Fatalf("error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			names := []string{info.oem, info.vendor, info.product, info.product_rev}
+			if tc.names != nil && !reflect.DeepEqual(names, tc.names) {
+				t.Errorf("names %q, want %q", names, tc.names)
+			}
+			if len(tc.modes) > 0 && !reflect.DeepEqual(info.modes, tc.modes) {
+				t.Errorf("modes %x, want %x", info.modes, tc.modes)
+			}
+			if !reflect.DeepEqual(info.problems, tc.problems) {
+				t.Errorf("problems %q, want %q", info.problems, tc.problems)
+			}
+		})
+	}
+}
+
+/* Mode information for an 800x600x32 mode with a linear framebuffer. */
+func x86emu_test_vbe_mode_info() []byte {
+	b := make([]byte, 256)
+	le := binary.LittleEndian
+	le.PutUint16(b[0x00:], 0x009b)
+	le.PutUint16(b[0x10:], 3200)
+	le.PutUint16(b[0x12:], 800)
+	le.PutUint16(b[0x14:], 600)
+	b[0x18], b[0x19], b[0x1b] = 1, 32, 0x06
+	le.PutUint32(b[0x28:], 0xe0000000)
+	return b
+}
+
+func TestVbeGetModeInfo(t *testing.T) {
+	le := binary.LittleEndian
+	for _, tc := range []struct {
+		name     string
+		mutate   func(b []byte)
+		problems []string
+	}{
+		{name: "good"},
+		{name: "not supported",
+			mutate:   func(b []byte) { b[0] &^= 0x01 },
+			problems: []string{"mode is listed but not supported by the hardware"}},
+		{name: "no framebuffer address",
+			mutate:   func(b []byte) { le.PutUint32(b[0x28:], 0) },
+			problems: []string{"linear framebuffer attribute set but no framebuffer address"}},
+		{name: "zero height",
+			mutate:   func(b []byte) { le.PutUint16(b[0x14:], 0) },
+			problems: []string{"resolution or depth is zero"}},
+		{name: "short pitch",
+			mutate:   func(b []byte) { le.PutUint16(b[0x10:], 800) },
+			problems: []string{"pitch 800 is less than a line of 800 pixels"}},
+		{name: "planar pitch",
+			mutate: func(b []byte) { le.PutUint16(b[0x10:], 100); b[0x18], b[0x19], b[0x1b] = 4, 4, 0x03 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			b := x86emu_test_vbe_mode_info()
+			if tc.mutate != nil {
+				tc.mutate(b)
+			}
+			x86emu_test_vbe(t, nil, b, nil)
+			m, err := X86EMU_vbeGetModeInfo(0x115)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.mode != 0x115 || m.framebuffer != le.Uint32(b[0x28:]) || m.width != 800 {
+				t.Errorf("decoded %v", m)
+			}
+			if !reflect.DeepEqual(m.problems, tc.problems) {
+				t.Errorf("problems %q, want %q", m.problems, tc.problems)
+			}
+		})
+	}
+}
+
+/* An EDID block; block 0 carries the header and the extension count. */
+func x86emu_test_edid_block(n int, extensions uint8) []byte {
+	b := make([]byte, EDID_BLOCK_SIZE)
+	if n == 0 {
+		copy(b, "\x00\xff\xff\xff\xff\xff\xff\x00")
+		binary.BigEndian.PutUint16(b[8:], 1<<10|2<<5|3) /* "ABC" */
+		binary.LittleEndian.PutUint16(b[10:], 0x1234)
+		binary.LittleEndian.PutUint32(b[12:], 42)
+		b[16], b[17], b[18], b[19] = 10, 30, 1, 4
+		b[126] = extensions
+	} else {
+		b[0] = 0x02 /* CEA extension */
+	}
+	x86emu_test_edid_sum(b)
+	return b
+}
+
+func x86emu_test_edid_sum(b []byte) {
+	sum := uint8(0)
+	for _, c := range b[:EDID_BLOCK_SIZE-1] {
+		sum += c
+	}
+	b[EDID_BLOCK_SIZE-1] = -sum
+}
+
+func TestVbeReadEdid(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		edid     [][]byte
+		err      bool
+		blocks   int
+		problems []string
+	}{
+		{name: "base block", edid: [][]byte{x86emu_test_edid_block(0, 0)}, blocks: 1},
+		{name: "with an extension",
+			edid:   [][]byte{x86emu_test_edid_block(0, 1), x86emu_test_edid_block(1, 0)},
+			blocks: 2},
+		{name: "missing extension",
+			edid:     [][]byte{x86emu_test_edid_block(0, 2), x86emu_test_edid_block(1, 0)},
+			blocks:   2,
+			problems: []string{"extension block 2: int 10h ax=4f15 failed: ax=014f"}},
+		{name: "bad checksum",
+			edid:     [][]byte{func() []byte { b := x86emu_test_edid_block(0, 0); b[20]++; return b }()},
+			blocks:   1,
+			problems: []string{"block 0: bad checksum"}},
+		{name: "no header",
+			edid: [][]byte{func() []byte {
+				b := x86emu_test_edid_block(0, 0)
+				b[0] = 0xff
+				x86emu_test_edid_sum(b)
+				return b
+			}()},
+			blocks:   1,
+			problems: []string{"no EDID header"}},
+		{name: "no ddc", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_bios(t)
+			x86emu_test_vbe(t, nil, nil, tc.edid)
+			e, err := X86EMU_vbeReadEdid()
+			if (err != nil) != tc.err {
+				t.Fatalf("error %v, want %v", err, tc.err)
+			}
+			if err != nil {
+				return
+			}
+			if len(e.raw) != tc.blocks*EDID_BLOCK_SIZE {
+				t.Errorf("read %d bytes, want %d blocks", len(e.raw), tc.blocks)
+			}
+			if e.manufacturer != "ABC" || e.product != 0x1234 || e.serial != 42 ||
+				e.week != 10 || e.year != 2020 || e.version != "1.4" {
+				t.Errorf("decoded %v", e)
+			}
+			if !reflect.DeepEqual(e.problems, tc.problems) {
+				t.Errorf("problems %q, want %q", e.problems, tc.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+ * Int 10h video services.
+ *
+ * Enough of the VGA BIOS for programs that print through the BIOS: mode
+ * sets, the cursor, teletype output, character writes and scrolling over
+ * the text buffer, with all state kept in the BIOS data area where guest
+ * code expects it.  There is no video hardware behind it, so graphics
+ * modes can be set but text written in them is not drawn, and the fonts
+ * int 10h AX=1130h hands out have the right geometry but blank glyphs.
+ *
+ * Teletype output can also be captured as plain text, which is what tests
+ * usually want to look at.
+ */
+
+/* BIOS data area video fields */
+const (
+	BDA_VIDEO_MODE   = 0x449
+	BDA_VIDEO_COLS   = 0x44a
+	BDA_VIDEO_PAGESZ = 0x44c
+	BDA_VIDEO_START  = 0x44e
+	BDA_CURSOR_POS   = 0x450 /* 8 pages of column, row */
+	BDA_CURSOR_SHAPE = 0x460
+	BDA_ACTIVE_PAGE  = 0x462
+	BDA_CRTC_BASE    = 0x463
+	BDA_VIDEO_ROWS   = 0x484 /* rows - 1 */
+	BDA_CHAR_HEIGHT  = 0x485
+	BDA_VIDEO_CTL    = 0x487
+	BDA_VIDEO_SWITCH = 0x488
+	BDA_VGA_FLAGS    = 0x489
+)
+
+type x86emu_video_mode struct {
+	text       bool
+	cols, rows uint32
+	base       uint32 /* linear address of the buffer */
+	page_size  uint32
+	height     uint32 /* character height in scan lines */
+	mono       bool
+}
+
+var x86emu_video_modes = map[uint8]x86emu_video_mode{
+	0x00: {true, 40, 25, 0xb8000, 0x0800, 16, false},
+	0x01: {true, 40, 25, 0xb8000, 0x0800, 16, false},
+	0x02: {true, 80, 25, 0xb8000, 0x1000, 16, false},
+	0x03: {true, 80, 25, 0xb8000, 0x1000, 16, false},
+	0x04: {false, 40, 25, 0xb8000, 0x4000, 8, false},
+	0x05: {false, 40, 25, 0xb8000, 0x4000, 8, false},
+	0x06: {false, 80, 25, 0xb8000, 0x4000, 8, false},
+	0x07: {true, 80, 25, 0xb0000, 0x1000, 14, true},
+	0x0d: {false, 40, 25, 0xa0000, 0x2000, 8, false},
+	0x0e: {false, 80, 25, 0xa0000, 0x4000, 8, false},
+	0x0f: {false, 80, 25, 0xa0000, 0x8000, 14, true},
+	0x10: {false, 80, 25, 0xa0000, 0x8000, 14, false},
+	0x11: {false, 80, 30, 0xa0000, 0xa000, 16, false},
+	0x12: {false, 80, 30, 0xa0000, 0xa000, 16, false},
+	0x13: {false, 40, 25, 0xa0000, 0x0000, 8, false},
+}
+
+var x86emu_video struct {
+	capture io.Writer
+	font8   uint32 /* linear addresses of the fonts */
+	font14  uint32
+	font16  uint32
+}
+
+// REMARKS:
+// Installs the int 10h handler and the font vectors, and sets text mode 3
+// as the BIOS leaves it after POST.  A VGA ROM run afterwards replaces the
+// vector and may chain to this one.
+func X86EMU_setupVideoBios() error {
+	v := &x86emu_video
+	fonts, err := x86emu_fseg_alloc(256*(8+14+16), 16)
+	if err != nil {
+		return err
+	}
+	v.font8 = fonts
+	v.font14 = v.font8 + 256*8
+	v.font16 = v.font14 + 256*14
+	if _, err := X86EMU_setupBiosVector(0x10, "int10", x86emu_int10); err != nil {
+		return err
+	}
+	x86emu_set_vector(0x1f, v.font8+128*8)
+	x86emu_set_vector(0x43, v.font16)
+	x86emu_video_set_mode(0x03)
+	return nil
+}
+
+/* Sends teletype output to w as plain text; nil stops capturing. */
+func X86EMU_captureTeletype(w io.Writer) {
+	x86emu_video.capture = w
+}
+
+/* Rows of the active text page, trailing blanks removed. */
+func X86EMU_textScreen() []string {
+	if m, ok := x86emu_video_mode_info(); !ok || !m.text {
+		return nil
+	}
+	page := uint8(x86emu_phys_read(BDA_ACTIVE_PAGE, 1))
+	var rows []string
+	for row := uint32(0); row < x86emu_video_rows(); row++ {
+		var b []byte
+		for col := uint32(0); col < x86emu_video_cols(); col++ {
+			c := uint8(x86emu_phys_read(x86emu_video_addr(page, row, col), 1))
+			if c < ' ' || c > '~' {
+				c = ' '
+			}
+			b = append(b, c)
+		}
+		rows = append(rows, strings.TrimRight(string(b), " "))
+	}
+	return rows
+}
+
+func x86emu_video_mode_info() (x86emu_video_mode, bool) {
+	m, ok := x86emu_video_modes[uint8(x86emu_phys_read(BDA_VIDEO_MODE, 1))&0x7f]
+	return m, ok
+}
+
+func x86emu_video_cols() uint32 {
+	return x86emu_phys_read(BDA_VIDEO_COLS, 2)
+}
+
+func x86emu_video_rows() uint32 {
+	return x86emu_phys_read(BDA_VIDEO_ROWS, 1) + 1
+}
+
+/* Address of the character cell at row, col of page. */
+func x86emu_video_addr(page uint8, row, col uint32) uint32 {
+	m, _ := x86emu_video_mode_info()
+	return m.base + uint32(page)*x86emu_phys_read(BDA_VIDEO_PAGESZ, 2) + (row*x86emu_video_cols()+col)*2
+}
+
+func x86emu_video_cursor(page uint8) (row, col uint32) {
+	pos := x86emu_phys_read(BDA_CURSOR_POS+2*uint32(page&7), 2)
+	return pos >> 8, pos & 0xff
+}
+
+func x86emu_video_set_cursor(page uint8, row, col uint32) {
+	x86emu_phys_write(BDA_CURSOR_POS+2*uint32(page&7), 2, row<<8|col)
+}
+
+func x86emu_video_set_mode(mode uint8) {
+	noclear := mode&0x80 != 0
+	mode &= 0x7f
+	m, ok := x86emu_video_modes[mode]
+	if !ok {
+		if DEBUG_SVC() {
+			fmt.Printf("int10: mode %02x not supported\n", mode)
+		}
+		return
+	}
+	x86emu_phys_write(BDA_VIDEO_MODE, 1, uint32(mode))
+	x86emu_phys_write(BDA_VIDEO_COLS, 2, m.cols)
+	x86emu_phys_write(BDA_VIDEO_PAGESZ, 2, m.page_size)
+	x86emu_phys_write(BDA_VIDEO_START, 2, 0)
+	for page := uint8(0); page < 8; page++ {
+		x86emu_video_set_cursor(page, 0, 0)
+	}
+	x86emu_phys_write(BDA_CURSOR_SHAPE, 2, 0x0607)
+	x86emu_phys_write(BDA_ACTIVE_PAGE, 1, 0)
+	crtc := uint32(0x3d4)
+	if m.mono {
+		crtc = 0x3b4
+	}
+	x86emu_phys_write(BDA_CRTC_BASE, 2, crtc)
+	x86emu_phys_write(BDA_VIDEO_ROWS, 1, m.rows-1)
+	x86emu_phys_write(BDA_CHAR_HEIGHT, 2, m.height)
+	ctl := uint32(0x60)
+	if noclear {
+		ctl |= 0x80
+	}
+	x86emu_phys_write(BDA_VIDEO_CTL, 1, ctl)
+	x86emu_phys_write(BDA_VIDEO_SWITCH, 1, 0xf9)
+	x86emu_phys_write(BDA_VGA_FLAGS, 1, 0x51)
+	if noclear {
+		return
+	}
+	if m.text {
+		for a := m.base; a < m.base+m.window(); a += 2 {
+			x86emu_phys_write(a, 2, 0x0720)
+		}
+	} else {
+		x86emu_phys_copy_in(m.base, make([]byte, m.window()))
+	}
+}
+
+/* Size of the memory window of the mode: 32K at B0000/B8000, 64K at A0000. */
+func (m x86emu_video_mode) window() uint32 {
+	if m.base == 0xa0000 {
+		return 0x10000
+	}
+	return 0x8000
+}
+
+// PARAMETERS:
+// page  - Display page
+// top, left, bottom, right - Window, inclusive
+// lines - Lines to scroll; 0 clears the window
+// attr  - Attribute of the blank lines
+// up    - Scroll up rather than down
+func x86emu_video_scroll(page uint8, top, left, bottom, right, lines uint32, attr uint8, up bool) {
+	m, ok := x86emu_video_mode_info()
+	if !ok || !m.text {
+		return
+	}
+	if right >= x86emu_video_cols() {
+		right = x86emu_video_cols() - 1
+	}
+	if bottom >= x86emu_video_rows() {
+		bottom = x86emu_video_rows() - 1
+	}
+	if top > bottom || left > right {
+		return
+	}
+	height := bottom - top + 1
+	if lines == 0 || lines > height {
+		lines = height
+	}
+	width := int(right-left+1) * 2
+	blank := make([]byte, width)
+	for i := 0; i < width; i += 2 {
+		blank[i], blank[i+1] = ' ', attr
+	}
+	for i := uint32(0); i < height; i++ {
+		row, src := top+i, top+i+lines
+		if !up {
+			row, src = bottom-i, bottom-i-lines
+		}
+		line := blank
+		if i+lines < height {
+			line = x86emu_phys_copy_out(x86emu_video_addr(page, src, left), width)
+		}
+		x86emu_phys_copy_in(x86emu_video_addr(page, row, left), line)
+	}
+}
+
+/* Writes count copies of ch, with attr unless attr < 0, at the cursor. */
+func x86emu_video_write(page uint8, ch uint8, attr int, count uint32) {
+	m, ok := x86emu_video_mode_info()
+	if !ok || !m.text {
+		return
+	}
+	row, col := x86emu_video_cursor(page)
+	pos := row*x86emu_video_cols() + col
+	end := x86emu_video_rows() * x86emu_video_cols()
+	for ; count > 0 && pos < end; count-- {
+		addr := m.base + uint32(page)*x86emu_phys_read(BDA_VIDEO_PAGESZ, 2) + pos*2
+		x86emu_phys_write(addr, 1, uint32(ch))
+		if attr >= 0 {
+			x86emu_phys_write(addr+1, 1, uint32(attr))
+		}
+		pos++
+	}
+}
+
+// PARAMETERS:
+// page - Display page
+// ch   - Character
+// attr - Attribute for the character, or < 0 to keep the cell's
+//
+// REMARKS:
+// Teletype output: BEL, BS, LF and CR are interpreted, the cursor moves on
+// and the page scrolls up at the bottom.
+func x86emu_video_tty(page uint8, ch uint8, attr int) {
+	if w := x86emu_video.capture; w != nil && (ch == '\n' || ch == '\t' || ch >= ' ') {
+		w.Write([]byte{ch})
+	}
+	row, col := x86emu_video_cursor(page)
+	switch ch {
+	case 0x07:
+	case 0x08:
+		if col > 0 {
+			col--
+		}
+	case '\n':
+		row++
+	case '\r':
+		col = 0
+	default:
+		x86emu_video_write(page, ch, attr, 1)
+		col++
+		if col >= x86emu_video_cols() {
+			col = 0
+			row++
+		}
+	}
+	if rows := x86emu_video_rows(); row >= rows {
+		row = rows - 1
+		fill := uint8(0x07)
+		if m, _ := x86emu_video_mode_info(); m.text {
+			fill = uint8(x86emu_phys_read(x86emu_video_addr(page, row, col)+1, 1))
+		}
+		x86emu_video_scroll(page, 0, 0, row, x86emu_video_cols()-1, 1, fill, true)
+	}
+	x86emu_video_set_cursor(page, row, col)
+}
+
+/* Int 10h AH=13h: writes CX characters at ES:BP from row DH, column DL. */
+func x86emu_video_write_string() {
+	r := &M().x86
+	mode := r.gen.A.Get8l()
+	page := r.gen.B.Get8h()
+	attr := int(r.gen.B.Get8l())
+	save_row, save_col := x86emu_video_cursor(page)
+	x86emu_video_set_cursor(page, uint32(r.gen.D.Get8h()), uint32(r.gen.D.Get8l()))
+	str := x86emu_seg_linear(SEG_ES, uint32(r.spc.BP.Get16()), 1, false)
+	for i := uint32(0); i < uint32(r.gen.C.Get16()); i++ {
+		ch := uint8(x86emu_phys_read(str, 1))
+		str++
+		if mode&2 != 0 {
+			/* string of character, attribute pairs */
+			attr = int(x86emu_phys_read(str, 1))
+			str++
+		}
+		x86emu_video_tty(page, ch, attr)
+	}
+	if mode&1 == 0 {
+		x86emu_video_set_cursor(page, save_row, save_col)
+	}
+}
+
+/* Int 10h AX=1130h: pointer to the font BH selects in ES:BP. */
+func x86emu_video_font_info() {
+	r := &M().x86
+	v := &x86emu_video
+	var font uint32
+	switch r.gen.B.Get8h() {
+	case 0x00:
+		font = x86emu_phys_read(0x1f*4, 4)
+	case 0x01:
+		font = x86emu_phys_read(0x43*4, 4)
+	case 0x02, 0x05:
+		font = v.font14
+	case 0x03:
+		font = v.font8
+	case 0x04:
+		font = v.font8 + 128*8
+	default:
+		font = v.font16
+	}
+	if r.gen.B.Get8h() > 0x01 {
+		font = FSEG_BASE<<12 | (font - FSEG_BASE)
+	}
+	x86emu_load_seg(SEG_ES, uint16(font>>16))
+	r.spc.BP.Set16(uint16(font))
+	r.gen.C.Set16(uint16(x86emu_phys_read(BDA_CHAR_HEIGHT, 2)))
+	r.gen.D.Setl8(uint8(x86emu_phys_read(BDA_VIDEO_ROWS, 1)))
+}
+
+func x86emu_int10() {
+	r := &M().x86
+	ah := r.gen.A.Get8h()
+	page := uint8(x86emu_phys_read(BDA_ACTIVE_PAGE, 1))
+	if DEBUG_SVC() && ah != 0x0e {
+		fmt.Printf("int10: ax=%04x bx=%04x cx=%04x dx=%04x\n",
+			r.gen.A.Get16(), r.gen.B.Get16(), r.gen.C.Get16(), r.gen.D.Get16())
+	}
+
+	switch ah {
+	case 0x00:
+		x86emu_video_set_mode(r.gen.A.Get8l())
+		mode := uint8(x86emu_phys_read(BDA_VIDEO_MODE, 1))
+		/* what VGA BIOSes return */
+		if mode <= 7 && mode != 6 {
+			r.gen.A.Setl8(0x30)
+		} else {
+			r.gen.A.Setl8(0x20)
+		}
+	case 0x01:
+		x86emu_phys_write(BDA_CURSOR_SHAPE, 2, uint32(r.gen.C.Get16()))
+	case 0x02:
+		x86emu_video_set_cursor(r.gen.B.Get8h(), uint32(r.gen.D.Get8h()), uint32(r.gen.D.Get8l()))
+	case 0x03:
+		row, col := x86emu_video_cursor(r.gen.B.Get8h())
+		r.gen.D.Set16(uint16(row<<8 | col))
+		r.gen.C.Set16(uint16(x86emu_phys_read(BDA_CURSOR_SHAPE, 2)))
+	case 0x05:
+		if p := r.gen.A.Get8l(); p < 8 {
+			x86emu_phys_write(BDA_ACTIVE_PAGE, 1, uint32(p))
+			x86emu_phys_write(BDA_VIDEO_START, 2, uint32(p)*x86emu_phys_read(BDA_VIDEO_PAGESZ, 2))
+		}
+	case 0x06, 0x07:
+		x86emu_video_scroll(page, uint32(r.gen.C.Get8h()), uint32(r.gen.C.Get8l()),
+			uint32(r.gen.D.Get8h()), uint32(r.gen.D.Get8l()), uint32(r.gen.A.Get8l()),
+			r.gen.B.Get8h(), ah == 0x06)
+	case 0x08:
+		row, col := x86emu_video_cursor(r.gen.B.Get8h())
+		r.gen.A.Set16(uint16(x86emu_phys_read(x86emu_video_addr(r.gen.B.Get8h(), row, col), 2)))
+	case 0x09:
+		x86emu_video_write(r.gen.B.Get8h(), r.gen.A.Get8l(), int(r.gen.B.Get8l()), uint32(r.gen.C.Get16()))
+	case 0x0a:
+		x86emu_video_write(r.gen.B.Get8h(), r.gen.A.Get8l(), -1, uint32(r.gen.C.Get16()))
+	case 0x0e:
+		x86emu_video_tty(page, r.gen.A.Get8l(), -1)
+	case 0x0f:
+		r.gen.A.Setl8(uint8(x86emu_phys_read(BDA_VIDEO_MODE, 1)) | uint8(x86emu_phys_read(BDA_VIDEO_CTL, 1)&0x80))
+		r.gen.A.Seth8(uint8(x86emu_video_cols()))
+		r.gen.B.Seth8(page)
+	case 0x11:
+		if r.gen.A.Get8l() == 0x30 {
+			x86emu_video_font_info()
+		}
+	case 0x12:
+		if r.gen.B.Get8l() == 0x10 {
+			/* EGA information: colour, 256K, no features */
+			r.gen.B.Set16(0x0003)
+			r.gen.C.Set16(0x0009)
+		}
+	case 0x13:
+		x86emu_video_write_string()
+	case 0x1a:
+		if r.gen.A.Get8l() == 0x00 {
+			/* display combination: VGA with analog colour display */
+			r.gen.B.Set16(0x0008)
+		}
+		r.gen.A.Setl8(0x1a)
+	default:
+		if DEBUG_SVC() {
+			fmt.Printf("int10: function %02x not supported\n", ah)
+		}
+	}
+}
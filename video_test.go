@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func x86emu_test_video(t *testing.T) {
+	t.Helper()
+	x86emu_test_bios(t)
+	if err := X86EMU_setupVideoBios(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoTeletype(t *testing.T) {
+	var lines []string
+	for i := 0; i < 25; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	for _, tc := range []struct {
+		name     string
+		in       string
+		rows     []string /* top of the screen; the rest is blank */
+		row, col uint32   /* cursor */
+		capture  string
+	}{
+		{"text", "hello", []string{"hello"}, 0, 5, "hello"},
+		{"cr lf", "ab\r\ncd", []string{"ab", "cd"}, 1, 2, "ab\ncd"},
+		{"lf keeps the column", "ab\ncd", []string{"ab", "  cd"}, 1, 4, "ab\ncd"},
+		{"backspace", "abc\b\bX", []string{"aXc"}, 0, 2, "abcX"},
+		{"backspace at column 0", "\bx", []string{"x"}, 0, 1, "x"},
+		{"bell", "a\ab", []string{"ab"}, 0, 2, "ab"},
+		{"wrap", strings.Repeat("x", 81), []string{strings.Repeat("x", 80), "x"}, 1, 1,
+			strings.Repeat("x", 81)},
+		{"scroll at the bottom", strings.Join(lines, "\r\n") + "\r\n", lines[1:], 24, 0,
+			strings.Join(lines, "\n") + "\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_video(t)
+			var w bytes.Buffer
+			X86EMU_captureTeletype(&w)
+			defer X86EMU_captureTeletype(nil)
+			for i := 0; i < len(tc.in); i++ {
+				M().x86.gen.A.Set16(0x0e00 | uint16(tc.in[i]))
+				M().x86.gen.B.Set16(0)
+				x86emu_test_int(t, 0x10)
+			}
+			screen := X86EMU_textScreen()
+			for i, row := range screen {
+				want := ""
+				if i < len(tc.rows) {
+					want = tc.rows[i]
+				}
+				if row != want {
+					t.Errorf("row %d: %q, want %q", i, row, want)
+				}
+			}
+			if row, col := x86emu_video_cursor(0); row != tc.row || col != tc.col {
+				t.Errorf("cursor at %d,%d, want %d,%d", row, col, tc.row, tc.col)
+			}
+			if w.String() != tc.capture {
+				t.Errorf("captured %q, want %q", w.String(), tc.capture)
+			}
+		})
+	}
+}
+
+/* Row r of the screen TestVideoScroll starts from, "" past the edges. */
+func x86emu_test_fill(r int) string {
+	if r < 0 || r > 24 {
+		return ""
+	}
+	return strings.Repeat(string(rune('a'+r)), 4)
+}
+
+func TestVideoScroll(t *testing.T) {
+	fill := x86emu_test_fill
+	for _, tc := range []struct {
+		name  string
+		ax    uint16 /* AH=06h up, 07h down; AL lines */
+		cx    uint16 /* top, left */
+		dx    uint16 /* bottom, right */
+		want  func(r int) string
+		blank [2]uint32 /* row, col of a blank cell */
+	}{
+		{"up one line", 0x0601, 0x0000, 0x184f,
+			func(r int) string { return fill(r + 1) }, [2]uint32{24, 0}},
+		{"down two lines", 0x0702, 0x0000, 0x184f,
+			func(r int) string { return fill(r - 2) }, [2]uint32{1, 0}},
+		{"clear", 0x0600, 0x0000, 0x184f,
+			func(r int) string { return "" }, [2]uint32{12, 40}},
+		{"window up", 0x0601, 0x0100, 0x0301,
+			func(r int) string {
+				switch r {
+				case 1, 2:
+					return fill(r + 1)[:2] + fill(r)[2:]
+				case 3:
+					return "  " + fill(r)[2:]
+				}
+				return fill(r)
+			}, [2]uint32{3, 1}},
+		{"window down", 0x0701, 0x0102, 0x0303,
+			func(r int) string {
+				switch r {
+				case 1:
+					return fill(r)[:2]
+				case 2, 3:
+					return fill(r)[:2] + fill(r - 1)[2:]
+				}
+				return fill(r)
+			}, [2]uint32{1, 3}},
+		{"more lines than the window clears it", 0x0609, 0x0100, 0x0301,
+			func(r int) string {
+				if r >= 1 && r <= 3 {
+					return "  " + fill(r)[2:]
+				}
+				return fill(r)
+			}, [2]uint32{2, 0}},
+		{"window past the screen edge", 0x0601, 0x1700, 0x30ff,
+			func(r int) string {
+				if r >= 23 {
+					return fill(r + 1)
+				}
+				return fill(r)
+			}, [2]uint32{24, 79}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x86emu_test_video(t)
+			for row := uint32(0); row < 25; row++ {
+				for col := uint32(0); col < 4; col++ {
+					x86emu_phys_write(x86emu_video_addr(0, row, col), 2, 0x0700|('a'+row))
+				}
+			}
+			r := &M().x86
+			r.gen.A.Set16(tc.ax)
+			r.gen.B.Set16(0x1f00)
+			r.gen.C.Set16(tc.cx)
+			r.gen.D.Set16(tc.dx)
+			x86emu_test_int(t, 0x10)
+			for i, row := range X86EMU_textScreen() {
+				if want := tc.want(i); row != want {
+					t.Errorf("row %d: %q, want %q", i, row, want)
+				}
+			}
+			addr := x86emu_video_addr(0, tc.blank[0], tc.blank[1])
+			if cell := x86emu_phys_read(addr, 2); cell != 0x1f20 {
+				t.Errorf("blank cell %04x, want 1f20", cell)
+			}
+		})
+	}
+}
+
+func TestVideoSetModeClearsItsWindow(t *testing.T) {
+	for _, tc := range []struct {
+		mode       uint8
+		start, end uint32 /* cleared */
+	}{
+		{0x03, 0xb8000, 0xc0000},
+		{0x04, 0xb8000, 0xc0000},
+		{0x06, 0xb8000, 0xc0000},
+		{0x07, 0xb0000, 0xb8000},
+		{0x12, 0xa0000, 0xb0000},
+		{0x13, 0xa0000, 0xb0000},
+	} {
+		t.Run(fmt.Sprintf("mode %02xh", tc.mode), func(t *testing.T) {
+			x86emu_test_video(t)
+			x86emu_phys_copy_in(0xa0000, bytes.Repeat([]byte{0xaa}, 0x28000))
+			x86emu_video_set_mode(tc.mode)
+			for _, a := range []uint32{0xa0000, 0xaffff, 0xb0000, 0xb7fff, 0xb8000, 0xbffff, 0xc0000, 0xc7fff} {
+				cleared := x86emu_phys_read(a, 1) != 0xaa
+				if want := a >= tc.start && a < tc.end; cleared != want {
+					t.Errorf("%05x cleared %v, want %v", a, cleared, want)
+				}
+			}
+		})
+	}
+}